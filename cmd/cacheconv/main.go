@@ -0,0 +1,83 @@
+// Command cacheconv converts between cache directories and single-file caches.
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/bassosimone/getoptx"
+	"github.com/bassosimone/websteps-illustrated/internal/caching"
+	"github.com/bassosimone/websteps-illustrated/internal/runtimex"
+)
+
+type CLI struct {
+	Help   bool   `doc:"prints this help message" short:"h"`
+	Input  string `doc:"cache directory to import or single-file cache (ending with .db) to export" short:"i" required:"true"`
+	Output string `doc:"single-file cache (ending with .db) where to import or directory where to export" short:"o" required:"true"`
+}
+
+// getopt parses command line options.
+func getopt() *CLI {
+	opts := &CLI{
+		Help:   false,
+		Input:  "",
+		Output: "",
+	}
+	parser := getoptx.MustNewParser(opts, getoptx.NoPositionalArguments())
+	parser.MustGetopt(os.Args)
+	if opts.Help {
+		parser.PrintUsage(os.Stdout)
+		os.Exit(0)
+	}
+	if caching.IsDBPath(opts.Input) == caching.IsDBPath(opts.Output) {
+		fmt.Fprintf(os.Stderr, "cacheconv: exactly one of -i and -o must end with %s\n",
+			caching.DBFileExtension)
+		parser.PrintUsage(os.Stderr)
+		os.Exit(1)
+	}
+	return opts
+}
+
+// importDir imports each subdirectory of the cache directory
+// (e.g., dns, endpoint, dnsping) as a bucket of the DB.
+func importDir(dirpath, dbpath string) {
+	entries, err := os.ReadDir(dirpath)
+	runtimex.Must(err, "cacheconv: cannot read cache directory")
+	db := caching.OpenDB(dbpath)
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		bucket := entry.Name()
+		count, err := db.ImportFSCache(bucket, filepath.Join(dirpath, bucket))
+		runtimex.Must(err, "cacheconv: cannot import "+bucket)
+		fmt.Fprintf(os.Stderr, "cacheconv: imported %d entries into %s\n", count, bucket)
+	}
+	runtimex.Must(db.Close(), "cacheconv: cannot close DB")
+}
+
+// exportDB exports each bucket of the DB as a subdirectory
+// of the cache directory (e.g., dns, endpoint, dnsping).
+func exportDB(dbpath, dirpath string) {
+	_, err := os.Stat(dbpath) // don't create an empty DB
+	runtimex.Must(err, "cacheconv: cannot open DB")
+	db := caching.OpenDB(dbpath)
+	buckets, err := db.Buckets()
+	runtimex.Must(err, "cacheconv: cannot read DB")
+	for _, bucket := range buckets {
+		count, err := db.ExportFSCache(bucket, filepath.Join(dirpath, bucket))
+		runtimex.Must(err, "cacheconv: cannot export "+bucket)
+		fmt.Fprintf(os.Stderr, "cacheconv: exported %d entries from %s\n", count, bucket)
+	}
+	runtimex.Must(db.Close(), "cacheconv: cannot close DB")
+}
+
+func main() {
+	opts := getopt()
+	if caching.IsDBPath(opts.Output) {
+		importDir(opts.Input, opts.Output)
+		return
+	}
+	exportDB(opts.Input, opts.Output)
+}
@@ -0,0 +1,373 @@
+// Command cachectl inspects and edits the cache used by websteps and thd,
+// which is either a directory or a single-file cache (ending with .db).
+//
+// Because the cache only knows the digests of the keys, cachectl reads
+// all the cached measurements and filters them by domain or address.
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bassosimone/getoptx"
+	"github.com/bassosimone/websteps-illustrated/internal/archival"
+	"github.com/bassosimone/websteps-illustrated/internal/logcat"
+	"github.com/bassosimone/websteps-illustrated/internal/measurex"
+	"github.com/bassosimone/websteps-illustrated/internal/runtimex"
+)
+
+// CLI contains command line flags.
+type CLI struct {
+	Address   string          `doc:"only consider endpoint measurements using this IP address or endpoint (e.g., 8.8.8.8 or 8.8.8.8:443); when set, we ignore DNS measurements" short:"a"`
+	Before    string          `doc:"prune cached measurements older than this date (e.g., 2022-03-30 or 2022-03-30T17:38:57Z)"`
+	CacheDir  string          `doc:"directory containing the cache (or single-file cache if the name ends with .db)" short:"C" required:"true"`
+	Domain    string          `doc:"only consider DNS and endpoint measurements for this domain" short:"d"`
+	Help      bool            `doc:"prints this help message" short:"h"`
+	JSON      bool            `doc:"show cached measurements using JSON rather than in readable form"`
+	LogFormat string          `doc:"log format to use: text or json (default: text)"`
+	Verbose   getoptx.Counter `doc:"enable verbose mode" short:"v"`
+}
+
+// usage explains the available commands.
+const usage = `
+Commands (options go before the command):
+
+  list             lists the cached DNS and endpoint measurements
+  show             shows the cached endpoint measurements
+  delete           deletes the cached measurements matching -d and/or -a
+  merge CACHE...   merges the given caches into the cache at -C
+  prune            deletes the cached measurements older than --before
+`
+
+// getopt parses command line options.
+func getopt() (*CLI, []string) {
+	opts := &CLI{
+		Address:   "",
+		Before:    "",
+		CacheDir:  "",
+		Domain:    "",
+		Help:      false,
+		JSON:      false,
+		LogFormat: "text",
+		Verbose:   0,
+	}
+	parser := getoptx.MustNewParser(
+		opts, getoptx.AtLeastOnePositionalArgument(),
+		getoptx.SetPositionalArgumentsPlaceholder("command [args...]"),
+	)
+	parser.MustGetopt(os.Args)
+	if opts.Help {
+		parser.PrintUsage(os.Stdout)
+		fmt.Fprint(os.Stdout, usage)
+		os.Exit(0)
+	}
+	if opts.Verbose > 0 {
+		logcat.IncrementLogLevel(int(opts.Verbose))
+	}
+	return opts, parser.Args()
+}
+
+// filter selects the cached measurements to consider.
+type filter struct {
+	address string
+	domain  string
+}
+
+// newFilter creates a new filter from the command line options.
+func newFilter(opts *CLI) *filter {
+	return &filter{
+		address: opts.Address,
+		domain:  strings.ToLower(opts.Domain),
+	}
+}
+
+// empty returns whether this filter selects all the measurements.
+func (f *filter) empty() bool {
+	return f.address == "" && f.domain == ""
+}
+
+// matchDNS returns whether we should consider a DNS measurement. Because
+// the address only makes sense for endpoints, we don't select any
+// DNS measurement when filtering by address.
+func (f *filter) matchDNS(m *measurex.DNSLookupMeasurement) bool {
+	if f.address != "" {
+		return false
+	}
+	return f.domain == "" || strings.ToLower(m.Domain()) == f.domain
+}
+
+// matchEndpoint returns whether we should consider an endpoint measurement.
+func (f *filter) matchEndpoint(m *measurex.EndpointMeasurement) bool {
+	if f.domain != "" && strings.ToLower(m.URLDomain()) != f.domain {
+		return false
+	}
+	if f.address != "" && m.Address != f.address && m.IPAddress() != f.address {
+		return false
+	}
+	return true
+}
+
+// list lists the cached measurements selected by the filter.
+func list(cache *measurex.Cache, f *filter) {
+	err := cache.WalkDNSLookupEntries(func(key string, elist []measurex.CachedDNSLookupMeasurement) error {
+		for _, e := range elist {
+			if e.M != nil && f.matchDNS(e.M) {
+				fmt.Printf("dns %s %s lookup for %s using %s: %s\n",
+					e.T.UTC().Format(time.RFC3339), e.M.LookupType(), e.M.Domain(),
+					e.M.ResolverURL(), describeDNSResult(e.M))
+			}
+		}
+		return nil
+	})
+	runtimex.Must(err, "cachectl: cannot walk the DNS cache")
+	err = cache.WalkEndpointEntries(func(key string, elist []measurex.CachedEndpointMeasurement) error {
+		for _, e := range elist {
+			if e.M != nil && f.matchEndpoint(e.M) {
+				fmt.Printf("endpoint %s %s %s: %s\n", e.T.UTC().Format(time.RFC3339),
+					e.M.URLAsString(), e.M.EndpointAddress(), describeEndpointResult(e.M))
+			}
+		}
+		return nil
+	})
+	runtimex.Must(err, "cachectl: cannot walk the endpoint cache")
+}
+
+// describeDNSResult describes the result of a DNS lookup.
+func describeDNSResult(m *measurex.DNSLookupMeasurement) string {
+	if m.Failure() != "" {
+		return string(m.Failure())
+	}
+	return fmt.Sprintf("%v", m.Addresses())
+}
+
+// describeEndpointResult describes the result of an endpoint measurement.
+func describeEndpointResult(m *measurex.EndpointMeasurement) string {
+	if m.Failure != "" {
+		return fmt.Sprintf("%s during %s", m.Failure, m.FailedOperation)
+	}
+	if code := m.StatusCode(); code > 0 {
+		return fmt.Sprintf("status %d", code)
+	}
+	return archival.FlatFailureToStringOrOK(m.Failure)
+}
+
+// show shows the cached endpoint measurements selected by the filter.
+func show(cache *measurex.Cache, f *filter, asJSON bool) {
+	err := cache.WalkEndpointEntries(func(key string, elist []measurex.CachedEndpointMeasurement) error {
+		for _, e := range elist {
+			if e.M != nil && f.matchEndpoint(e.M) {
+				if asJSON {
+					showJSON(&e)
+					continue
+				}
+				showReadable(&e)
+			}
+		}
+		return nil
+	})
+	runtimex.Must(err, "cachectl: cannot walk the endpoint cache")
+}
+
+// remove deletes the cached measurements selected by the filter.
+func remove(cache *measurex.Cache, f *filter) {
+	if f.empty() {
+		fmt.Fprintf(os.Stderr, "cachectl: delete requires -d and/or -a\n")
+		os.Exit(1)
+	}
+	var (
+		count   int
+		emptied []string
+	)
+	err := cache.WalkDNSLookupEntries(func(key string, elist []measurex.CachedDNSLookupMeasurement) error {
+		var out []measurex.CachedDNSLookupMeasurement
+		for _, e := range elist {
+			if e.M != nil && f.matchDNS(e.M) {
+				count++
+				continue
+			}
+			out = append(out, e)
+		}
+		switch {
+		case len(out) == len(elist):
+			return nil
+		case len(out) <= 0:
+			emptied = append(emptied, key) // delete all at once after walking
+			return nil
+		default:
+			return cache.ReplaceDNSLookupEntry(key, out)
+		}
+	})
+	runtimex.Must(err, "cachectl: cannot delete from the DNS cache")
+	err = cache.DeleteDNSLookupEntries(emptied...)
+	runtimex.Must(err, "cachectl: cannot delete from the DNS cache")
+	emptied = nil
+	err = cache.WalkEndpointEntries(func(key string, elist []measurex.CachedEndpointMeasurement) error {
+		var out []measurex.CachedEndpointMeasurement
+		for _, e := range elist {
+			if e.M != nil && f.matchEndpoint(e.M) {
+				count++
+				continue
+			}
+			out = append(out, e)
+		}
+		switch {
+		case len(out) == len(elist):
+			return nil
+		case len(out) <= 0:
+			emptied = append(emptied, key) // delete all at once after walking
+			return nil
+		default:
+			return cache.ReplaceEndpointEntry(key, out)
+		}
+	})
+	runtimex.Must(err, "cachectl: cannot delete from the endpoint cache")
+	err = cache.DeleteEndpointEntries(emptied...)
+	runtimex.Must(err, "cachectl: cannot delete from the endpoint cache")
+	fmt.Fprintf(os.Stderr, "cachectl: deleted %d cached measurements\n", count)
+}
+
+// merge merges the cache at each srcdir into the given cache.
+func merge(cache *measurex.Cache, srcdirs []string) {
+	if len(srcdirs) <= 0 {
+		fmt.Fprintf(os.Stderr, "cachectl: merge requires at least one cache to merge\n")
+		os.Exit(1)
+	}
+	for _, srcdir := range srcdirs {
+		_, err := os.Stat(srcdir) // don't create an empty cache
+		runtimex.Must(err, "cachectl: cannot open cache")
+		src := measurex.NewCache(srcdir)
+		var count int
+		err = src.WalkDNSLookupEntries(func(key string, elist []measurex.CachedDNSLookupMeasurement) error {
+			count++
+			return cache.MergeDNSLookupEntry(key, elist)
+		})
+		runtimex.Must(err, "cachectl: cannot merge the DNS cache")
+		err = src.WalkEndpointEntries(func(key string, elist []measurex.CachedEndpointMeasurement) error {
+			count++
+			return cache.MergeEndpointEntry(key, elist)
+		})
+		runtimex.Must(err, "cachectl: cannot merge the endpoint cache")
+		fmt.Fprintf(os.Stderr, "cachectl: merged %d entries from %s\n", count, srcdir)
+	}
+}
+
+// parseDate parses the value of --before.
+func parseDate(value string) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, nil
+	}
+	return time.Parse("2006-01-02", value)
+}
+
+// prune deletes the cached measurements older than opts.Before.
+func prune(cache *measurex.Cache, opts *CLI) {
+	if opts.Before == "" {
+		fmt.Fprintf(os.Stderr, "cachectl: prune requires --before\n")
+		os.Exit(1)
+	}
+	before, err := parseDate(opts.Before)
+	runtimex.Must(err, "cachectl: cannot parse --before")
+	var (
+		count   int
+		emptied []string
+	)
+	err = cache.WalkDNSLookupEntries(func(key string, elist []measurex.CachedDNSLookupMeasurement) error {
+		var out []measurex.CachedDNSLookupMeasurement
+		for _, e := range elist {
+			if e.T.Before(before) {
+				count++
+				continue
+			}
+			out = append(out, e)
+		}
+		switch {
+		case len(out) == len(elist):
+			return nil
+		case len(out) <= 0:
+			emptied = append(emptied, key) // delete all at once after walking
+			return nil
+		default:
+			return cache.ReplaceDNSLookupEntry(key, out)
+		}
+	})
+	runtimex.Must(err, "cachectl: cannot prune the DNS cache")
+	err = cache.DeleteDNSLookupEntries(emptied...)
+	runtimex.Must(err, "cachectl: cannot prune the DNS cache")
+	emptied = nil
+	err = cache.WalkEndpointEntries(func(key string, elist []measurex.CachedEndpointMeasurement) error {
+		var out []measurex.CachedEndpointMeasurement
+		for _, e := range elist {
+			if e.T.Before(before) {
+				count++
+				continue
+			}
+			out = append(out, e)
+		}
+		switch {
+		case len(out) == len(elist):
+			return nil
+		case len(out) <= 0:
+			emptied = append(emptied, key) // delete all at once after walking
+			return nil
+		default:
+			return cache.ReplaceEndpointEntry(key, out)
+		}
+	})
+	runtimex.Must(err, "cachectl: cannot prune the endpoint cache")
+	err = cache.DeleteEndpointEntries(emptied...)
+	runtimex.Must(err, "cachectl: cannot prune the endpoint cache")
+	fmt.Fprintf(os.Stderr, "cachectl: pruned %d cached measurements\n", count)
+}
+
+// isAddress returns whether the given string is an IP address or an endpoint.
+func isAddress(s string) bool {
+	if net.ParseIP(s) != nil {
+		return true
+	}
+	addr, _, err := net.SplitHostPort(s)
+	return err == nil && net.ParseIP(addr) != nil
+}
+
+func main() {
+	opts, args := getopt()
+	if opts.Address != "" && !isAddress(opts.Address) {
+		fmt.Fprintf(os.Stderr, "cachectl: -a requires an IP address or an endpoint\n")
+		os.Exit(1)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	wg := &sync.WaitGroup{}
+	logger, err := logcat.NewLogger(opts.LogFormat, os.Stderr, 0)
+	runtimex.Must(err, "cannot create logger")
+	logcat.StartConsumer(ctx, logger, false, wg)
+	defer wg.Wait()
+	defer cancel()
+	if args[0] != "merge" {
+		if len(args) > 1 {
+			fmt.Fprintf(os.Stderr, "cachectl: unexpected arguments: %v (options go before the command)\n", args[1:])
+			os.Exit(1)
+		}
+		_, err := os.Stat(opts.CacheDir) // don't create an empty cache
+		runtimex.Must(err, "cachectl: cannot open cache")
+	}
+	cache := measurex.NewCache(opts.CacheDir)
+	switch args[0] {
+	case "list":
+		list(cache, newFilter(opts))
+	case "show":
+		show(cache, newFilter(opts), opts.JSON)
+	case "delete":
+		remove(cache, newFilter(opts))
+	case "merge":
+		merge(cache, args[1:])
+	case "prune":
+		prune(cache, opts)
+	default:
+		fmt.Fprintf(os.Stderr, "cachectl: unknown command: %s\n%s", args[0], usage)
+		os.Exit(1)
+	}
+}
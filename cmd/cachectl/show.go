@@ -0,0 +1,109 @@
+package main
+
+//
+// Show
+//
+// Code to show cached endpoint measurements.
+//
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/bassosimone/websteps-illustrated/internal/archival"
+	"github.com/bassosimone/websteps-illustrated/internal/measurex"
+	"github.com/bassosimone/websteps-illustrated/internal/runtimex"
+)
+
+// showMaxBody is the maximum number of body bytes we show.
+const showMaxBody = 512
+
+// showJSON shows a cached endpoint measurement using JSON.
+func showJSON(e *measurex.CachedEndpointMeasurement) {
+	data, err := json.MarshalIndent(e, "", "  ")
+	runtimex.PanicOnError(err, "json.MarshalIndent failed")
+	fmt.Printf("%s\n", string(data))
+}
+
+// showReadable shows a cached endpoint measurement in readable form.
+func showReadable(e *measurex.CachedEndpointMeasurement) {
+	m := e.M
+	fmt.Printf("cached:    %s\n", e.T.UTC().Format(time.RFC3339))
+	fmt.Printf("url:       %s\n", m.URLAsString())
+	fmt.Printf("endpoint:  %s\n", m.EndpointAddress())
+	if len(m.OrigCookies) > 0 {
+		fmt.Printf("cookies:   %s\n", strings.Join(measurex.SortedSerializedCookiesNames(m.OrigCookies), " "))
+	}
+	if !m.Finished.IsZero() {
+		fmt.Printf("finished:  %s\n", m.Finished.UTC().Format(time.RFC3339Nano))
+	}
+	fmt.Printf("result:    %s\n", describeEndpointResult(m))
+	if ev := m.TCPConnect; ev != nil {
+		fmt.Printf("connect:   %s in %s\n", archival.FlatFailureToStringOrOK(ev.Failure),
+			ev.Finished.Sub(ev.Started))
+	}
+	if ev := m.QUICTLSHandshake; ev != nil {
+		fmt.Printf("handshake: %s in %s (sni=%s alpn=%v proto=%s version=%s certs=%d)\n",
+			archival.FlatFailureToStringOrOK(ev.Failure), ev.Finished.Sub(ev.Started),
+			ev.SNI, ev.ALPN, ev.NegotiatedProto, ev.TLSVersion, len(ev.PeerCerts))
+	}
+	if ev := m.HTTPRoundTrip; ev != nil {
+		fmt.Printf("http:      %s %s: %s in %s\n", ev.Method, ev.URL,
+			archival.FlatFailureToStringOrOK(ev.Failure), ev.Finished.Sub(ev.Started))
+		showHeaders(">", ev.RequestHeaders)
+		if ev.StatusCode > 0 {
+			fmt.Printf("  < %d %s\n", ev.StatusCode, http.StatusText(int(ev.StatusCode)))
+		}
+		showHeaders("<", ev.ResponseHeaders)
+		if m.HTTPTitle != "" {
+			fmt.Printf("title:     %s\n", m.HTTPTitle)
+		}
+		if m.Location != nil {
+			fmt.Printf("location:  %s\n", m.LocationAsString())
+		}
+		fmt.Printf("body:      %d bytes (truncated=%v tlsh=%s)\n", ev.ResponseBodyLength,
+			ev.ResponseBodyIsTruncated, ev.ResponseBodyTLSH)
+		showBody(ev.ResponseBody)
+		if speed, samples := m.DownloadSpeed(); samples > 0 {
+			fmt.Printf("speed:     %.0f bytes/s (%d samples)\n", speed, samples)
+		}
+	}
+	fmt.Printf("\n")
+}
+
+// showHeaders shows the given headers in sorted order.
+func showHeaders(prefix string, headers http.Header) {
+	var keys []string
+	for key := range headers {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		for _, value := range headers[key] {
+			fmt.Printf("  %s %s: %s\n", prefix, key, value)
+		}
+	}
+}
+
+// showBody shows the beginning of a textual body.
+func showBody(body []byte) {
+	if len(body) <= 0 {
+		return
+	}
+	if !utf8.Valid(body) {
+		fmt.Printf("  (binary body)\n")
+		return
+	}
+	text := string(body)
+	if len(text) > showMaxBody {
+		text = strings.ToValidUTF8(text[:showMaxBody], "") + "..."
+	}
+	for _, line := range strings.Split(text, "\n") {
+		fmt.Printf("  | %s\n", line)
+	}
+}
@@ -0,0 +1,101 @@
+// Command collectord is a tiny stand-in OONI collector for testing. It
+// also serves a fake IP echo service at /ip for discovering the probe IP.
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/bassosimone/getoptx"
+	"github.com/bassosimone/websteps-illustrated/internal/collector"
+	"github.com/bassosimone/websteps-illustrated/internal/engine/geolocate"
+	"github.com/bassosimone/websteps-illustrated/internal/logcat"
+	"github.com/bassosimone/websteps-illustrated/internal/runtimex"
+)
+
+type CLI struct {
+	Address   string          `doc:"address where to listen (default: \"127.0.0.1:9877\")" short:"A"`
+	Help      bool            `doc:"prints this help message" short:"h"`
+	LogFormat string          `doc:"log format to use: text or json (default: text)"`
+	Output    string          `doc:"file where to append the measurements we accept (default: collector.jsonl)" short:"o"`
+	ProbeIP   string          `doc:"IP address that the /ip echo service returns (default: the client IP)"`
+	Verbose   getoptx.Counter `doc:"enable verbose mode" short:"v"`
+}
+
+// getopt parses command line options.
+func getopt() *CLI {
+	opts := &CLI{
+		Address:   "127.0.0.1:9877",
+		Help:      false,
+		LogFormat: "text",
+		Output:    "collector.jsonl",
+		ProbeIP:   "",
+		Verbose:   0,
+	}
+	parser := getoptx.MustNewParser(opts, getoptx.NoPositionalArguments())
+	parser.MustGetopt(os.Args)
+	if opts.Help {
+		parser.PrintUsage(os.Stdout)
+		os.Exit(0)
+	}
+	if opts.Verbose > 0 {
+		logcat.IncrementLogLevel(int(opts.Verbose))
+	}
+	return opts
+}
+
+// handleSignals handles signals.
+func handleSignals(cancel context.CancelFunc) {
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+	sig := <-sigs
+	logcat.Noticef("got signal %d", sig)
+	cancel()
+}
+
+func main() {
+	ctx, cancel := context.WithCancel(context.Background())
+	opts := getopt()
+
+	// 1. open the output file and start listening
+	filep, err := os.OpenFile(opts.Output, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	runtimex.Must(err, "collectord: cannot open output file")
+	listener, err := net.Listen("tcp", opts.Address)
+	runtimex.Must(err, "collectord")
+	fmt.Fprintf(os.Stderr, "collectord: listening at: \"%s\"\n", opts.Address)
+
+	// 2. configure logging
+	logger, err := logcat.NewLogger(opts.LogFormat, os.Stderr, logcat.DefaultLoggerWriteTimestamps)
+	runtimex.Must(err, "cannot create logger")
+	wg := &sync.WaitGroup{}
+	logcat.StartConsumer(ctx, logger, false, wg)
+
+	// 3. handle SIGINT and SIGTERM in the background
+	go handleSignals(cancel)
+
+	// 4. serve the collector API and the echo service in the background
+	collectorServer := collector.NewServer(filep)
+	mux := http.NewServeMux()
+	mux.Handle("/report", collectorServer)
+	mux.Handle("/report/", collectorServer)
+	mux.Handle("/ip", &geolocate.EchoHandler{IP: opts.ProbeIP})
+	srv := &http.Server{Addr: opts.Address, Handler: mux}
+	go srv.Serve(listener)
+
+	// 5. wait for signals to happen and shutdown the server
+	<-ctx.Done()
+	shutdownCtx, shutdownCancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer shutdownCancel()
+	srv.Shutdown(shutdownCtx)
+	runtimex.Must(filep.Close(), "collectord: cannot close output file")
+
+	// 6. wait for all logs to be written
+	wg.Wait()
+}
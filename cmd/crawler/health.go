@@ -0,0 +1,423 @@
+package main
+
+//
+// Health
+//
+// Classifies the health of each input URL using the URLMeasurement
+// results produced by the crawler and suggests test-list actions.
+//
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/bassosimone/websteps-illustrated/internal/archival"
+	"github.com/bassosimone/websteps-illustrated/internal/logcat"
+	"github.com/bassosimone/websteps-illustrated/internal/measurex"
+	"github.com/bassosimone/websteps-illustrated/internal/netxlite"
+	"github.com/bassosimone/websteps-illustrated/internal/runtimex"
+	"github.com/glaslos/tlsh"
+	"golang.org/x/net/publicsuffix"
+)
+
+// These are the possible health statuses of an input URL.
+const (
+	// healthStatusHealthy means we could fetch a webpage.
+	healthStatusHealthy = "healthy"
+
+	// healthStatusDeadDNS means the domain does not resolve.
+	healthStatusDeadDNS = "dead_dns"
+
+	// healthStatusParked means the domain seems parked.
+	healthStatusParked = "parked"
+
+	// healthStatusRedirectElsewhere means the URL permanently
+	// redirects to another registrable domain.
+	healthStatusRedirectElsewhere = "redirect_elsewhere"
+
+	// healthStatusTLSMismatch means every HTTPS endpoint presents
+	// a certificate that is not valid for the domain.
+	healthStatusTLSMismatch = "tls_mismatch"
+
+	// healthStatusUnreachable means we could not fetch any webpage.
+	healthStatusUnreachable = "unreachable"
+
+	// healthStatusInvalidURL means the crawler rejected the URL.
+	healthStatusInvalidURL = "invalid_url"
+)
+
+// These are the test-list actions we suggest.
+const (
+	// healthActionKeep means the URL should stay in the test list.
+	healthActionKeep = "keep"
+
+	// healthActionRemove means the URL should leave the test list.
+	healthActionRemove = "remove"
+
+	// healthActionUpdate means the URL should become SuggestedURL.
+	healthActionUpdate = "update"
+
+	// healthActionReview means a human should review the URL.
+	healthActionReview = "review"
+)
+
+// healthParkedKeywords contains lowercase strings that commonly
+// appear in the title or in the body of parked webpages.
+var healthParkedKeywords = []string{
+	"buy this domain",
+	"domain for sale",
+	"domain is for sale",
+	"domain may be for sale",
+	"domain parking",
+	"parked domain",
+	"parked free",
+	"parkingcrew",
+	"sedoparking",
+	"this domain has been registered",
+}
+
+// healthParkingServices contains the registrable domains of services
+// that host parked webpages or sell parked domains.
+var healthParkingServices = []string{
+	"afternic.com",
+	"bodis.com",
+	"dan.com",
+	"hugedomains.com",
+	"parkingcrew.net",
+	"sedo.com",
+	"undeveloped.com",
+}
+
+// healthParkedMinBodyKeywords is the minimum number of distinct keywords
+// that the body of a webpage must contain for considering it parked. A
+// single keyword in the body is weak evidence, e.g., a news article or
+// a hosting provider's homepage could mention "domain parking".
+const healthParkedMinBodyKeywords = 2
+
+// healthTLSHMaxDiff is the maximum TLSH difference between the body of
+// a webpage and the body of a parked webpage for considering the former
+// also parked (parking services typically use the same template).
+const healthTLSHMaxDiff = 40
+
+// healthEntry is the health classification of an input URL.
+type healthEntry struct {
+	// Input is the input URL.
+	Input string `json:"input"`
+
+	// Status is the health status.
+	Status string `json:"status"`
+
+	// Action is the suggested test-list action.
+	Action string `json:"action"`
+
+	// SuggestedURL is the URL to use instead of Input (if any).
+	SuggestedURL string `json:"suggested_url,omitempty"`
+
+	// Reasons explains why we chose Status.
+	Reasons []string `json:"reasons"`
+
+	// bodyTLSH is the TLSH of the fetched webpage body (if any).
+	bodyTLSH string
+}
+
+// healthReport is the report containing all the classifications.
+type healthReport struct {
+	// Entries contains an entry for each input URL.
+	Entries []*healthEntry `json:"entries"`
+
+	// Stats maps each status to the number of input URLs.
+	Stats map[string]int `json:"stats"`
+}
+
+// newHealthReport creates a new healthReport.
+func newHealthReport() *healthReport {
+	return &healthReport{
+		Entries: []*healthEntry{},
+		Stats:   map[string]int{},
+	}
+}
+
+// addInvalidURL adds an entry for an input URL rejected by the crawler.
+func (r *healthReport) addInvalidURL(input string, err error) {
+	r.Entries = append(r.Entries, &healthEntry{
+		Input:        input,
+		Status:       healthStatusInvalidURL,
+		Action:       healthActionReview,
+		SuggestedURL: "",
+		Reasons:      []string{err.Error()},
+		bodyTLSH:     "",
+	})
+}
+
+// add classifies an input URL given all the URL measurements
+// the crawler produced for it and adds the result to the report.
+func (r *healthReport) add(input string, ums []*measurex.URLMeasurement) {
+	entry := classifyHealth(input, ums)
+	logcat.Noticef("health: %s: %s (%s)", input, entry.Status, strings.Join(entry.Reasons, "; "))
+	r.Entries = append(r.Entries, entry)
+}
+
+// finalize marks as parked the webpages whose body is very similar to
+// a webpage we already know is parked and computes the stats.
+func (r *healthReport) finalize() {
+	var parked []*healthEntry
+	for _, e := range r.Entries {
+		if e.Status == healthStatusParked && e.bodyTLSH != "" {
+			parked = append(parked, e)
+		}
+	}
+	for _, e := range r.Entries {
+		if e.Status != healthStatusHealthy || e.bodyTLSH == "" {
+			continue
+		}
+		for _, p := range parked {
+			if diff, ok := healthTLSHDiff(e.bodyTLSH, p.bodyTLSH); ok && diff <= healthTLSHMaxDiff {
+				e.Status, e.Action = healthStatusParked, healthActionReview
+				e.Reasons = []string{fmt.Sprintf(
+					"body is similar to the parked webpage of %s (TLSH diff %d)", p.Input, diff)}
+				break
+			}
+		}
+	}
+	for _, e := range r.Entries {
+		r.Stats[e.Status]++
+	}
+}
+
+// write writes the report as JSON into the given file.
+func (r *healthReport) write(filename string) {
+	data, err := json.MarshalIndent(r, "", "  ")
+	runtimex.PanicOnError(err, "json.MarshalIndent failed")
+	data = append(data, '\n')
+	err = os.WriteFile(filename, data, 0600)
+	runtimex.Must(err, "cannot write health report")
+}
+
+// classifyHealth classifies a single input URL.
+func classifyHealth(input string, ums []*measurex.URLMeasurement) *healthEntry {
+	entry := &healthEntry{
+		Input:        input,
+		Status:       "",
+		Action:       "",
+		SuggestedURL: "",
+		Reasons:      []string{},
+		bodyTLSH:     "",
+	}
+	if len(ums) < 1 {
+		entry.Status, entry.Action = healthStatusUnreachable, healthActionReview
+		entry.Reasons = append(entry.Reasons, "the crawler did not measure anything")
+		return entry
+	}
+	initial := ums[0]
+	if reason, dead := healthDeadDNS(initial); dead {
+		entry.Status, entry.Action = healthStatusDeadDNS, healthActionRemove
+		entry.Reasons = append(entry.Reasons, reason)
+		return entry
+	}
+	page := healthFinalPage(ums)
+	if page != nil {
+		entry.bodyTLSH = page.ResponseBodyTLSH()
+		if reason, parked := healthParkedPage(page); parked {
+			// Keywords are heuristic, so we want a human to double check.
+			entry.Status, entry.Action = healthStatusParked, healthActionReview
+			entry.Reasons = append(entry.Reasons, reason)
+			return entry
+		}
+	}
+	if epnt, found := healthParkingRedirect(ums); found {
+		entry.Status, entry.Action = healthStatusParked, healthActionRemove
+		entry.Reasons = append(entry.Reasons, fmt.Sprintf(
+			"%s redirects to parking service %s", epnt.URLAsString(), epnt.LocationAsString()))
+		return entry
+	}
+	if epnt, found := healthRedirectElsewhere(initial); found {
+		entry.Status, entry.Action = healthStatusRedirectElsewhere, healthActionUpdate
+		entry.SuggestedURL = epnt.LocationAsString()
+		entry.Reasons = append(entry.Reasons, fmt.Sprintf(
+			"%s permanently redirects to %s", epnt.URLAsString(), epnt.LocationAsString()))
+		return entry
+	}
+	if reason, mismatch := healthTLSMismatch(initial); mismatch {
+		entry.Status, entry.Action = healthStatusTLSMismatch, healthActionReview
+		entry.Reasons = append(entry.Reasons, reason)
+		if epnt, found := healthAnyPage(initial, "http"); found {
+			entry.Action, entry.SuggestedURL = healthActionUpdate, epnt.URLAsString()
+			entry.Reasons = append(entry.Reasons, "the website works using cleartext HTTP")
+		}
+		return entry
+	}
+	if page == nil {
+		entry.Status, entry.Action = healthStatusUnreachable, healthActionReview
+		entry.Reasons = append(entry.Reasons, "we could not fetch any webpage")
+		return entry
+	}
+	entry.Status, entry.Action = healthStatusHealthy, healthActionKeep
+	entry.Reasons = append(entry.Reasons, fmt.Sprintf(
+		"%s returns %d", page.URLAsString(), page.StatusCode()))
+	return entry
+}
+
+// healthDeadDNS returns whether all the address lookups of the initial
+// URL measurement failed because the domain does not exist or does not
+// have any address. In such a case, it also returns the reason.
+func healthDeadDNS(initial *measurex.URLMeasurement) (string, bool) {
+	var count int
+	for _, dns := range initial.DNS {
+		if dns.LookupType() != archival.DNSLookupTypeGetaddrinfo {
+			continue
+		}
+		count++
+		switch dns.Failure() {
+		case netxlite.FailureDNSNXDOMAINError, netxlite.FailureDNSNoAnswer:
+			// continue checking the other lookups
+		case "":
+			if len(dns.Addresses()) > 0 {
+				return "", false
+			}
+		default:
+			return "", false // e.g., timeout: we cannot say anything
+		}
+	}
+	if count < 1 {
+		return "", false
+	}
+	return fmt.Sprintf("all the %d lookups for %s fail with NXDOMAIN or no answer",
+		count, initial.Domain()), true
+}
+
+// healthFinalPage returns the last successful non-redirect HTTP(S)
+// measurement, if any, preferring 2xx over the other status codes.
+func healthFinalPage(ums []*measurex.URLMeasurement) (out *measurex.EndpointMeasurement) {
+	for _, um := range ums {
+		for _, epnt := range um.Endpoint {
+			if epnt.Failure != "" || epnt.HTTPRoundTrip == nil || epnt.IsHTTPRedirect() {
+				continue
+			}
+			if out == nil || !healthIsSuccess(out.StatusCode()) || healthIsSuccess(epnt.StatusCode()) {
+				out = epnt
+			}
+		}
+	}
+	return
+}
+
+// healthIsSuccess returns whether the status code is 2xx.
+func healthIsSuccess(code int64) bool {
+	return code >= 200 && code < 300
+}
+
+// healthParkedPage returns whether the title of a webpage contains a
+// parked-domain keyword or its body contains at least a given number
+// of distinct parked-domain keywords and, if so, the reason.
+func healthParkedPage(page *measurex.EndpointMeasurement) (string, bool) {
+	title := strings.ToLower(page.HTTPTitle)
+	for _, keyword := range healthParkedKeywords {
+		if strings.Contains(title, keyword) {
+			return fmt.Sprintf("the title of %s contains '%s'", page.URLAsString(), keyword), true
+		}
+	}
+	body := strings.ToLower(string(page.ResponseBody()))
+	var found []string
+	for _, keyword := range healthParkedKeywords {
+		if strings.Contains(body, keyword) {
+			found = append(found, keyword)
+		}
+	}
+	if len(found) < healthParkedMinBodyKeywords {
+		return "", false
+	}
+	return fmt.Sprintf("the body of %s contains '%s'", page.URLAsString(),
+		strings.Join(found, "', '")), true
+}
+
+// healthParkingRedirect returns the first redirect to a parking service.
+func healthParkingRedirect(ums []*measurex.URLMeasurement) (*measurex.EndpointMeasurement, bool) {
+	for _, um := range ums {
+		for _, epnt := range um.Endpoint {
+			if epnt.Failure != "" || !epnt.IsHTTPRedirect() {
+				continue
+			}
+			domain, err := publicsuffix.EffectiveTLDPlusOne(epnt.RedirectLocationDomain())
+			if err != nil {
+				continue
+			}
+			for _, service := range healthParkingServices {
+				if domain == service {
+					return epnt, true
+				}
+			}
+		}
+	}
+	return nil, false
+}
+
+// healthRedirectElsewhere returns the first endpoint of the initial URL
+// measurement using the input URL scheme that permanently redirects to
+// another registrable domain. We require all the successful endpoints
+// using such a scheme to redirect, to avoid flagging load balancers that
+// only redirect some clients.
+func healthRedirectElsewhere(initial *measurex.URLMeasurement) (*measurex.EndpointMeasurement, bool) {
+	var out *measurex.EndpointMeasurement
+	for _, epnt := range initial.Endpoint {
+		if epnt.Failure != "" || epnt.Scheme() != initial.URL.Scheme {
+			continue
+		}
+		switch epnt.StatusCode() {
+		case 301, 308:
+		default:
+			return nil, false
+		}
+		if epnt.Location == nil || epnt.SeemsLegitimateRedirect() {
+			return nil, false
+		}
+		if out == nil {
+			out = epnt
+		}
+	}
+	return out, out != nil
+}
+
+// healthTLSMismatch returns whether all the HTTPS endpoints of the initial
+// URL measurement fail because of an invalid hostname and the reason.
+func healthTLSMismatch(initial *measurex.URLMeasurement) (string, bool) {
+	var count int
+	for _, epnt := range initial.Endpoint {
+		if epnt.Scheme() != "https" {
+			continue
+		}
+		if epnt.Failure != netxlite.FailureSSLInvalidHostname {
+			return "", false
+		}
+		count++
+	}
+	if count < 1 {
+		return "", false
+	}
+	return fmt.Sprintf("all the %d HTTPS endpoints for %s fail with %s",
+		count, initial.Domain(), netxlite.FailureSSLInvalidHostname), true
+}
+
+// healthAnyPage returns any successful endpoint using the given scheme.
+func healthAnyPage(um *measurex.URLMeasurement, scheme string) (*measurex.EndpointMeasurement, bool) {
+	for _, epnt := range um.Endpoint {
+		if epnt.Failure == "" && epnt.Scheme() == scheme && epnt.HTTPRoundTrip != nil {
+			return epnt, true
+		}
+	}
+	return nil, false
+}
+
+// healthTLSHDiff returns the difference between two TLSH strings.
+func healthTLSHDiff(a, b string) (int, bool) {
+	ta, err := tlsh.ParseStringToTlsh(a)
+	if err != nil {
+		return 0, false
+	}
+	tb, err := tlsh.ParseStringToTlsh(b)
+	if err != nil {
+		return 0, false
+	}
+	return ta.Diff(tb), true
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/bassosimone/websteps-illustrated/internal/archival"
+	"github.com/bassosimone/websteps-illustrated/internal/measurex"
+)
+
+func TestHealthParkedPage(t *testing.T) {
+	tests := []struct {
+		name   string
+		title  string
+		body   string
+		expect bool
+	}{{
+		name:   "keyword in the title",
+		title:  "example.com - Domain for sale",
+		body:   "<html></html>",
+		expect: true,
+	}, {
+		name:   "single keyword in the body",
+		title:  "Our services",
+		body:   "<p>We also offer domain parking to our customers.</p>",
+		expect: false,
+	}, {
+		name:   "several keywords in the body",
+		title:  "example.com",
+		body:   "<p>Buy this domain. This domain may be for sale. Powered by ParkingCrew.</p>",
+		expect: true,
+	}, {
+		name:   "no keywords",
+		title:  "Example Domain",
+		body:   "<p>This domain is for use in illustrative examples.</p>",
+		expect: false,
+	}}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			page := &measurex.EndpointMeasurement{
+				URL:       &measurex.SimpleURL{Scheme: "https", Host: "example.com", Path: "/"},
+				HTTPTitle: tt.title,
+				HTTPRoundTrip: &archival.FlatHTTPRoundTripEvent{
+					ResponseBody: []byte(tt.body),
+				},
+			}
+			if _, parked := healthParkedPage(page); parked != tt.expect {
+				t.Fatal("expected", tt.expect, "got", parked)
+			}
+		})
+	}
+}
@@ -1,4 +1,6 @@
-// Command crawler crawls a set of URLs
+// Command crawler crawls a set of URLs. With --health-report, it also
+// classifies each input URL (e.g., dead DNS, parked domain) and writes a
+// JSON report suggesting how to update the test list.
 package main
 
 import (
@@ -14,25 +16,29 @@ import (
 )
 
 type CLI struct {
-	CacheDir   string          `doc:"directory where to store cache" short:"C"`
-	Help       bool            `doc:"prints this help message" short:"h"`
-	HostHeader string          `doc:"force using this host header"`
-	Input      []string        `doc:"add URL to list of URLs to crawl" short:"i"`
-	InputFile  []string        `doc:"add input file containing URLs to crawl" short:"f"`
-	SNI        string          `doc:"force using this SNI"`
-	Verbose    getoptx.Counter `doc:"enable verbose mode" short:"v"`
+	CacheDir     string          `doc:"directory where to store cache (or single-file cache if the name ends with .db)" short:"C"`
+	HealthReport string          `doc:"classify the health of each input URL and write a JSON report with suggested test-list actions into the given file"`
+	Help         bool            `doc:"prints this help message" short:"h"`
+	HostHeader   string          `doc:"force using this host header"`
+	Input        []string        `doc:"add URL to list of URLs to crawl" short:"i"`
+	InputFile    []string        `doc:"add input file containing URLs to crawl" short:"f"`
+	LogFormat    string          `doc:"log format to use: text or json (default: text)"`
+	SNI          string          `doc:"force using this SNI"`
+	Verbose      getoptx.Counter `doc:"enable verbose mode" short:"v"`
 }
 
 // getopt parses command line flags.
 func getopt() *CLI {
 	opts := &CLI{
-		CacheDir:   "",
-		Help:       false,
-		HostHeader: "",
-		Input:      []string{},
-		InputFile:  []string{},
-		SNI:        "",
-		Verbose:    0,
+		CacheDir:     "",
+		HealthReport: "",
+		Help:         false,
+		HostHeader:   "",
+		Input:        []string{},
+		InputFile:    []string{},
+		LogFormat:    "text",
+		SNI:          "",
+		Verbose:      0,
 	}
 	parser := getoptx.MustNewParser(opts, getoptx.NoPositionalArguments())
 	parser.MustGetopt(os.Args)
@@ -114,17 +120,29 @@ func main() {
 	amx := newMeasurer(opts)
 	ctx, cancel := context.WithCancel(context.Background())
 	wg := &sync.WaitGroup{}
-	logcat.StartConsumer(ctx, logcat.DefaultLogger(os.Stdout, 0), false, wg)
+	logger, err := logcat.NewLogger(opts.LogFormat, os.Stdout, 0)
+	runtimex.Must(err, "cannot create logger")
+	logcat.StartConsumer(ctx, logger, false, wg)
+	report := newHealthReport()
 	for _, input := range opts.Input {
 		crawler := newCrawler(opts, amx)
 		mchan, err := crawler.Crawl(ctx, input)
 		if err != nil {
 			logcat.Warnf("cannot start crawler: %s", err.Error())
+			report.addInvalidURL(input, err)
 			continue
 		}
-		for range mchan {
-			// just drain the channel
+		var ums []*measurex.URLMeasurement
+		for um := range mchan {
+			ums = append(ums, um)
 		}
+		if opts.HealthReport != "" {
+			report.add(input, ums)
+		}
+	}
+	if opts.HealthReport != "" {
+		report.finalize()
+		report.write(opts.HealthReport)
 	}
 	cancel()  // "sighup" to log writer
 	wg.Wait() // wait for all logs to be written
@@ -17,12 +17,15 @@ import (
 
 // CLI contains command line flags.
 type CLI struct {
+	DotResolver    []string        `doc:"add DNS-over-TLS resolver endpoint"`
 	EnableHTTPS    bool            `doc:"also query for HTTPSSvc records"`
 	EnableNS       bool            `doc:"also query for NS records"`
 	HTTPSResolver  []string        `doc:"add HTTPS resolver URL"`
 	Help           bool            `doc:"prints this help message" short:"h"`
+	LogFormat      string          `doc:"log format to use: text or json (default: text)"`
 	Raw            bool            `doc:"emits measurements in the internal data format"`
 	SystemResolver bool            `doc:"use the system resolver"`
+	TCPResolver    []string        `doc:"add TCP resolver endpoint"`
 	UDPResolver    []string        `doc:"add UDP resolver endpoint"`
 	Verbose        getoptx.Counter `doc:"enable verbose mode" short:"v"`
 }
@@ -30,12 +33,15 @@ type CLI struct {
 // getopt parses command line options.
 func getopt() (*CLI, []string) {
 	opts := &CLI{
+		DotResolver:    []string{},
 		EnableHTTPS:    false,
 		EnableNS:       false,
 		HTTPSResolver:  []string{},
 		Help:           false,
+		LogFormat:      "text",
 		Raw:            false,
 		SystemResolver: false,
+		TCPResolver:    []string{},
 		UDPResolver:    []string{},
 		Verbose:        0,
 	}
@@ -67,6 +73,8 @@ func makeplans(opts *CLI, args []string) []*measurex.DNSLookupPlan {
 		flags |= measurex.DNSLookupFlagNS
 	}
 	resolvers := measurex.NewResolversUDP(opts.UDPResolver...)
+	resolvers = append(resolvers, measurex.NewResolversTCP(opts.TCPResolver...)...)
+	resolvers = append(resolvers, measurex.NewResolversDoT(opts.DotResolver...)...)
 	resolvers = append(resolvers, measurex.NewResolversHTTPS(opts.HTTPSResolver...)...)
 	if opts.SystemResolver || len(resolvers) <= 0 {
 		if len(resolvers) <= 0 {
@@ -99,7 +107,9 @@ func main() {
 	begin := time.Now()
 	ctx, cancel := context.WithCancel(context.Background())
 	wg := &sync.WaitGroup{}
-	logcat.StartConsumer(ctx, logcat.DefaultLogger(os.Stdout, 0), false, wg)
+	logger, err := logcat.NewLogger(opts.LogFormat, os.Stdout, 0)
+	runtimex.Must(err, "cannot create logger")
+	logcat.StartConsumer(ctx, logger, false, wg)
 	for m := range mx.DNSLookups(ctx, plans...) {
 		if opts.Raw {
 			dump(m)
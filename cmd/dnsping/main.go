@@ -18,19 +18,21 @@ import (
 )
 
 type CLI struct {
-	Cache    string          `doc:"directory with dnsping cache" short:"C"`
-	Count    int             `doc:"number of repetitions" short:"c"`
-	Help     bool            `doc:"prints this help message" short:"h"`
-	Resolver []string        `doc:"resolver to use (default: 8.8.4.4:53)" short:"r"`
-	Verbose  getoptx.Counter `doc:"enable verbose mode" short:"v"`
+	Cache     string          `doc:"directory with dnsping cache (or single-file cache if the name ends with .db)" short:"C"`
+	Count     int             `doc:"number of repetitions" short:"c"`
+	Help      bool            `doc:"prints this help message" short:"h"`
+	LogFormat string          `doc:"log format to use: text or json (default: text)"`
+	Resolver  []string        `doc:"resolver to use (default: 8.8.4.4:53)" short:"r"`
+	Verbose   getoptx.Counter `doc:"enable verbose mode" short:"v"`
 }
 
 func main() {
 	opts := &CLI{
-		Count:    10,
-		Help:     false,
-		Resolver: []string{},
-		Verbose:  0,
+		Count:     10,
+		Help:      false,
+		LogFormat: "text",
+		Resolver:  []string{},
+		Verbose:   0,
 	}
 	parser := getoptx.MustNewParser(
 		opts, getoptx.AtLeastOnePositionalArgument(),
@@ -65,7 +67,9 @@ func main() {
 	}
 	ctx, cancel := context.WithCancel(context.Background())
 	wg := &sync.WaitGroup{}
-	logcat.StartConsumer(ctx, logcat.DefaultLogger(os.Stderr, 0), false, wg)
+	logger, err := logcat.NewLogger(opts.LogFormat, os.Stderr, 0)
+	runtimex.Must(err, "cannot create logger")
+	logcat.StartConsumer(ctx, logger, false, wg)
 	ch := engine.RunAsync(plans)
 	result := <-ch
 	data, err := json.Marshal(result.ToArchival(begin))
@@ -0,0 +1,208 @@
+// Command reanalyze reads the raw test keys emitted by `websteps --raw`
+// (or by `replay -o`), recomputes the analysis using the current code,
+// and prints the old and new flags of each URL whose flags changed.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/bassosimone/getoptx"
+	"github.com/bassosimone/websteps-illustrated/internal/engine/experiment/websteps"
+	"github.com/bassosimone/websteps-illustrated/internal/logcat"
+	"github.com/bassosimone/websteps-illustrated/internal/runtimex"
+)
+
+// CLI contains command line flags.
+type CLI struct {
+	All           bool            `doc:"also print the URLs whose flags did not change" short:"a"`
+	AnalysisRules string          `doc:"classify failures using the rules in the given YAML or JSON file (see websteps.AnalysisRuleset)"`
+	BlockpageDB   string          `doc:"recognize blockpages using the fingerprints in the given YAML or JSON file (see websteps.BlockpageDB)"`
+	Help          bool            `doc:"prints this help message" short:"h"`
+	LogFormat     string          `doc:"log format to use: text or json (default: text)"`
+	Logfile       string          `doc:"file in which to write logs (default: discard logs)" short:"L"`
+	Output        string          `doc:"optional file where to write the reanalyzed raw test keys" short:"o"`
+	Verbose       getoptx.Counter `doc:"enable verbose mode. Use more than once for more verbosity." short:"v"`
+}
+
+// getopt parses command line options.
+func getopt() (*CLI, []string) {
+	opts := &CLI{
+		All:           false,
+		AnalysisRules: "",
+		BlockpageDB:   "",
+		Help:          false,
+		LogFormat:     "text",
+		Logfile:       "",
+		Output:        "",
+		Verbose:       0,
+	}
+	parser := getoptx.MustNewParser(
+		opts, getoptx.AtLeastOnePositionalArgument(),
+		getoptx.SetPositionalArgumentsPlaceholder("report.jsonl [report.jsonl...]"),
+	)
+	parser.MustGetopt(os.Args)
+	if opts.Help {
+		parser.PrintUsage(os.Stdout)
+		os.Exit(0)
+	}
+	if opts.Verbose > 0 {
+		logcat.IncrementLogLevel(int(opts.Verbose))
+	}
+	return opts, parser.Args()
+}
+
+func main() {
+	opts, args := getopt()
+	ctx, cancel := context.WithCancel(context.Background())
+	wg := &sync.WaitGroup{}
+	if opts.Logfile != "" {
+		logfile, err := os.Create(opts.Logfile)
+		runtimex.Must(err, "cannot open log file")
+		defer func() {
+			err := logfile.Close()
+			runtimex.Must(err, "cannot close log file")
+		}()
+		logger, err := logcat.NewLogger(opts.LogFormat, logfile, 0)
+		runtimex.Must(err, "cannot create logger")
+		logcat.StartConsumer(ctx, logger, false, wg)
+	}
+	var rules *websteps.AnalysisRuleset
+	if opts.AnalysisRules != "" {
+		var err error
+		rules, err = websteps.LoadAnalysisRuleset(opts.AnalysisRules)
+		runtimex.Must(err, "cannot load analysis rules")
+	}
+	var blockpages *websteps.BlockpageDB
+	if opts.BlockpageDB != "" {
+		var err error
+		blockpages, err = websteps.LoadBlockpageDB(opts.BlockpageDB)
+		runtimex.Must(err, "cannot load blockpage DB")
+	}
+	output := openOutput(opts)
+	st := &stats{}
+	for _, filepath := range args {
+		reanalyzeFile(opts, rules, blockpages, filepath, output, st)
+	}
+	runtimex.Must(output.Close(), "cannot close output file")
+	cancel()  // "sighup" to logs writer
+	wg.Wait() // wait for all logs to be written
+	fmt.Printf("%d/%d measurements changed flags\n", st.changed, st.total)
+}
+
+// stats contains statistics about the reanalysis.
+type stats struct {
+	// changed is the number of test keys whose flags changed.
+	changed int
+
+	// total is the total number of test keys.
+	total int
+}
+
+// reanalyzeFile reanalyzes all the test keys inside the given file.
+func reanalyzeFile(opts *CLI, rules *websteps.AnalysisRuleset,
+	blockpages *websteps.BlockpageDB, filepath string, output io.Writer, st *stats) {
+	filep, err := os.Open(filepath)
+	runtimex.Must(err, "cannot open input file")
+	defer filep.Close()
+	decoder := json.NewDecoder(filep)
+	for {
+		var tk websteps.TestKeys
+		err := decoder.Decode(&tk)
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		runtimex.Must(err, "cannot parse input file")
+		old := stepsFlags(&tk)
+		oldFlags := tk.Flags
+		tk.Reanalyze(rules, blockpages)
+		st.total++
+		if oldFlags != tk.Flags || !stepsFlagsEqual(old, stepsFlags(&tk)) {
+			st.changed++
+			printDiff("DIFF", &tk, oldFlags, old)
+		} else if opts.All {
+			printDiff("SAME", &tk, oldFlags, old)
+		}
+		data, err := json.Marshal(&tk)
+		runtimex.PanicOnError(err, "json.Marshal failed")
+		data = append(data, '\n')
+		_, err = output.Write(data)
+		runtimex.Must(err, "cannot write output file")
+	}
+}
+
+// stepsFlags returns the flags of each step.
+func stepsFlags(tk *websteps.TestKeys) (out []int64) {
+	for _, ssm := range tk.Steps {
+		if ssm != nil {
+			out = append(out, ssm.Flags)
+			continue
+		}
+		out = append(out, 0)
+	}
+	return
+}
+
+// stepsFlagsEqual returns whether two lists of steps flags are equal.
+func stepsFlagsEqual(a, b []int64) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for idx := range a {
+		if a[idx] != b[idx] {
+			return false
+		}
+	}
+	return true
+}
+
+// printDiff prints the old and new flags of the test keys and of each step.
+func printDiff(prefix string, tk *websteps.TestKeys, oldFlags int64, old []int64) {
+	fmt.Printf("%s %s: '%s' => '%s'\n", prefix, tk.URL, hashtags(oldFlags), hashtags(tk.Flags))
+	for idx, ssm := range tk.Steps {
+		if ssm == nil || ssm.Flags == old[idx] {
+			continue
+		}
+		var URL string
+		if ssm.ProbeInitial != nil && ssm.ProbeInitial.URL != nil {
+			URL = ssm.ProbeInitial.URL.String()
+		}
+		fmt.Printf("    step %d %s: '%s' => '%s'\n", idx, URL,
+			hashtags(old[idx]), hashtags(ssm.Flags))
+	}
+}
+
+// hashtags returns the hashtags describing the given flags.
+func hashtags(flags int64) string {
+	tags, _ := websteps.ExplainFlagsUsingTagsAndSeverity(flags)
+	return strings.Join(tags, " ")
+}
+
+// discardCloser is an io.WriteCloser discarding its input.
+type discardCloser struct{}
+
+// Write implements io.Writer.
+func (discardCloser) Write(b []byte) (int, error) {
+	return len(b), nil
+}
+
+// Close implements io.Closer.
+func (discardCloser) Close() error {
+	return nil
+}
+
+// openOutput opens the output file, if needed.
+func openOutput(opts *CLI) io.WriteCloser {
+	if opts.Output == "" {
+		return discardCloser{}
+	}
+	filep, err := os.Create(opts.Output)
+	runtimex.Must(err, "cannot open output file")
+	return filep
+}
@@ -0,0 +1,139 @@
+// Command replay replays test cases without using the network and
+// checks whether the analysis flags match the expected flags. We report
+// test cases marked as known failures as XFAIL rather than FAIL.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+
+	"github.com/bassosimone/getoptx"
+	"github.com/bassosimone/websteps-illustrated/internal/engine/experiment/websteps"
+	"github.com/bassosimone/websteps-illustrated/internal/logcat"
+	"github.com/bassosimone/websteps-illustrated/internal/runtimex"
+	"github.com/bassosimone/websteps-illustrated/internal/testcase"
+)
+
+// CLI contains command line flags.
+type CLI struct {
+	AnalysisRules string          `doc:"classify failures using the rules in the given YAML or JSON file (see websteps.AnalysisRuleset)"`
+	Emoji         bool            `doc:"enable emitting messages with emojis" short:"e"`
+	Help          bool            `doc:"prints this help message" short:"h"`
+	Keep          bool            `doc:"keep the temporary directories containing the caches"`
+	LogFormat     string          `doc:"log format to use: text or json (default: text)"`
+	Logfile       string          `doc:"file in which to write logs (default: discard logs)" short:"L"`
+	Output        string          `doc:"optional file where to write the raw test keys" short:"o"`
+	Verbose       getoptx.Counter `doc:"enable verbose mode. Use more than once for more verbosity." short:"v"`
+}
+
+// getopt parses command line options.
+func getopt() (*CLI, []string) {
+	opts := &CLI{
+		AnalysisRules: "",
+		Emoji:         false,
+		Help:          false,
+		Keep:          false,
+		LogFormat:     "text",
+		Logfile:       "",
+		Output:        "",
+		Verbose:       0,
+	}
+	parser := getoptx.MustNewParser(
+		opts, getoptx.AtLeastOnePositionalArgument(),
+		getoptx.SetPositionalArgumentsPlaceholder("testcase.yaml [testcase.yaml...]"),
+	)
+	parser.MustGetopt(os.Args)
+	if opts.Help {
+		parser.PrintUsage(os.Stdout)
+		os.Exit(0)
+	}
+	if opts.Verbose > 0 {
+		logcat.IncrementLogLevel(int(opts.Verbose))
+	}
+	return opts, parser.Args()
+}
+
+func main() {
+	opts, args := getopt()
+	ctx, cancel := context.WithCancel(context.Background())
+	wg := &sync.WaitGroup{}
+	if opts.Logfile != "" {
+		logfile, err := os.Create(opts.Logfile)
+		runtimex.Must(err, "cannot open log file")
+		defer func() {
+			err := logfile.Close()
+			runtimex.Must(err, "cannot close log file")
+		}()
+		logger, err := logcat.NewLogger(opts.LogFormat, logfile, 0)
+		runtimex.Must(err, "cannot create logger")
+		logcat.StartConsumer(ctx, logger, opts.Emoji, wg)
+	}
+	var rules *websteps.AnalysisRuleset
+	if opts.AnalysisRules != "" {
+		var err error
+		rules, err = websteps.LoadAnalysisRuleset(opts.AnalysisRules)
+		runtimex.Must(err, "cannot load analysis rules")
+	}
+	var failures int
+	for _, filepath := range args {
+		tk, err := replay(ctx, opts, rules, filepath)
+		if errors.Is(err, testcase.ErrKnownFailure) {
+			maybeWriteOutput(opts, tk)
+			fmt.Printf("XFAIL %s: %s\n", filepath, err.Error())
+			continue
+		}
+		if err != nil {
+			fmt.Printf("FAIL %s: %s\n", filepath, err.Error())
+			failures++
+			continue
+		}
+		maybeWriteOutput(opts, tk)
+		fmt.Printf("PASS %s\n", filepath)
+	}
+	cancel()  // "sighup" to logs writer
+	wg.Wait() // wait for all logs to be written
+	if failures > 0 {
+		fmt.Printf("%d/%d test cases failed\n", failures, len(args))
+		os.Exit(1)
+	}
+}
+
+// replay replays and checks a single test case.
+func replay(ctx context.Context, opts *CLI, rules *websteps.AnalysisRuleset,
+	filepath string) (*websteps.TestKeys, error) {
+	tc, err := testcase.Load(filepath)
+	if err != nil {
+		return nil, err
+	}
+	dirpath, err := os.MkdirTemp("", "replay")
+	runtimex.Must(err, "cannot create temporary directory")
+	if opts.Keep {
+		fmt.Printf("caches for %s are in %s\n", filepath, dirpath)
+	} else {
+		defer os.RemoveAll(dirpath)
+	}
+	tk, err := tc.ReplayWithAnalysisRules(ctx, dirpath, rules)
+	if err != nil {
+		return nil, err
+	}
+	return tk, tc.Check(tk)
+}
+
+// maybeWriteOutput appends the given test keys to the output file.
+func maybeWriteOutput(opts *CLI, tk *websteps.TestKeys) {
+	if opts.Output == "" {
+		return
+	}
+	filep, err := os.OpenFile(opts.Output, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	runtimex.Must(err, "cannot open output file")
+	data, err := json.Marshal(tk)
+	runtimex.PanicOnError(err, "json.Marshal failed")
+	data = append(data, '\n')
+	_, err = filep.Write(data)
+	runtimex.Must(err, "cannot write output file")
+	runtimex.Must(filep.Close(), "cannot close output file")
+}
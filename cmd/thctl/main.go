@@ -23,6 +23,7 @@ type CLI struct {
 	Both         bool            `doc:"ask the test helper to test both HTTP and HTTPS"`
 	Help         bool            `doc:"prints this help message" short:"h"`
 	Input        string          `doc:"URL to submit to the test helper" short:"i" required:"true"`
+	LogFormat    string          `doc:"log format to use: text or json (default: text)"`
 	QUICEndpoint []string        `doc:"ask the test helper to test this QUIC endpoint"`
 	TCPEndpoint  []string        `doc:"ask the test helper to test this TCP endpoint"`
 	Verbose      getoptx.Counter `doc:"enable verbose mode" short:"v"`
@@ -36,6 +37,7 @@ func getopt() *CLI {
 		Both:         false,
 		Help:         false,
 		Input:        "",
+		LogFormat:    "text",
 		QUICEndpoint: []string{},
 		TCPEndpoint:  []string{},
 		Verbose:      0,
@@ -86,7 +88,9 @@ func main() {
 	begin := time.Now()
 	ctx, cancel := context.WithCancel(context.Background())
 	wg := &sync.WaitGroup{}
-	logcat.StartConsumer(ctx, logcat.DefaultLogger(os.Stderr, 0), false, wg)
+	logger, err := logcat.NewLogger(opts.LogFormat, os.Stderr, 0)
+	runtimex.Must(err, "cannot create logger")
+	logcat.StartConsumer(ctx, logger, false, wg)
 	resp, err := clnt.THRequest(ctx, request)
 	runtimex.Must(err, "TH failed")
 	if opts.Archival {
@@ -3,11 +3,13 @@ package main
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
 	"net"
 	"net/http"
 	"os"
 	"os/signal"
+	"sort"
 	"sync"
 	"syscall"
 	"time"
@@ -16,31 +18,56 @@ import (
 	"github.com/bassosimone/websteps-illustrated/internal/engine/experiment/websteps"
 	"github.com/bassosimone/websteps-illustrated/internal/logcat"
 	"github.com/bassosimone/websteps-illustrated/internal/measurex"
+	"github.com/bassosimone/websteps-illustrated/internal/metrics"
 	"github.com/bassosimone/websteps-illustrated/internal/runtimex"
 )
 
 type CLI struct {
-	Address             string          `doc:"address where to listen (default: \":9876\")" short:"A"`
-	CacheDir            string          `doc:"directory where to store cache (default: empty)" short:"C"`
-	CacheDisableNetwork bool            `doc:"the cache would not rely on the network to fill missing entries" short:"N"`
-	CacheForever        bool            `doc:"never expire cache entries and keep adding to the cache"`
-	Help                bool            `doc:"prints this help message" short:"h"`
-	Logfile             string          `doc:"write logs to the specified file instead of to stderr" short:"L"`
-	User                string          `doc:"user to drop privileges to (Linux only; default: nobody)" short:"u"`
-	Verbose             getoptx.Counter `doc:"enable verbose mode" short:"v"`
+	Address                string          `doc:"address where to listen (default: \":9876\")" short:"A"`
+	CacheDir               string          `doc:"directory where to store cache (or single-file cache if the name ends with .db) (default: empty)" short:"C"`
+	CacheDisableNetwork    bool            `doc:"the cache would not rely on the network to fill missing entries" short:"N"`
+	CacheForever           bool            `doc:"never expire cache entries and keep adding to the cache"`
+	CacheMaxSize           int64           `doc:"maximum size in bytes of each of the dns and endpoint caches; zero means no limit (default: 0)"`
+	CachePolicy            string          `doc:"load the caching policy from the given YAML or JSON file (see measurex.CachingPolicyConfig; default: measurex.DefaultCachingPolicyConfig)"`
+	Help                   bool            `doc:"prints this help message" short:"h"`
+	LogFormat              string          `doc:"log format to use: text or json (default: text)"`
+	Logfile                string          `doc:"write logs to the specified file instead of to stderr" short:"L"`
+	MaxAddressesPerFamily  int             `doc:"maximum number of IP addresses per family measured by each step (default: 32)"`
+	MaxConcurrent          int             `doc:"maximum number of steps running at the same time; zero means no limit (default: 64)"`
+	MaxConcurrentPerClient int             `doc:"maximum number of running or queued steps per client IP; zero means no limit (default: 8)"`
+	MaxQueueWait           time.Duration   `doc:"maximum time a step waits inside the queue (default: 10s)"`
+	MaxQueued              int             `doc:"maximum number of steps waiting to run when we're running the maximum number of steps (default: 128)"`
+	MetricsAddress         string          `doc:"address where to serve /metrics, /healthz, and /cache/stats, which should not be reachable by clients (default: \"127.0.0.1:9877\")"`
+	StepsBurst             int             `doc:"maximum number of steps per client IP we admit in a burst (default: same as --steps-per-minute)"`
+	StepsPerMinute         int             `doc:"maximum number of steps per minute per client IP; zero means no limit (default: 60)"`
+	TrustedProxies         int             `doc:"number of trusted reverse proxies in front of thd that append to X-Forwarded-For, used to obtain the client IP (default: 0)"`
+	User                   string          `doc:"user to drop privileges to (Linux only; default: nobody)" short:"u"`
+	Verbose                getoptx.Counter `doc:"enable verbose mode" short:"v"`
 }
 
 // getopt parses command line options.
 func getopt() *CLI {
 	opts := &CLI{
-		Address:             ":9876",
-		CacheDir:            "",
-		CacheDisableNetwork: false,
-		CacheForever:        false,
-		Help:                false,
-		Logfile:             "",
-		User:                "nobody",
-		Verbose:             0,
+		Address:                ":9876",
+		CacheDir:               "",
+		CacheDisableNetwork:    false,
+		CacheForever:           false,
+		CacheMaxSize:           0,
+		CachePolicy:            "",
+		Help:                   false,
+		LogFormat:              "text",
+		Logfile:                "",
+		MaxAddressesPerFamily:  websteps.DefaultTHMaxAddressesPerFamily,
+		MaxConcurrent:          64,
+		MaxConcurrentPerClient: 8,
+		MaxQueueWait:           websteps.DefaultTHAdmissionMaxQueueWait,
+		MaxQueued:              128,
+		MetricsAddress:         "127.0.0.1:9877",
+		StepsBurst:             0,
+		StepsPerMinute:         60,
+		TrustedProxies:         0,
+		User:                   "nobody",
+		Verbose:                0,
 	}
 	parser := getoptx.MustNewParser(opts, getoptx.NoPositionalArguments())
 	parser.MustGetopt(os.Args)
@@ -48,6 +75,10 @@ func getopt() *CLI {
 		parser.PrintUsage(os.Stdout)
 		os.Exit(0)
 	}
+	if opts.CacheForever && opts.CachePolicy != "" {
+		fmt.Fprintf(os.Stderr, "thd: --cache-forever and --cache-policy are mutually exclusive\n")
+		os.Exit(1)
+	}
 	if opts.Verbose > 0 {
 		logcat.IncrementLogLevel(int(opts.Verbose))
 	}
@@ -56,25 +87,123 @@ func getopt() *CLI {
 
 // maybeOpenCache opens the cache if we configured a cache. Otherwise this
 // function returns a nil pointer and false indicating there's no cache.
-func maybeOpenCache(ctx context.Context, opts *CLI) (*measurex.Cache, bool) {
+func maybeOpenCache(ctx context.Context, opts *CLI, reg *metrics.Registry) (*measurex.Cache, bool) {
 	if opts.CacheDir == "" {
 		return nil, false
 	}
-	fmt.Fprintf(os.Stderr, "thd: using cache at %s with disableNetwork=%v\n",
-		opts.CacheDir, opts.CacheDisableNetwork)
+	fmt.Fprintf(os.Stderr, "thd: using cache at %s with disableNetwork=%v maxSize=%d\n",
+		opts.CacheDir, opts.CacheDisableNetwork, opts.CacheMaxSize)
 	cache := measurex.NewCache(opts.CacheDir)
 	cache.DisableNetwork = opts.CacheDisableNetwork
+	cache.SetKeepUnused(opts.CacheForever)
+	cache.SetMaxBytes(opts.CacheMaxSize)
+	cache.SetMetrics(reg)
 	cache.StartTrimmer(ctx)
 	return cache, true
 }
 
-// handleSignals handles signals.
-func handleSignals(cancel context.CancelFunc) {
+// newCachingPolicy creates the policy for using cached measurements.
+func newCachingPolicy(opts *CLI) measurex.CachingPolicy {
+	if opts.CacheForever {
+		return measurex.CachingForeverPolicy()
+	}
+	if opts.CachePolicy == "" {
+		return measurex.NewConfigurableCachingPolicy(measurex.DefaultCachingPolicyConfig())
+	}
+	config, err := measurex.LoadCachingPolicyConfig(opts.CachePolicy)
+	runtimex.Must(err, "thd: cannot load caching policy")
+	fmt.Fprintf(os.Stderr, "thd: using caching policy at %s\n", opts.CachePolicy)
+	return measurex.NewConfigurableCachingPolicy(config)
+}
+
+// newAdmissionController creates the controller that limits the
+// amount of work we perform on behalf of clients.
+func newAdmissionController(opts *CLI) *websteps.THAdmissionController {
+	fmt.Fprintf(os.Stderr, "thd: admission control: maxConcurrent=%d maxConcurrentPerClient=%d maxQueued=%d stepsPerMinute=%d trustedProxies=%d\n",
+		opts.MaxConcurrent, opts.MaxConcurrentPerClient, opts.MaxQueued, opts.StepsPerMinute, opts.TrustedProxies)
+	return websteps.NewTHAdmissionController(&websteps.THAdmissionConfig{
+		MaxConcurrent:          opts.MaxConcurrent,
+		MaxConcurrentPerClient: opts.MaxConcurrentPerClient,
+		MaxQueued:              opts.MaxQueued,
+		MaxQueueWait:           opts.MaxQueueWait,
+		StepsPerMinute:         opts.StepsPerMinute,
+		Burst:                  opts.StepsBurst,
+		TrustedProxies:         opts.TrustedProxies,
+	})
+}
+
+// listenForMetrics opens the listener for serving metrics. We never serve
+// metrics using the public address because they reveal information about
+// the clients and the cache. By default, we only listen on the loopback.
+func listenForMetrics(opts *CLI) net.Listener {
+	listener, err := net.Listen("tcp", opts.MetricsAddress)
+	runtimex.Must(err, "thd")
+	fmt.Fprintf(os.Stderr, "thd: serving metrics at: \"%s\"\n", opts.MetricsAddress)
+	return listener
+}
+
+// healthz tells the caller that we're alive.
+func healthz(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Write([]byte("ok\n"))
+}
+
+// cacheStatsHandler serves the cache statistics as JSON.
+type cacheStatsHandler struct {
+	cache *measurex.Cache
+}
+
+func (h *cacheStatsHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	data, err := json.Marshal(h.cache.Stats())
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(data)
+}
+
+// logCacheStats writes the cache statistics to the logs.
+func logCacheStats(cache *measurex.Cache) {
+	allStats := cache.Stats()
+	var names []string
+	for name := range allStats {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		stats := allStats[name]
+		logcat.Noticef("cache %s: entries=%d bytes=%d hits=%d misses=%d evictions=%d",
+			name, stats.Entries, stats.Bytes, stats.Hits, stats.Misses, stats.Evictions)
+	}
+}
+
+// isStatsSignal returns whether sig is one of the statsSignals.
+func isStatsSignal(sig os.Signal) bool {
+	for _, s := range statsSignals {
+		if sig == s {
+			return true
+		}
+	}
+	return false
+}
+
+// handleSignals handles signals. On statsSignals (i.e., SIGUSR1), we log
+// the cache statistics, if we have a cache, and continue running.
+func handleSignals(cancel context.CancelFunc, cache *measurex.Cache) {
 	// See https://gobyexample.com/signals
 	sigs := make(chan os.Signal, 1)
-	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
-	sig := <-sigs
-	logcat.Noticef("got signal %d", sig)
+	signal.Notify(sigs, append([]os.Signal{syscall.SIGINT, syscall.SIGTERM}, statsSignals...)...)
+	for {
+		sig := <-sigs
+		logcat.Noticef("got signal %d", sig)
+		if !isStatsSignal(sig) {
+			break
+		}
+		if cache != nil {
+			logCacheStats(cache)
+		}
+	}
 	cancel()
 }
 
@@ -109,16 +238,21 @@ func main() {
 	listener, err := net.Listen("tcp", opts.Address)
 	runtimex.Must(err, "thd")
 	fmt.Fprintf(os.Stderr, "thd: listening at: \"%s\"\n", opts.Address)
+	metricsListener := listenForMetrics(opts)
+	cpp := newCachingPolicy(opts) // read config before dropping privileges
 
 	// 2. drop root privileges if needed. This function must run first and
 	// for sure before we attempt to write to the disk. Files will have wrong
 	// ownership if we drop privileges after writing to the disk.
 	dropprivileges(opts.User)
 
-	// 3. open cache and setup a periodic trimming goroutine.
-	cache, hasCache := maybeOpenCache(ctx, opts)
+	// 3. create the metrics registry, open cache and setup a
+	// periodic trimming goroutine.
+	reg := metrics.NewRegistry()
+	cache, hasCache := maybeOpenCache(ctx, opts, reg)
 
-	// 4. construct THHandler with options that use the cache if needed.
+	// 4. construct THHandler with options that use the cache if needed
+	// and that limit the amount of work we perform for clients.
 	thOptions := &websteps.THHandlerOptions{
 		MeasurerFactory: func(options *measurex.Options) (measurex.AbstractMeasurer, error) {
 			lib := measurex.NewDefaultLibrary()
@@ -126,43 +260,51 @@ func main() {
 			if !hasCache {
 				return mx, nil
 			}
-			var cpp measurex.CachingPolicy
-			switch opts.CacheForever {
-			case true:
-				cpp = measurex.CachingForeverPolicy()
-			case false:
-				cpp = measurex.ReasonableCachingPolicy()
-			}
 			cmx := measurex.NewCachingMeasurer(mx, cache, cpp)
 			return cmx, nil
 		},
-		Resolvers: nil,
-		Saver:     nil,
+		Resolvers:             nil,
+		Saver:                 nil,
+		Admission:             newAdmissionController(opts),
+		MaxAddressesPerFamily: opts.MaxAddressesPerFamily,
+		Metrics:               reg,
 	}
 	thh := websteps.NewTHHandler(thOptions)
 
 	// 5. configure logging
 	logfp, closelog := openlog(opts)
 	defer closelog()
-	logger := logcat.DefaultLogger(logfp, logcat.DefaultLoggerWriteTimestamps)
+	logger, err := logcat.NewLogger(opts.LogFormat, logfp, logcat.DefaultLoggerWriteTimestamps)
+	runtimex.Must(err, "cannot create logger")
 	wg := &sync.WaitGroup{}
 	logcat.StartConsumer(ctx, logger, false, wg)
 
-	// 6. handle SIGINT and SIGTERM in the background
-	go handleSignals(cancel)
+	// 6. handle SIGINT, SIGTERM, and SIGUSR1 in the background
+	go handleSignals(cancel, cache)
 
-	// 7. configure and start the HTTP server in the background
+	// 7. configure and start the HTTP servers in the background
 	mux := http.NewServeMux()
 	mux.Handle("/websteps/v1/http", http.HandlerFunc(thh.ServeWithHTTP))
 	mux.Handle("/websteps/v1/websocket", http.HandlerFunc(thh.ServeWithWebsocket))
+	mux.Handle("/websteps/v2/websocket", http.HandlerFunc(thh.ServeWithWebsocketV2))
+	mux.Handle("/healthz", http.HandlerFunc(healthz))
+	metricsMux := http.NewServeMux()
+	metricsMux.Handle("/metrics", reg)
+	metricsMux.Handle("/healthz", http.HandlerFunc(healthz))
+	if hasCache {
+		metricsMux.Handle("/cache/stats", &cacheStatsHandler{cache})
+	}
 	srv := &http.Server{Addr: opts.Address, Handler: mux}
 	go srv.Serve(listener)
+	metricsSrv := &http.Server{Addr: opts.MetricsAddress, Handler: metricsMux}
+	go metricsSrv.Serve(metricsListener)
 
 	// 8. wait for signals to happen
 	<-ctx.Done()
 
-	// 9. shutdown the server
+	// 9. shutdown the servers
 	shutdown(srv)
+	shutdown(metricsSrv)
 
 	// 10. wait for all logs to be written
 	wg.Wait()
@@ -0,0 +1,12 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+// statsSignals contains the signals that cause us to log cache statistics.
+var statsSignals = []os.Signal{syscall.SIGUSR1}
@@ -0,0 +1,9 @@
+//go:build windows
+// +build windows
+
+package main
+
+import "os"
+
+// statsSignals is empty because there is no SIGUSR1 on Windows.
+var statsSignals = []os.Signal{}
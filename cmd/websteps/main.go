@@ -13,48 +13,88 @@ import (
 	"time"
 
 	"github.com/bassosimone/getoptx"
+	"github.com/bassosimone/websteps-illustrated/internal/censorsim"
+	"github.com/bassosimone/websteps-illustrated/internal/collector"
 	"github.com/bassosimone/websteps-illustrated/internal/dnsping"
 	"github.com/bassosimone/websteps-illustrated/internal/engine/experiment/websteps"
+	"github.com/bassosimone/websteps-illustrated/internal/engine/geolocate"
 	"github.com/bassosimone/websteps-illustrated/internal/logcat"
 	"github.com/bassosimone/websteps-illustrated/internal/measurex"
+	"github.com/bassosimone/websteps-illustrated/internal/model"
+	"github.com/bassosimone/websteps-illustrated/internal/netrecord"
+	"github.com/bassosimone/websteps-illustrated/internal/netxlite"
 	"github.com/bassosimone/websteps-illustrated/internal/runtimex"
+	"github.com/bassosimone/websteps-illustrated/internal/scrubber"
+	"github.com/bassosimone/websteps-illustrated/internal/traceroute"
 )
 
 type CLI struct {
-	Backend              string          `doc:"backend URL (default: use OONI backend)" short:"b"`
+	AnalysisRules        string          `doc:"classify failures using the rules in the given YAML or JSON file (see websteps.AnalysisRuleset)"`
+	Backend              string          `doc:"backend URL (default: use OONI backend). Use a /websteps/v2/websocket URL to reuse a single connection for all the requests." short:"b"`
+	BlockpageDB          string          `doc:"recognize blockpages using the fingerprints in the given YAML or JSON file (see websteps.BlockpageDB)"`
 	CacheDisableNetwork  bool            `doc:"caches would not rely on the network to fill missing entries" short:"N"`
+	Collector            string          `doc:"also submit measurements to the OONI-compatible collector with the given base URL (e.g., http://127.0.0.1:9877)"`
+	CollectorQueueDir    string          `doc:"directory where we queue measurements to submit to the collector (default: collector-queue)"`
+	DNSInjection         bool            `doc:"also resend successful UDP DNS queries using dnsping to detect injected replies not containing bogons (slow)"`
+	DotResolver          []string        `doc:"also resolve domains using this DNS-over-TLS resolver endpoint (e.g., dns.google:853)"`
 	Emoji                bool            `doc:"enable emitting messages with emojis" short:"e"`
 	Help                 bool            `doc:"prints this help message" short:"h"`
 	Input                []string        `doc:"add URL to list of URLs to crawl. You must provide input using this option or -f." short:"i"`
 	InputFile            []string        `doc:"add input file containing URLs to crawl. You must provide input using this option or -i." short:"f"`
+	LogFormat            string          `doc:"log format to use: text or json (default: text)"`
 	Logfile              string          `doc:"file in which to write logs" short:"L"`
 	Mode                 string          `doc:"control depth versus breadth. One of: deep, default, and fast." short:"m"`
 	Output               string          `doc:"file where to write output (default: report.jsonl)" short:"o"`
 	PredictableResolvers bool            `doc:"always use the same resolver, thus producting a fully reusable probe cache" short:"P"`
-	ProbeCacheDir        string          `doc:"optional directory where the probe cache lives. This case is R/W without any pruning policy." short:"C"`
+	ProbeCacheDir        string          `doc:"optional directory where the probe cache lives. This case is R/W without any pruning policy. Use a single-file cache if the name ends with .db." short:"C"`
+	ProbeIP              []string        `doc:"do not discover the probe IP and redact this IP address from measurements instead"`
+	ProbeIPLookup        []string        `doc:"discover the probe IP using this STUN server (e.g., stun:stun.l.google.com:19302) or IP echo service URL (e.g., https://api64.ipify.org). The default is to use a STUN server."`
 	Random               bool            `doc:"shuffle input list before running through it"`
 	Raw                  bool            `doc:"emit raw websteps format rather than OONI data format"`
-	THCacheDir           string          `doc:"optional directory where to TH cache lives. This cache is write only. Force a local 'thd' to use it running './thd -C dir'." short:"T"`
+	RecordNetwork        string          `doc:"record the network session into the given JSON file (see internal/netrecord). Use with -P to replay it later."`
+	ReplayNetwork        string          `doc:"replay the network session recorded into the given JSON file rather than using the network (see internal/netrecord). Use with -P."`
+	SimulateCensorship   string          `doc:"simulate censorship using the rules in the given JSON file (see internal/censorsim)"`
+	TCPResolver          []string        `doc:"also resolve domains using this DNS-over-TCP resolver endpoint (e.g., 8.8.8.8:53)"`
+	THCacheDir           string          `doc:"optional directory where to TH cache lives. This cache is write only. Force a local 'thd' to use it running './thd -C dir'. Use a single-file cache if the name ends with .db." short:"T"`
+	TLSClientHello       string          `doc:"TLS ClientHello fingerprint to use. One of: go, chrome, firefox, ios, and randomized."`
+	Traceroute           bool            `doc:"localize the hop that interferes with TCP, TLS, or DNS by resending the triggering packet with increasing TTLs (slow)"`
+	UseHTTPSRR           bool            `doc:"use the port and ech parameters of HTTPS RRs when planning HTTPS endpoints, including extra endpoints using ECH"`
 	Verbose              getoptx.Counter `doc:"enable verbose mode. Use more than once for more verbosity." short:"v"`
 }
 
 // getopt parses command line flags.
 func getopt() (getoptx.Parser, *CLI) {
 	opts := &CLI{
+		AnalysisRules:        "",
 		Backend:              "wss://0.th.ooni.org/websteps/v1/websocket",
+		BlockpageDB:          "",
 		CacheDisableNetwork:  false,
+		Collector:            "",
+		CollectorQueueDir:    "collector-queue",
+		DNSInjection:         false,
+		DotResolver:          []string{},
 		Emoji:                false,
 		Help:                 false,
 		Input:                []string{},
 		InputFile:            []string{},
+		LogFormat:            "text",
 		Logfile:              "",
 		Mode:                 "default",
 		Output:               "report.jsonl",
 		PredictableResolvers: false,
 		ProbeCacheDir:        "",
+		ProbeIP:              []string{},
+		ProbeIPLookup:        []string{},
 		Random:               false,
 		Raw:                  false,
+		RecordNetwork:        "",
+		ReplayNetwork:        "",
+		SimulateCensorship:   "",
+		TCPResolver:          []string{},
 		THCacheDir:           "",
+		TLSClientHello:       measurex.DefaultTLSClientHello,
+		Traceroute:           false,
+		UseHTTPSRR:           false,
 		Verbose:              0,
 	}
 	parser := getoptx.MustNewParser(opts, getoptx.NoPositionalArguments())
@@ -68,6 +108,10 @@ func getopt() (getoptx.Parser, *CLI) {
 		parser.PrintUsage(os.Stderr)
 		os.Exit(1)
 	}
+	if opts.RecordNetwork != "" && opts.ReplayNetwork != "" {
+		fmt.Fprintf(os.Stderr, "websteps: --record-network and --replay-network are mutually exclusive.\n")
+		os.Exit(1)
+	}
 	if opts.Verbose > 0 {
 		logcat.IncrementLogLevel(int(opts.Verbose))
 	}
@@ -115,6 +159,13 @@ func measurexOptions(parser getoptx.Parser, opts *CLI) *measurex.Options {
 	clientOptions := &measurex.Options{
 		MaxAddressesPerFamily: measurex.DefaultMaxAddressPerFamily,
 		MaxCrawlerDepth:       measurex.DefaultMaxCrawlerDepth,
+		TLSClientHello:        opts.TLSClientHello,
+		UseHTTPSRR:            opts.UseHTTPSRR,
+	}
+	if !measurex.IsKnownTLSClientHello(opts.TLSClientHello) {
+		fmt.Fprintf(os.Stderr, "websteps: invalid argument passed to --tls-client-hello flag.\n")
+		parser.PrintUsage(os.Stderr)
+		os.Exit(1)
 	}
 	switch opts.Mode {
 	case "deep":
@@ -174,11 +225,224 @@ func maybeUsePredictableResolvers(opts *CLI, clnt *websteps.Client) {
 	}
 }
 
+func maybeAddExtraResolvers(opts *CLI, clnt *websteps.Client) {
+	clnt.Resolvers = append(clnt.Resolvers, measurex.NewResolversTCP(opts.TCPResolver...)...)
+	clnt.Resolvers = append(clnt.Resolvers, measurex.NewResolversDoT(opts.DotResolver...)...)
+}
+
+func maybeLoadAnalysisRules(opts *CLI, clnt *websteps.Client) {
+	if opts.AnalysisRules != "" {
+		rules, err := websteps.LoadAnalysisRuleset(opts.AnalysisRules)
+		runtimex.Must(err, "cannot load analysis rules")
+		clnt.AnalysisRules = rules
+	}
+}
+
+// maybeLoadBlockpageDB loads the blockpage DB if configured.
+func maybeLoadBlockpageDB(opts *CLI, clnt *websteps.Client) {
+	if opts.BlockpageDB != "" {
+		db, err := websteps.LoadBlockpageDB(opts.BlockpageDB)
+		runtimex.Must(err, "cannot load blockpage DB")
+		clnt.BlockpageDB = db
+	}
+}
+
+// newRedactor discovers the probe IPs, unless the user provided them, and
+// returns a redactor that removes them from measurements. Because we cannot
+// submit measurements containing the probe IP, failing to discover the
+// probe IP is fatal when we're submitting to a collector.
+func newRedactor(ctx context.Context, opts *CLI) (*scrubber.Redactor, []string) {
+	if len(opts.ProbeIP) > 0 {
+		return scrubber.NewRedactor(opts.ProbeIP...), opts.ProbeIP
+	}
+	specs := opts.ProbeIPLookup
+	if len(specs) <= 0 {
+		specs = []string{"stun:" + geolocate.DefaultSTUNServer}
+	}
+	var lookuppers []geolocate.IPLookupper
+	for _, spec := range specs {
+		v, err := geolocate.NewIPLookupper(spec)
+		runtimex.Must(err, "cannot create probe IP lookupper")
+		lookuppers = append(lookuppers, v...)
+	}
+	ips, err := geolocate.LookupProbeIPs(ctx, lookuppers...)
+	if err != nil && opts.Collector != "" {
+		runtimex.Must(err, "cannot discover the probe IP (use -probe-ip to provide it)")
+	}
+	if err != nil {
+		logcat.Warnf("cannot discover the probe IP, so we cannot redact it: %s", err.Error())
+	}
+	for _, ip := range ips {
+		logcat.Infof("we will redact the probe IP %s from measurements", ip)
+	}
+	return scrubber.NewRedactor(ips...), ips
+}
+
+// maybeEnableTraceroute enables the traceroute follow-up if configured.
+func maybeEnableTraceroute(opts *CLI, clnt *websteps.Client) {
+	if opts.Traceroute {
+		clnt.TracerouteMaxTTL = traceroute.DefaultMaxTTL
+	}
+}
+
+// maybeRecordNetwork replaces netxlite.TProxy with a recorder if
+// needed and returns the function to save the recorded session.
+func maybeRecordNetwork(opts *CLI) func() {
+	if opts.RecordNetwork == "" {
+		return func() {}
+	}
+	rec := netrecord.NewRecorder(netxlite.TProxy)
+	netxlite.TProxy = rec
+	return func() {
+		err := rec.WriteFile(opts.RecordNetwork)
+		runtimex.Must(err, "cannot save recorded network session")
+	}
+}
+
+// maybeReplayNetwork replaces netxlite.TProxy with a replayer if needed.
+func maybeReplayNetwork(opts *CLI) {
+	if opts.ReplayNetwork == "" {
+		return
+	}
+	session, err := netrecord.LoadSession(opts.ReplayNetwork)
+	runtimex.Must(err, "cannot load recorded network session")
+	netxlite.TProxy = netrecord.NewReplayer(session)
+}
+
+// maybeSimulateCensorship replaces netxlite.TProxy with a censorship
+// simulator if needed and returns the function to stop it.
+func maybeSimulateCensorship(opts *CLI) func() {
+	if opts.SimulateCensorship == "" {
+		return func() {}
+	}
+	config, err := censorsim.LoadConfig(opts.SimulateCensorship)
+	runtimex.Must(err, "cannot load censorship simulator config")
+	sim, err := censorsim.New(config, netxlite.TProxy)
+	runtimex.Must(err, "cannot create censorship simulator")
+	netxlite.TProxy = sim
+	return func() {
+		err := sim.Close()
+		runtimex.Must(err, "cannot close censorship simulator")
+	}
+}
+
+const (
+	// softwareName is the software name we use in measurements.
+	softwareName = "websteps-illustrated"
+
+	// softwareVersion is the software version we use in measurements.
+	softwareVersion = "0.1.0-dev"
+
+	// testName is the experiment name we use in measurements.
+	testName = "websteps"
+
+	// testVersion is the experiment version we use in measurements.
+	testVersion = "0.1.0"
+)
+
+// maybeNewSubmitter returns the background submitter for the collector,
+// if we configured a collector, or nil otherwise. Because it uses an on-disk
+// queue, the submitter first attempts to submit measurements that we
+// could not submit during previous runs.
+func maybeNewSubmitter(ctx context.Context, opts *CLI) *backgroundSubmitter {
+	if opts.Collector == "" {
+		return nil
+	}
+	submitter, err := collector.NewSubmitter(
+		collector.NewClient(opts.Collector), opts.CollectorQueueDir)
+	runtimex.Must(err, "cannot create collector submitter")
+	return newBackgroundSubmitter(ctx, submitter)
+}
+
+// backgroundSubmitter submits measurements using a background goroutine, so
+// that talking to the collector does not delay measuring the next input.
+//
+// The zero value is invalid; please, use newBackgroundSubmitter to construct.
+type backgroundSubmitter struct {
+	// done is closed when the background goroutine terminates.
+	done chan struct{}
+
+	// kick tells the background goroutine to flush the queue.
+	kick chan struct{}
+
+	// submitter is the underlying submitter.
+	submitter *collector.Submitter
+}
+
+// newBackgroundSubmitter creates a new backgroundSubmitter using the given
+// submitter and starts flushing its queue in the background.
+func newBackgroundSubmitter(ctx context.Context,
+	submitter *collector.Submitter) *backgroundSubmitter {
+	bs := &backgroundSubmitter{
+		done:      make(chan struct{}),
+		kick:      make(chan struct{}, 1),
+		submitter: submitter,
+	}
+	go bs.loop(ctx)
+	bs.kick <- struct{}{} // submit measurements queued by previous runs
+	return bs
+}
+
+// Submit adds the measurement to the on-disk queue and tells the
+// background goroutine to flush the queue.
+func (bs *backgroundSubmitter) Submit(m *model.Measurement) {
+	if err := bs.submitter.Enqueue(m); err != nil {
+		logcat.Warnf("cannot queue measurement: %s", err.Error())
+		return
+	}
+	select {
+	case bs.kick <- struct{}{}:
+	default:
+		// a flush is already pending and will also submit m
+	}
+}
+
+// Close waits for the background goroutine to submit the measurements
+// that are still pending. Measurements we cannot submit stay in the queue
+// and we will attempt to submit them again during the next run.
+func (bs *backgroundSubmitter) Close() {
+	close(bs.kick)
+	<-bs.done
+}
+
+// loop is the background goroutine flushing the queue.
+func (bs *backgroundSubmitter) loop(ctx context.Context) {
+	defer close(bs.done)
+	for range bs.kick {
+		if err := bs.submitter.Flush(ctx); err != nil {
+			logcat.Warnf("cannot submit queued measurements: %s", err.Error())
+		}
+	}
+}
+
+// newMeasurementTemplate creates the template for the measurements
+// that we submit to the collector.
+func newMeasurementTemplate(begin time.Time,
+	opts *CLI, probeIPs []string) *collector.MeasurementTemplate {
+	mt := collector.NewMeasurementTemplate(softwareName, softwareVersion, testName, testVersion)
+	mt.TestHelpers["backend"] = opts.Backend
+	mt.TestStartTime = begin
+	if len(probeIPs) > 0 {
+		// We use the probe IP for geolocation but we never include it.
+		if asn, org, err := geolocate.LookupASN(probeIPs[0]); err == nil {
+			mt.ProbeASN, mt.ProbeNetworkName = collector.FormatASN(asn), org
+		}
+		if cc, err := geolocate.LookupCC(probeIPs[0]); err == nil {
+			mt.ProbeCC = cc
+		}
+	}
+	return mt
+}
+
 func main() {
 	parser, opts := getopt()
+	maybeReplayNetwork(opts)
+	saveRecording := maybeRecordNetwork(opts)
+	defer saveRecording()
+	stopSimulator := maybeSimulateCensorship(opts)
+	defer stopSimulator()
 	filep, err := os.OpenFile(opts.Output, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
 	runtimex.Must(err, "cannot create output file")
-	begin := time.Now()
 	ctx, cancel := context.WithCancel(context.Background())
 	wg := &sync.WaitGroup{}
 	if opts.Logfile != "" {
@@ -188,17 +452,35 @@ func main() {
 			err := logfile.Close()
 			runtimex.Must(err, "cannot close log file")
 		}()
-		logcat.StartConsumer(ctx, logcat.DefaultLogger(logfile, 0), opts.Emoji, wg)
+		logger, err := logcat.NewLogger(opts.LogFormat, logfile, 0)
+		runtimex.Must(err, "cannot create logger")
+		logcat.StartConsumer(ctx, logger, opts.Emoji, wg)
 	}
-	logcat.StartConsumer(ctx, logcat.DefaultLogger(os.Stdout, 0), opts.Emoji, wg)
+	logger, err := logcat.NewLogger(opts.LogFormat, os.Stdout, 0)
+	runtimex.Must(err, "cannot create logger")
+	logcat.StartConsumer(ctx, logger, opts.Emoji, wg)
+	// Discover the probe IPs before measuring, so the discovery does not
+	// compete with measurements for the network.
+	redactor, probeIPs := newRedactor(ctx, opts)
+	begin := time.Now()
 	clientOptions := measurexOptions(parser, opts)
 	clnt := websteps.NewClient(nil, nil, opts.Backend, clientOptions)
 	maybeSetCaches(opts, clnt)
 	maybeUsePredictableResolvers(opts, clnt)
+	maybeAddExtraResolvers(opts, clnt)
+	maybeLoadAnalysisRules(opts, clnt)
+	maybeLoadBlockpageDB(opts, clnt)
+	maybeEnableTraceroute(opts, clnt)
+	clnt.DNSPingSuccessfulQueries = opts.DNSInjection
 	go clnt.Loop(ctx, websteps.LoopFlagGreedy)
 	wg.Add(1)
 	go submitInput(ctx, wg, clnt, opts)
-	processOutput(begin, filep, clnt, opts.Raw)
+	submitter := maybeNewSubmitter(ctx, opts)
+	mt := newMeasurementTemplate(begin, opts, probeIPs)
+	processOutput(begin, filep, clnt, opts.Raw, redactor, submitter, mt)
+	if submitter != nil {
+		submitter.Close() // wait for pending submissions
+	}
 	cancel()  // "sighup" to background goroutines
 	wg.Wait() // wait for all goroutines to join
 	runtimex.Must(filep.Close(), "cannot close output file")
@@ -217,21 +499,37 @@ func submitInput(ctx context.Context, wg *sync.WaitGroup, clnt *websteps.Client,
 
 // result is the result of running websteps on an input URL.
 type result struct {
-	// TestKeys contains the experiment test keys.
-	TestKeys *websteps.ArchivalTestKeys `json:"test_keys"`
+	// TestKeys contains the redacted experiment test keys.
+	TestKeys json.RawMessage `json:"test_keys"`
 }
 
-func processOutput(begin time.Time, filep io.Writer, clnt *websteps.Client, raw bool) {
+func processOutput(begin time.Time, filep io.Writer, clnt *websteps.Client, raw bool,
+	redactor *scrubber.Redactor, submitter *backgroundSubmitter, mt *collector.MeasurementTemplate) {
+	// The client measures an input at a time, so each measurement
+	// starts when we receive the output of the previous one.
+	started := begin
 	for tkoe := range clnt.Output {
+		finished := time.Now()
 		if err := tkoe.Err; err != nil {
 			logcat.Warn(err.Error())
+			started = finished
 			continue
 		}
+		archival, err := redactor.Redact(tkoe.TestKeys.ToArchival(begin))
+		runtimex.Must(err, "cannot redact test keys")
+		if submitter != nil {
+			m := mt.NewMeasurement(tkoe.TestKeys.URL,
+				json.RawMessage(archival), started, finished.Sub(started))
+			submitter.Submit(m)
+		}
+		started = finished
 		if raw {
-			store(filep, tkoe.TestKeys)
+			data, err := redactor.Redact(tkoe.TestKeys)
+			runtimex.Must(err, "cannot redact test keys")
+			store(filep, json.RawMessage(data))
 			continue
 		}
-		r := &result{TestKeys: tkoe.TestKeys.ToArchival(begin)}
+		r := &result{TestKeys: archival}
 		store(filep, r)
 	}
 }
@@ -11,6 +11,7 @@ require (
 	gitlab.com/yawning/utls.git v0.0.12-1
 	golang.org/x/net v0.0.0-20220225172249-27dd8689420f
 	golang.org/x/sys v0.0.0-20211216021012-1d35b9e2eb4e
+	gopkg.in/yaml.v3 v3.0.0-20200605160147-a5ece683394c
 )
 
 require (
@@ -18,7 +19,6 @@ require (
 	github.com/mitchellh/go-wordwrap v1.0.1 // indirect
 	github.com/oschwald/maxminddb-golang v1.8.0 // indirect
 	github.com/pborman/getopt/v2 v2.1.0 // indirect
-	gopkg.in/yaml.v3 v3.0.0-20200605160147-a5ece683394c // indirect
 )
 
 require (
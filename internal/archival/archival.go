@@ -417,6 +417,7 @@ func (ev *FlatQUICTLSHandshakeEvent) ToArchival(begin time.Time) model.ArchivalT
 	return model.ArchivalTLSOrQUICHandshakeResult{
 		Address:            ev.RemoteAddr,
 		CipherSuite:        ev.CipherSuite,
+		ClientHello:        ev.ClientHello,
 		Failure:            ev.Failure.ToArchivalFailure(),
 		NegotiatedProtocol: ev.NegotiatedProto,
 		NoTLSVerify:        ev.SkipVerify,
@@ -31,11 +31,13 @@ type FlatDNSLookupEvent struct {
 	Addresses       []string `json:",omitempty"`
 	CNAME           string   `json:",omitempty"`
 	Domain          string
+	ECHConfigList   []byte      `json:",omitempty"`
 	Failure         FlatFailure `json:",omitempty"`
 	Finished        time.Time
 	LookupType      DNSLookupType
 	NS              []string `json:",omitempty"`
 	PTRs            []string `json:",omitempty"`
+	Port            uint16   `json:",omitempty"`
 	ResolverAddress string   `json:",omitempty"`
 	ResolverNetwork NetworkType
 	Started         time.Time
@@ -50,11 +52,13 @@ func NewFakeFlatDNSLookupEvent(resolverNetwork NetworkType, resolverAddress stri
 		Addresses:       addresses,
 		CNAME:           "",
 		Domain:          domain,
+		ECHConfigList:   nil,
 		Failure:         "",
 		Finished:        now,
 		LookupType:      lookupType,
 		NS:              nil,
 		PTRs:            nil,
+		Port:            0,
 		ResolverAddress: resolverAddress,
 		ResolverNetwork: resolverNetwork,
 		Started:         now,
@@ -130,6 +134,7 @@ type FlatNetworkEvent struct {
 type FlatQUICTLSHandshakeEvent struct {
 	ALPN            []string    `json:",omitempty"`
 	CipherSuite     string      `json:",omitempty"`
+	ClientHello     string      `json:",omitempty"`
 	Failure         FlatFailure `json:",omitempty"`
 	Finished        time.Time
 	NegotiatedProto string `json:",omitempty"`
@@ -125,6 +125,7 @@ func (s *Saver) quicDialContext(ctx context.Context, dialer model.QUICDialer,
 	s.appendQUICTLSHandshake(&FlatQUICTLSHandshakeEvent{
 		ALPN:            tlsConfig.NextProtos,
 		CipherSuite:     netxlite.TLSCipherSuiteString(state.CipherSuite),
+		ClientHello:     "", // we cannot choose the QUIC ClientHello
 		Failure:         NewFlatFailure(err),
 		Finished:        time.Now(),
 		NegotiatedProto: state.NegotiatedProtocol,
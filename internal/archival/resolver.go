@@ -91,11 +91,13 @@ func (s *Saver) lookupHost(ctx context.Context, reso model.Resolver, domain stri
 		Addresses:       addrs,
 		CNAME:           "",
 		Domain:          domain,
+		ECHConfigList:   nil,
 		Failure:         NewFlatFailure(err),
 		Finished:        time.Now(),
 		LookupType:      DNSLookupTypeGetaddrinfo,
 		NS:              nil,
 		PTRs:            nil,
+		Port:            0,
 		ResolverAddress: reso.Address(),
 		ResolverNetwork: NetworkType(reso.Network()),
 		Started:         started,
@@ -117,11 +119,13 @@ func (s *Saver) lookupHTTPS(ctx context.Context, reso model.Resolver, domain str
 		Addresses:       s.safeAddresses(https),
 		CNAME:           "",
 		Domain:          domain,
+		ECHConfigList:   s.safeECHConfigList(https),
 		Failure:         NewFlatFailure(err),
 		Finished:        time.Now(),
 		LookupType:      DNSLookupTypeHTTPS,
 		NS:              nil,
 		PTRs:            nil,
+		Port:            s.safePort(https),
 		ResolverAddress: reso.Address(),
 		ResolverNetwork: NetworkType(reso.Network()),
 		Started:         started,
@@ -136,6 +140,20 @@ func (s *Saver) safeALPNs(https *model.HTTPSSvc) (out []string) {
 	return
 }
 
+func (s *Saver) safeECHConfigList(https *model.HTTPSSvc) (out []byte) {
+	if https != nil {
+		out = https.ECHConfigList
+	}
+	return
+}
+
+func (s *Saver) safePort(https *model.HTTPSSvc) (out uint16) {
+	if https != nil {
+		out = https.Port
+	}
+	return
+}
+
 func (s *Saver) safeAddresses(https *model.HTTPSSvc) (out []string) {
 	if https != nil {
 		out = append(out, https.IPv4...)
@@ -152,11 +170,13 @@ func (s *Saver) lookupNS(ctx context.Context, reso model.Resolver, domain string
 		Addresses:       nil,
 		CNAME:           "",
 		Domain:          domain,
+		ECHConfigList:   nil,
 		Failure:         NewFlatFailure(err),
 		Finished:        time.Now(),
 		LookupType:      DNSLookupTypeNS,
 		NS:              s.ns(ns),
 		PTRs:            nil,
+		Port:            0,
 		ResolverAddress: reso.Address(),
 		ResolverNetwork: NetworkType(reso.Network()),
 		Started:         started,
@@ -179,11 +199,13 @@ func (s *Saver) lookupPTR(ctx context.Context, reso model.Resolver, domain strin
 		Addresses:       nil,
 		CNAME:           "",
 		Domain:          domain,
+		ECHConfigList:   nil,
 		Failure:         NewFlatFailure(err),
 		Finished:        time.Now(),
 		LookupType:      DNSLookupTypeReverse,
 		NS:              []string{},
 		PTRs:            domains,
+		Port:            0,
 		ResolverAddress: reso.Address(),
 		ResolverNetwork: NetworkType(reso.Network()),
 		Started:         started,
@@ -9,6 +9,17 @@ import (
 	"time"
 )
 
+const (
+	// BytesReadOperation is the operation of the network events that
+	// the Saver emits, while aggregating network events, to report the
+	// number of bytes received since the previous event.
+	BytesReadOperation = "bytes_read"
+
+	// BytesWrittenOperation is like BytesReadOperation but reports the
+	// number of bytes sent since the previous event.
+	BytesWrittenOperation = "bytes_written"
+)
+
 // Saver allows to save network, DNS, QUIC, TLS, HTTP events.
 //
 // You MUST use NewSaver to create a new instance.
@@ -72,7 +83,7 @@ func (s *Saver) emitIOMetricsLocked(now time.Time) {
 		Failure:    "",
 		Finished:   now,
 		Network:    "",
-		Operation:  "bytes_read",
+		Operation:  BytesReadOperation,
 		RemoteAddr: "",
 		Started:    now,
 	})
@@ -81,7 +92,7 @@ func (s *Saver) emitIOMetricsLocked(now time.Time) {
 		Failure:    "",
 		Finished:   now,
 		Network:    "",
-		Operation:  "bytes_written",
+		Operation:  BytesWrittenOperation,
 		RemoteAddr: "",
 		Started:    now,
 	})
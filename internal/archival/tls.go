@@ -18,24 +18,33 @@ import (
 
 // WrapTLSHandshaker wraps a TLS handshaker to use the saver.
 func (s *Saver) WrapTLSHandshaker(thx model.TLSHandshaker) model.TLSHandshaker {
+	return s.WrapTLSHandshakerWithClientHello(thx, "")
+}
+
+// WrapTLSHandshakerWithClientHello is like WrapTLSHandshaker but also
+// records the name of the ClientHello fingerprint used by the handshaker.
+func (s *Saver) WrapTLSHandshakerWithClientHello(
+	thx model.TLSHandshaker, clientHello string) model.TLSHandshaker {
 	return &tlsHandshakerSaver{
 		TLSHandshaker: thx,
+		clientHello:   clientHello,
 		s:             s,
 	}
 }
 
 type tlsHandshakerSaver struct {
 	model.TLSHandshaker
-	s *Saver
+	clientHello string
+	s           *Saver
 }
 
 func (thx *tlsHandshakerSaver) Handshake(ctx context.Context,
 	conn net.Conn, config *tls.Config) (net.Conn, tls.ConnectionState, error) {
-	return thx.s.tlsHandshake(ctx, thx.TLSHandshaker, conn, config)
+	return thx.s.tlsHandshake(ctx, thx.TLSHandshaker, thx.clientHello, conn, config)
 }
 
 func (s *Saver) tlsHandshake(ctx context.Context, thx model.TLSHandshaker,
-	conn net.Conn, config *tls.Config) (net.Conn, tls.ConnectionState, error) {
+	clientHello string, conn net.Conn, config *tls.Config) (net.Conn, tls.ConnectionState, error) {
 	network := conn.RemoteAddr().Network()
 	remoteAddr := conn.RemoteAddr().String()
 	started := time.Now()
@@ -45,6 +54,7 @@ func (s *Saver) tlsHandshake(ctx context.Context, thx model.TLSHandshaker,
 	s.appendQUICTLSHandshake(&FlatQUICTLSHandshakeEvent{
 		ALPN:            config.NextProtos,
 		CipherSuite:     netxlite.TLSCipherSuiteString(state.CipherSuite),
+		ClientHello:     clientHello,
 		Failure:         NewFlatFailure(err),
 		Finished:        time.Now(),
 		NegotiatedProto: state.NegotiatedProtocol,
@@ -0,0 +1,90 @@
+package caching
+
+//
+// Convert
+//
+// Code to convert between FSCache and DB.
+//
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/rogpeppe/go-internal/lockedfile"
+)
+
+// ImportFSCache copies all the entries of the FSCache living in dirpath
+// into the given bucket of the DB and returns the number of entries
+// we copied. Because FSCache only knows the digests of the keys, we copy
+// digests rather than keys, which is fine because DBCache uses the same
+// digests. We preserve the modification time of each entry.
+func (db *DB) ImportFSCache(bucket, dirpath string) (int, error) {
+	var count int
+	for i := 0; i < 256; i++ {
+		subdir := filepath.Join(dirpath, fmt.Sprintf("%02x", i))
+		entries, err := os.ReadDir(subdir)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return count, err
+		}
+		for _, entry := range entries {
+			digest, ok := fsCacheEntryDigest(entry.Name())
+			if !ok || !entry.Type().IsRegular() {
+				continue
+			}
+			info, err := entry.Info()
+			if err != nil {
+				return count, err
+			}
+			value, err := lockedfile.Read(filepath.Join(subdir, entry.Name()))
+			if err != nil {
+				return count, err
+			}
+			if err := db.setDigest(bucket, digest, info.ModTime(), value); err != nil {
+				return count, err
+			}
+			count++
+		}
+	}
+	return count, nil
+}
+
+// fsCacheEntryDigest returns the digest of the key of the
+// FSCache entry with the given file name, if any.
+func fsCacheEntryDigest(name string) (string, bool) {
+	digest := strings.TrimSuffix(name, "-d")
+	if digest == name || len(digest) != 2*dbDigestLength {
+		return "", false
+	}
+	if _, err := hex.DecodeString(digest); err != nil {
+		return "", false
+	}
+	return digest, true
+}
+
+// ExportFSCache is the opposite of ImportFSCache: it copies all the
+// entries in the given DB bucket into the FSCache living in dirpath.
+func (db *DB) ExportFSCache(bucket, dirpath string) (int, error) {
+	var count int
+	err := db.Walk(bucket, func(entry *Entry) error {
+		dpath, fpath := fsmapDigest(dirpath, entry.Digest)
+		if err := os.MkdirAll(dpath, 0700); err != nil {
+			return err
+		}
+		if err := lockedfile.Write(fpath, bytes.NewReader(entry.Value), 0600); err != nil {
+			return err
+		}
+		if err := os.Chtimes(fpath, entry.ModTime, entry.ModTime); err != nil {
+			return err
+		}
+		count++
+		return nil
+	})
+	return count, err
+}
@@ -0,0 +1,763 @@
+package caching
+
+//
+// DB
+//
+// Contains a single-file key-value store that we use as an alternative
+// to FSCache when we want to ship a cache as a single file.
+//
+// The file starts with a magic string followed by records. Each record
+// sets the value of a key inside a bucket and a later record for the same
+// bucket and key overrides previous records. We keep an in-memory index
+// of the records and periodically compact the file. The record format is
+// the following (integers use the network byte order):
+//
+//     length  uint32   length of the body
+//     body    []byte   see below
+//     crc     uint32   CRC32 (IEEE) of the body
+//
+// The body contains the following fields:
+//
+//     blen    uint8    length of the bucket name
+//     bucket  []byte   the bucket name
+//     digest  [32]byte SHA256 of the key (we use the same hashing as FSCache)
+//     mtime   int64    Unix time of the last write
+//     value   []byte   the value (all the remaining bytes)
+//
+// Many processes may use the same DB concurrently (e.g., a websteps
+// client writing its TH cache and a thd reading it). We serialize
+// all the operations using a lock file next to the DB file.
+//
+// Records only contain the time of the last write, because appending a
+// record for each read would make the file grow without bounds. So, each
+// process remembers in memory when it last read each entry and we keep the
+// entries read recently when trimming, like FSCache does.
+//
+// We use our own store rather than an embedded key-value store such as
+// bbolt because we only need appending, lookups by digest, and compaction,
+// which we can implement using the standard library and the file lock we
+// already use for FSCache. An embedded store would add a dependency, would
+// need its own locking to share the file with other processes, and would
+// not let us keep the simple append-only format, which allows us to discard
+// a partial record after a crash and to ship caches as testdata.
+//
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rogpeppe/go-internal/lockedfile"
+)
+
+const (
+	// DBFileExtension is the extension that identifies a DB file.
+	DBFileExtension = ".db"
+
+	// dbMagic is the magic string at the beginning of a DB file.
+	dbMagic = "wsdb0001"
+
+	// dbDigestLength is the length of a key digest.
+	dbDigestLength = sha256.Size
+
+	// dbMaxRecordLength is the maximum length of a record body.
+	dbMaxRecordLength = 1 << 28
+)
+
+// IsDBPath returns whether the given cache path refers to a DB
+// file rather than to a directory containing an FSCache.
+func IsDBPath(path string) bool {
+	return strings.HasSuffix(path, DBFileExtension)
+}
+
+// ErrInvalidDB indicates that a file is not a valid DB file.
+var ErrInvalidDB = errors.New("caching: invalid DB file")
+
+// DB is a single-file key-value store containing buckets.
+//
+// The zero value is invalid; please, use OpenDB to construct.
+type DB struct {
+	// atime maps a bucket and a key digest to the Unix time of
+	// the last read of the entry performed by this process.
+	atime map[string]map[string]int64
+
+	// bytes maps each bucket to the size of its values.
+	bytes map[string]int64
+
+	// evicted maps each bucket to the number of entries we have
+	// removed to honor the bucket's maximum size.
+	evicted map[string]int64
+
+	// file is the open DB file or nil.
+	file *os.File
+
+	// index maps a bucket and a key digest to the record.
+	index map[string]map[string]*dbRecord
+
+	// keepUnused contains the buckets whose entries we should
+	// not trim when they have not been used recently.
+	keepUnused map[string]bool
+
+	// lastTrim is the last time we trimmed the DB.
+	lastTrim time.Time
+
+	// lock serializes access among processes.
+	lock *lockedfile.Mutex
+
+	// maxBytes maps each bucket to its maximum size.
+	maxBytes map[string]int64
+
+	// mu serializes access among goroutines.
+	mu sync.Mutex
+
+	// now returns the current time.
+	now func() time.Time
+
+	// path is the DB file path.
+	path string
+
+	// size is the number of bytes of the file we have indexed.
+	size int64
+
+	// trimmed maps each bucket to the number of entries we have
+	// trimmed but not yet accounted in the trimmed metric.
+	trimmed map[string]int
+}
+
+// dbRecord is the in-memory index entry of a record.
+type dbRecord struct {
+	// length is the value length.
+	length int
+
+	// mtime is the Unix time of the last write.
+	mtime int64
+
+	// offset is the offset of the value inside the file.
+	offset int64
+}
+
+// dbRegistry contains the DBs opened by this process.
+var dbRegistry = struct {
+	dbs map[string]*DB
+	mu  sync.Mutex
+}{
+	dbs: map[string]*DB{},
+	mu:  sync.Mutex{},
+}
+
+// OpenDB returns the DB at the given path. All the callers using
+// the same path within this process share the same DB instance. We
+// create the DB file, if needed, the first time we use it, hence any
+// error opening the file will be returned by the DB operations.
+func OpenDB(path string) *DB {
+	if abspath, err := filepath.Abs(path); err == nil {
+		path = abspath
+	}
+	dbRegistry.mu.Lock()
+	defer dbRegistry.mu.Unlock()
+	if db := dbRegistry.dbs[path]; db != nil {
+		return db
+	}
+	db := &DB{
+		atime:      map[string]map[string]int64{},
+		bytes:      map[string]int64{},
+		evicted:    map[string]int64{},
+		file:       nil,
+		index:      map[string]map[string]*dbRecord{},
+		keepUnused: map[string]bool{},
+		lastTrim:   time.Time{},
+		lock:       lockedfile.MutexAt(path + ".lock"),
+		maxBytes:   map[string]int64{},
+		mu:         sync.Mutex{},
+		now:        time.Now,
+		path:       path,
+		size:       0,
+		trimmed:    map[string]int{},
+	}
+	dbRegistry.dbs[path] = db
+	return db
+}
+
+// Path returns the path of the DB file.
+func (db *DB) Path() string {
+	return db.path
+}
+
+// Close closes the DB file. Further operations will reopen it.
+func (db *DB) Close() error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	return db.closeFile()
+}
+
+// closeFile closes the file and clears the index.
+func (db *DB) closeFile() (err error) {
+	if db.file != nil {
+		err = db.file.Close()
+	}
+	db.bytes = map[string]int64{}
+	db.file = nil
+	db.index = map[string]map[string]*dbRecord{}
+	db.size = 0
+	return
+}
+
+// locked calls fx while holding both the goroutines
+// lock and the processes lock and after having read the
+// records that other processes have written.
+func (db *DB) locked(fx func() error) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	unlock, err := db.lock.Lock()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	if err := db.refresh(); err != nil {
+		return err
+	}
+	return fx()
+}
+
+// refresh opens the DB file, if needed, and indexes new records.
+func (db *DB) refresh() error {
+	if db.file != nil {
+		// Another process may have compacted the DB and replaced the file.
+		current, err1 := os.Stat(db.path)
+		ours, err2 := db.file.Stat()
+		if err1 != nil || err2 != nil || !os.SameFile(current, ours) {
+			db.closeFile()
+		}
+	}
+	if db.file == nil {
+		if err := db.openFile(); err != nil {
+			return err
+		}
+	}
+	return db.scan()
+}
+
+// openFile opens the DB file and checks or writes the magic string.
+func (db *DB) openFile() error {
+	if err := os.MkdirAll(filepath.Dir(db.path), 0700); err != nil {
+		return err
+	}
+	file, err := os.OpenFile(db.path, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	magic := make([]byte, len(dbMagic))
+	count, err := file.ReadAt(magic, 0)
+	switch {
+	case count == 0 && err == io.EOF:
+		if _, err := file.WriteAt([]byte(dbMagic), 0); err != nil {
+			file.Close()
+			return err
+		}
+	case err != nil || string(magic) != dbMagic:
+		file.Close()
+		return fmt.Errorf("%w: %s", ErrInvalidDB, db.path)
+	}
+	db.file = file
+	db.size = int64(len(dbMagic))
+	return nil
+}
+
+// scan indexes the records after the ones we have already indexed. A
+// partial record at the end of the file is the result of a crash while
+// writing, so we truncate the file to discard it. A corrupted record
+// followed by other records, instead, means that the file is damaged,
+// so we return ErrInvalidDB and leave the file alone.
+func (db *DB) scan() error {
+	info, err := db.file.Stat()
+	if err != nil {
+		return err
+	}
+	if info.Size() == db.size {
+		return nil // the common case
+	}
+	reader := bufio.NewReader(io.NewSectionReader(db.file, db.size, info.Size()-db.size))
+	for db.size < info.Size() {
+		bucket, digest, record, length, err := db.readRecord(reader, db.size, info.Size())
+		switch {
+		case errors.Is(err, errDBPartialRecord):
+			return db.file.Truncate(db.size)
+		case errors.Is(err, ErrInvalidDB):
+			return fmt.Errorf("%w: %s: corrupted record at offset %d", ErrInvalidDB, db.path, db.size)
+		case err != nil:
+			return err
+		}
+		db.setRecord(bucket, digest, record)
+		db.size += length
+	}
+	return nil
+}
+
+// errDBPartialRecord indicates that the last record of the file is partial.
+var errDBPartialRecord = errors.New("caching: partial DB record")
+
+// readRecord reads the record at the given offset from the reader and
+// returns the record and the number of bytes it occupies. The size is the
+// file size, which we use to tell a partial last record (for which we
+// return errDBPartialRecord) from a corrupted record (ErrInvalidDB).
+func (db *DB) readRecord(reader io.Reader, offset, size int64) (
+	bucket, digest string, record *dbRecord, length int64, err error) {
+	header := make([]byte, 4)
+	if _, err = io.ReadFull(reader, header); err != nil {
+		err = dbMapReadError(err)
+		return
+	}
+	bodyLength := binary.BigEndian.Uint32(header)
+	end := offset + 4 + int64(bodyLength) + 4
+	if end > size {
+		err = errDBPartialRecord // the record extends beyond the end of the file
+		return
+	}
+	if bodyLength > dbMaxRecordLength {
+		err = ErrInvalidDB
+		return
+	}
+	body := make([]byte, bodyLength+4)
+	if _, err = io.ReadFull(reader, body); err != nil {
+		err = dbMapReadError(err)
+		return
+	}
+	crc := binary.BigEndian.Uint32(body[bodyLength:])
+	body = body[:bodyLength]
+	if crc32.ChecksumIEEE(body) != crc {
+		err = ErrInvalidDB
+		if end == size {
+			err = errDBPartialRecord // we did not finish writing the last record
+		}
+		return
+	}
+	if len(body) < 1 || len(body) < 1+int(body[0])+dbDigestLength+8 {
+		err = ErrInvalidDB
+		return
+	}
+	blen := int(body[0])
+	bucket = string(body[1 : 1+blen])
+	digest = hex.EncodeToString(body[1+blen : 1+blen+dbDigestLength])
+	valueOffset := 1 + blen + dbDigestLength + 8
+	record = &dbRecord{
+		length: len(body) - valueOffset,
+		mtime:  int64(binary.BigEndian.Uint64(body[1+blen+dbDigestLength:])),
+		offset: offset + 4 + int64(valueOffset),
+	}
+	length = int64(4 + len(body) + 4)
+	return
+}
+
+// dbMapReadError maps a short read to errDBPartialRecord.
+func dbMapReadError(err error) error {
+	if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return errDBPartialRecord
+	}
+	return err
+}
+
+// setRecord adds a record to the index.
+func (db *DB) setRecord(bucket, digest string, record *dbRecord) {
+	entries := db.index[bucket]
+	if entries == nil {
+		entries = map[string]*dbRecord{}
+		db.index[bucket] = entries
+	}
+	if prev := entries[digest]; prev != nil {
+		db.bytes[bucket] -= int64(prev.length)
+	}
+	db.bytes[bucket] += int64(record.length)
+	entries[digest] = record
+}
+
+// newDBRecord serializes a record.
+func newDBRecord(bucket, digest string, mtime int64, value []byte) ([]byte, error) {
+	rawDigest, err := hex.DecodeString(digest)
+	if err != nil || len(rawDigest) != dbDigestLength {
+		return nil, fmt.Errorf("caching: invalid digest: %s", digest)
+	}
+	if len(bucket) > 255 {
+		return nil, fmt.Errorf("caching: bucket name too long: %s", bucket)
+	}
+	bodyLength := 1 + len(bucket) + dbDigestLength + 8 + len(value)
+	if bodyLength > dbMaxRecordLength {
+		return nil, fmt.Errorf("caching: value too large: %d bytes", len(value))
+	}
+	out := make([]byte, 4, 4+bodyLength+4)
+	binary.BigEndian.PutUint32(out, uint32(bodyLength))
+	out = append(out, byte(len(bucket)))
+	out = append(out, bucket...)
+	out = append(out, rawDigest...)
+	var mtimeBytes [8]byte
+	binary.BigEndian.PutUint64(mtimeBytes[:], uint64(mtime))
+	out = append(out, mtimeBytes[:]...)
+	out = append(out, value...)
+	var crcBytes [4]byte
+	binary.BigEndian.PutUint32(crcBytes[:], crc32.ChecksumIEEE(out[4:]))
+	return append(out, crcBytes[:]...), nil
+}
+
+// appendRecord appends a record to the file and indexes it.
+func (db *DB) appendRecord(bucket, digest string, mtime int64, value []byte) error {
+	data, err := newDBRecord(bucket, digest, mtime, value)
+	if err != nil {
+		return err
+	}
+	if _, err := db.file.WriteAt(data, db.size); err != nil {
+		db.file.Truncate(db.size) // try to avoid leaving a partial record around
+		return err
+	}
+	db.setRecord(bucket, digest, &dbRecord{
+		length: len(value),
+		mtime:  mtime,
+		offset: db.size + int64(len(data)-4-len(value)),
+	})
+	db.size += int64(len(data))
+	return nil
+}
+
+// readValue reads the value of the given record.
+func (db *DB) readValue(record *dbRecord) ([]byte, error) {
+	value := make([]byte, record.length)
+	if _, err := db.file.ReadAt(value, record.offset); err != nil {
+		return nil, err
+	}
+	return value, nil
+}
+
+// keyDigest returns the digest of a key, which is also the
+// name of the file FSCache uses, without the "-d" suffix.
+func keyDigest(key string) string {
+	return fmt.Sprintf("%x", sha256.Sum256([]byte(key)))
+}
+
+// getDigest returns the value of the given digest in the given bucket
+// and remembers that we have used the entry.
+func (db *DB) getDigest(bucket, digest string) (value []byte, err error) {
+	err = db.locked(func() error {
+		record := db.index[bucket][digest]
+		if record == nil {
+			return os.ErrNotExist
+		}
+		value, err = db.readValue(record)
+		if err != nil {
+			return err
+		}
+		db.markAsUsed(bucket, digest)
+		return nil
+	})
+	return
+}
+
+// markAsUsed records that we have just read the given digest in
+// the given bucket. The caller MUST hold the locks.
+func (db *DB) markAsUsed(bucket, digest string) {
+	if db.atime[bucket] == nil {
+		db.atime[bucket] = map[string]int64{}
+	}
+	db.atime[bucket][digest] = db.now().Unix()
+}
+
+// setDigest sets the value of the given digest in the given bucket. If
+// the bucket is now larger than its maximum size, we compact the DB.
+func (db *DB) setDigest(bucket, digest string, mtime time.Time, value []byte) error {
+	return db.locked(func() error {
+		if err := db.appendRecord(bucket, digest, mtime.Unix(), value); err != nil {
+			return err
+		}
+		if db.overMaxBytes() {
+			return db.compact(time.Time{})
+		}
+		return nil
+	})
+}
+
+// SetMaxBytes sets the maximum size of the values in the given bucket. When
+// the bucket exceeds this size, we remove the least recently used entries
+// when compacting the DB. A zero or negative value means no maximum size.
+func (db *DB) SetMaxBytes(bucket string, maxBytes int64) {
+	db.mu.Lock()
+	db.maxBytes[bucket] = maxBytes
+	db.mu.Unlock()
+}
+
+// SetKeepUnused sets whether we should keep the entries of the given
+// bucket that have not been used recently when trimming the DB. We still
+// remove the least recently used entries exceeding the maximum size.
+func (db *DB) SetKeepUnused(bucket string, keepUnused bool) {
+	db.mu.Lock()
+	db.keepUnused[bucket] = keepUnused
+	db.mu.Unlock()
+}
+
+// overMaxBytes returns whether any bucket exceeds its maximum
+// size. The caller MUST hold the locks.
+func (db *DB) overMaxBytes() bool {
+	for bucket, maxBytes := range db.maxBytes {
+		if maxBytes > 0 && db.bytes[bucket] > maxBytes {
+			return true
+		}
+	}
+	return false
+}
+
+// bucketStats returns the entries, bytes, and evictions of a bucket.
+func (db *DB) bucketStats(bucket string) (stats Stats, err error) {
+	err = db.locked(func() error {
+		stats.Entries = int64(len(db.index[bucket]))
+		stats.Bytes = db.bytes[bucket]
+		stats.Evictions = db.evicted[bucket]
+		return nil
+	})
+	return
+}
+
+// Buckets returns the sorted names of the buckets inside the DB.
+func (db *DB) Buckets() (out []string, err error) {
+	err = db.locked(func() error {
+		for bucket := range db.index {
+			out = append(out, bucket)
+		}
+		return nil
+	})
+	sort.Strings(out)
+	return
+}
+
+// Entry is a cache entry returned by DB.Walk and by Store.Walk.
+type Entry struct {
+	// Digest is the SHA256 of the key in hex.
+	Digest string
+
+	// ModTime is the time of the last write.
+	ModTime time.Time
+
+	// Value is the value.
+	Value []byte
+}
+
+// Walk calls fx for each entry in the given bucket in digest order. We
+// hold the DB lock while walking, so fx MUST NOT use the DB.
+func (db *DB) Walk(bucket string, fx func(entry *Entry) error) error {
+	return db.locked(func() error {
+		entries := db.index[bucket]
+		var digests []string
+		for digest := range entries {
+			digests = append(digests, digest)
+		}
+		sort.Strings(digests)
+		for _, digest := range digests {
+			record := entries[digest]
+			value, err := db.readValue(record)
+			if err != nil {
+				return err
+			}
+			err = fx(&Entry{
+				Digest:  digest,
+				ModTime: time.Unix(record.mtime, 0),
+				Value:   value,
+			})
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// digests returns the sorted digests of the entries in the given bucket.
+func (db *DB) digests(bucket string) (out []string, err error) {
+	err = db.locked(func() error {
+		for digest := range db.index[bucket] {
+			out = append(out, digest)
+		}
+		return nil
+	})
+	sort.Strings(out)
+	return
+}
+
+// getEntry returns the entry with the given digest in the given bucket.
+func (db *DB) getEntry(bucket, digest string) (entry *Entry, err error) {
+	err = db.locked(func() error {
+		record := db.index[bucket][digest]
+		if record == nil {
+			return os.ErrNotExist
+		}
+		value, err := db.readValue(record)
+		if err != nil {
+			return err
+		}
+		entry = &Entry{
+			Digest:  digest,
+			ModTime: time.Unix(record.mtime, 0),
+			Value:   value,
+		}
+		return nil
+	})
+	return
+}
+
+// deleteDigests removes the given digests from the given bucket. Because
+// records cannot express a deletion, we remove the digests from the index
+// and compact the DB, so it's better to delete many digests at once.
+func (db *DB) deleteDigests(bucket string, digests ...string) error {
+	return db.locked(func() error {
+		entries := db.index[bucket]
+		var found bool
+		for _, digest := range digests {
+			if record := entries[digest]; record != nil {
+				db.bytes[bucket] -= int64(record.length)
+				delete(entries, digest)
+				found = true
+			}
+		}
+		if !found {
+			return nil
+		}
+		if err := db.compact(time.Time{}); err != nil {
+			db.closeFile() // the index does not reflect the file anymore
+			return err
+		}
+		return nil
+	})
+}
+
+// trim compacts the DB at most once every cacheTrimInterval (or when a
+// bucket exceeds its maximum size), removing the overridden records, the
+// entries exceeding the buckets' maximum size, and the entries not used for
+// at least cacheTrimLimit (where a use is either a write or a read by this
+// process), and returns the number of entries of the given bucket we
+// removed since the previous call with the same bucket.
+func (db *DB) trim(bucket string) (int, error) {
+	var count int
+	err := db.locked(func() error {
+		now := db.now()
+		if now.Sub(db.lastTrim) >= cacheTrimInterval || db.overMaxBytes() {
+			db.lastTrim = now
+			if err := db.compact(now.Add(-cacheTrimLimit - cacheMtimeInterval)); err != nil {
+				return err
+			}
+		}
+		count = db.trimmed[bucket]
+		delete(db.trimmed, bucket)
+		return nil
+	})
+	return count, err
+}
+
+// compact rewrites the DB file without the overridden records, without
+// the entries whose last use is before the given cutoff (unless we should
+// keep the unused entries of their bucket), and without the least recently
+// used entries of the buckets exceeding their maximum size. The caller
+// MUST hold the locks.
+func (db *DB) compact(cutoff time.Time) error {
+	temppath := db.path + ".tmp"
+	filep, err := os.OpenFile(temppath, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(temppath) // fails if we have renamed
+	writer := bufio.NewWriter(filep)
+	writer.WriteString(dbMagic)
+	trimmed, evicted := map[string]int{}, map[string]int64{}
+	for bucket, entries := range db.index {
+		bucketCutoff := cutoff
+		if db.keepUnused[bucket] {
+			bucketCutoff = time.Time{}
+		}
+		live, total := db.liveRecords(bucket, entries, bucketCutoff)
+		trimmed[bucket] += len(entries) - len(live)
+		if maxBytes := db.maxBytes[bucket]; maxBytes > 0 && total > maxBytes {
+			target := evictionTarget(maxBytes)
+			for len(live) > 0 && total > target {
+				total -= int64(live[0].length)
+				live = live[1:]
+				evicted[bucket]++
+			}
+		}
+		for _, record := range live {
+			value, err := db.readValue(record.dbRecord)
+			if err != nil {
+				filep.Close()
+				return err
+			}
+			data, err := newDBRecord(bucket, record.digest, record.mtime, value)
+			if err != nil {
+				filep.Close()
+				return err
+			}
+			writer.Write(data)
+		}
+	}
+	if err := writer.Flush(); err != nil {
+		filep.Close()
+		return err
+	}
+	if err := filep.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(temppath, db.path); err != nil {
+		return err
+	}
+	for bucket, count := range trimmed {
+		db.trimmed[bucket] += count
+	}
+	for bucket, count := range evicted {
+		db.evicted[bucket] += count
+	}
+	db.closeFile()
+	if err := db.refresh(); err != nil {
+		return err
+	}
+	for bucket, atimes := range db.atime {
+		for digest := range atimes {
+			if db.index[bucket][digest] == nil {
+				delete(atimes, digest)
+			}
+		}
+	}
+	return nil
+}
+
+// dbLiveRecord is a record that survives compaction.
+type dbLiveRecord struct {
+	*dbRecord
+	digest string
+	used   int64
+}
+
+// liveRecords returns the records of the given bucket used after the
+// cutoff sorted from the least recently used one and their total size.
+func (db *DB) liveRecords(bucket string, entries map[string]*dbRecord,
+	cutoff time.Time) (out []dbLiveRecord, total int64) {
+	for digest, record := range entries {
+		used := record.mtime
+		if atime := db.atime[bucket][digest]; atime > used {
+			used = atime
+		}
+		if used < cutoff.Unix() {
+			continue
+		}
+		out = append(out, dbLiveRecord{dbRecord: record, digest: digest, used: used})
+		total += int64(record.length)
+	}
+	sort.SliceStable(out, func(i, j int) bool {
+		if out[i].used != out[j].used {
+			return out[i].used < out[j].used
+		}
+		return out[i].digest < out[j].digest
+	})
+	return
+}
@@ -0,0 +1,217 @@
+package caching
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// newDBCacheForTesting creates a DBCache inside a temporary directory.
+func newDBCacheForTesting(t *testing.T) *DBCache {
+	return NewDBCache(filepath.Join(t.TempDir(), "cache.db"), "dns")
+}
+
+// dbTestExpectValue fails the test if key's value is not expect.
+func dbTestExpectValue(t *testing.T, dc *DBCache, key, expect string) {
+	value, err := dc.Get(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(value) != expect {
+		t.Fatal("expected", expect, "got", string(value))
+	}
+}
+
+// dbTestFileSize returns the size of the DB file.
+func dbTestFileSize(t *testing.T, dc *DBCache) int64 {
+	info, err := os.Stat(dc.db.Path())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return info.Size()
+}
+
+// dbTestAppend appends data to the DB file.
+func dbTestAppend(t *testing.T, dc *DBCache, data []byte) {
+	filep, err := os.OpenFile(dc.db.Path(), os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := filep.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	if err := filep.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDBAppendAndReopen(t *testing.T) {
+	dc := newDBCacheForTesting(t)
+	for key, value := range map[string]string{"a": "1", "b": "2"} {
+		if err := dc.Set(key, []byte(value)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := dc.Set("a", []byte("3")); err != nil {
+		t.Fatal(err) // a later record overrides the previous one
+	}
+	dbTestExpectValue(t, dc, "a", "3")
+	if err := dc.db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	// After reopening, we should rebuild the same index from the file.
+	dbTestExpectValue(t, dc, "a", "3")
+	dbTestExpectValue(t, dc, "b", "2")
+	if _, err := dc.Get("c"); !os.IsNotExist(err) {
+		t.Fatal("unexpected error", err)
+	}
+	if stats := dc.Stats(); stats.Entries != 2 {
+		t.Fatal("unexpected number of entries", stats.Entries)
+	}
+}
+
+func TestDBTruncatesTornTail(t *testing.T) {
+	record, err := newDBRecord("dns", keyDigest("c"), 0, []byte("3"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name string
+		tail []byte
+	}{{
+		name: "partial header",
+		tail: record[:2],
+	}, {
+		name: "partial body",
+		tail: record[:len(record)-3],
+	}, {
+		name: "complete record with invalid CRC",
+		tail: append(append([]byte{}, record[:len(record)-1]...), record[len(record)-1]^0xff),
+	}}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dc := newDBCacheForTesting(t)
+			if err := dc.Set("a", []byte("1")); err != nil {
+				t.Fatal(err)
+			}
+			size := dbTestFileSize(t, dc)
+			dbTestAppend(t, dc, tt.tail)
+			dbTestExpectValue(t, dc, "a", "1")
+			if got := dbTestFileSize(t, dc); got != size {
+				t.Fatal("expected size", size, "got", got)
+			}
+			// We should be able to append after truncating.
+			if err := dc.Set("b", []byte("2")); err != nil {
+				t.Fatal(err)
+			}
+			dc.db.Close()
+			dbTestExpectValue(t, dc, "a", "1")
+			dbTestExpectValue(t, dc, "b", "2")
+		})
+	}
+}
+
+func TestDBMidFileCorruption(t *testing.T) {
+	dc := newDBCacheForTesting(t)
+	if err := dc.Set("a", []byte("1")); err != nil {
+		t.Fatal(err)
+	}
+	if err := dc.Set("b", []byte("2")); err != nil {
+		t.Fatal(err)
+	}
+	dc.db.Close()
+	data, err := os.ReadFile(dc.db.Path())
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Corrupt the first record's mtime, which is inside the CRC-protected body.
+	data[len(dbMagic)+4+1+len("dns")+dbDigestLength] ^= 0xff
+	if err := os.WriteFile(dc.db.Path(), data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := dc.Get("b"); !errors.Is(err, ErrInvalidDB) {
+		t.Fatal("unexpected error", err)
+	}
+	if err := dc.Set("c", []byte("3")); !errors.Is(err, ErrInvalidDB) {
+		t.Fatal("unexpected error", err)
+	}
+	if got := dbTestFileSize(t, dc); got != int64(len(data)) {
+		t.Fatal("we should not modify a corrupted file", got)
+	}
+}
+
+func TestDBTrimKeepsRecentlyReadEntries(t *testing.T) {
+	tests := []struct {
+		name        string
+		keepUnused  bool
+		wantTrimmed int
+	}{{
+		name:        "we trim unused entries by default",
+		keepUnused:  false,
+		wantTrimmed: 1,
+	}, {
+		name:        "we keep unused entries when asked to do so",
+		keepUnused:  true,
+		wantTrimmed: 0,
+	}}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dc := newDBCacheForTesting(t)
+			dc.SetKeepUnused(tt.keepUnused)
+			now := time.Now()
+			dc.db.now = func() time.Time { return now }
+			for _, key := range []string{"hot", "cold"} {
+				if err := dc.Set(key, []byte(key)); err != nil {
+					t.Fatal(err)
+				}
+			}
+			// We read the hot entry frequently and we never
+			// write it again, while we never read the cold one.
+			for i := 0; i < 3; i++ {
+				now = now.Add(cacheTrimLimit / 2)
+				dbTestExpectValue(t, dc, "hot", "hot")
+			}
+			count, err := dc.db.trim(dc.bucket)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if count != tt.wantTrimmed {
+				t.Fatal("expected", tt.wantTrimmed, "trimmed entries, got", count)
+			}
+			dbTestExpectValue(t, dc, "hot", "hot")
+			_, err = dc.Get("cold")
+			if tt.keepUnused && err != nil {
+				t.Fatal("unexpected error", err)
+			}
+			if !tt.keepUnused && !os.IsNotExist(err) {
+				t.Fatal("unexpected error", err)
+			}
+		})
+	}
+}
+
+func TestDBEvictsLeastRecentlyUsedEntries(t *testing.T) {
+	dc := newDBCacheForTesting(t)
+	now := time.Now()
+	dc.db.now = func() time.Time { return now }
+	for _, key := range []string{"a", "b", "c"} {
+		now = now.Add(time.Second)
+		if err := dc.Set(key, []byte("0123456789")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Reading the least recently written entry makes it the
+	// most recently used one, so we should evict b instead.
+	now = now.Add(time.Second)
+	dbTestExpectValue(t, dc, "a", "0123456789")
+	dc.SetMaxBytes(25)
+	if _, err := dc.db.trim(dc.bucket); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := dc.Get("b"); !os.IsNotExist(err) {
+		t.Fatal("unexpected error", err)
+	}
+	dbTestExpectValue(t, dc, "a", "0123456789")
+}
@@ -0,0 +1,188 @@
+package caching
+
+//
+// DBCache
+//
+// Contains a cache using a bucket of a DB.
+//
+
+import (
+	"os"
+	"path/filepath"
+
+	"github.com/bassosimone/websteps-illustrated/internal/atomicx"
+	"github.com/bassosimone/websteps-illustrated/internal/metrics"
+	"github.com/bassosimone/websteps-illustrated/internal/model"
+)
+
+// DBCache is a cache using a bucket of a DB. It is functionally
+// equivalent to an FSCache but stores all the entries in a single file.
+type DBCache struct {
+	bucket  string
+	db      *DB
+	gets    *metrics.Counter
+	hits    *atomicx.Int64
+	misses  *atomicx.Int64
+	name    string
+	sets    *metrics.Counter
+	trimmed *metrics.Counter
+}
+
+// NewDBCache creates a new DBCache using the given bucket of the DB at
+// the given path. We'll create the DB file, if needed, on first use.
+func NewDBCache(path, bucket string) *DBCache {
+	return &DBCache{
+		bucket:  bucket,
+		db:      OpenDB(path),
+		gets:    nil,
+		hits:    atomicx.NewInt64(0),
+		misses:  atomicx.NewInt64(0),
+		name:    "",
+		sets:    nil,
+		trimmed: nil,
+	}
+}
+
+// SetMetrics is like FSCache.SetMetrics.
+func (dc *DBCache) SetMetrics(reg *metrics.Registry, name string) {
+	dc.gets = reg.NewCounter("caching_dbcache_gets_total",
+		"Number of DBCache Get operations by cache and result.", "cache", "result")
+	dc.name = name
+	dc.sets = reg.NewCounter("caching_dbcache_sets_total",
+		"Number of DBCache Set operations by cache and result.", "cache", "result")
+	dc.trimmed = reg.NewCounter("caching_dbcache_trimmed_total",
+		"Number of DBCache entries removed because unused.", "cache")
+}
+
+var _ model.KeyValueStore = &DBCache{}
+
+// Get implements KeyValueStore.Get.
+func (dc *DBCache) Get(key string) ([]byte, error) {
+	data, err := dc.db.getDigest(dc.bucket, keyDigest(key))
+	result := "hit"
+	switch {
+	case os.IsNotExist(err):
+		result = "miss"
+		dc.misses.Add(1)
+	case err != nil:
+		result = "error"
+	default:
+		dc.hits.Add(1)
+	}
+	dc.gets.Inc(dc.name, result)
+	return data, err
+}
+
+// Set implements KeyValueStore.Set.
+func (dc *DBCache) Set(key string, value []byte) error {
+	if err := dc.db.setDigest(dc.bucket, keyDigest(key), dc.db.now(), value); err != nil {
+		dc.sets.Inc(dc.name, "error")
+		return err
+	}
+	dc.sets.Inc(dc.name, "ok")
+	return nil
+}
+
+// Delete is like FSCache.Delete. Because we need to compact the
+// DB to delete entries, it's better to delete many keys at once.
+func (dc *DBCache) Delete(keys ...string) error {
+	var digests []string
+	for _, key := range keys {
+		digests = append(digests, keyDigest(key))
+	}
+	return dc.db.deleteDigests(dc.bucket, digests...)
+}
+
+// SetMaxBytes is like FSCache.SetMaxBytes. Because all the buckets share
+// the same file, we remove the least recently used entries when we compact
+// the DB. Unlike FSCache, only reads performed by this process are uses.
+func (dc *DBCache) SetMaxBytes(maxBytes int64) {
+	dc.db.SetMaxBytes(dc.bucket, maxBytes)
+}
+
+// SetKeepUnused is like FSCache.SetKeepUnused.
+func (dc *DBCache) SetKeepUnused(keepUnused bool) {
+	dc.db.SetKeepUnused(dc.bucket, keepUnused)
+}
+
+// Stats is like FSCache.Stats. The number of hits and misses only
+// accounts for the operations performed using this DBCache.
+func (dc *DBCache) Stats() Stats {
+	stats, _ := dc.db.bucketStats(dc.bucket)
+	stats.Hits = dc.hits.Load()
+	stats.Misses = dc.misses.Load()
+	return stats
+}
+
+// Trim is like FSCache.Trim. Because all the buckets share the same
+// file, trimming a bucket may actually trim all the buckets.
+func (dc *DBCache) Trim() {
+	count, _ := dc.db.trim(dc.bucket)
+	dc.trimmed.Add(float64(count), dc.name)
+}
+
+// Walk is like FSCache.Walk. Unlike DB.Walk, we do not hold the DB
+// lock when calling fx, so fx may use this DBCache.
+func (dc *DBCache) Walk(fx func(entry *Entry) error) error {
+	digests, err := dc.db.digests(dc.bucket)
+	if err != nil {
+		return err
+	}
+	for _, digest := range digests {
+		entry, err := dc.db.getEntry(dc.bucket, digest)
+		if os.IsNotExist(err) {
+			continue // deleted while we were walking
+		}
+		if err != nil {
+			return err
+		}
+		if err := fx(entry); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Store is the cache abstraction used by measurex and dnsping. Both
+// FSCache and DBCache implement this interface.
+type Store interface {
+	model.KeyValueStore
+
+	// Delete removes the given keys from the cache.
+	Delete(keys ...string) error
+
+	// SetKeepUnused sets whether Trim should keep unused entries.
+	SetKeepUnused(keepUnused bool)
+
+	// SetMaxBytes sets the maximum size of the cache.
+	SetMaxBytes(maxBytes int64)
+
+	// SetMetrics configures the registry where to collect metrics.
+	SetMetrics(reg *metrics.Registry, name string)
+
+	// Stats returns the cache statistics.
+	Stats() Stats
+
+	// Trim removes old cache entries that are likely not to be reused
+	// and the least recently used entries exceeding the maximum size.
+	Trim()
+
+	// Walk calls fx for each entry of the cache in digest order.
+	Walk(fx func(entry *Entry) error) error
+}
+
+var (
+	_ Store = &DBCache{}
+	_ Store = &FSCache{}
+)
+
+// NewStore returns the Store for the given bucket of the cache at the
+// given path. If IsDBPath(path) is true, we return a DBCache using the
+// given bucket of such a DB. Otherwise, we return an FSCache using
+// the bucket subdirectory of the given directory.
+func NewStore(path, bucket string) Store {
+	if IsDBPath(path) {
+		return NewDBCache(path, bucket)
+	}
+	return NewFSCache(filepath.Join(path, bucket))
+}
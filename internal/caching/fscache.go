@@ -9,38 +9,116 @@ package caching
 
 import (
 	"bytes"
-	"crypto/sha256"
 	"fmt"
 	"os"
 	"path/filepath"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
+	"github.com/bassosimone/websteps-illustrated/internal/metrics"
 	"github.com/bassosimone/websteps-illustrated/internal/model"
 	"github.com/rogpeppe/go-internal/lockedfile"
 )
 
 // FSCache provides a simple cache-on-filesystem functionality.
 type FSCache struct {
-	dirpath string
-	now     func() time.Time
+	dirpath    string
+	evicted    *metrics.Counter
+	evicting   bool
+	gets       *metrics.Counter
+	keepUnused bool
+	maxBytes   int64
+	mu         sync.Mutex
+	name       string
+	now        func() time.Time
+	scanned    bool
+	sets       *metrics.Counter
+	stats      Stats
+	trimmed    *metrics.Counter
 }
 
 // NewFSCache creates a new simpleCache instance.
 func NewFSCache(dirpath string) *FSCache {
 	return &FSCache{
-		dirpath: dirpath,
-		now:     time.Now,
+		dirpath:    dirpath,
+		evicted:    nil,
+		evicting:   false,
+		gets:       nil,
+		keepUnused: false,
+		maxBytes:   0,
+		mu:         sync.Mutex{},
+		name:       "",
+		now:        time.Now,
+		scanned:    false,
+		sets:       nil,
+		stats:      Stats{},
+		trimmed:    nil,
 	}
 }
 
+// SetMetrics configures the registry where to collect metrics. The name
+// argument identifies this cache and is the value of the "cache" label. You
+// MUST call this function before using the cache.
+func (sc *FSCache) SetMetrics(reg *metrics.Registry, name string) {
+	sc.evicted = reg.NewCounter("caching_fscache_evicted_total",
+		"Number of FSCache entries removed to honor the maximum size.", "cache")
+	sc.gets = reg.NewCounter("caching_fscache_gets_total",
+		"Number of FSCache Get operations by cache and result.", "cache", "result")
+	sc.name = name
+	sc.sets = reg.NewCounter("caching_fscache_sets_total",
+		"Number of FSCache Set operations by cache and result.", "cache", "result")
+	sc.trimmed = reg.NewCounter("caching_fscache_trimmed_total",
+		"Number of FSCache entries removed because unused.", "cache")
+}
+
+// SetMaxBytes sets the maximum size of the cache. When the cache exceeds
+// this size, we remove the least recently used entries. A zero or negative
+// value means that there is no maximum size, which is the default. You
+// SHOULD call this function before using the cache.
+func (sc *FSCache) SetMaxBytes(maxBytes int64) {
+	sc.mu.Lock()
+	sc.maxBytes = maxBytes
+	sc.mu.Unlock()
+}
+
+// SetKeepUnused sets whether Trim should keep the entries that have not
+// been used recently, which is useful when we want to cache forever. Trim
+// still removes the least recently used entries exceeding the maximum size.
+func (sc *FSCache) SetKeepUnused(keepUnused bool) {
+	sc.mu.Lock()
+	sc.keepUnused = keepUnused
+	sc.mu.Unlock()
+}
+
 var _ model.KeyValueStore = &FSCache{}
 
 // Get implements KeyValueStore.Get.
 func (sc *FSCache) Get(key string) ([]byte, error) {
 	_, fpath := sc.fsmap(key)
-	return lockedfile.Read(fpath)
+	data, err := lockedfile.Read(fpath)
+	result := "hit"
+	switch {
+	case os.IsNotExist(err):
+		result = "miss"
+	case err != nil:
+		result = "error"
+	}
+	sc.gets.Inc(sc.name, result)
+	sc.mu.Lock()
+	switch result {
+	case "hit":
+		sc.stats.Hits++
+	case "miss":
+		sc.stats.Misses++
+	}
+	sc.mu.Unlock()
+	if err == nil {
+		sc.maybeMarkAsUsed(fpath) // needed for LRU eviction
+	}
+	return data, err
 }
 
 // Set implements KeyValueStore.Set.
@@ -48,21 +126,217 @@ func (sc *FSCache) Set(key string, value []byte) error {
 	dpath, fpath := sc.fsmap(key)
 	const dperms = 0700
 	if err := os.MkdirAll(dpath, dperms); err != nil {
+		sc.sets.Inc(sc.name, "error")
 		return err
 	}
+	var prevSize int64 = -1 // meaning that the entry does not exist
+	if info, err := os.Stat(fpath); err == nil {
+		prevSize = info.Size()
+	}
 	const fperms = 0600
 	if err := lockedfile.Write(fpath, bytes.NewReader(value), fperms); err != nil {
+		sc.sets.Inc(sc.name, "error")
 		return err
 	}
+	sc.sets.Inc(sc.name, "ok")
 	sc.maybeMarkAsUsed(fpath)
+	sc.accountSet(prevSize, int64(len(value)))
 	return nil
 }
 
+// Delete removes the given keys from the cache. Removing
+// a key that is not in the cache is not an error.
+func (sc *FSCache) Delete(keys ...string) error {
+	for _, key := range keys {
+		_, fpath := sc.fsmap(key)
+		info, err := os.Stat(fpath)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if err := os.Remove(fpath); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		sc.mu.Lock()
+		if sc.scanned {
+			sc.stats.Entries--
+			sc.stats.Bytes -= info.Size()
+		}
+		sc.mu.Unlock()
+	}
+	return nil
+}
+
+// Walk calls fx for each entry of the cache in digest order. Because
+// FSCache only knows the digests of the keys, fx cannot know the key
+// of an entry unless the key is derivable from the value.
+func (sc *FSCache) Walk(fx func(entry *Entry) error) error {
+	for i := 0; i < 256; i++ {
+		subdir := filepath.Join(sc.dirpath, fmt.Sprintf("%02x", i))
+		dirents, err := os.ReadDir(subdir)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		for _, dirent := range dirents {
+			digest, ok := fsCacheEntryDigest(dirent.Name())
+			if !ok || !dirent.Type().IsRegular() {
+				continue
+			}
+			fpath := filepath.Join(subdir, dirent.Name())
+			info, err := os.Stat(fpath)
+			if os.IsNotExist(err) {
+				continue // deleted while we were walking
+			}
+			if err != nil {
+				return err
+			}
+			value, err := lockedfile.Read(fpath)
+			if os.IsNotExist(err) {
+				continue // ditto
+			}
+			if err != nil {
+				return err
+			}
+			err = fx(&Entry{
+				Digest:  digest,
+				ModTime: info.ModTime(),
+				Value:   value,
+			})
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// accountSet updates the statistics after a Set and evicts entries
+// if the cache is now larger than its maximum size.
+func (sc *FSCache) accountSet(prevSize, size int64) {
+	sc.mu.Lock()
+	if sc.scanned {
+		if prevSize < 0 {
+			sc.stats.Entries++
+			prevSize = 0
+		}
+		sc.stats.Bytes += size - prevSize
+	}
+	needScan := sc.maxBytes > 0 && (!sc.scanned || sc.stats.Bytes > sc.maxBytes)
+	sc.mu.Unlock()
+	if needScan {
+		sc.scanAndEvict()
+	}
+}
+
+// Stats returns the cache statistics. The first call may be slow
+// because we need to scan the cache to count entries and bytes. After
+// that, we update the statistics incrementally and we rescan the cache
+// when trimming it. Because other processes may write into the same
+// directory, the number of entries and bytes may be inaccurate.
+func (sc *FSCache) Stats() Stats {
+	sc.mu.Lock()
+	scanned := sc.scanned
+	sc.mu.Unlock()
+	if !scanned {
+		sc.scanAndEvict()
+	}
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	return sc.stats
+}
+
+// fsCacheEntry is an entry found while scanning the cache.
+type fsCacheEntry struct {
+	mtime time.Time
+	path  string
+	size  int64
+}
+
+// scanAndEvict scans the cache to count entries and bytes and, if the
+// cache exceeds its maximum size, removes the least recently used entries
+// until the cache size is below the eviction target.
+func (sc *FSCache) scanAndEvict() {
+	sc.mu.Lock()
+	if sc.evicting {
+		sc.mu.Unlock()
+		return // another goroutine is already doing this
+	}
+	sc.evicting = true
+	maxBytes := sc.maxBytes
+	sc.mu.Unlock()
+	defer func() {
+		sc.mu.Lock()
+		sc.evicting = false
+		sc.mu.Unlock()
+	}()
+	entries, total := sc.scan()
+	var evicted, kept int64
+	if maxBytes > 0 && total > maxBytes {
+		sort.SliceStable(entries, func(i, j int) bool {
+			return entries[i].mtime.Before(entries[j].mtime)
+		})
+		target := evictionTarget(maxBytes)
+		for len(entries) > 0 && total > target {
+			if err := os.Remove(entries[0].path); err == nil || os.IsNotExist(err) {
+				total -= entries[0].size
+				evicted++
+			} else {
+				kept++ // the entry is still there, so we must count it
+			}
+			entries = entries[1:]
+		}
+		sc.evicted.Add(float64(evicted), sc.name)
+	}
+	sc.mu.Lock()
+	sc.scanned = true
+	sc.stats.Entries = int64(len(entries)) + kept
+	sc.stats.Bytes = total
+	sc.stats.Evictions += evicted
+	sc.mu.Unlock()
+}
+
+// scan returns all the cache entries and their total size.
+func (sc *FSCache) scan() (entries []fsCacheEntry, total int64) {
+	for i := 0; i < 256; i++ {
+		subdir := filepath.Join(sc.dirpath, fmt.Sprintf("%02x", i))
+		dirents, err := os.ReadDir(subdir)
+		if err != nil {
+			continue
+		}
+		for _, dirent := range dirents {
+			if !strings.HasSuffix(dirent.Name(), "-d") {
+				continue
+			}
+			info, err := dirent.Info()
+			if err != nil || !info.Mode().IsRegular() {
+				continue
+			}
+			entries = append(entries, fsCacheEntry{
+				mtime: info.ModTime(),
+				path:  filepath.Join(subdir, dirent.Name()),
+				size:  info.Size(),
+			})
+			total += info.Size()
+		}
+	}
+	return
+}
+
 // fsmap maps a given key to a directory and a file paths.
 func (sc *FSCache) fsmap(key string) (dpath, fpath string) {
-	hs := sha256.Sum256([]byte(key))
-	dpath = filepath.Join(sc.dirpath, fmt.Sprintf("%02x", hs[0]))
-	fpath = filepath.Join(dpath, fmt.Sprintf("%02x-d", hs))
+	return fsmapDigest(sc.dirpath, keyDigest(key))
+}
+
+// fsmapDigest maps the digest of a key (see keyDigest) to the directory
+// and the file paths used by an FSCache living in dirpath.
+func fsmapDigest(dirpath, digest string) (dpath, fpath string) {
+	dpath = filepath.Join(dirpath, digest[:2])
+	fpath = filepath.Join(dpath, digest+"-d")
 	return
 }
 
@@ -109,12 +383,29 @@ func (sc *FSCache) maybeMarkAsUsed(file string) {
 	os.Chtimes(file, now, now)
 }
 
-// Trim removes old cache entries that are likely not to be reused.
+// Trim removes old cache entries that are likely not to be reused and,
+// if the cache exceeds its maximum size, the least recently used entries.
+func (sc *FSCache) Trim() {
+	sc.mu.Lock()
+	keepUnused := sc.keepUnused
+	sc.mu.Unlock()
+	if !keepUnused {
+		sc.trimUnused()
+	}
+	sc.mu.Lock()
+	rescan := sc.scanned || sc.maxBytes > 0
+	sc.mu.Unlock()
+	if rescan {
+		sc.scanAndEvict() // also updates the stats after trimming
+	}
+}
+
+// trimUnused removes old cache entries that are likely not to be reused.
 //
 // SPDX-License-Identifier: BSD-3-Clause
 //
 // Source: https://github.com/rogpeppe/go-internal/commit/797a764460877f0a4bd570a61d60d10815e728e6
-func (sc *FSCache) Trim() {
+func (sc *FSCache) trimUnused() {
 	now := sc.now()
 
 	trimfilepath := filepath.Join(sc.dirpath, "trim.txt")
@@ -166,7 +457,9 @@ func (sc *FSCache) trimSubdir(subdir string, cutoff time.Time) {
 		entry := filepath.Join(subdir, name)
 		info, err := os.Stat(entry)
 		if err == nil && info.ModTime().Before(cutoff) {
-			os.Remove(entry)
+			if os.Remove(entry) == nil {
+				sc.trimmed.Inc(sc.name)
+			}
 		}
 	}
 }
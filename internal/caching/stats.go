@@ -0,0 +1,36 @@
+package caching
+
+//
+// Stats
+//
+// Cache statistics and size limits.
+//
+
+// Stats contains cache statistics.
+type Stats struct {
+	// Entries is the number of entries in the cache.
+	Entries int64 `json:"entries"`
+
+	// Bytes is the size of the entries in the cache.
+	Bytes int64 `json:"bytes"`
+
+	// Hits is the number of Get operations that found an entry.
+	Hits int64 `json:"hits"`
+
+	// Misses is the number of Get operations that did not find an entry.
+	Misses int64 `json:"misses"`
+
+	// Evictions is the number of entries removed to honor the maximum size.
+	Evictions int64 `json:"evictions"`
+}
+
+// evictionLowWatermark is the fraction of the maximum size to which we
+// shrink a cache when it exceeds its maximum size. We shrink below the
+// maximum size to avoid evicting entries on every subsequent write.
+const evictionLowWatermark = 0.9
+
+// evictionTarget returns the size to which we should shrink a cache
+// that exceeds the given maximum size.
+func evictionTarget(maxBytes int64) int64 {
+	return int64(float64(maxBytes) * evictionLowWatermark)
+}
@@ -0,0 +1,278 @@
+// Package censorsim contains an in-process censorship simulator.
+//
+// The Simulator implements model.UnderlyingNetworkLibrary, therefore
+// you can assign it to netxlite.TProxy to censor all the network
+// operations performed by netxlite. The Simulator is configured using
+// a JSON file containing rules. Here's an example:
+//
+//     {
+//       "dns": [{
+//         "domain": "www.example.com",
+//         "action": "inject",
+//         "addresses": ["10.10.34.35"]
+//       }],
+//       "endpoints": [{
+//         "network": "udp",
+//         "address": "93.184.216.34:443",
+//         "action": "drop"
+//       }],
+//       "sni": [{
+//         "pattern": "example.org",
+//         "action": "reset"
+//       }],
+//       "host": [{
+//         "pattern": "example.org",
+//         "action": "throttle",
+//         "bytes_per_second": 1024
+//       }]
+//     }
+//
+// DNS rules apply to the system resolver and to DNS-over-UDP. We do
+// not censor DNS-over-TCP, DNS-over-TLS, and DNS-over-HTTPS. Endpoint
+// rules apply to TCP connect and to UDP datagrams. SNI rules apply
+// to the TLS ClientHello and Host rules apply to cleartext HTTP requests.
+//
+// Some rules require local servers: the hijack action redirects TCP
+// connections to blockpage servers listening on the loopback and we
+// inject DNS replies by sending them from a loopback UDP socket.
+//
+// See testdata/censorsim for more example configurations.
+package censorsim
+
+//
+// Config
+//
+// Configuration of the censorship simulator.
+//
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+)
+
+// These are the actions that rules could take.
+const (
+	// ActionDrop drops SYN segments (for TCP) or datagrams (for UDP).
+	ActionDrop = "drop"
+
+	// ActionEOF closes the connection after the offending payload.
+	ActionEOF = "eof"
+
+	// ActionHijack redirects TCP connections to a blockpage server.
+	ActionHijack = "hijack"
+
+	// ActionInject injects a DNS reply containing the rule addresses.
+	ActionInject = "inject"
+
+	// ActionNoAnswer injects a DNS reply without answers.
+	ActionNoAnswer = "no-answer"
+
+	// ActionNXDOMAIN injects a NXDOMAIN DNS reply.
+	ActionNXDOMAIN = "nxdomain"
+
+	// ActionRefused injects a REFUSED DNS reply (for DNS) or
+	// refuses the connection (for TCP).
+	ActionRefused = "refused"
+
+	// ActionReset resets the connection after the offending payload.
+	ActionReset = "reset"
+
+	// ActionServfail injects a SERVFAIL DNS reply.
+	ActionServfail = "servfail"
+
+	// ActionThrottle throttles the connection after the offending payload.
+	ActionThrottle = "throttle"
+
+	// ActionTimeout drops the offending payload and what follows.
+	ActionTimeout = "timeout"
+)
+
+// Config contains the Simulator config.
+type Config struct {
+	// DNS contains rules for DNS lookups.
+	DNS []*DNSRule `json:"dns"`
+
+	// Endpoints contains rules for TCP and UDP endpoints.
+	Endpoints []*EndpointRule `json:"endpoints"`
+
+	// SNI contains rules for the TLS ClientHello SNI.
+	SNI []*StreamRule `json:"sni"`
+
+	// Host contains rules for the HTTP Host header.
+	Host []*StreamRule `json:"host"`
+
+	// Blockpage is the OPTIONAL blockpage served by hijacked
+	// connections. If empty, we use a default blockpage.
+	Blockpage string `json:"blockpage"`
+}
+
+// DNSRule is a rule for DNS lookups.
+type DNSRule struct {
+	// Domain is the domain to censor. A domain starting with "*."
+	// matches the domain itself and all its subdomains.
+	Domain string `json:"domain"`
+
+	// Action is one of "inject", "no-answer", "nxdomain", "refused",
+	// "servfail", and "timeout".
+	Action string `json:"action"`
+
+	// Addresses contains the addresses returned by "inject".
+	Addresses []string `json:"addresses"`
+}
+
+// EndpointRule is a rule for TCP and UDP endpoints.
+type EndpointRule struct {
+	// Network is either "tcp" or "udp".
+	Network string `json:"network"`
+
+	// Address is either an IP address or an IP address and a port.
+	Address string `json:"address"`
+
+	// Action is one of "drop", "hijack", "refused", and "reset". Only
+	// the "drop" action is valid for UDP endpoints.
+	Action string `json:"action"`
+}
+
+// StreamRule is a rule for the SNI or the Host header.
+type StreamRule struct {
+	// Pattern is the SNI or Host to censor. A pattern starting
+	// with "*." also matches all the subdomains.
+	Pattern string `json:"pattern"`
+
+	// Action is one of "eof", "reset", "throttle", and "timeout".
+	Action string `json:"action"`
+
+	// BytesPerSecond is the download speed used by "throttle".
+	BytesPerSecond int64 `json:"bytes_per_second"`
+}
+
+// ErrInvalidConfig indicates that the config is invalid.
+var ErrInvalidConfig = errors.New("censorsim: invalid config")
+
+// LoadConfig loads the config from the given JSON file.
+func LoadConfig(filepath string) (*Config, error) {
+	data, err := os.ReadFile(filepath)
+	if err != nil {
+		return nil, err
+	}
+	var config Config
+	if err := json.Unmarshal(data, &config); err != nil {
+		return nil, err
+	}
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
+	return &config, nil
+}
+
+// Validate returns an error if the config is not valid.
+func (c *Config) Validate() error {
+	for _, r := range c.DNS {
+		switch r.Action {
+		case ActionNoAnswer, ActionNXDOMAIN, ActionRefused, ActionServfail, ActionTimeout:
+		case ActionInject:
+			for _, addr := range r.Addresses {
+				if net.ParseIP(addr) == nil {
+					return fmt.Errorf("%w: invalid address: %s", ErrInvalidConfig, addr)
+				}
+			}
+		default:
+			return fmt.Errorf("%w: invalid DNS action: %s", ErrInvalidConfig, r.Action)
+		}
+	}
+	for _, r := range c.Endpoints {
+		switch {
+		case r.Network == "udp" && r.Action == ActionDrop:
+		case r.Network == "tcp" && r.Action == ActionDrop:
+		case r.Network == "tcp" && r.Action == ActionHijack:
+		case r.Network == "tcp" && r.Action == ActionRefused:
+		case r.Network == "tcp" && r.Action == ActionReset:
+		default:
+			return fmt.Errorf("%w: invalid endpoint rule: %s/%s",
+				ErrInvalidConfig, r.Network, r.Action)
+		}
+	}
+	for _, r := range append(append([]*StreamRule{}, c.SNI...), c.Host...) {
+		switch r.Action {
+		case ActionEOF, ActionReset, ActionTimeout:
+		case ActionThrottle:
+			if r.BytesPerSecond <= 0 {
+				return fmt.Errorf("%w: invalid bytes per second: %d",
+					ErrInvalidConfig, r.BytesPerSecond)
+			}
+		default:
+			return fmt.Errorf("%w: invalid stream action: %s", ErrInvalidConfig, r.Action)
+		}
+	}
+	return nil
+}
+
+// matchDNS returns the rule matching the given domain, if any.
+func (c *Config) matchDNS(domain string) (*DNSRule, bool) {
+	for _, r := range c.DNS {
+		if matchDomain(r.Domain, domain) {
+			return r, true
+		}
+	}
+	return nil, false
+}
+
+// matchEndpoint returns the rule matching the given endpoint, if any.
+func (c *Config) matchEndpoint(network, address string) (*EndpointRule, bool) {
+	ipAddr, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, false
+	}
+	for _, r := range c.Endpoints {
+		if r.Network != network {
+			continue
+		}
+		if r.Address == address || r.Address == ipAddr {
+			return r, true
+		}
+	}
+	return nil, false
+}
+
+// matchSNI returns the rule matching the given SNI, if any.
+func (c *Config) matchSNI(sni string) (*StreamRule, bool) {
+	return matchStream(c.SNI, sni)
+}
+
+// matchHost returns the rule matching the given Host, if any.
+func (c *Config) matchHost(host string) (*StreamRule, bool) {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	return matchStream(c.Host, host)
+}
+
+// matchStream returns the rule in rules matching value, if any.
+func matchStream(rules []*StreamRule, value string) (*StreamRule, bool) {
+	for _, r := range rules {
+		if matchDomain(r.Pattern, value) {
+			return r, true
+		}
+	}
+	return nil, false
+}
+
+// matchDomain returns whether the pattern matches the domain.
+func matchDomain(pattern, domain string) bool {
+	pattern = normalizeDomain(pattern)
+	domain = normalizeDomain(domain)
+	if strings.HasPrefix(pattern, "*.") {
+		pattern = pattern[2:]
+		return domain == pattern || strings.HasSuffix(domain, "."+pattern)
+	}
+	return domain == pattern
+}
+
+// normalizeDomain lowercases the domain and removes the final dot.
+func normalizeDomain(domain string) string {
+	return strings.TrimSuffix(strings.ToLower(domain), ".")
+}
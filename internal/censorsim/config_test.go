@@ -0,0 +1,66 @@
+package censorsim
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+)
+
+func TestLoadConfigExamples(t *testing.T) {
+	files, err := filepath.Glob(filepath.Join("..", "..", "testdata", "censorsim", "*.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) <= 0 {
+		t.Fatal("no example configs")
+	}
+	for _, file := range files {
+		t.Run(filepath.Base(file), func(t *testing.T) {
+			if _, err := LoadConfig(file); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+func TestConfigValidate(t *testing.T) {
+	tests := []struct {
+		name   string
+		config *Config
+	}{{
+		name: "invalid DNS action",
+		config: &Config{
+			DNS: []*DNSRule{{Domain: "example.com", Action: "reset"}},
+		},
+	}, {
+		name: "invalid injected address",
+		config: &Config{
+			DNS: []*DNSRule{{
+				Domain:    "example.com",
+				Action:    ActionInject,
+				Addresses: []string{"example.org"},
+			}},
+		},
+	}, {
+		name: "hijack for UDP",
+		config: &Config{
+			Endpoints: []*EndpointRule{{
+				Network: "udp",
+				Address: "93.184.216.34:443",
+				Action:  ActionHijack,
+			}},
+		},
+	}, {
+		name: "throttle without speed",
+		config: &Config{
+			Host: []*StreamRule{{Pattern: "example.com", Action: ActionThrottle}},
+		},
+	}}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.config.Validate(); !errors.Is(err, ErrInvalidConfig) {
+				t.Fatal("unexpected error", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,233 @@
+package censorsim
+
+//
+// Simulator
+//
+// Implementation of model.UnderlyingNetworkLibrary.
+//
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"time"
+
+	"github.com/bassosimone/websteps-illustrated/internal/logcat"
+	"github.com/bassosimone/websteps-illustrated/internal/model"
+	"github.com/bassosimone/websteps-illustrated/internal/netxlite"
+	"github.com/lucas-clemente/quic-go"
+)
+
+// Simulator is the censorship simulator. You MUST use New to
+// create a new instance and you MUST call Close when done.
+type Simulator struct {
+	// config is the config.
+	config *Config
+
+	// httpServer is the cleartext blockpage server.
+	httpServer *httptest.Server
+
+	// httpsServer is the TLS blockpage server.
+	httpsServer *httptest.Server
+
+	// injector is the DNS injector.
+	injector *dnsInjector
+
+	// underlying is the underlying library.
+	underlying model.UnderlyingNetworkLibrary
+}
+
+// DefaultBlockpage is the blockpage we use when Config.Blockpage is empty.
+const DefaultBlockpage = `<!DOCTYPE html>
+<html>
+<head><title>Access Denied</title></head>
+<body><h1>Access Denied</h1><p>This website has been blocked.</p></body>
+</html>
+`
+
+// New creates a new Simulator instance using the given config and
+// the given underlying network library (e.g., netxlite.TProxy).
+func New(config *Config, underlying model.UnderlyingNetworkLibrary) (*Simulator, error) {
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
+	injector, err := newDNSInjector()
+	if err != nil {
+		return nil, err
+	}
+	blockpage := config.Blockpage
+	if blockpage == "" {
+		blockpage = DefaultBlockpage
+	}
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		w.Write([]byte(blockpage))
+	})
+	sim := &Simulator{
+		config:      config,
+		httpServer:  newBlockpageServer(handler),
+		httpsServer: newBlockpageServer(handler),
+		injector:    injector,
+		underlying:  underlying,
+	}
+	sim.httpServer.Start()
+	sim.httpsServer.StartTLS()
+	return sim, nil
+}
+
+// newBlockpageServer creates a new blockpage server that does not
+// log errors, since hijacked TLS connections always fail.
+func newBlockpageServer(handler http.Handler) *httptest.Server {
+	srv := httptest.NewUnstartedServer(handler)
+	srv.Config.ErrorLog = log.New(io.Discard, "", 0)
+	return srv
+}
+
+// Close stops the background servers used by the Simulator.
+func (s *Simulator) Close() error {
+	s.httpServer.Close()
+	s.httpsServer.Close()
+	return s.injector.Close()
+}
+
+var _ model.UnderlyingNetworkLibrary = &Simulator{}
+
+// ListenUDP implements model.UnderlyingNetworkLibrary.ListenUDP.
+func (s *Simulator) ListenUDP(network string, laddr *net.UDPAddr) (model.UDPLikeConn, error) {
+	pconn, err := s.underlying.ListenUDP(network, laddr)
+	if err != nil {
+		return nil, err
+	}
+	return s.newUDPConn(pconn), nil
+}
+
+// LookupHost implements model.UnderlyingNetworkLibrary.LookupHost.
+func (s *Simulator) LookupHost(ctx context.Context, domain string) ([]string, error) {
+	rule, found := s.config.matchDNS(domain)
+	if !found {
+		return s.underlying.LookupHost(ctx, domain)
+	}
+	logcat.Emitf(logcat.DEBUG, logcat.UNEXPECTED, "censorsim: %s for getaddrinfo %s",
+		rule.Action, domain)
+	switch rule.Action {
+	case ActionInject:
+		return rule.Addresses, nil
+	case ActionNoAnswer:
+		return nil, netxlite.ErrOODNSNoAnswer
+	case ActionNXDOMAIN:
+		return nil, netxlite.ErrOODNSNoSuchHost
+	case ActionRefused:
+		return nil, netxlite.ErrOODNSRefused
+	case ActionServfail:
+		return nil, netxlite.ErrOODNSServfail
+	default:
+		<-ctx.Done()
+		return nil, ctx.Err()
+	}
+}
+
+// NewSimpleDialer implements model.UnderlyingNetworkLibrary.NewSimpleDialer.
+func (s *Simulator) NewSimpleDialer(timeout time.Duration) model.SimpleDialer {
+	return &simpleDialer{
+		dialer:  s.underlying.NewSimpleDialer(timeout),
+		sim:     s,
+		timeout: timeout,
+	}
+}
+
+// simpleDialer is the model.SimpleDialer returned by NewSimpleDialer.
+type simpleDialer struct {
+	// dialer is the underlying dialer.
+	dialer model.SimpleDialer
+
+	// sim is the simulator.
+	sim *Simulator
+
+	// timeout is the dialer timeout.
+	timeout time.Duration
+}
+
+// errTimeout is the error returned when we simulate a timeout.
+var errTimeout = errors.New("censorsim: i/o timeout")
+
+// DialContext implements model.SimpleDialer.DialContext.
+func (d *simpleDialer) DialContext(
+	ctx context.Context, network, address string) (net.Conn, error) {
+	switch network {
+	case "tcp", "tcp4", "tcp6":
+	default:
+		// We only censor UDP when using ListenUDP.
+		return d.dialer.DialContext(ctx, network, address)
+	}
+	var action string
+	if rule, found := d.sim.config.matchEndpoint("tcp", address); found {
+		logcat.Emitf(logcat.DEBUG, logcat.UNEXPECTED, "censorsim: %s for %s/tcp",
+			rule.Action, address)
+		action = rule.Action
+	}
+	switch action {
+	case ActionDrop:
+		timer := time.NewTimer(d.timeout)
+		defer timer.Stop()
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-timer.C:
+			return nil, errTimeout
+		}
+	case ActionRefused:
+		return nil, netxlite.ECONNREFUSED
+	case ActionHijack:
+		address = d.sim.blockpageAddress(address)
+	}
+	conn, err := d.dialer.DialContext(ctx, network, address)
+	if err != nil {
+		return nil, err
+	}
+	return d.sim.newStreamConn(conn, action), nil
+}
+
+var _ model.UnderlyingCryptoLibrary = &Simulator{}
+
+// TLSHandshake implements model.UnderlyingCryptoLibrary.TLSHandshake. When
+// we censor the conn, we perform the handshake, so the censorship applies to
+// the ClientHello. Otherwise, we let the underlying library control the
+// handshake, if it can (e.g., because it records or replays it).
+func (s *Simulator) TLSHandshake(ctx context.Context, conn net.Conn,
+	config *tls.Config, handshake model.TLSHandshakeFunc) (model.TLSConn, error) {
+	_, censorSNI := s.config.matchSNI(config.ServerName)
+	_, censorEndpoint := s.config.matchEndpoint("tcp", conn.RemoteAddr().String())
+	cl, good := s.underlying.(model.UnderlyingCryptoLibrary)
+	if censorSNI || censorEndpoint || !good {
+		return handshake(ctx, conn, config)
+	}
+	return cl.TLSHandshake(ctx, conn, config, handshake)
+}
+
+// QUICDial implements model.UnderlyingCryptoLibrary.QUICDial. Like we do
+// in TLSHandshake, we only let the underlying library control the dial
+// when we do not censor the remote endpoint.
+func (s *Simulator) QUICDial(ctx context.Context, pconn model.UDPLikeConn,
+	remoteAddr *net.UDPAddr, address string, tlsConfig *tls.Config,
+	quicConfig *quic.Config, dial model.QUICDialFunc) (quic.EarlySession, error) {
+	_, censorEndpoint := s.config.matchEndpoint("udp", remoteAddr.String())
+	cl, good := s.underlying.(model.UnderlyingCryptoLibrary)
+	if censorEndpoint || !good {
+		return dial(ctx, pconn, remoteAddr, address, tlsConfig, quicConfig)
+	}
+	return cl.QUICDial(ctx, pconn, remoteAddr, address, tlsConfig, quicConfig, dial)
+}
+
+// blockpageAddress returns the address of the blockpage server we should
+// use for a connection hijacked while connecting to the given address.
+func (s *Simulator) blockpageAddress(address string) string {
+	if _, port, _ := net.SplitHostPort(address); port == "443" {
+		return s.httpsServer.Listener.Addr().String()
+	}
+	return s.httpServer.Listener.Addr().String()
+}
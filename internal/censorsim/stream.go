@@ -0,0 +1,197 @@
+package censorsim
+
+//
+// Stream
+//
+// Censorship of TCP connections.
+//
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/bassosimone/websteps-illustrated/internal/logcat"
+	"github.com/bassosimone/websteps-illustrated/internal/netxlite"
+)
+
+// streamConn is a net.Conn that inspects the first payload written
+// by the client and, if needed, censors the connection.
+type streamConn struct {
+	// Conn is the underlying conn.
+	net.Conn
+
+	// bytesPerSecond is the throttling speed (if throttling).
+	bytesPerSecond int64
+
+	// failure is the failure to return on I/O (if any).
+	failure error
+
+	// inspected indicates we've already inspected the first write.
+	inspected bool
+
+	// mu provides mutual exclusion.
+	mu sync.Mutex
+
+	// pending is the endpoint action to apply on first write.
+	pending string
+
+	// sim is the simulator.
+	sim *Simulator
+
+	// swallow indicates we should swallow all writes.
+	swallow bool
+}
+
+// newStreamConn creates a new streamConn. The action argument is
+// the endpoint action that applies to this connection (if any).
+func (s *Simulator) newStreamConn(conn net.Conn, action string) *streamConn {
+	return &streamConn{
+		Conn:           conn,
+		bytesPerSecond: 0,
+		failure:        nil,
+		inspected:      false,
+		mu:             sync.Mutex{},
+		pending:        action,
+		sim:            s,
+		swallow:        false,
+	}
+}
+
+// Write implements net.Conn.Write.
+func (c *streamConn) Write(b []byte) (int, error) {
+	c.mu.Lock()
+	first := !c.inspected
+	if first {
+		c.inspected = true
+		c.inspect(b)
+	}
+	failure, swallow := c.failure, c.swallow
+	c.mu.Unlock()
+	if first && failure != nil {
+		return len(b), nil // pretend the offending payload was sent
+	}
+	if failure != nil {
+		return 0, failure
+	}
+	if swallow {
+		return len(b), nil
+	}
+	return c.Conn.Write(b)
+}
+
+// inspect inspects the first payload written by the client. This
+// function MUST be called while holding the mutex.
+func (c *streamConn) inspect(b []byte) {
+	action := c.pending
+	if action == ActionReset {
+		c.failure = netxlite.ECONNRESET
+		c.Conn.Close()
+	}
+	if action == ActionHijack || action == ActionReset {
+		return // do not apply stream rules to hijacked and reset connections
+	}
+	var (
+		rule  *StreamRule
+		found bool
+	)
+	if sni, good := extractSNI(b); good {
+		rule, found = c.sim.config.matchSNI(sni)
+	} else if host, good := extractHost(b); good {
+		rule, found = c.sim.config.matchHost(host)
+	}
+	if !found {
+		return
+	}
+	logcat.Emitf(logcat.DEBUG, logcat.UNEXPECTED, "censorsim: %s for %s", rule.Action,
+		rule.Pattern)
+	switch rule.Action {
+	case ActionEOF:
+		c.failure = io.EOF
+		c.Conn.Close()
+	case ActionReset:
+		c.failure = netxlite.ECONNRESET
+		c.Conn.Close()
+	case ActionThrottle:
+		c.bytesPerSecond = rule.BytesPerSecond
+	case ActionTimeout:
+		c.swallow = true
+	}
+}
+
+// Read implements net.Conn.Read.
+func (c *streamConn) Read(b []byte) (int, error) {
+	c.mu.Lock()
+	failure, bps := c.failure, c.bytesPerSecond
+	c.mu.Unlock()
+	if failure != nil {
+		return 0, failure
+	}
+	if bps <= 0 {
+		return c.Conn.Read(b)
+	}
+	// Deliver at most a tenth of the bytes per second each time
+	// and then sleep for the time required to deliver them.
+	chunk := bps / 10
+	if chunk <= 0 {
+		chunk = 1
+	}
+	if int64(len(b)) > chunk {
+		b = b[:chunk]
+	}
+	count, err := c.Conn.Read(b)
+	time.Sleep(time.Duration(int64(count) * int64(time.Second) / bps))
+	return count, err
+}
+
+// extractSNI extracts the SNI if b is a TLS ClientHello.
+func extractSNI(b []byte) (string, bool) {
+	const handshakeRecord = 22
+	if len(b) <= 0 || b[0] != handshakeRecord {
+		return "", false
+	}
+	var sni string
+	conn := tls.Server(&clientHelloConn{Reader: bytes.NewReader(b)}, &tls.Config{
+		GetConfigForClient: func(chi *tls.ClientHelloInfo) (*tls.Config, error) {
+			sni = chi.ServerName
+			return nil, errStopHandshake
+		},
+	})
+	conn.Handshake()
+	return sni, sni != ""
+}
+
+// errStopHandshake allows to stop the handshake after the ClientHello.
+var errStopHandshake = errors.New("censorsim: stop handshake")
+
+// clientHelloConn is a fake net.Conn that reads a ClientHello from
+// a buffer and allows us to parse it using crypto/tls.
+type clientHelloConn struct {
+	net.Conn
+	io.Reader
+}
+
+// Read implements net.Conn.Read.
+func (c *clientHelloConn) Read(b []byte) (int, error) {
+	return c.Reader.Read(b)
+}
+
+// Write implements net.Conn.Write.
+func (c *clientHelloConn) Write(b []byte) (int, error) {
+	return 0, errStopHandshake
+}
+
+// extractHost extracts the Host header if b is an HTTP request.
+func extractHost(b []byte) (string, bool) {
+	req, err := http.ReadRequest(bufio.NewReader(bytes.NewReader(b)))
+	if err != nil {
+		return "", false
+	}
+	return req.Host, req.Host != ""
+}
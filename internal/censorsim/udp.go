@@ -0,0 +1,185 @@
+package censorsim
+
+//
+// UDP
+//
+// Censorship of UDP datagrams and DNS-over-UDP.
+//
+
+import (
+	"net"
+	"sync"
+
+	"github.com/bassosimone/websteps-illustrated/internal/logcat"
+	"github.com/bassosimone/websteps-illustrated/internal/model"
+	"github.com/miekg/dns"
+)
+
+// udpConn is a model.UDPLikeConn that drops datagrams and injects
+// DNS replies according to the simulator rules.
+type udpConn struct {
+	// UDPLikeConn is the underlying conn.
+	model.UDPLikeConn
+
+	// mu provides mutual exclusion.
+	mu sync.Mutex
+
+	// sim is the simulator.
+	sim *Simulator
+
+	// spoofed contains the source addresses of injected replies.
+	spoofed []net.Addr
+}
+
+// newUDPConn creates a new udpConn instance.
+func (s *Simulator) newUDPConn(pconn model.UDPLikeConn) *udpConn {
+	return &udpConn{
+		UDPLikeConn: pconn,
+		mu:          sync.Mutex{},
+		sim:         s,
+		spoofed:     []net.Addr{},
+	}
+}
+
+// WriteTo implements model.UDPLikeConn.WriteTo.
+func (c *udpConn) WriteTo(p []byte, addr net.Addr) (int, error) {
+	if rule, found := c.sim.config.matchEndpoint("udp", addr.String()); found {
+		logcat.Emitf(logcat.DEBUG, logcat.UNEXPECTED, "censorsim: %s for %s/udp",
+			rule.Action, addr.String())
+		return len(p), nil // the only action for UDP is drop
+	}
+	if _, port, _ := net.SplitHostPort(addr.String()); port == "53" {
+		if reply, matched := c.sim.newDNSReply(p); matched {
+			if reply != nil {
+				c.inject(reply, addr)
+			}
+			return len(p), nil // the query does not reach the server
+		}
+	}
+	return c.UDPLikeConn.WriteTo(p, addr)
+}
+
+// inject injects the given reply pretending it comes from addr.
+func (c *udpConn) inject(reply []byte, addr net.Addr) {
+	local, good := c.LocalAddr().(*net.UDPAddr)
+	if !good {
+		return
+	}
+	dest := &net.UDPAddr{IP: local.IP, Port: local.Port}
+	if dest.IP == nil || dest.IP.IsUnspecified() {
+		dest.IP = net.IPv4(127, 0, 0, 1)
+	}
+	c.mu.Lock()
+	c.spoofed = append(c.spoofed, addr)
+	c.mu.Unlock()
+	if err := c.sim.injector.inject(reply, dest); err != nil {
+		logcat.Bugf("censorsim: cannot inject DNS reply: %s", err.Error())
+	}
+}
+
+// ReadFrom implements model.UDPLikeConn.ReadFrom.
+func (c *udpConn) ReadFrom(p []byte) (int, net.Addr, error) {
+	count, addr, err := c.UDPLikeConn.ReadFrom(p)
+	if err != nil || addr.String() != c.sim.injector.address() {
+		return count, addr, err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.spoofed) > 0 {
+		addr = c.spoofed[0]
+		c.spoofed = c.spoofed[1:]
+	}
+	return count, addr, err
+}
+
+// newDNSReply returns the DNS reply to inject for the given raw
+// query. The boolean return value indicates whether the query matches
+// any rule. A nil reply with a true boolean means that we should just
+// drop the query and let the client time out.
+func (s *Simulator) newDNSReply(rawQuery []byte) ([]byte, bool) {
+	query := &dns.Msg{}
+	if err := query.Unpack(rawQuery); err != nil || len(query.Question) != 1 {
+		return nil, false
+	}
+	q0 := query.Question[0]
+	rule, found := s.config.matchDNS(q0.Name)
+	if !found {
+		return nil, false
+	}
+	logcat.Emitf(logcat.DEBUG, logcat.UNEXPECTED, "censorsim: %s for %s/%s",
+		rule.Action, q0.Name, dns.TypeToString[q0.Qtype])
+	reply := &dns.Msg{}
+	reply.SetReply(query)
+	switch rule.Action {
+	case ActionNXDOMAIN:
+		reply.Rcode = dns.RcodeNameError
+	case ActionRefused:
+		reply.Rcode = dns.RcodeRefused
+	case ActionServfail:
+		reply.Rcode = dns.RcodeServerFailure
+	case ActionInject:
+		reply.Answer = newDNSAnswers(q0, rule.Addresses)
+	case ActionTimeout:
+		return nil, true
+	}
+	data, err := reply.Pack()
+	if err != nil {
+		logcat.Bugf("censorsim: cannot pack DNS reply: %s", err.Error())
+		return nil, true
+	}
+	return data, true
+}
+
+// newDNSAnswers creates the answers for the given question.
+func newDNSAnswers(q0 dns.Question, addresses []string) (out []dns.RR) {
+	for _, addr := range addresses {
+		ip := net.ParseIP(addr)
+		if ip == nil {
+			continue
+		}
+		header := dns.RR_Header{
+			Name:   q0.Name,
+			Rrtype: q0.Qtype,
+			Class:  dns.ClassINET,
+			Ttl:    3600,
+		}
+		switch {
+		case q0.Qtype == dns.TypeA && ip.To4() != nil:
+			out = append(out, &dns.A{Hdr: header, A: ip.To4()})
+		case q0.Qtype == dns.TypeAAAA && ip.To4() == nil:
+			out = append(out, &dns.AAAA{Hdr: header, AAAA: ip})
+		}
+	}
+	return
+}
+
+// dnsInjector injects DNS replies using a loopback UDP socket.
+type dnsInjector struct {
+	// pconn is the loopback UDP socket.
+	pconn *net.UDPConn
+}
+
+// newDNSInjector creates a new dnsInjector.
+func newDNSInjector() (*dnsInjector, error) {
+	pconn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		return nil, err
+	}
+	return &dnsInjector{pconn: pconn}, nil
+}
+
+// address returns the address of the injector.
+func (di *dnsInjector) address() string {
+	return di.pconn.LocalAddr().String()
+}
+
+// inject sends the given reply to the given destination.
+func (di *dnsInjector) inject(reply []byte, dest *net.UDPAddr) error {
+	_, err := di.pconn.WriteTo(reply, dest)
+	return err
+}
+
+// Close closes the injector.
+func (di *dnsInjector) Close() error {
+	return di.pconn.Close()
+}
@@ -0,0 +1,70 @@
+package collector
+
+//
+// API
+//
+// Messages exchanged with the collector.
+//
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+)
+
+const (
+	// DataFormatVersion is the data format version we use.
+	DataFormatVersion = "0.2.0"
+
+	// FormatJSON is the only format we support for measurements.
+	FormatJSON = "json"
+)
+
+// OpenReportRequest is the request to open a report.
+type OpenReportRequest struct {
+	DataFormatVersion string `json:"data_format_version"`
+	Format            string `json:"format"`
+	ProbeASN          string `json:"probe_asn"`
+	ProbeCC           string `json:"probe_cc"`
+	SoftwareName      string `json:"software_name"`
+	SoftwareVersion   string `json:"software_version"`
+	TestName          string `json:"test_name"`
+	TestStartTime     string `json:"test_start_time"`
+	TestVersion       string `json:"test_version"`
+}
+
+// OpenReportResponse is the response to an OpenReportRequest.
+type OpenReportResponse struct {
+	BackendVersion   string   `json:"backend_version"`
+	ReportID         string   `json:"report_id"`
+	SupportedFormats []string `json:"supported_formats"`
+}
+
+// UpdateReportRequest is the request to submit a measurement.
+type UpdateReportRequest struct {
+	Format  string          `json:"format"`
+	Content json.RawMessage `json:"content"`
+}
+
+// UpdateReportResponse is the response to an UpdateReportRequest.
+type UpdateReportResponse struct {
+	MeasurementUID string `json:"measurement_uid"`
+}
+
+// ErrHTTPStatus indicates that the collector returned a non-200 status.
+var ErrHTTPStatus = errors.New("collector: unexpected HTTP status")
+
+// HTTPStatusError wraps ErrHTTPStatus and contains the status code.
+type HTTPStatusError struct {
+	StatusCode int
+}
+
+// Error implements error.
+func (e *HTTPStatusError) Error() string {
+	return fmt.Sprintf("%s: %d", ErrHTTPStatus.Error(), e.StatusCode)
+}
+
+// Unwrap allows to use errors.Is with ErrHTTPStatus.
+func (e *HTTPStatusError) Unwrap() error {
+	return ErrHTTPStatus
+}
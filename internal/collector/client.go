@@ -0,0 +1,99 @@
+package collector
+
+//
+// Client
+//
+// Client for the collector API.
+//
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/bassosimone/websteps-illustrated/internal/engine/httpheader"
+	"github.com/bassosimone/websteps-illustrated/internal/model"
+	"github.com/bassosimone/websteps-illustrated/internal/netxlite"
+)
+
+// maxResponseBodySize is the maximum response body size we accept.
+const maxResponseBodySize = 1 << 20
+
+// Client is a client for the collector API. The zero value is
+// invalid; please, use NewClient to construct.
+type Client struct {
+	// BaseURL is the collector base URL (e.g., "https://api.ooni.io").
+	BaseURL string
+
+	// HTTPClient is the HTTP client to use.
+	HTTPClient model.HTTPClient
+
+	// UserAgent is the User-Agent header to use.
+	UserAgent string
+}
+
+// NewClient creates a new Client for the collector at the given base URL.
+func NewClient(baseURL string) *Client {
+	return &Client{
+		BaseURL:    strings.TrimSuffix(baseURL, "/"),
+		HTTPClient: netxlite.NewHTTPClientStdlib(model.DiscardLogger),
+		UserAgent:  httpheader.UserAgent(),
+	}
+}
+
+// OpenReport opens a new report.
+func (c *Client) OpenReport(
+	ctx context.Context, req *OpenReportRequest) (*OpenReportResponse, error) {
+	var resp OpenReportResponse
+	if err := c.postJSON(ctx, "/report", req, &resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+// UpdateReport submits the given serialized measurement as part of the
+// report with the given ID. The measurement's report_id must be reportID.
+func (c *Client) UpdateReport(ctx context.Context,
+	reportID string, content []byte) (*UpdateReportResponse, error) {
+	req := &UpdateReportRequest{
+		Format:  FormatJSON,
+		Content: content,
+	}
+	var resp UpdateReportResponse
+	if err := c.postJSON(ctx, "/report/"+reportID, req, &resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+// postJSON sends a JSON request to the given path and reads the JSON response.
+func (c *Client) postJSON(ctx context.Context, path string, in, out interface{}) error {
+	data, err := json.Marshal(in)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(
+		ctx, "POST", c.BaseURL+path, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", c.UserAgent)
+	resp, err := c.HTTPClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return &HTTPStatusError{StatusCode: resp.StatusCode}
+	}
+	reader := io.LimitReader(resp.Body, maxResponseBodySize)
+	data, err = netxlite.ReadAllContext(ctx, reader)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, out)
+}
@@ -0,0 +1,9 @@
+// Package collector submits measurements to an OONI-compatible collector.
+//
+// We implement the subset of the OONI collector API we need: opening
+// a report with `POST /report` and submitting a measurement with
+// `POST /report/{report_id}`. The Submitter adds an on-disk queue and
+// retries on top of the Client, so measurements we could not submit
+// survive until the next run. The Server is a tiny stand-in collector
+// that you can use for testing on the local host.
+package collector
@@ -0,0 +1,152 @@
+package collector
+
+//
+// Measurement
+//
+// Code to wrap test keys into a full OONI measurement.
+//
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"time"
+
+	"github.com/bassosimone/websteps-illustrated/internal/engine/geolocate"
+	"github.com/bassosimone/websteps-illustrated/internal/model"
+)
+
+// TimeFormat is the format of times in OONI measurements.
+const TimeFormat = "2006-01-02 15:04:05"
+
+// MeasurementTemplate contains the fields that are common to all
+// the measurements collected during a run of a given experiment.
+type MeasurementTemplate struct {
+	// Annotations contains optional annotations.
+	Annotations map[string]string
+
+	// ProbeASN is the probe ASN (e.g., "AS30722").
+	ProbeASN string
+
+	// ProbeCC is the probe country code (e.g., "IT").
+	ProbeCC string
+
+	// ProbeNetworkName is the name of the probe network.
+	ProbeNetworkName string
+
+	// ResolverASN is the resolver ASN (e.g., "AS15169").
+	ResolverASN string
+
+	// ResolverIP is the resolver IP address.
+	ResolverIP string
+
+	// ResolverNetworkName is the name of the resolver network.
+	ResolverNetworkName string
+
+	// SoftwareName is the name of the software.
+	SoftwareName string
+
+	// SoftwareVersion is the version of the software.
+	SoftwareVersion string
+
+	// TestHelpers contains the test helpers we're using.
+	TestHelpers map[string]interface{}
+
+	// TestName is the name of the experiment.
+	TestName string
+
+	// TestStartTime is when we started running the experiment.
+	TestStartTime time.Time
+
+	// TestVersion is the version of the experiment.
+	TestVersion string
+}
+
+// NewMeasurementTemplate creates a new MeasurementTemplate for the given
+// software and experiment that uses default (unknown) probe information.
+func NewMeasurementTemplate(softwareName, softwareVersion,
+	testName, testVersion string) *MeasurementTemplate {
+	return &MeasurementTemplate{
+		Annotations:         map[string]string{},
+		ProbeASN:            FormatASN(geolocate.DefaultProbeASN),
+		ProbeCC:             geolocate.DefaultProbeCC,
+		ProbeNetworkName:    geolocate.DefaultProbeNetworkName,
+		ResolverASN:         FormatASN(geolocate.DefaultResolverASN),
+		ResolverIP:          geolocate.DefaultResolverIP,
+		ResolverNetworkName: geolocate.DefaultResolverNetworkName,
+		SoftwareName:        softwareName,
+		SoftwareVersion:     softwareVersion,
+		TestHelpers:         map[string]interface{}{},
+		TestName:            testName,
+		TestStartTime:       time.Now(),
+		TestVersion:         testVersion,
+	}
+}
+
+// FormatASN formats an ASN number using the AS%d format.
+func FormatASN(asn uint) string {
+	return fmt.Sprintf("AS%d", asn)
+}
+
+// NewMeasurement creates a new measurement for the given input and
+// test keys, which started at the given time and lasted runtime. The
+// returned measurement has an empty report ID, which the Submitter
+// fills when it is submitting the measurement.
+func (mt *MeasurementTemplate) NewMeasurement(input string,
+	testKeys interface{}, started time.Time, runtime time.Duration) *model.Measurement {
+	m := &model.Measurement{
+		Annotations:               map[string]string{},
+		DataFormatVersion:         DataFormatVersion,
+		Extensions:                nil,
+		ID:                        "",
+		Input:                     model.MeasurementTarget(input),
+		InputHashes:               nil,
+		MeasurementStartTime:      started.UTC().Format(TimeFormat),
+		MeasurementStartTimeSaved: started,
+		Options:                   nil,
+		ProbeASN:                  mt.ProbeASN,
+		ProbeCC:                   mt.ProbeCC,
+		ProbeCity:                 "",
+		ProbeIP:                   model.DefaultProbeIP,
+		ProbeNetworkName:          mt.ProbeNetworkName,
+		ReportID:                  "",
+		ResolverASN:               mt.ResolverASN,
+		ResolverIP:                mt.ResolverIP,
+		ResolverNetworkName:       mt.ResolverNetworkName,
+		SoftwareName:              mt.SoftwareName,
+		SoftwareVersion:           mt.SoftwareVersion,
+		TestHelpers:               mt.TestHelpers,
+		TestKeys:                  testKeys,
+		TestName:                  mt.TestName,
+		MeasurementRuntime:        runtime.Seconds(),
+		TestStartTime:             mt.TestStartTime.UTC().Format(TimeFormat),
+		TestVersion:               mt.TestVersion,
+	}
+	if input != "" {
+		m.InputHashes = []string{InputHash(input)}
+	}
+	m.AddAnnotations(mt.Annotations)
+	return m
+}
+
+// InputHash returns the SHA256 of the given input in hex.
+func InputHash(input string) string {
+	sum := sha256.Sum256([]byte(input))
+	return hex.EncodeToString(sum[:])
+}
+
+// newOpenReportRequest creates the request to open a report
+// that can contain the given measurement.
+func newOpenReportRequest(m *model.Measurement) *OpenReportRequest {
+	return &OpenReportRequest{
+		DataFormatVersion: DataFormatVersion,
+		Format:            FormatJSON,
+		ProbeASN:          m.ProbeASN,
+		ProbeCC:           m.ProbeCC,
+		SoftwareName:      m.SoftwareName,
+		SoftwareVersion:   m.SoftwareVersion,
+		TestName:          m.TestName,
+		TestStartTime:     m.TestStartTime,
+		TestVersion:       m.TestVersion,
+	}
+}
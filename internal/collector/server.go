@@ -0,0 +1,193 @@
+package collector
+
+//
+// Server
+//
+// A tiny stand-in collector for testing.
+//
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bassosimone/websteps-illustrated/internal/logcat"
+	"github.com/bassosimone/websteps-illustrated/internal/netxlite"
+)
+
+// maxRequestBodySize is the maximum request body size the Server accepts.
+const maxRequestBodySize = 1 << 24
+
+// Server is a tiny stand-in OONI collector. It implements opening a report
+// and submitting measurements, checks that submitted measurements are
+// consistent with their report, and writes them to Output as JSONL.
+//
+// The zero value is invalid; please, use NewServer to construct.
+type Server struct {
+	// Output is where we write the measurements we accept. A nil
+	// value means that we only keep the measurements in memory.
+	Output io.Writer
+
+	// measurements contains the measurements we accepted.
+	measurements []json.RawMessage
+
+	// mu provides mutual exclusion.
+	mu sync.Mutex
+
+	// reports maps a report ID to the corresponding report.
+	reports map[string]*OpenReportRequest
+
+	// seq is used to generate unique IDs.
+	seq int64
+}
+
+// NewServer creates a new Server writing measurements to output.
+func NewServer(output io.Writer) *Server {
+	return &Server{
+		Output:       output,
+		measurements: []json.RawMessage{},
+		mu:           sync.Mutex{},
+		reports:      map[string]*OpenReportRequest{},
+		seq:          0,
+	}
+}
+
+// Measurements returns the measurements we accepted so far.
+func (s *Server) Measurements() []json.RawMessage {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]json.RawMessage{}, s.measurements...)
+}
+
+// ServeHTTP implements http.Handler.
+func (s *Server) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.Method != "POST" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	reader := io.LimitReader(req.Body, maxRequestBodySize)
+	data, err := netxlite.ReadAllContext(req.Context(), reader)
+	if err != nil {
+		logcat.Shrugf("[collectord] cannot read request body: %s", err.Error())
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	var (
+		out    interface{}
+		status int
+	)
+	switch path := strings.TrimSuffix(req.URL.Path, "/"); {
+	case path == "/report":
+		out, status = s.openReport(data)
+	case strings.HasPrefix(path, "/report/") && strings.HasSuffix(path, "/close"):
+		out, status = s.closeReport(strings.TrimSuffix(strings.TrimPrefix(path, "/report/"), "/close"))
+	case strings.HasPrefix(path, "/report/"):
+		out, status = s.updateReport(strings.TrimPrefix(path, "/report/"), data)
+	default:
+		out, status = nil, http.StatusNotFound
+	}
+	if status != http.StatusOK {
+		w.WriteHeader(status)
+		return
+	}
+	data, err = json.Marshal(out)
+	if err != nil {
+		logcat.Bugf("[collectord] cannot marshal response: %s", err.Error())
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(data)
+}
+
+// openReport implements POST /report.
+func (s *Server) openReport(data []byte) (interface{}, int) {
+	var req OpenReportRequest
+	if err := json.Unmarshal(data, &req); err != nil {
+		logcat.Shrugf("[collectord] cannot unmarshal open request: %s", err.Error())
+		return nil, http.StatusBadRequest
+	}
+	if req.Format != FormatJSON || req.TestName == "" || req.ProbeASN == "" || req.ProbeCC == "" {
+		logcat.Shrugf("[collectord] invalid open request: %+v", req)
+		return nil, http.StatusBadRequest
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.seq++
+	reportID := fmt.Sprintf("%s_%s_%s_n0_%d", time.Now().UTC().Format("20060102T150405Z"),
+		req.TestName, req.ProbeCC, s.seq)
+	s.reports[reportID] = &req
+	logcat.Infof("[collectord] opened report %s", reportID)
+	return &OpenReportResponse{
+		BackendVersion:   "collectord",
+		ReportID:         reportID,
+		SupportedFormats: []string{FormatJSON},
+	}, http.StatusOK
+}
+
+// serverMeasurementMetadata contains the measurement fields we check.
+type serverMeasurementMetadata struct {
+	ProbeASN        string `json:"probe_asn"`
+	ProbeCC         string `json:"probe_cc"`
+	ReportID        string `json:"report_id"`
+	SoftwareName    string `json:"software_name"`
+	SoftwareVersion string `json:"software_version"`
+	TestName        string `json:"test_name"`
+	TestVersion     string `json:"test_version"`
+}
+
+// updateReport implements POST /report/{report_id}.
+func (s *Server) updateReport(reportID string, data []byte) (interface{}, int) {
+	var req UpdateReportRequest
+	if err := json.Unmarshal(data, &req); err != nil {
+		logcat.Shrugf("[collectord] cannot unmarshal update request: %s", err.Error())
+		return nil, http.StatusBadRequest
+	}
+	var meta serverMeasurementMetadata
+	if err := json.Unmarshal(req.Content, &meta); err != nil || req.Format != FormatJSON {
+		logcat.Shrugf("[collectord] invalid measurement for %s", reportID)
+		return nil, http.StatusBadRequest
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	report := s.reports[reportID]
+	if report == nil {
+		logcat.Shrugf("[collectord] no such report: %s", reportID)
+		return nil, http.StatusNotFound
+	}
+	if meta.ReportID != reportID || meta.ProbeASN != report.ProbeASN ||
+		meta.ProbeCC != report.ProbeCC || meta.SoftwareName != report.SoftwareName ||
+		meta.SoftwareVersion != report.SoftwareVersion || meta.TestName != report.TestName ||
+		meta.TestVersion != report.TestVersion {
+		logcat.Shrugf("[collectord] measurement inconsistent with %s: %+v", reportID, meta)
+		return nil, http.StatusBadRequest
+	}
+	if s.Output != nil {
+		line := append(append([]byte{}, req.Content...), '\n')
+		if _, err := s.Output.Write(line); err != nil {
+			logcat.Warnf("[collectord] cannot write measurement: %s", err.Error())
+			return nil, http.StatusInternalServerError
+		}
+	}
+	s.measurements = append(s.measurements, req.Content)
+	s.seq++
+	uid := fmt.Sprintf("%s_%d", time.Now().UTC().Format("20060102150405.000000"), s.seq)
+	logcat.Infof("[collectord] report %s: accepted measurement %s", reportID, uid)
+	return &UpdateReportResponse{MeasurementUID: uid}, http.StatusOK
+}
+
+// closeReport implements POST /report/{report_id}/close.
+func (s *Server) closeReport(reportID string) (interface{}, int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.reports[reportID] == nil {
+		return nil, http.StatusNotFound
+	}
+	delete(s.reports, reportID)
+	logcat.Infof("[collectord] closed report %s", reportID)
+	return map[string]interface{}{}, http.StatusOK
+}
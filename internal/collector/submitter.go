@@ -0,0 +1,267 @@
+package collector
+
+//
+// Submitter
+//
+// Queues measurements on disk and submits them with retries.
+//
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bassosimone/websteps-illustrated/internal/atomicx"
+	"github.com/bassosimone/websteps-illustrated/internal/logcat"
+	"github.com/bassosimone/websteps-illustrated/internal/model"
+)
+
+const (
+	// DefaultMaxRetries is the default Submitter.MaxRetries value.
+	DefaultMaxRetries = 3
+
+	// DefaultRetryDelay is the default Submitter.RetryDelay value.
+	DefaultRetryDelay = 2 * time.Second
+)
+
+// Submitter submits measurements to a collector. Every measurement is
+// first written into an on-disk queue and only removed from the queue
+// after the collector has accepted it. Measurements that we cannot
+// submit stay in the queue and we retry them on the next Flush, which
+// may also happen during a subsequent run. The collector rejecting a
+// measurement (i.e., a 4xx status other than 404) is permanent: in
+// such a case, we rename the queue file using the ".rejected" suffix.
+//
+// The zero value is invalid; please, use NewSubmitter to construct.
+type Submitter struct {
+	// Client is the collector client.
+	Client *Client
+
+	// MaxRetries is the maximum number of times we retry each
+	// operation with the collector before giving up.
+	MaxRetries int
+
+	// QueueDir is the directory containing the queue.
+	QueueDir string
+
+	// RetryDelay is the delay before the first retry. We double
+	// the delay before each subsequent retry.
+	RetryDelay time.Duration
+
+	// mu ensures there's a single Flush at a time.
+	mu sync.Mutex
+
+	// reports maps the key of an open report to its ID.
+	reports map[string]string
+
+	// seq is used to generate unique queue file names.
+	seq *atomicx.Int64
+}
+
+// NewSubmitter creates a new Submitter for the given client using the
+// given queue dir, which we create if it does not already exist.
+func NewSubmitter(client *Client, queueDir string) (*Submitter, error) {
+	if err := os.MkdirAll(queueDir, 0700); err != nil {
+		return nil, err
+	}
+	return &Submitter{
+		Client:     client,
+		MaxRetries: DefaultMaxRetries,
+		QueueDir:   queueDir,
+		RetryDelay: DefaultRetryDelay,
+		mu:         sync.Mutex{},
+		reports:    map[string]string{},
+		seq:        atomicx.NewInt64(0),
+	}, nil
+}
+
+// Submit adds the given measurement to the queue and then flushes the
+// queue. A non-nil error means that the measurement is still queued, or
+// rejected, or we could not queue it.
+func (s *Submitter) Submit(ctx context.Context, m *model.Measurement) error {
+	if err := s.Enqueue(m); err != nil {
+		return err
+	}
+	return s.Flush(ctx)
+}
+
+// Enqueue adds the given measurement to the on-disk queue.
+func (s *Submitter) Enqueue(m *model.Measurement) error {
+	data, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	seq := s.seq.Add(1)
+	name := fmt.Sprintf("%020d-%06d", time.Now().UnixNano(), seq)
+	filename := filepath.Join(s.QueueDir, name+".json")
+	tempname := filepath.Join(s.QueueDir, name+".tmp")
+	// Write and rename to ensure that we never submit a partial file.
+	if err := os.WriteFile(tempname, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tempname, filename)
+}
+
+// Pending returns the names of the queued files in submission order.
+func (s *Submitter) Pending() ([]string, error) {
+	entries, err := os.ReadDir(s.QueueDir)
+	if err != nil {
+		return nil, err
+	}
+	var out []string
+	for _, entry := range entries {
+		if entry.Type().IsRegular() && strings.HasSuffix(entry.Name(), ".json") {
+			out = append(out, entry.Name())
+		}
+	}
+	sort.Strings(out)
+	return out, nil
+}
+
+// Flush submits all the queued measurements in order. We stop at the first
+// measurement we cannot submit because, in such a case, the collector (or
+// the network) is most likely not working. Measurements rejected by the
+// collector do not stop the flush but we return ErrRejected at the end.
+func (s *Submitter) Flush(ctx context.Context) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	names, err := s.Pending()
+	if err != nil {
+		return err
+	}
+	var rejected int
+	for _, name := range names {
+		filename := filepath.Join(s.QueueDir, name)
+		err := s.submitFile(ctx, filename)
+		switch {
+		case err == nil:
+			if err := os.Remove(filename); err != nil {
+				return err
+			}
+		case isRejected(err):
+			logcat.Shrugf("[collector] %s rejected: %s", name, err.Error())
+			if err := os.Rename(filename, filename+".rejected"); err != nil {
+				return err
+			}
+			rejected++
+		default:
+			logcat.Shrugf("[collector] cannot submit %s: %s", name, err.Error())
+			return err
+		}
+	}
+	if rejected > 0 {
+		return ErrRejected
+	}
+	return nil
+}
+
+// ErrRejected indicates that the collector rejected some measurements.
+var ErrRejected = errors.New("collector: rejected some measurements")
+
+// submitFile submits the measurement inside the given queue file.
+func (s *Submitter) submitFile(ctx context.Context, filename string) error {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return err
+	}
+	var m model.Measurement
+	if err := json.Unmarshal(data, &m); err != nil {
+		// A corrupt file is like a measurement rejected by the collector.
+		return &HTTPStatusError{StatusCode: 400}
+	}
+	return s.retry(ctx, func() error {
+		reportID, err := s.openReport(ctx, &m)
+		if err != nil {
+			return err
+		}
+		m.ReportID = reportID
+		content, err := json.Marshal(&m)
+		if err != nil {
+			return err
+		}
+		resp, err := s.Client.UpdateReport(ctx, reportID, content)
+		var statusErr *HTTPStatusError
+		if errors.As(err, &statusErr) && statusErr.StatusCode == 404 {
+			// The report does not exist anymore (e.g., it has expired),
+			// so we need to open a new report in the next attempt.
+			delete(s.reports, s.reportKey(&m))
+		}
+		if err != nil {
+			return err
+		}
+		logcat.Infof("[collector] submitted %s as %s", m.Input, resp.MeasurementUID)
+		return nil
+	})
+}
+
+// openReport returns the ID of an open report compatible with the
+// given measurement, opening a new report if needed.
+func (s *Submitter) openReport(ctx context.Context, m *model.Measurement) (string, error) {
+	key := s.reportKey(m)
+	if reportID := s.reports[key]; reportID != "" {
+		return reportID, nil
+	}
+	resp, err := s.Client.OpenReport(ctx, newOpenReportRequest(m))
+	if err != nil {
+		return "", err
+	}
+	if resp.ReportID == "" {
+		return "", ErrMissingReportID
+	}
+	logcat.Infof("[collector] opened report %s", resp.ReportID)
+	s.reports[key] = resp.ReportID
+	return resp.ReportID, nil
+}
+
+// ErrMissingReportID indicates that the collector did not return a report ID.
+var ErrMissingReportID = errors.New("collector: missing report ID")
+
+// reportKey returns the key identifying the report that can contain the
+// given measurement. The collector expects all the measurements in a report
+// to have the same metadata used when opening the report.
+func (s *Submitter) reportKey(m *model.Measurement) string {
+	data, _ := json.Marshal(newOpenReportRequest(m))
+	return string(data)
+}
+
+// isRejected returns whether the error indicates that the collector has
+// rejected the request (i.e., a 4xx status other than 404), in which case
+// retrying is pointless. A 404 means that the report does not exist.
+func isRejected(err error) bool {
+	var statusErr *HTTPStatusError
+	return errors.As(err, &statusErr) && statusErr.StatusCode >= 400 &&
+		statusErr.StatusCode < 500 && statusErr.StatusCode != 404
+}
+
+// retry calls fx until it succeeds, we run out of retries, or
+// the collector rejects the request (see isRejected).
+func (s *Submitter) retry(ctx context.Context, fx func() error) (err error) {
+	delay := s.RetryDelay
+	for attempt := 0; ; attempt++ {
+		if err = fx(); err == nil {
+			return nil
+		}
+		if isRejected(err) {
+			return err
+		}
+		if attempt >= s.MaxRetries {
+			return err
+		}
+		logcat.Shrugf("[collector] %s; retrying in %s", err.Error(), delay)
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		case <-timer.C:
+		}
+		delay *= 2
+	}
+}
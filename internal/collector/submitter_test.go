@@ -0,0 +1,149 @@
+package collector
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/bassosimone/websteps-illustrated/internal/model"
+)
+
+// newSubmitterTestMeasurement creates a measurement for the given input.
+func newSubmitterTestMeasurement(input string) *model.Measurement {
+	mt := NewMeasurementTemplate("miniooni", "0.1.0", "websteps", "0.1.0")
+	return mt.NewMeasurement(input, map[string]interface{}{}, time.Now(), time.Second)
+}
+
+// newSubmitterForTesting creates a Submitter using the given server and a
+// temporary queue directory and retrying without waiting.
+func newSubmitterForTesting(t *testing.T, URL string) *Submitter {
+	submitter, err := NewSubmitter(NewClient(URL), t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	submitter.MaxRetries = 1
+	submitter.RetryDelay = time.Millisecond
+	return submitter
+}
+
+// submitterTestPending returns the number of pending measurements.
+func submitterTestPending(t *testing.T, submitter *Submitter) int {
+	names, err := submitter.Pending()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return len(names)
+}
+
+func TestSubmitterWithServer(t *testing.T) {
+	server := NewServer(nil)
+	srvr := httptest.NewServer(server)
+	defer srvr.Close()
+	submitter := newSubmitterForTesting(t, srvr.URL)
+	ctx := context.Background()
+	for _, input := range []string{"https://example.com/", "https://example.org/"} {
+		if err := submitter.Submit(ctx, newSubmitterTestMeasurement(input)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := submitterTestPending(t, submitter); n != 0 {
+		t.Fatal("expected an empty queue, got", n)
+	}
+	measurements := server.Measurements()
+	if len(measurements) != 2 {
+		t.Fatal("expected two measurements, got", len(measurements))
+	}
+	var reportIDs []string
+	for _, data := range measurements {
+		var m model.Measurement
+		if err := json.Unmarshal(data, &m); err != nil {
+			t.Fatal(err)
+		}
+		reportIDs = append(reportIDs, m.ReportID)
+	}
+	if reportIDs[0] == "" || reportIDs[0] != reportIDs[1] {
+		t.Fatal("expected the same report for both measurements", reportIDs)
+	}
+}
+
+func TestSubmitterReopensClosedReport(t *testing.T) {
+	server := NewServer(nil)
+	srvr := httptest.NewServer(server)
+	defer srvr.Close()
+	submitter := newSubmitterForTesting(t, srvr.URL)
+	ctx := context.Background()
+	if err := submitter.Submit(ctx, newSubmitterTestMeasurement("https://example.com/")); err != nil {
+		t.Fatal(err)
+	}
+	for _, reportID := range submitter.reports {
+		resp, err := http.Post(srvr.URL+"/report/"+reportID+"/close", "application/json", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+	}
+	if err := submitter.Submit(ctx, newSubmitterTestMeasurement("https://example.org/")); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(server.Measurements()); n != 2 {
+		t.Fatal("expected two measurements, got", n)
+	}
+}
+
+func TestSubmitterRejectedMeasurement(t *testing.T) {
+	server := NewServer(nil)
+	srvr := httptest.NewServer(server)
+	defer srvr.Close()
+	submitter := newSubmitterForTesting(t, srvr.URL)
+	m := newSubmitterTestMeasurement("https://example.com/")
+	m.ProbeCC = "" // the server refuses to open such a report
+	if err := submitter.Submit(context.Background(), m); !errors.Is(err, ErrRejected) {
+		t.Fatal("unexpected error", err)
+	}
+	if n := submitterTestPending(t, submitter); n != 0 {
+		t.Fatal("expected an empty queue, got", n)
+	}
+	rejected, err := filepath.Glob(filepath.Join(submitter.QueueDir, "*.rejected"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rejected) != 1 {
+		t.Fatal("expected a rejected measurement, got", rejected)
+	}
+}
+
+func TestSubmitterKeepsQueueWhenCollectorIsDown(t *testing.T) {
+	server := NewServer(nil)
+	srvr := httptest.NewServer(server)
+	URL := srvr.URL
+	srvr.Close() // the collector is now down
+	submitter := newSubmitterForTesting(t, URL)
+	ctx := context.Background()
+	if err := submitter.Submit(ctx, newSubmitterTestMeasurement("https://example.com/")); err == nil {
+		t.Fatal("expected an error")
+	}
+	if n := submitterTestPending(t, submitter); n != 1 {
+		t.Fatal("expected a queued measurement, got", n)
+	}
+	// Simulate a subsequent run that uses a working collector.
+	srvr = httptest.NewServer(server)
+	defer srvr.Close()
+	other, err := NewSubmitter(NewClient(srvr.URL), submitter.QueueDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := other.Flush(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(server.Measurements()); n != 1 {
+		t.Fatal("expected one measurement, got", n)
+	}
+	if n := submitterTestPending(t, other); n != 0 {
+		t.Fatal("expected an empty queue, got", n)
+	}
+}
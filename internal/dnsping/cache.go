@@ -2,7 +2,6 @@ package dnsping
 
 import (
 	"encoding/json"
-	"path"
 	"time"
 
 	"github.com/bassosimone/websteps-illustrated/internal/caching"
@@ -22,15 +21,15 @@ type Cache struct {
 	DisableNetwork bool
 
 	// DNSPing is a reference to the underlying cache.
-	DNSPing *caching.FSCache
+	DNSPing caching.Store
 }
 
-// NewCache creates a new cache inside the given directory.
+// NewCache creates a new cache inside the given directory or, when
+// caching.IsDBPath(dirpath) is true, inside the given DB file.
 func NewCache(dirpath string) *Cache {
-	p := path.Join(dirpath, "dnsping")
 	return &Cache{
 		DisableNetwork: false,
-		DNSPing:        caching.NewFSCache(p),
+		DNSPing:        caching.NewStore(dirpath, "dnsping"),
 	}
 }
 
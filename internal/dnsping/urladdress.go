@@ -54,10 +54,12 @@ func (spr *SinglePingResult) DNSLookupMeasurementList(
 				Addresses:       entry.Addresses,
 				CNAME:           "",
 				Domain:          spr.Domain,
+				ECHConfigList:   nil,
 				Failure:         entry.Error,
 				Finished:        entry.Finished,
 				LookupType:      spr.lookupType(),
 				NS:              []string{},
+				Port:            0,
 				ResolverAddress: "dnsping",
 				ResolverNetwork: "",
 				Started:         spr.Started,
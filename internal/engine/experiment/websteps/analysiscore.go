@@ -25,6 +25,9 @@ type Analysis struct {
 
 	// TH contains the TH results analysis.
 	TH []*AnalysisEndpoint `json:"th"`
+
+	// SNI contains the SNI follow-up results analysis.
+	SNI []*AnalysisEndpoint `json:"sni"`
 }
 
 // We represent analysis results using an int64 bitmask. We define
@@ -39,7 +42,9 @@ type Analysis struct {
 //     32  36   40   44   48   52   56   60   64
 //
 // The failure flags indicate censorship conditions we detected. The
-// HTTP flags provide further details regarding #httpDiff like results.
+// HTTP flags provide further details regarding #httpDiff like results. The
+// SNI and IP blocking flags provide further details regarding #tlsReset,
+// #tlsTimeout, and #tlsEOF results (see snifollowup.go).
 //
 // All the other flags are reserved for future. Consumers of the data
 // format should completely ignore all the reserved flags.
@@ -65,6 +70,9 @@ const (
 	AnalysisHTTPTimeout = 1 << 15
 	AnalysisHTTPReset   = 1 << 16
 	AnalysisHTTPEOF     = 1 << 17
+	AnalysisThrottling  = 1 << 18
+	AnalysisBlockpage   = 1 << 19
+	AnalysisDNSInjected = 1 << 20
 
 	//
 	// Reserved
@@ -77,8 +85,31 @@ const (
 	AnalysisHTTPDiffBodyLength         = 1 << 37
 	AnalysisHTTPDiffLegitimateRedirect = 1 << 38
 	AnalysisHTTPDiffTransparentProxy   = 1 << 39
+	AnalysisSNIBlocking                = 1 << 40
+	AnalysisIPBlocking                 = 1 << 41
 )
 
+// analysisIDGenerator generates the IDs of the analysis results. We use
+// a measurex.AbstractMeasurer when measuring, so analysis results share
+// the same IDs space with measurements.
+type analysisIDGenerator interface {
+	NextID() int64
+}
+
+// analyze runs all the analysis algorithms using the given rules and
+// blockpage DB, saves their results into ssm.Analysis, and updates ssm.Flags.
+func (ssm *SingleStepMeasurement) analyze(idgen analysisIDGenerator,
+	rules *AnalysisRuleset, blockpages *BlockpageDB) {
+	ssm.Analysis = &Analysis{
+		DNS:      ssm.dnsAnalysis(idgen, rules),
+		Endpoint: ssm.endpointAnalysis(idgen, rules, blockpages),
+		TH:       ssm.analyzeTHResults(idgen),
+		SNI:      ssm.sniFollowUpAnalysis(idgen),
+	}
+	ssm.tracerouteAnalysis()
+	ssm.Flags = ssm.aggregateFlags()
+}
+
 // AnalysisFlagsContainAnomalies returns true if the flags contain
 // an anomaly and false otherwise.
 func AnalysisFlagsContainAnomalies(f int64) bool {
@@ -98,6 +129,9 @@ func (ssm *SingleStepMeasurement) aggregateFlags() (flags int64) {
 		for _, score := range ssm.Analysis.TH {
 			flags |= score.Flags
 		}
+		for _, score := range ssm.Analysis.SNI {
+			flags |= score.Flags
+		}
 	}
 	return
 }
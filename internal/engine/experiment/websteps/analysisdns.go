@@ -45,7 +45,8 @@ func (ad *AnalysisDNS) Describe() string {
 //
 // The return value is a list of analysis statements, one for each comparison. This
 // function returns nil when there's no DNS lookup data to analyze.
-func (ssm *SingleStepMeasurement) dnsAnalysis(mx measurex.AbstractMeasurer) (out []*AnalysisDNS) {
+func (ssm *SingleStepMeasurement) dnsAnalysis(
+	mx analysisIDGenerator, rules *AnalysisRuleset) (out []*AnalysisDNS) {
 	logcat.Substep("analyzing DNS measurements results")
 	if ssm.ProbeInitial == nil {
 		logcat.Bug("dnsAnalysis passed ssm with nil ProbeInitial")
@@ -75,7 +76,11 @@ func (ssm *SingleStepMeasurement) dnsAnalysis(mx measurex.AbstractMeasurer) (out
 	// 4. pit each probe lookup against the TH lookups.
 	for _, d := range ssm.ProbeInitial.DNS {
 		logcat.Inspectf("inspecting %s", d.Describe())
-		out = append(out, analyzeSingleDNSLookup(mx, d, thDNS, pings, endpoints...))
+		score := analyzeSingleDNSLookup(mx, rules, d, thDNS, pings, endpoints...)
+		flags, refs := analysisDNSInjection(score.ID, rules.DNSInjection, d, pings)
+		score.Flags |= flags
+		score.Refs = append(score.Refs, refs...)
+		out = append(out, score)
 	}
 
 	// 8. zap unflagged results and return
@@ -95,10 +100,12 @@ func dnsAnalysisRemoveUnflaggedResults(in []*AnalysisDNS) (out []*AnalysisDNS) {
 
 // analyzeSingleDNSLookup takes in input a given DNS lookup measurement and returns a score
 // for such a measurement by comparing it to other lookup measurements. This function uses the
-// given abstract measurer to assign an ID to the returned score. This function also uses a
+// given ID generator to assign an ID to the returned score. This function also uses a
 // list of endpoint measurements to validate the IP addresses inside the lookup. This function
-// also uses the list of pings to cancel timeouts and perform cross checks.
-func analyzeSingleDNSLookup(mx measurex.AbstractMeasurer, lookup *measurex.DNSLookupMeasurement,
+// also uses the list of pings to cancel timeouts and perform cross checks. We use the
+// given rules to classify the failure when only the given lookup fails.
+func analyzeSingleDNSLookup(mx analysisIDGenerator, rules *AnalysisRuleset,
+	lookup *measurex.DNSLookupMeasurement,
 	otherLookups []*measurex.DNSLookupMeasurement, pings []*dnsping.SinglePingResult,
 	epnts ...[]*measurex.EndpointMeasurement) *AnalysisDNS {
 
@@ -156,8 +163,8 @@ func analyzeSingleDNSLookup(mx measurex.AbstractMeasurer, lookup *measurex.DNSLo
 	if lookup.Failure() == "" {
 		// Countries like Iran censor returning bogon addresses.
 		if dnsAnalysisBogonsCheck(lookup) {
-			// TODO(bassosimone): here we can double down on the bogon
-			// analysis by checking for injection in dnsping.
+			// Note that dnsAnalysis doubles down on the bogon analysis
+			// by checking for injection using dnsping.
 			logcat.Confirmedf(
 				"[#%d] #%d is confirmed anomaly because it contains a bogon", score.ID, lookup.ID)
 			score.Flags |= AnalysisBogon
@@ -214,34 +221,24 @@ func analyzeSingleDNSLookup(mx measurex.AbstractMeasurer, lookup *measurex.DNSLo
 
 	// Now there is the case where only the lookup we're examinging failed.
 	if failure := lookup.Failure(); failure != "" {
-		switch failure {
-		case netxlite.FailureDNSNXDOMAINError:
-			// TODO(bassosimone): here we can double down on the NXDOMAIN
-			// analysis by checking for injection in dnsping.
-			logcat.Confirmedf("[#%d] #%d succeeds and #%d fails with NXDOMAIN",
-				score.ID, peerLookup.ID, lookup.ID)
-			score.Flags |= AnalysisNXDOMAIN
-		case netxlite.FailureDNSRefusedError:
-			logcat.Confirmedf("[#%d] #%d succeeds and #%d fails with Refused",
-				score.ID, peerLookup.ID, lookup.ID)
-			score.Flags |= AnalysisDNSRefused
-		case netxlite.FailureGenericTimeoutError:
-			flags, pingID := dnsAnalysisDoubleCheckTimeout(score.ID, lookup, peerLookup, pings)
-			score.Flags |= flags
-			score.Refs = append(score.Refs, pingID...)
-		case netxlite.FailureDNSNoAnswer:
-			logcat.Confirmedf("[#%d] #%d succeeds and #%d fails with no_answer",
-				score.ID, peerLookup.ID, lookup.ID)
-			score.Flags |= AnalysisDNSNoAnswer
-		case netxlite.FailureDNSServfailError:
-			logcat.Confirmedf("[#%d] #%d succeeds and #%d fails with Servfail",
-				score.ID, peerLookup.ID, lookup.ID)
-			score.Flags |= AnalysisDNSServfail
-		default:
-			logcat.Infof(
-				"[#%d] #%d succeeds and #%d fails with %s (which is an umapped error)",
-				score.ID, peerLookup.ID, lookup.ID)
+		rule, found := rules.MatchDNS(lookup)
+		if !found {
+			logcat.Shrugf("[#%d] no rule matches #%d, which fails with %s",
+				score.ID, lookup.ID, failure)
 			score.Flags |= AnalysisInconclusive
+			return score
+		}
+		logcat.Infof("[#%d] #%d succeeds and #%d fails with %s: using rule %s",
+			score.ID, peerLookup.ID, lookup.ID, failure, rule.Describe())
+		flags := analysisRuleFlags(rule.Flags)
+		if rule.DNSPingCheck {
+			var pingID []int64
+			flags, pingID = dnsAnalysisDoubleCheckWithDNSPing(score.ID, lookup, peerLookup, pings, flags)
+			score.Refs = append(score.Refs, pingID...)
+		}
+		score.Flags |= flags
+		if score.Flags != 0 {
+			ExplainFlagsWithLogging(score, score.Flags)
 		}
 		return score
 	}
@@ -316,13 +313,14 @@ func dnsAnalysisFindMatchingLookup(
 	return nil, false
 }
 
-// dnsAnalysisDoubleCheckTimeout determines whether the timeout in lookup was
-// transient or further confirmed by dnsping. This function will also emit log messages
+// dnsAnalysisDoubleCheckWithDNSPing determines whether the failure in lookup was
+// transient or further confirmed by dnsping. It returns zero flags if the failure was
+// transient and the given flags otherwise. This function will also emit log messages
 // explaining our analysis, so the caller doesn't need to do that.
-func dnsAnalysisDoubleCheckTimeout(scoreID int64,
+func dnsAnalysisDoubleCheckWithDNSPing(scoreID int64,
 	lookup, peerLookup *measurex.DNSLookupMeasurement,
-	pings []*dnsping.SinglePingResult) (flags int64, pingID []int64) {
-	// Note that we can only cancel timeouts during UDP lookups
+	pings []*dnsping.SinglePingResult, flags int64) (int64, []int64) {
+	// Note that we can only cancel failures during UDP lookups
 	if lookup.ResolverNetwork() == archival.NetworkTypeUDP {
 		for _, ping := range pings {
 			const urlMeasurementID = 0 // does not matter
@@ -337,13 +335,14 @@ func dnsAnalysisDoubleCheckTimeout(scoreID int64,
 				if e.Failure() != "" {
 					continue
 				}
-				logcat.Celebratef("[#%d] #%d succeeds and #%d fails with timeout (but %d %s)",
-					scoreID, peerLookup.ID, lookup.ID, e.ID, "shows the timeout was transient")
+				logcat.Celebratef("[#%d] #%d succeeds and #%d fails with %s (but %d %s)",
+					scoreID, peerLookup.ID, lookup.ID, lookup.Failure(), e.ID,
+					"shows the failure was transient")
 				return 0, []int64{e.ID}
 			}
 		}
 	}
-	logcat.Unexpectedf("[#%d] #%d succeeds and #%d fails with timeout",
-		scoreID, peerLookup.ID, lookup.ID)
-	return AnalysisDNSTimeout, nil
+	logcat.Unexpectedf("[#%d] #%d succeeds and #%d fails with %s",
+		scoreID, peerLookup.ID, lookup.ID, lookup.Failure())
+	return flags, nil
 }
@@ -9,7 +9,6 @@ package websteps
 import (
 	"fmt"
 
-	"github.com/bassosimone/websteps-illustrated/internal/archival"
 	"github.com/bassosimone/websteps-illustrated/internal/logcat"
 	"github.com/bassosimone/websteps-illustrated/internal/measurex"
 	"github.com/bassosimone/websteps-illustrated/internal/netxlite"
@@ -28,6 +27,9 @@ type AnalysisEndpoint struct {
 
 	// Flags contains the analysis flags.
 	Flags int64 `json:"flags"`
+
+	// Blockpage is the ID of the matching blockpage fingerprint (if any).
+	Blockpage string `json:"blockpage,omitempty"`
 }
 
 // Describes this analysis.
@@ -37,23 +39,59 @@ func (ad *AnalysisEndpoint) Describe() string {
 
 // endpointAnalysis analyzes the probe's endpoint measurements. This function
 // returns nil when there's no endpoint data to analyze.
-func (ssm *SingleStepMeasurement) endpointAnalysis(mx measurex.AbstractMeasurer) (out []*AnalysisEndpoint) {
+func (ssm *SingleStepMeasurement) endpointAnalysis(mx analysisIDGenerator,
+	rules *AnalysisRuleset, blockpages *BlockpageDB) (out []*AnalysisEndpoint) {
 	logcat.Substep("analyzing endpoint measurements results")
 	if ssm.TH != nil {
-		if ssm.ProbeInitial != nil {
-			for _, pe := range ssm.ProbeInitial.Endpoint {
-				logcat.Inspectf("inspecting %s", pe.Describe())
-				out = append(out, analyzeSingleEndpointMeasurement(mx, pe, ssm.TH.Endpoint))
-			}
-		}
-		for _, pe := range ssm.ProbeAdditional {
+		probeEpnts := ssm.probeEndpoints()
+		for _, pe := range probeEpnts {
 			logcat.Inspectf("inspecting %s", pe.Describe())
-			out = append(out, analyzeSingleEndpointMeasurement(mx, pe, ssm.TH.Endpoint))
+			score, found := ssm.earlyEndpointAnalysis[pe.ID]
+			if !found {
+				score = analyzeSingleEndpointMeasurement(mx, rules, blockpages, pe, ssm.TH.Endpoint)
+			}
+			score.Flags |= analysisThrottling(score.ID, rules.Throttling, pe, probeEpnts, ssm.TH.Endpoint)
+			out = append(out, score)
 		}
 	}
 	return endpointAnalysisRemoveUnflaggedResults(out)
 }
 
+// probeEndpoints returns the initial and the additional probe's endpoints.
+func (ssm *SingleStepMeasurement) probeEndpoints() (out []*measurex.EndpointMeasurement) {
+	if ssm.ProbeInitial != nil {
+		out = append(out, ssm.ProbeInitial.Endpoint...)
+	}
+	out = append(out, ssm.ProbeAdditional...)
+	return
+}
+
+// earlyEndpointAnalysisStep analyzes the probe's endpoints that we can compare
+// with the TH results received so far while the TH is still streaming partial
+// results, and saves the results for endpointAnalysis. We only analyze endpoints
+// whose analysis does not depend on TH results we may not have received yet. A
+// successful HTTP endpoint may need the HTTP diff and redirect checks, which look
+// at all the TH's endpoints, so we leave it to endpointAnalysis. The throttling
+// check also looks at all the endpoints, so endpointAnalysis always runs it.
+func (ssm *SingleStepMeasurement) earlyEndpointAnalysisStep(mx analysisIDGenerator,
+	rules *AnalysisRuleset, blockpages *BlockpageDB) {
+	for _, pe := range ssm.probeEndpoints() {
+		if _, found := ssm.earlyEndpointAnalysis[pe.ID]; found {
+			continue // already analyzed
+		}
+		if pe.Failure == "" && pe.Scheme() != "https" {
+			continue // may need to look at all the TH's endpoints
+		}
+		if _, found := analysisEndpointFindMatchingMeasurement(
+			0, pe, ssm.TH.Endpoint, 0); !found {
+			continue // the TH has not measured this endpoint yet
+		}
+		logcat.Inspectf("inspecting %s while the TH is still running", pe.Describe())
+		ssm.earlyEndpointAnalysis[pe.ID] = analyzeSingleEndpointMeasurement(
+			mx, rules, blockpages, pe, ssm.TH.Endpoint)
+	}
+}
+
 // endpointAnalysisRemoveUnflaggedResults takes in input a set of analysis results and returns
 // in output another list without any result containing no flags.
 func endpointAnalysisRemoveUnflaggedResults(in []*AnalysisEndpoint) (out []*AnalysisEndpoint) {
@@ -65,9 +103,11 @@ func endpointAnalysisRemoveUnflaggedResults(in []*AnalysisEndpoint) (out []*Anal
 	return
 }
 
-// analyzeSingleEndpointMeasurement analyzes a single endpoint measurement.
-func analyzeSingleEndpointMeasurement(
-	mx measurex.AbstractMeasurer, epnt *measurex.EndpointMeasurement,
+// analyzeSingleEndpointMeasurement analyzes a single endpoint measurement. We use
+// the given rules to classify the failure when only the probe fails and the
+// given blockpage DB to recognize known blockpages.
+func analyzeSingleEndpointMeasurement(mx analysisIDGenerator, rules *AnalysisRuleset,
+	blockpages *BlockpageDB, epnt *measurex.EndpointMeasurement,
 	otherEpnts []*measurex.EndpointMeasurement) *AnalysisEndpoint {
 
 	// Let's start by creating the score
@@ -76,6 +116,7 @@ func analyzeSingleEndpointMeasurement(
 		URLMeasurementID: epnt.URLMeasurementID,
 		Refs:             []int64{epnt.ID},
 		Flags:            0,
+		Blockpage:        "",
 	}
 
 	logcat.Infof("[#%d] analyzing #%d: %s", score.ID, epnt.ID, epnt.Summary())
@@ -99,6 +140,26 @@ func analyzeSingleEndpointMeasurement(
 		}
 	}
 
+	// If we find a known blockpage and the TH's response does not also match
+	// it, then it's clearly censorship. We check before the bogon check because
+	// some blockpage servers use bogons. When the TH's response also matches,
+	// the fingerprint is matching the website's content and we continue.
+	if fp, found := blockpages.Match(epnt); found {
+		thEpnt, _ := analysisEndpointFindMatchingMeasurement(score.ID, epnt, otherEpnts, 0)
+		if !fp.MatchTH(epnt, thEpnt) {
+			logcat.Confirmedf("[#%d] #%d is confirmed anomaly because it matches blockpage %s",
+				score.ID, epnt.ID, fp.Describe())
+			if thEpnt != nil {
+				score.Refs = append(score.Refs, thEpnt.ID)
+			}
+			score.Flags |= AnalysisBlockpage
+			score.Blockpage = fp.ID
+			return score
+		}
+		logcat.Shrugf("[#%d] #%d matches blockpage %s but so does the TH's response #%d",
+			score.ID, epnt.ID, fp.Describe(), thEpnt.ID)
+	}
+
 	// If we find a bogon address, then it's clearly an anomaly
 	if addr := epnt.IPAddress(); addr != "" && netxlite.IsBogon(addr) {
 		logcat.Confirmedf("[#%d] #%d is confirmed anomaly because it contains a bogon", score.ID, epnt.ID)
@@ -151,95 +212,16 @@ func analyzeSingleEndpointMeasurement(
 
 	// So, let's check whether just the "experiment" failed.
 	if epnt.Failure != "" {
-		switch epnt.FailedOperation {
-		case netxlite.ConnectOperation:
-			switch epnt.Failure {
-			case netxlite.FailureGenericTimeoutError:
-				score.Flags |= AnalysisTCPTimeout
-			case netxlite.FailureConnectionRefused:
-				score.Flags |= AnalysisTCPRefused
-			default:
-				score.Flags |= AnalysisInconclusive
-			}
-		case netxlite.TLSHandshakeOperation:
-			switch epnt.Failure {
-			case netxlite.FailureGenericTimeoutError:
-				score.Flags |= AnalysisTLSTimeout
-			case netxlite.FailureConnectionReset:
-				score.Flags |= AnalysisTLSReset
-			case netxlite.FailureSSLInvalidCertificate,
-				netxlite.FailureSSLInvalidHostname,
-				netxlite.FailureSSLUnknownAuthority:
-				score.Flags |= AnalysisCertificate
-			case netxlite.FailureEOFError:
-				score.Flags |= AnalysisTLSEOF
-			default:
-				score.Flags |= AnalysisInconclusive
-			}
-		case netxlite.QUICHandshakeOperation:
-			switch epnt.Failure {
-			case netxlite.FailureGenericTimeoutError:
-				score.Flags |= AnalysisQUICTimeout
-			case netxlite.FailureSSLInvalidCertificate,
-				netxlite.FailureSSLInvalidHostname,
-				netxlite.FailureSSLUnknownAuthority:
-				score.Flags |= AnalysisCertificate
-			default:
-				score.Flags |= AnalysisInconclusive
-			}
-		case netxlite.HTTPRoundTripOperation:
-			// Here we need to attribute the failure to the adversary-
-			// observable highest-level protocol.
-			var (
-				isHTTPS = epnt.Scheme() == "https" && epnt.Network == archival.NetworkTypeTCP
-				isHTTP3 = epnt.Scheme() == "https" && epnt.Network == archival.NetworkTypeQUIC
-				isHTTP  = epnt.Scheme() == "http"
-			)
-			switch epnt.Failure {
-			case netxlite.FailureGenericTimeoutError:
-				switch {
-				case isHTTP:
-					score.Flags |= AnalysisHTTPTimeout
-				case isHTTP3:
-					score.Flags |= AnalysisQUICTimeout
-				case isHTTPS:
-					score.Flags |= AnalysisTLSTimeout
-				default:
-					score.Flags |= AnalysisProbeBug // what scheme is this?!
-				}
-			case netxlite.FailureConnectionReset:
-				switch {
-				case isHTTP:
-					score.Flags |= AnalysisHTTPReset
-				case isHTTPS:
-					score.Flags |= AnalysisTLSReset
-				default:
-					score.Flags |= AnalysisProbeBug // what scheme is this?!
-				}
-			case netxlite.FailureEOFError:
-				switch {
-				case isHTTP:
-					score.Flags |= AnalysisHTTPEOF
-				case isHTTPS:
-					score.Flags |= AnalysisTLSEOF
-				default:
-					score.Flags |= AnalysisProbeBug // what scheme is this?!
-				}
-			default:
-				switch {
-				case isHTTP:
-					score.Flags |= AnalysisInconclusive
-				case isHTTPS, isHTTP3:
-					score.Flags |= AnalysisInconclusive
-				default:
-					score.Flags |= AnalysisProbeBug // what scheme is this?!
-				}
-			}
-		default:
-			// We should not have a different failed operation, so
-			// it's clearly a bug if we end up here
-			score.Flags |= AnalysisProbeBug
+		rule, found := rules.MatchEndpoint(epnt)
+		if !found {
+			logcat.Shrugf("[#%d] no rule matches #%d, which fails with %s during %s",
+				score.ID, epnt.ID, epnt.Failure, epnt.FailedOperation)
+			score.Flags |= AnalysisInconclusive
+			return score
 		}
+		logcat.Infof("[#%d] #%d fails with %s during %s: using rule %s",
+			score.ID, epnt.ID, epnt.Failure, epnt.FailedOperation, rule.Describe())
+		score.Flags |= analysisRuleFlags(rule.Flags)
 		ExplainFlagsWithLogging(score, score.Flags)
 		return score
 	}
@@ -0,0 +1,145 @@
+package websteps
+
+//
+// Analysis injection
+//
+// Code for analyzing #dnsInjection.
+//
+// A DNS resolver sends a single reply for each query. When dnsping
+// receives more than one reply for the same query and the replies
+// differ (e.g., in their rcode, addresses, or TTLs), someone on the
+// path is most likely injecting forged replies. The forged reply is
+// usually faster than the legitimate one, because the injector is
+// closer to the probe than the resolver. Identical replies, instead,
+// are most likely just duplicate packets, so we ignore them.
+//
+// Because injectors only target DNS over UDP and dnsping only pings
+// the resolver that the probe used, we only run this analysis for UDP
+// lookups and only use pings sent to the same resolver address.
+//
+// The AnalysisRuleset's DNSInjection rule tells us which flags to set
+// and whether replies only differing in their TTLs are duplicates.
+//
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/bassosimone/websteps-illustrated/internal/archival"
+	"github.com/bassosimone/websteps-illustrated/internal/dnsping"
+	"github.com/bassosimone/websteps-illustrated/internal/logcat"
+	"github.com/bassosimone/websteps-illustrated/internal/measurex"
+	"github.com/bassosimone/websteps-illustrated/internal/netxlite"
+	"github.com/miekg/dns"
+)
+
+// analysisDNSInjection returns the flags of the given rule when dnsping received
+// different replies for the same query of the domain of the given lookup. The
+// second return value contains the IDs of the replies that differ. A nil rule
+// means that we should not check for DNS injection.
+func analysisDNSInjection(scoreID int64, rule *AnalysisDNSInjectionRule,
+	lookup *measurex.DNSLookupMeasurement,
+	pings []*dnsping.SinglePingResult) (flags int64, refs []int64) {
+	if rule == nil {
+		return 0, nil
+	}
+	switch lookup.ResolverNetwork() {
+	case archival.NetworkTypeUDP:
+	default:
+		return 0, nil
+	}
+	for _, ping := range pings {
+		if ping.Domain != lookup.Domain() {
+			continue
+		}
+		if ping.ResolverAddress != lookup.ResolverAddress() {
+			continue
+		}
+		if !analysisDNSInjectionQueryTypeMatches(lookup.LookupType(), ping.QueryType) {
+			continue
+		}
+		replies := analysisDNSInjectionValidReplies(ping)
+		if len(replies) < 2 {
+			continue
+		}
+		first := replies[0]
+		firstSummary := analysisDNSInjectionReplySummary(first, rule.IgnoreTTLs)
+		for _, reply := range replies[1:] {
+			summary := analysisDNSInjectionReplySummary(reply, rule.IgnoreTTLs)
+			if summary == firstSummary {
+				logcat.Infof("[#%d] #%d is a duplicate of #%d for %s",
+					scoreID, reply.ID, first.ID, ping.Describe())
+				continue
+			}
+			logcat.Confirmedf("[#%d] #%d (%s) arrived %s before #%d (%s) for %s",
+				scoreID, first.ID, firstSummary, reply.Finished.Sub(first.Finished),
+				reply.ID, summary, ping.Describe())
+			flags |= analysisRuleFlags(rule.Flags)
+			refs = analysisDNSInjectionAppendRef(refs, first.ID)
+			refs = analysisDNSInjectionAppendRef(refs, reply.ID)
+		}
+	}
+	return flags, refs
+}
+
+// analysisDNSInjectionQueryTypeMatches returns whether a dnsping query
+// of the given type is relevant for a lookup of the given type.
+func analysisDNSInjectionQueryTypeMatches(lookupType archival.DNSLookupType, qtype uint16) bool {
+	switch lookupType {
+	case archival.DNSLookupTypeGetaddrinfo:
+		return qtype == dns.TypeA || qtype == dns.TypeAAAA
+	case archival.DNSLookupTypeHTTPS:
+		return qtype == dns.TypeHTTPS
+	default:
+		return false
+	}
+}
+
+// analysisDNSInjectionValidReplies returns the replies we could parse and that
+// came from the resolver's address. We exclude the other replies because they
+// do not tell us anything about what the resolver's address sent us.
+func analysisDNSInjectionValidReplies(
+	ping *dnsping.SinglePingResult) (out []*dnsping.SinglePingReply) {
+	for _, reply := range ping.Replies {
+		if reply.ID <= 0 || reply.Rcode == "" || len(reply.Reply) <= 0 {
+			continue // we could not parse this reply
+		}
+		if reply.Error == netxlite.FailureDNSReplyFromUnexpectedServer {
+			continue
+		}
+		out = append(out, reply)
+	}
+	return
+}
+
+// analysisDNSInjectionReplySummary returns a summary of the content of
+// the reply containing the rcode, the addresses, and the TTLs (unless
+// we should ignore the TTLs, in which case the summary omits them).
+func analysisDNSInjectionReplySummary(reply *dnsping.SinglePingReply, ignoreTTLs bool) string {
+	addrs := append([]string{}, reply.Addresses...)
+	sort.Strings(addrs)
+	if ignoreTTLs {
+		return fmt.Sprintf("rcode=%s addrs=[%s]", reply.Rcode, strings.Join(addrs, " "))
+	}
+	var ttls []string
+	msg := &dns.Msg{}
+	if err := msg.Unpack(reply.Reply); err == nil {
+		for _, rr := range msg.Answer {
+			ttls = append(ttls, fmt.Sprintf("%d", rr.Header().Ttl))
+		}
+	}
+	sort.Strings(ttls)
+	return fmt.Sprintf("rcode=%s addrs=[%s] ttls=[%s]", reply.Rcode,
+		strings.Join(addrs, " "), strings.Join(ttls, " "))
+}
+
+// analysisDNSInjectionAppendRef appends id to refs unless it's already there.
+func analysisDNSInjectionAppendRef(refs []int64, id int64) []int64 {
+	for _, ref := range refs {
+		if ref == id {
+			return refs
+		}
+	}
+	return append(refs, id)
+}
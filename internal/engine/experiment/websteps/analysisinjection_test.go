@@ -0,0 +1,130 @@
+package websteps
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/bassosimone/websteps-illustrated/internal/archival"
+	"github.com/bassosimone/websteps-illustrated/internal/dnsping"
+	"github.com/bassosimone/websteps-illustrated/internal/measurex"
+	"github.com/miekg/dns"
+)
+
+// newInjectionTestReply creates a parseable A reply for example.com
+// containing the given address and TTL.
+func newInjectionTestReply(t *testing.T, id int64, addr string,
+	ttl uint32, finished time.Time) *dnsping.SinglePingReply {
+	rr, err := dns.NewRR(fmt.Sprintf("example.com. %d IN A %s", ttl, addr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg := &dns.Msg{}
+	msg.SetQuestion("example.com.", dns.TypeA)
+	msg.Response = true
+	msg.Answer = append(msg.Answer, rr)
+	data, err := msg.Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &dnsping.SinglePingReply{
+		ID:            id,
+		SourceAddress: "8.8.8.8:53",
+		Reply:         data,
+		Error:         "",
+		Finished:      finished,
+		Rcode:         "NOERROR",
+		Addresses:     []string{addr},
+		ALPNs:         nil,
+	}
+}
+
+func TestAnalysisDNSInjection(t *testing.T) {
+	now := time.Now()
+	newPing := func(resolver string) *dnsping.SinglePingResult {
+		return &dnsping.SinglePingResult{
+			ID:              1,
+			ResolverAddress: resolver,
+			Delay:           0,
+			Domain:          "example.com",
+			QueryType:       dns.TypeA,
+			QueryID:         0,
+			Query:           nil,
+			Started:         now,
+			Replies: []*dnsping.SinglePingReply{
+				newInjectionTestReply(t, 2, "10.10.34.35", 60, now.Add(10*time.Millisecond)),
+				newInjectionTestReply(t, 3, "93.184.216.34", 3600, now.Add(50*time.Millisecond)),
+			},
+		}
+	}
+	newLookup := func(network archival.NetworkType, resolver string) *measurex.DNSLookupMeasurement {
+		return &measurex.DNSLookupMeasurement{
+			ID: 4,
+			Lookup: archival.NewFakeFlatDNSLookupEvent(network, resolver,
+				archival.DNSLookupTypeGetaddrinfo, "example.com", nil,
+				[]string{"93.184.216.34"}),
+		}
+	}
+	newTTLOnlyPing := func() *dnsping.SinglePingResult {
+		ping := newPing("8.8.8.8:53")
+		ping.Replies[0] = newInjectionTestReply(
+			t, 2, "93.184.216.34", 60, now.Add(10*time.Millisecond))
+		return ping
+	}
+	ignoreTTLs := &AnalysisDNSInjectionRule{
+		IgnoreTTLs: true,
+		Flags:      []string{"#dnsInjection"},
+	}
+	tests := []struct {
+		name   string
+		rule   *AnalysisDNSInjectionRule
+		lookup *measurex.DNSLookupMeasurement
+		ping   *dnsping.SinglePingResult
+		expect int64
+	}{{
+		name:   "different replies from the same UDP resolver",
+		rule:   defaultAnalysisDNSInjectionRule(),
+		lookup: newLookup(archival.NetworkTypeUDP, "8.8.8.8:53"),
+		ping:   newPing("8.8.8.8:53"),
+		expect: AnalysisDNSInjected,
+	}, {
+		name:   "pings sent to another resolver",
+		rule:   defaultAnalysisDNSInjectionRule(),
+		lookup: newLookup(archival.NetworkTypeUDP, "8.8.8.8:53"),
+		ping:   newPing("1.1.1.1:53"),
+		expect: 0,
+	}, {
+		name:   "lookups using the system resolver",
+		rule:   defaultAnalysisDNSInjectionRule(),
+		lookup: newLookup(archival.NetworkTypeSystem, ""),
+		ping:   newPing("8.8.8.8:53"),
+		expect: 0,
+	}, {
+		name:   "without a rule",
+		rule:   nil,
+		lookup: newLookup(archival.NetworkTypeUDP, "8.8.8.8:53"),
+		ping:   newPing("8.8.8.8:53"),
+		expect: 0,
+	}, {
+		name:   "replies only differing in their TTLs",
+		rule:   defaultAnalysisDNSInjectionRule(),
+		lookup: newLookup(archival.NetworkTypeUDP, "8.8.8.8:53"),
+		ping:   newTTLOnlyPing(),
+		expect: AnalysisDNSInjected,
+	}, {
+		name:   "replies only differing in their TTLs when ignoring TTLs",
+		rule:   ignoreTTLs,
+		lookup: newLookup(archival.NetworkTypeUDP, "8.8.8.8:53"),
+		ping:   newTTLOnlyPing(),
+		expect: 0,
+	}}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			flags, _ := analysisDNSInjection(0, tt.rule, tt.lookup,
+				[]*dnsping.SinglePingResult{tt.ping})
+			if flags != tt.expect {
+				t.Fatal("expected", tt.expect, "got", flags)
+			}
+		})
+	}
+}
@@ -0,0 +1,466 @@
+package websteps
+
+//
+// Analysis rules
+//
+// Declarative rules mapping failures to analysis flags.
+//
+// We use these rules when only the probe's measurement failed and
+// the matching TH measurement succeeded. Each rule matches some
+// properties of the failed measurement (an empty list matches any
+// value) and maps them to a list of hashtags (e.g., "#tcpTimeout").
+// We evaluate the rules in order and the first matching rule wins.
+//
+// The throttling rule is different: it applies to successful endpoints
+// and contains the thresholds for flagging a slow download (see the
+// analysisthrottling.go file). Without such a rule, we don't flag.
+//
+// The DNS injection rule is also different: it applies to the replies
+// that dnsping received for the probe's UDP lookups and tells us how to
+// flag different replies for the same query (see the analysisinjection.go
+// file). Without such a rule, we don't flag.
+//
+// DefaultAnalysisRuleset contains the default rules. You can load
+// alternative rules from YAML or JSON using LoadAnalysisRuleset. The
+// testdata/analysisrules.yaml file contains the same rules and a test
+// fails when the two disagree, so remember to update both.
+//
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/bassosimone/websteps-illustrated/internal/archival"
+	"github.com/bassosimone/websteps-illustrated/internal/measurex"
+	"github.com/bassosimone/websteps-illustrated/internal/netxlite"
+	"gopkg.in/yaml.v3"
+)
+
+// AnalysisRuleset contains the analysis rules.
+type AnalysisRuleset struct {
+	// DNS contains rules for failed DNS lookups.
+	DNS []*AnalysisDNSRule `json:"dns" yaml:"dns"`
+
+	// Endpoint contains rules for failed endpoint measurements.
+	Endpoint []*AnalysisEndpointRule `json:"endpoint" yaml:"endpoint"`
+
+	// Throttling is the OPTIONAL rule for slow downloads.
+	Throttling *AnalysisThrottlingRule `json:"throttling,omitempty" yaml:"throttling,omitempty"`
+
+	// DNSInjection is the OPTIONAL rule for injected DNS replies.
+	DNSInjection *AnalysisDNSInjectionRule `json:"dns_injection,omitempty" yaml:"dns_injection,omitempty"`
+}
+
+// AnalysisDNSRule is a rule for failed DNS lookups.
+type AnalysisDNSRule struct {
+	// Name is the OPTIONAL name of the rule.
+	Name string `json:"name,omitempty" yaml:"name,omitempty"`
+
+	// Failure contains the failures matched by this rule.
+	Failure []string `json:"failure,omitempty" yaml:"failure,omitempty"`
+
+	// LookupType contains the lookup types matched by this rule.
+	LookupType []string `json:"lookup_type,omitempty" yaml:"lookup_type,omitempty"`
+
+	// ResolverNetwork contains the resolver networks matched by this rule.
+	ResolverNetwork []string `json:"resolver_network,omitempty" yaml:"resolver_network,omitempty"`
+
+	// Flags contains the hashtags of the flags to set.
+	Flags []string `json:"flags" yaml:"flags"`
+
+	// DNSPingCheck indicates that we should not set any flag if
+	// dnsping successfully resolved the same domain using UDP.
+	DNSPingCheck bool `json:"dnsping_check,omitempty" yaml:"dnsping_check,omitempty"`
+}
+
+// AnalysisEndpointRule is a rule for failed endpoint measurements.
+type AnalysisEndpointRule struct {
+	// Name is the OPTIONAL name of the rule.
+	Name string `json:"name,omitempty" yaml:"name,omitempty"`
+
+	// FailedOperation contains the failed operations matched by this rule.
+	FailedOperation []string `json:"failed_operation,omitempty" yaml:"failed_operation,omitempty"`
+
+	// Failure contains the failures matched by this rule.
+	Failure []string `json:"failure,omitempty" yaml:"failure,omitempty"`
+
+	// Scheme contains the URL schemes matched by this rule.
+	Scheme []string `json:"scheme,omitempty" yaml:"scheme,omitempty"`
+
+	// Network contains the networks matched by this rule.
+	Network []string `json:"network,omitempty" yaml:"network,omitempty"`
+
+	// Flags contains the hashtags of the flags to set.
+	Flags []string `json:"flags" yaml:"flags"`
+}
+
+// AnalysisThrottlingRule is the rule for slow downloads.
+type AnalysisThrottlingRule struct {
+	// MinSamples is the minimum number of speed samples we need to
+	// consider a download speed reliable. The archival.Saver emits a
+	// sample every 250 ms, so four samples are roughly one second.
+	MinSamples int `json:"min_samples" yaml:"min_samples"`
+
+	// SpeedRatio is the ratio between the expected speed and the
+	// actual speed above which we set the flags.
+	SpeedRatio float64 `json:"speed_ratio" yaml:"speed_ratio"`
+
+	// Flags contains the hashtags of the flags to set.
+	Flags []string `json:"flags" yaml:"flags"`
+}
+
+// AnalysisDNSInjectionRule is the rule for injected DNS replies.
+type AnalysisDNSInjectionRule struct {
+	// IgnoreTTLs indicates that we should consider replies that only
+	// differ in their TTLs as duplicates rather than as injected.
+	IgnoreTTLs bool `json:"ignore_ttls,omitempty" yaml:"ignore_ttls,omitempty"`
+
+	// Flags contains the hashtags of the flags to set.
+	Flags []string `json:"flags" yaml:"flags"`
+}
+
+// ErrInvalidAnalysisRuleset indicates that the ruleset is not valid.
+var ErrInvalidAnalysisRuleset = errors.New("websteps: invalid analysis ruleset")
+
+// LoadAnalysisRuleset loads an AnalysisRuleset from the given YAML
+// or JSON file and validates it.
+func LoadAnalysisRuleset(filename string) (*AnalysisRuleset, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	return ParseAnalysisRuleset(data)
+}
+
+// ParseAnalysisRuleset parses an AnalysisRuleset from YAML or JSON
+// (which is a subset of YAML) and validates it.
+func ParseAnalysisRuleset(data []byte) (*AnalysisRuleset, error) {
+	var rs AnalysisRuleset
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	decoder.KnownFields(true)
+	if err := decoder.Decode(&rs); err != nil && !errors.Is(err, io.EOF) {
+		return nil, fmt.Errorf("%w: %s", ErrInvalidAnalysisRuleset, err.Error())
+	}
+	if err := rs.Validate(); err != nil {
+		return nil, err
+	}
+	return &rs, nil
+}
+
+// Validate returns an error if any rule uses unknown hashtags.
+func (rs *AnalysisRuleset) Validate() error {
+	for idx, rule := range rs.DNS {
+		if _, unknown := ParseHashtags(rule.Flags...); len(unknown) > 0 {
+			return fmt.Errorf("%w: dns rule %d: unknown hashtags: %s",
+				ErrInvalidAnalysisRuleset, idx, strings.Join(unknown, ", "))
+		}
+	}
+	for idx, rule := range rs.Endpoint {
+		if _, unknown := ParseHashtags(rule.Flags...); len(unknown) > 0 {
+			return fmt.Errorf("%w: endpoint rule %d: unknown hashtags: %s",
+				ErrInvalidAnalysisRuleset, idx, strings.Join(unknown, ", "))
+		}
+	}
+	if rule := rs.Throttling; rule != nil {
+		if _, unknown := ParseHashtags(rule.Flags...); len(unknown) > 0 {
+			return fmt.Errorf("%w: throttling rule: unknown hashtags: %s",
+				ErrInvalidAnalysisRuleset, strings.Join(unknown, ", "))
+		}
+		if rule.MinSamples <= 0 || rule.SpeedRatio <= 1 {
+			return fmt.Errorf("%w: throttling rule: invalid min_samples or speed_ratio",
+				ErrInvalidAnalysisRuleset)
+		}
+	}
+	if rule := rs.DNSInjection; rule != nil {
+		if _, unknown := ParseHashtags(rule.Flags...); len(unknown) > 0 {
+			return fmt.Errorf("%w: dns_injection rule: unknown hashtags: %s",
+				ErrInvalidAnalysisRuleset, strings.Join(unknown, ", "))
+		}
+	}
+	return nil
+}
+
+// MatchDNS returns the first rule matching the given failed lookup.
+func (rs *AnalysisRuleset) MatchDNS(lookup *measurex.DNSLookupMeasurement) (*AnalysisDNSRule, bool) {
+	for _, rule := range rs.DNS {
+		if rule.Match(lookup) {
+			return rule, true
+		}
+	}
+	return nil, false
+}
+
+// MatchEndpoint returns the first rule matching the given failed endpoint.
+func (rs *AnalysisRuleset) MatchEndpoint(epnt *measurex.EndpointMeasurement) (*AnalysisEndpointRule, bool) {
+	for _, rule := range rs.Endpoint {
+		if rule.Match(epnt) {
+			return rule, true
+		}
+	}
+	return nil, false
+}
+
+// Match returns whether this rule matches the given lookup.
+func (r *AnalysisDNSRule) Match(lookup *measurex.DNSLookupMeasurement) bool {
+	return analysisRuleMatch(r.Failure, string(lookup.Failure())) &&
+		analysisRuleMatch(r.LookupType, string(lookup.LookupType())) &&
+		analysisRuleMatch(r.ResolverNetwork, string(lookup.ResolverNetwork()))
+}
+
+// Describe returns a description of this rule.
+func (r *AnalysisDNSRule) Describe() string {
+	return analysisRuleDescribe(r.Name, r.Flags)
+}
+
+// Match returns whether this rule matches the given endpoint.
+func (r *AnalysisEndpointRule) Match(epnt *measurex.EndpointMeasurement) bool {
+	return analysisRuleMatch(r.FailedOperation, string(epnt.FailedOperation)) &&
+		analysisRuleMatch(r.Failure, string(epnt.Failure)) &&
+		analysisRuleMatch(r.Scheme, epnt.Scheme()) &&
+		analysisRuleMatch(r.Network, string(epnt.Network))
+}
+
+// Describe returns a description of this rule.
+func (r *AnalysisEndpointRule) Describe() string {
+	return analysisRuleDescribe(r.Name, r.Flags)
+}
+
+// analysisRuleMatch returns true if patterns is empty or contains value.
+func analysisRuleMatch(patterns []string, value string) bool {
+	if len(patterns) <= 0 {
+		return true
+	}
+	for _, pattern := range patterns {
+		if pattern == value {
+			return true
+		}
+	}
+	return false
+}
+
+// analysisRuleDescribe describes a rule for logging.
+func analysisRuleDescribe(name string, flags []string) string {
+	if name == "" {
+		name = "unnamed rule"
+	}
+	return fmt.Sprintf("'%s' => [%s]", name, strings.Join(flags, " "))
+}
+
+// analysisRuleFlags maps the hashtags of a rule to flags.
+func analysisRuleFlags(tags []string) int64 {
+	flags, _ := ParseHashtags(tags...)
+	return flags
+}
+
+// DefaultAnalysisRuleset returns a new instance of the default ruleset.
+func DefaultAnalysisRuleset() *AnalysisRuleset {
+	return &AnalysisRuleset{
+		DNS:          defaultAnalysisDNSRules(),
+		Endpoint:     defaultAnalysisEndpointRules(),
+		Throttling:   defaultAnalysisThrottlingRule(),
+		DNSInjection: defaultAnalysisDNSInjectionRule(),
+	}
+}
+
+// defaultAnalysisRuleset is the ruleset used when the client
+// does not configure any ruleset.
+var defaultAnalysisRuleset = DefaultAnalysisRuleset()
+
+// defaultAnalysisDNSRules returns the default rules for failed lookups.
+func defaultAnalysisDNSRules() []*AnalysisDNSRule {
+	return []*AnalysisDNSRule{{
+		Name:    "nxdomain",
+		Failure: []string{netxlite.FailureDNSNXDOMAINError},
+		Flags:   []string{"#nxdomain"},
+	}, {
+		Name:    "refused",
+		Failure: []string{netxlite.FailureDNSRefusedError},
+		Flags:   []string{"#dnsRefused"},
+	}, {
+		// Timeouts may be transient, so we check with dnsping.
+		Name:         "timeout",
+		Failure:      []string{netxlite.FailureGenericTimeoutError},
+		Flags:        []string{"#dnsTimeout"},
+		DNSPingCheck: true,
+	}, {
+		Name:    "no answer",
+		Failure: []string{netxlite.FailureDNSNoAnswer},
+		Flags:   []string{"#dnsNoAnswer"},
+	}, {
+		Name:    "servfail",
+		Failure: []string{netxlite.FailureDNSServfailError},
+		Flags:   []string{"#dnsServfail"},
+	}, {
+		Name:  "unmapped error",
+		Flags: []string{"#inconclusive"},
+	}}
+}
+
+// defaultAnalysisEndpointRules returns the default rules for failed endpoints.
+func defaultAnalysisEndpointRules() []*AnalysisEndpointRule {
+	var (
+		certificateErrors = []string{
+			netxlite.FailureSSLInvalidCertificate,
+			netxlite.FailureSSLInvalidHostname,
+			netxlite.FailureSSLUnknownAuthority,
+		}
+		connect           = []string{netxlite.ConnectOperation}
+		tlsHandshake      = []string{netxlite.TLSHandshakeOperation}
+		quicHandshake     = []string{netxlite.QUICHandshakeOperation}
+		httpRoundTrip     = []string{netxlite.HTTPRoundTripOperation}
+		timeout           = []string{netxlite.FailureGenericTimeoutError}
+		connectionRefused = []string{netxlite.FailureConnectionRefused}
+		connectionReset   = []string{netxlite.FailureConnectionReset}
+		eof               = []string{netxlite.FailureEOFError}
+		http              = []string{"http"}
+		https             = []string{"https"}
+		tcp               = []string{string(archival.NetworkTypeTCP)}
+		quic              = []string{string(archival.NetworkTypeQUIC)}
+		inconclusive      = []string{"#inconclusive"}
+		probeBug          = []string{"#probeBug"}
+	)
+	return []*AnalysisEndpointRule{{
+		Name:            "connect timeout",
+		FailedOperation: connect,
+		Failure:         timeout,
+		Flags:           []string{"#tcpTimeout"},
+	}, {
+		Name:            "connect refused",
+		FailedOperation: connect,
+		Failure:         connectionRefused,
+		Flags:           []string{"#tcpRefused"},
+	}, {
+		Name:            "connect other error",
+		FailedOperation: connect,
+		Flags:           inconclusive,
+	}, {
+		Name:            "TLS handshake timeout",
+		FailedOperation: tlsHandshake,
+		Failure:         timeout,
+		Flags:           []string{"#tlsTimeout"},
+	}, {
+		Name:            "TLS handshake reset",
+		FailedOperation: tlsHandshake,
+		Failure:         connectionReset,
+		Flags:           []string{"#tlsReset"},
+	}, {
+		Name:            "TLS handshake certificate error",
+		FailedOperation: tlsHandshake,
+		Failure:         certificateErrors,
+		Flags:           []string{"#certificate"},
+	}, {
+		Name:            "TLS handshake EOF",
+		FailedOperation: tlsHandshake,
+		Failure:         eof,
+		Flags:           []string{"#tlsEOF"},
+	}, {
+		Name:            "TLS handshake other error",
+		FailedOperation: tlsHandshake,
+		Flags:           inconclusive,
+	}, {
+		Name:            "QUIC handshake timeout",
+		FailedOperation: quicHandshake,
+		Failure:         timeout,
+		Flags:           []string{"#quicTimeout"},
+	}, {
+		Name:            "QUIC handshake certificate error",
+		FailedOperation: quicHandshake,
+		Failure:         certificateErrors,
+		Flags:           []string{"#certificate"},
+	}, {
+		Name:            "QUIC handshake other error",
+		FailedOperation: quicHandshake,
+		Flags:           inconclusive,
+	}, {
+		// For HTTP round trips, we attribute the failure to the
+		// adversary-observable highest-level protocol.
+		Name:            "HTTP timeout",
+		FailedOperation: httpRoundTrip,
+		Failure:         timeout,
+		Scheme:          http,
+		Flags:           []string{"#httpTimeout"},
+	}, {
+		Name:            "HTTP3 timeout",
+		FailedOperation: httpRoundTrip,
+		Failure:         timeout,
+		Scheme:          https,
+		Network:         quic,
+		Flags:           []string{"#quicTimeout"},
+	}, {
+		Name:            "HTTPS timeout",
+		FailedOperation: httpRoundTrip,
+		Failure:         timeout,
+		Scheme:          https,
+		Network:         tcp,
+		Flags:           []string{"#tlsTimeout"},
+	}, {
+		Name:            "HTTP reset",
+		FailedOperation: httpRoundTrip,
+		Failure:         connectionReset,
+		Scheme:          http,
+		Flags:           []string{"#httpReset"},
+	}, {
+		Name:            "HTTPS reset",
+		FailedOperation: httpRoundTrip,
+		Failure:         connectionReset,
+		Scheme:          https,
+		Network:         tcp,
+		Flags:           []string{"#tlsReset"},
+	}, {
+		Name:            "HTTP EOF",
+		FailedOperation: httpRoundTrip,
+		Failure:         eof,
+		Scheme:          http,
+		Flags:           []string{"#httpEOF"},
+	}, {
+		Name:            "HTTPS EOF",
+		FailedOperation: httpRoundTrip,
+		Failure:         eof,
+		Scheme:          https,
+		Network:         tcp,
+		Flags:           []string{"#tlsEOF"},
+	}, {
+		// What scheme or network is this?!
+		Name:            "HTTP unexpected timeout, reset, or EOF",
+		FailedOperation: httpRoundTrip,
+		Failure: []string{
+			netxlite.FailureGenericTimeoutError,
+			netxlite.FailureConnectionReset,
+			netxlite.FailureEOFError,
+		},
+		Flags: probeBug,
+	}, {
+		Name:            "HTTP other error",
+		FailedOperation: httpRoundTrip,
+		Scheme:          []string{"http", "https"},
+		Flags:           inconclusive,
+	}, {
+		// We should not have a different failed operation, so
+		// it's clearly a bug if we end up here.
+		Name:  "unexpected failed operation",
+		Flags: probeBug,
+	}}
+}
+
+// defaultAnalysisThrottlingRule returns the default rule for slow downloads.
+func defaultAnalysisThrottlingRule() *AnalysisThrottlingRule {
+	return &AnalysisThrottlingRule{
+		MinSamples: 4,
+		SpeedRatio: 5.0,
+		Flags:      []string{"#throttling"},
+	}
+}
+
+// defaultAnalysisDNSInjectionRule returns the default rule for injected
+// DNS replies. We do not ignore the TTLs because a resolver sends a single
+// reply for each query, so even different TTLs are suspicious.
+func defaultAnalysisDNSInjectionRule() *AnalysisDNSInjectionRule {
+	return &AnalysisDNSInjectionRule{
+		IgnoreTTLs: false,
+		Flags:      []string{"#dnsInjection"},
+	}
+}
@@ -0,0 +1,35 @@
+package websteps
+
+import (
+	"encoding/json"
+	"path/filepath"
+	"testing"
+)
+
+func TestDefaultAnalysisRulesetMatchesYAML(t *testing.T) {
+	// Implementation note: we compare the JSON serialization because
+	// the YAML parser produces nil lists where the code uses empty lists.
+	rs, err := LoadAnalysisRuleset(filepath.Join("..", "..", "..", "..", "testdata", "analysisrules.yaml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect, err := json.MarshalIndent(DefaultAnalysisRuleset(), "", "  ")
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := json.MarshalIndent(rs, "", "  ")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(expect) != string(got) {
+		t.Fatalf("testdata/analysisrules.yaml differs from DefaultAnalysisRuleset\nexpected:\n%s\ngot:\n%s",
+			string(expect), string(got))
+	}
+}
+
+func TestParseAnalysisRulesetRejectsUnknownHashtags(t *testing.T) {
+	data := []byte("endpoint:\n  - failure: [connection_reset]\n    flags: ['#nonexistent']\n")
+	if _, err := ParseAnalysisRuleset(data); err == nil {
+		t.Fatal("expected an error")
+	}
+}
@@ -15,7 +15,7 @@ import (
 // out whether the probe's DNS results are compatible with the TH's ones. This function
 // returns a nil slice if there are no TH measurements to analyze.
 func (ssm *SingleStepMeasurement) analyzeTHResults(
-	amx measurex.AbstractMeasurer) (out []*AnalysisEndpoint) {
+	amx analysisIDGenerator) (out []*AnalysisEndpoint) {
 	if ssm.ProbeInitial == nil || ssm.TH == nil {
 		logcat.Emitf(logcat.DEBUG, logcat.SHRUG, "passed nil ProbeInitial or TH")
 		return
@@ -88,6 +88,7 @@ func (ssm *SingleStepMeasurement) analyzeTHResults(
 				URLMeasurementID: ssm.ProbeInitialURLMeasurementID(),
 				Refs:             []int64{epnt.ID, otherEpnt.ID},
 				Flags:            0,
+				Blockpage:        "",
 			}
 			logcat.Inspectf("[#%d] comparing #%d to #%d", score.ID, epnt.ID, otherEpnt.ID)
 			score.Flags |= analysisWebHTTPDiff(score.ID, epnt, otherEpnt)
@@ -0,0 +1,95 @@
+package websteps
+
+//
+// Analysis throttling
+//
+// Code for analyzing #throttling.
+//
+// We compare the speed at which the probe downloaded the HTTP response
+// body of an endpoint with the speed measured by the TH for the same
+// endpoint. Because the TH usually has much better connectivity than the
+// probe, we only flag throttling when the probe is much slower than the
+// TH, according to the thresholds in the AnalysisRuleset.
+//
+// We also compare with the probe endpoints of the same step that belong
+// to other domains, when there are any. If those are as slow as this
+// endpoint, we cannot distinguish throttling from a slow network, so we
+// do not flag. We don't compare with endpoints of the same domain, which
+// a censor throttling the domain would slow down as much as this one.
+//
+// We need reasonably large bodies to collect enough samples, so this
+// analysis is only meaningful when measuring with a large value of
+// MaxHTTPSResponseBodySnapshotSizeThrottling.
+//
+
+import (
+	"fmt"
+
+	"github.com/bassosimone/websteps-illustrated/internal/logcat"
+	"github.com/bassosimone/websteps-illustrated/internal/measurex"
+)
+
+// analysisThrottling returns the flags of the given rule when the probe
+// downloaded the response body of epnt much slower than the matching TH
+// endpoint and than the fastest probe endpoint of another domain. A nil
+// rule means that we should not check for throttling.
+func analysisThrottling(scoreID int64, rule *AnalysisThrottlingRule,
+	epnt *measurex.EndpointMeasurement, probeEpnts, thEpnts []*measurex.EndpointMeasurement) int64 {
+	if rule == nil {
+		return 0
+	}
+	speed, ok := analysisThrottlingDownloadSpeed(rule, epnt)
+	if !ok {
+		return 0
+	}
+	otherEpnt, found := analysisEndpointFindMatchingMeasurement(scoreID, epnt, thEpnts, 0)
+	if !found {
+		return 0
+	}
+	thSpeed, ok := analysisThrottlingDownloadSpeed(rule, otherEpnt)
+	if !ok {
+		logcat.Shrugf("[#%d] cannot compare #%d's speed with the TH's speed", scoreID, epnt.ID)
+		return 0
+	}
+	if speed*rule.SpeedRatio > thSpeed {
+		logcat.Celebratef("[#%d] #%d downloads at %s and the TH downloads at %s",
+			scoreID, epnt.ID, analysisThrottlingFormatSpeed(speed),
+			analysisThrottlingFormatSpeed(thSpeed))
+		return 0
+	}
+	for _, peer := range probeEpnts {
+		if peer.URLDomain() == epnt.URLDomain() {
+			continue // throttling the domain would also slow down peer
+		}
+		peerSpeed, ok := analysisThrottlingDownloadSpeed(rule, peer)
+		if !ok {
+			continue
+		}
+		if speed*rule.SpeedRatio > peerSpeed {
+			logcat.Shrugf("[#%d] #%d downloads at %s like #%d, which downloads at %s",
+				scoreID, epnt.ID, analysisThrottlingFormatSpeed(speed), peer.ID,
+				analysisThrottlingFormatSpeed(peerSpeed))
+			return 0
+		}
+	}
+	logcat.Unexpectedf("[#%d] #%d downloads at %s but the TH downloads at %s",
+		scoreID, epnt.ID, analysisThrottlingFormatSpeed(speed),
+		analysisThrottlingFormatSpeed(thSpeed))
+	return analysisRuleFlags(rule.Flags)
+}
+
+// analysisThrottlingDownloadSpeed returns the download speed of a successful
+// HTTP measurement when we have enough samples to compute it reliably.
+func analysisThrottlingDownloadSpeed(
+	rule *AnalysisThrottlingRule, epnt *measurex.EndpointMeasurement) (float64, bool) {
+	if epnt.Failure != "" || epnt.HTTPRoundTrip == nil {
+		return 0, false
+	}
+	speed, samples := epnt.DownloadSpeed()
+	return speed, samples >= rule.MinSamples
+}
+
+// analysisThrottlingFormatSpeed formats a speed in bytes per second.
+func analysisThrottlingFormatSpeed(speed float64) string {
+	return fmt.Sprintf("%.1f kbit/s", speed*8/1000)
+}
@@ -0,0 +1,104 @@
+package websteps
+
+import (
+	"testing"
+	"time"
+
+	"github.com/bassosimone/websteps-illustrated/internal/archival"
+	"github.com/bassosimone/websteps-illustrated/internal/measurex"
+)
+
+// newThrottlingTestEndpoint creates an endpoint measurement for the given
+// domain and address that downloads at the given speed in bytes per second.
+func newThrottlingTestEndpoint(id int64, domain, address string,
+	speed int64) *measurex.EndpointMeasurement {
+	epnt := &measurex.EndpointMeasurement{
+		ID:            id,
+		URL:           &measurex.SimpleURL{Scheme: "http", Host: domain, Path: "/"},
+		Network:       archival.NetworkTypeTCP,
+		Address:       address,
+		HTTPRoundTrip: &archival.FlatHTTPRoundTripEvent{},
+	}
+	for idx := int64(0); idx < 8; idx++ {
+		epnt.SpeedSamples = append(epnt.SpeedSamples, &measurex.SpeedSample{
+			T:     time.Duration(idx) * 250 * time.Millisecond,
+			Count: idx * speed / 4,
+		})
+	}
+	return epnt
+}
+
+func TestAnalysisThrottling(t *testing.T) {
+	const (
+		slow = 10000
+		fast = 1000000
+	)
+	rule := defaultAnalysisThrottlingRule()
+	tests := []struct {
+		name   string
+		rule   *AnalysisThrottlingRule
+		probe  []*measurex.EndpointMeasurement
+		th     []*measurex.EndpointMeasurement
+		expect int64
+	}{{
+		name: "probe as fast as the TH",
+		rule: rule,
+		probe: []*measurex.EndpointMeasurement{
+			newThrottlingTestEndpoint(1, "example.com", "1.1.1.1:80", fast),
+		},
+		th: []*measurex.EndpointMeasurement{
+			newThrottlingTestEndpoint(2, "example.com", "1.1.1.1:80", fast),
+		},
+		expect: 0,
+	}, {
+		name: "probe much slower than the TH",
+		rule: rule,
+		probe: []*measurex.EndpointMeasurement{
+			newThrottlingTestEndpoint(1, "example.com", "1.1.1.1:80", slow),
+		},
+		th: []*measurex.EndpointMeasurement{
+			newThrottlingTestEndpoint(2, "example.com", "1.1.1.1:80", fast),
+		},
+		expect: AnalysisThrottling,
+	}, {
+		name: "slow peers of the same domain do not suppress the flag",
+		rule: rule,
+		probe: []*measurex.EndpointMeasurement{
+			newThrottlingTestEndpoint(1, "example.com", "1.1.1.1:80", slow),
+			newThrottlingTestEndpoint(3, "example.com", "2.2.2.2:80", slow),
+		},
+		th: []*measurex.EndpointMeasurement{
+			newThrottlingTestEndpoint(2, "example.com", "1.1.1.1:80", fast),
+		},
+		expect: AnalysisThrottling,
+	}, {
+		name: "slow peers of other domains suppress the flag",
+		rule: rule,
+		probe: []*measurex.EndpointMeasurement{
+			newThrottlingTestEndpoint(1, "example.com", "1.1.1.1:80", slow),
+			newThrottlingTestEndpoint(3, "example.org", "2.2.2.2:80", slow),
+		},
+		th: []*measurex.EndpointMeasurement{
+			newThrottlingTestEndpoint(2, "example.com", "1.1.1.1:80", fast),
+		},
+		expect: 0,
+	}, {
+		name: "without a rule we do not flag",
+		rule: nil,
+		probe: []*measurex.EndpointMeasurement{
+			newThrottlingTestEndpoint(1, "example.com", "1.1.1.1:80", slow),
+		},
+		th: []*measurex.EndpointMeasurement{
+			newThrottlingTestEndpoint(2, "example.com", "1.1.1.1:80", fast),
+		},
+		expect: 0,
+	}}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := analysisThrottling(0, tt.rule, tt.probe[0], tt.probe, tt.th)
+			if got != tt.expect {
+				t.Fatal("expected", tt.expect, "got", got)
+			}
+		})
+	}
+}
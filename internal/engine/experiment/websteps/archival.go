@@ -12,6 +12,7 @@ import (
 	"github.com/bassosimone/websteps-illustrated/internal/dnsping"
 	"github.com/bassosimone/websteps-illustrated/internal/logcat"
 	"github.com/bassosimone/websteps-illustrated/internal/measurex"
+	"github.com/bassosimone/websteps-illustrated/internal/traceroute"
 )
 
 // ArchivalTestKeys contains the archival test keys.
@@ -49,6 +50,8 @@ type ArchivalSingleStepMeasurement struct {
 	TH              *ArchivalTHResponse                    `json:"th"`
 	DNSPing         *dnsping.ArchivalResult                `json:"dnsping"`
 	ProbeAdditional []measurex.ArchivalEndpointMeasurement `json:"probe_additional"`
+	SNIFollowUp     []*ArchivalSNIFollowUpMeasurement      `json:"sni_follow_up"`
+	Traceroute      []*traceroute.ArchivalResult           `json:"traceroute"`
 
 	// Overall analysis of this step
 	Analysis *Analysis `json:"analysis"`
@@ -57,8 +60,9 @@ type ArchivalSingleStepMeasurement struct {
 
 // ArchivalTHResponse is the archival format of a TH response.
 type ArchivalTHResponse struct {
-	DNS      []measurex.ArchivalDNSLookupMeasurement `json:"dns"`
-	Endpoint []measurex.ArchivalEndpointMeasurement  `json:"endpoint"`
+	DNS        []measurex.ArchivalDNSLookupMeasurement `json:"dns"`
+	Endpoint   []measurex.ArchivalEndpointMeasurement  `json:"endpoint"`
+	Incomplete bool                                    `json:"incomplete,omitempty"`
 }
 
 // ToArchival converts test keys to the OONI archival data format.
@@ -87,6 +91,8 @@ func (ssm *SingleStepMeasurement) ToArchival(begin time.Time) *ArchivalSingleSte
 		TH:              nil, // later
 		DNSPing:         nil, // later
 		ProbeAdditional: nil, // later
+		SNIFollowUp:     nil, // later
+		Traceroute:      nil, // later
 		Analysis:        nil, // later
 		Flags:           ssm.Flags,
 	}
@@ -101,6 +107,12 @@ func (ssm *SingleStepMeasurement) ToArchival(begin time.Time) *ArchivalSingleSte
 		out.ProbeAdditional = measurex.NewArchivalEndpointMeasurementList(
 			begin, ssm.ProbeAdditional, bodyFlags)
 	}
+	for _, m := range ssm.SNIFollowUp {
+		out.SNIFollowUp = append(out.SNIFollowUp, m.ToArchival(begin))
+	}
+	for _, r := range ssm.Traceroute {
+		out.Traceroute = append(out.Traceroute, r.ToArchival(begin))
+	}
 	out.Analysis = ssm.Analysis
 	return out
 }
@@ -0,0 +1,300 @@
+package websteps
+
+//
+// Blockpage
+//
+// Database of blockpage fingerprints.
+//
+// Each fingerprint has an ID and some conditions: a regexp matching
+// the response body, a TLSH and a maximum TLSH distance from the
+// response body, a response header name and a regexp matching its
+// value, and a list of known blockpage IP addresses. A fingerprint
+// matches a successful HTTP measurement when all its conditions
+// match. We evaluate the fingerprints in order and the first
+// matching fingerprint wins.
+//
+// A fingerprint may also match legitimate content (e.g., a news article
+// quoting a blockpage), so the analysis only flags a blockpage when the
+// TH's response for the same endpoint does not also match (see MatchTH).
+//
+// DefaultBlockpageDB contains the default fingerprints. You can load
+// alternative fingerprints from YAML or JSON using LoadBlockpageDB. The
+// testdata/blockpages.yaml file contains the same fingerprints and a test
+// fails when the two disagree, so remember to update both.
+//
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+
+	"github.com/bassosimone/websteps-illustrated/internal/measurex"
+	"github.com/bassosimone/websteps-illustrated/internal/runtimex"
+	"github.com/glaslos/tlsh"
+	"gopkg.in/yaml.v3"
+)
+
+// BlockpageDB is a database of blockpage fingerprints.
+type BlockpageDB struct {
+	// Fingerprints contains the fingerprints.
+	Fingerprints []*BlockpageFingerprint `json:"fingerprints" yaml:"fingerprints"`
+}
+
+// BlockpageFingerprint is the fingerprint of a blockpage. All the
+// fields except ID and Description are conditions. An empty
+// condition matches any measurement but a fingerprint must contain
+// at least one non-empty condition.
+type BlockpageFingerprint struct {
+	// ID is the MANDATORY unique ID of the fingerprint.
+	ID string `json:"id" yaml:"id"`
+
+	// Description is the OPTIONAL description of the fingerprint.
+	Description string `json:"description,omitempty" yaml:"description,omitempty"`
+
+	// BodyRegexp is a regexp that must match the response body.
+	BodyRegexp string `json:"body_regexp,omitempty" yaml:"body_regexp,omitempty"`
+
+	// BodyTLSH is the TLSH of the blockpage body.
+	BodyTLSH string `json:"body_tlsh,omitempty" yaml:"body_tlsh,omitempty"`
+
+	// BodyTLSHMaxDiff is the maximum TLSH distance between BodyTLSH
+	// and the TLSH of the response body. If zero, we use
+	// DefaultBlockpageTLSHMaxDiff.
+	BodyTLSHMaxDiff int `json:"body_tlsh_max_diff,omitempty" yaml:"body_tlsh_max_diff,omitempty"`
+
+	// Header is the name of a response header that must exist.
+	Header string `json:"header,omitempty" yaml:"header,omitempty"`
+
+	// HeaderRegexp is a regexp that must match the value of Header.
+	HeaderRegexp string `json:"header_regexp,omitempty" yaml:"header_regexp,omitempty"`
+
+	// Addresses contains the IP addresses of known blockpage servers.
+	Addresses []string `json:"addresses,omitempty" yaml:"addresses,omitempty"`
+
+	// bodyRegexp is the compiled BodyRegexp.
+	bodyRegexp *regexp.Regexp
+
+	// bodyTLSH is the parsed BodyTLSH.
+	bodyTLSH *tlsh.Tlsh
+
+	// headerRegexp is the compiled HeaderRegexp.
+	headerRegexp *regexp.Regexp
+}
+
+// DefaultBlockpageTLSHMaxDiff is the default value of
+// BlockpageFingerprint.BodyTLSHMaxDiff.
+const DefaultBlockpageTLSHMaxDiff = 30
+
+// ErrInvalidBlockpageDB indicates that the blockpage DB is not valid.
+var ErrInvalidBlockpageDB = errors.New("websteps: invalid blockpage DB")
+
+// LoadBlockpageDB loads a BlockpageDB from the given YAML
+// or JSON file and validates it.
+func LoadBlockpageDB(filename string) (*BlockpageDB, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	return ParseBlockpageDB(data)
+}
+
+// ParseBlockpageDB parses a BlockpageDB from YAML or JSON
+// (which is a subset of YAML) and validates it.
+func ParseBlockpageDB(data []byte) (*BlockpageDB, error) {
+	var db BlockpageDB
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	decoder.KnownFields(true)
+	if err := decoder.Decode(&db); err != nil && !errors.Is(err, io.EOF) {
+		return nil, fmt.Errorf("%w: %s", ErrInvalidBlockpageDB, err.Error())
+	}
+	if err := db.Validate(); err != nil {
+		return nil, err
+	}
+	return &db, nil
+}
+
+// Validate returns an error if any fingerprint is not valid. As a side
+// effect, this method prepares the fingerprints for matching, so you
+// MUST call it before calling Match.
+func (db *BlockpageDB) Validate() error {
+	ids := map[string]bool{}
+	for idx, fp := range db.Fingerprints {
+		if err := fp.prepare(); err != nil {
+			return fmt.Errorf("%w: fingerprint %d: %s", ErrInvalidBlockpageDB, idx, err.Error())
+		}
+		if ids[fp.ID] {
+			return fmt.Errorf("%w: fingerprint %d: duplicate ID: %s", ErrInvalidBlockpageDB, idx, fp.ID)
+		}
+		ids[fp.ID] = true
+	}
+	return nil
+}
+
+// Match returns the first fingerprint matching the given endpoint.
+func (db *BlockpageDB) Match(epnt *measurex.EndpointMeasurement) (*BlockpageFingerprint, bool) {
+	if epnt.Failure != "" || epnt.HTTPRoundTrip == nil {
+		return nil, false
+	}
+	for _, fp := range db.Fingerprints {
+		if fp.Match(epnt) {
+			return fp, true
+		}
+	}
+	return nil, false
+}
+
+// prepare validates the fingerprint and compiles its conditions.
+func (fp *BlockpageFingerprint) prepare() (err error) {
+	if fp.ID == "" {
+		return errors.New("missing ID")
+	}
+	if fp.BodyRegexp == "" && fp.BodyTLSH == "" && fp.Header == "" && len(fp.Addresses) <= 0 {
+		return fmt.Errorf("%s: no conditions", fp.ID)
+	}
+	if fp.HeaderRegexp != "" && fp.Header == "" {
+		return fmt.Errorf("%s: header_regexp without header", fp.ID)
+	}
+	if fp.BodyRegexp != "" {
+		if fp.bodyRegexp, err = regexp.Compile(fp.BodyRegexp); err != nil {
+			return fmt.Errorf("%s: %w", fp.ID, err)
+		}
+	}
+	if fp.BodyTLSH != "" {
+		if fp.bodyTLSH, err = tlsh.ParseStringToTlsh(fp.BodyTLSH); err != nil {
+			return fmt.Errorf("%s: %w", fp.ID, err)
+		}
+	}
+	if fp.HeaderRegexp != "" {
+		if fp.headerRegexp, err = regexp.Compile(fp.HeaderRegexp); err != nil {
+			return fmt.Errorf("%s: %w", fp.ID, err)
+		}
+	}
+	return nil
+}
+
+// Match returns whether this fingerprint matches the given endpoint.
+func (fp *BlockpageFingerprint) Match(epnt *measurex.EndpointMeasurement) bool {
+	return fp.matchBodyRegexp(epnt) && fp.matchBodyTLSH(epnt) &&
+		fp.matchHeader(epnt) && fp.matchAddresses(epnt)
+}
+
+// MatchTH returns whether the TH's response also matches this fingerprint,
+// given the probe's endpoint, which matches it, and the corresponding TH's
+// endpoint, which may be nil. Because the TH does not send us the response
+// body, we also consider the TH's response matching when its body is similar
+// to the probe's body, meaning that the TH has fetched the same webpage.
+func (fp *BlockpageFingerprint) MatchTH(epnt, thEpnt *measurex.EndpointMeasurement) bool {
+	if thEpnt == nil || thEpnt.Failure != "" || thEpnt.HTTPRoundTrip == nil {
+		return false
+	}
+	if fp.Match(thEpnt) {
+		return true
+	}
+	probeTLSH, good := blockpageParseTLSH(epnt.ResponseBodyTLSH())
+	if !good {
+		return false
+	}
+	thTLSH, good := blockpageParseTLSH(thEpnt.ResponseBodyTLSH())
+	if !good {
+		return false
+	}
+	return probeTLSH.Diff(thTLSH) <= DefaultBlockpageTLSHMaxDiff
+}
+
+// blockpageParseTLSH parses the TLSH of a response body. It returns false
+// when the TLSH is missing (e.g., the body is too short to compute it) or
+// invalid. We need to check for the empty string because the TLSH
+// library panics when parsing an empty string.
+func blockpageParseTLSH(value string) (*tlsh.Tlsh, bool) {
+	if value == "" {
+		return nil, false
+	}
+	parsed, err := tlsh.ParseStringToTlsh(value)
+	if err != nil {
+		return nil, false
+	}
+	return parsed, true
+}
+
+// Describe returns a description of this fingerprint.
+func (fp *BlockpageFingerprint) Describe() string {
+	if fp.Description == "" {
+		return fmt.Sprintf("'%s'", fp.ID)
+	}
+	return fmt.Sprintf("'%s' (%s)", fp.ID, fp.Description)
+}
+
+func (fp *BlockpageFingerprint) matchBodyRegexp(epnt *measurex.EndpointMeasurement) bool {
+	return fp.bodyRegexp == nil || fp.bodyRegexp.Match(epnt.ResponseBody())
+}
+
+func (fp *BlockpageFingerprint) matchBodyTLSH(epnt *measurex.EndpointMeasurement) bool {
+	if fp.bodyTLSH == nil {
+		return true
+	}
+	other, good := blockpageParseTLSH(epnt.ResponseBodyTLSH())
+	if !good {
+		return false // e.g., the body is too short to compute the TLSH
+	}
+	maxDiff := fp.BodyTLSHMaxDiff
+	if maxDiff <= 0 {
+		maxDiff = DefaultBlockpageTLSHMaxDiff
+	}
+	return fp.bodyTLSH.Diff(other) <= maxDiff
+}
+
+func (fp *BlockpageFingerprint) matchHeader(epnt *measurex.EndpointMeasurement) bool {
+	if fp.Header == "" {
+		return true
+	}
+	values := epnt.ResponseHeaders().Values(fp.Header)
+	for _, value := range values {
+		if fp.headerRegexp == nil || fp.headerRegexp.MatchString(value) {
+			return true
+		}
+	}
+	return false
+}
+
+func (fp *BlockpageFingerprint) matchAddresses(epnt *measurex.EndpointMeasurement) bool {
+	return analysisRuleMatch(fp.Addresses, epnt.IPAddress())
+}
+
+// DefaultBlockpageDB returns a new instance of the default DB.
+func DefaultBlockpageDB() *BlockpageDB {
+	db := &BlockpageDB{
+		Fingerprints: defaultBlockpageFingerprints(),
+	}
+	runtimex.PanicOnError(db.Validate(), "invalid default blockpage DB")
+	return db
+}
+
+// defaultBlockpageDB is the DB used when the client
+// does not configure any DB.
+var defaultBlockpageDB = DefaultBlockpageDB()
+
+// defaultBlockpageFingerprints returns the default fingerprints.
+func defaultBlockpageFingerprints() []*BlockpageFingerprint {
+	return []*BlockpageFingerprint{{
+		ID:          "ir_iframe",
+		Description: "Iran: iframe pointing to the national blockpage server",
+		BodyRegexp:  `iframe src="http://10\.10\.34\.3[4-6]`,
+	}, {
+		ID:           "ru_rostelecom",
+		Description:  "Russia: redirect to the Rostelecom blockpage",
+		Header:       "Location",
+		HeaderRegexp: `^https?://warning\.rt\.ru`,
+	}, {
+		ID:           "id_internet_positif",
+		Description:  "Indonesia: redirect to the Internet Positif blockpage",
+		Header:       "Location",
+		HeaderRegexp: `^https?://(www\.)?internet-?positif\.`,
+	}, {
+		ID:          "gr_gaming_commission",
+		Description: "Greece: Hellenic Gaming Commission blockpage",
+		BodyRegexp:  `www\.gamingcommission\.gov\.gr/index\.php/forbidden-access-black-list`,
+	}}
+}
@@ -0,0 +1,116 @@
+package websteps
+
+import (
+	"encoding/json"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/bassosimone/websteps-illustrated/internal/archival"
+	"github.com/bassosimone/websteps-illustrated/internal/measurex"
+	"github.com/glaslos/tlsh"
+)
+
+func TestDefaultBlockpageDBMatchesYAML(t *testing.T) {
+	db, err := LoadBlockpageDB(filepath.Join("..", "..", "..", "..", "testdata", "blockpages.yaml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect, err := json.MarshalIndent(DefaultBlockpageDB(), "", "  ")
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := json.MarshalIndent(db, "", "  ")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(expect) != string(got) {
+		t.Fatalf("testdata/blockpages.yaml differs from DefaultBlockpageDB\nexpected:\n%s\ngot:\n%s",
+			string(expect), string(got))
+	}
+}
+
+// newBlockpageTestEndpoint creates a successful endpoint measurement
+// with the given response body and headers.
+func newBlockpageTestEndpoint(id int64, body string,
+	headers http.Header) *measurex.EndpointMeasurement {
+	var bodyTLSH string
+	if hash, err := tlsh.HashBytes([]byte(body)); err == nil {
+		bodyTLSH = hash.String()
+	}
+	return &measurex.EndpointMeasurement{
+		ID:      id,
+		URL:     &measurex.SimpleURL{Scheme: "http", Host: "example.com", Path: "/"},
+		Network: archival.NetworkTypeTCP,
+		Address: "93.184.216.34:80",
+		HTTPRoundTrip: &archival.FlatHTTPRoundTripEvent{
+			ResponseBody:     []byte(body),
+			ResponseBodyTLSH: bodyTLSH,
+			ResponseHeaders:  headers,
+			StatusCode:       200,
+		},
+	}
+}
+
+func TestBlockpageFingerprintMatchTH(t *testing.T) {
+	article := strings.Repeat(`<p>Censors in Iran serve a page containing
+<code>iframe src="http://10.10.34.34</code> to users who try to access blocked
+websites. This article explains how researchers detect such pages.</p>`, 4)
+	blockpage := `<html><head><title>M1-6</title></head><body>
+<iframe src="http://10.10.34.34?type=Invalid Site&policy=MainPolicy" style="width: 100%;
+height: 100%" scrolling="no" marginwidth="0" marginheight="0" frameborder="0"
+vspace="0" hspace="0"></iframe></body></html>`
+	legit := strings.Repeat(`<p>Welcome to our website! Here you can find the
+latest news about our products, our team, and upcoming events in town.</p>`, 4)
+	db := DefaultBlockpageDB()
+	tests := []struct {
+		name   string
+		probe  *measurex.EndpointMeasurement
+		th     *measurex.EndpointMeasurement
+		expect bool
+	}{{
+		name:   "the TH did not measure the endpoint",
+		probe:  newBlockpageTestEndpoint(1, blockpage, nil),
+		th:     nil,
+		expect: false,
+	}, {
+		name:  "the TH failed",
+		probe: newBlockpageTestEndpoint(1, blockpage, nil),
+		th: &measurex.EndpointMeasurement{
+			ID:      2,
+			Failure: "connection_refused",
+		},
+		expect: false,
+	}, {
+		name:   "the TH fetched another webpage",
+		probe:  newBlockpageTestEndpoint(1, blockpage, nil),
+		th:     newBlockpageTestEndpoint(2, legit, nil),
+		expect: false,
+	}, {
+		name:   "the TH fetched the same webpage",
+		probe:  newBlockpageTestEndpoint(1, article, nil),
+		th:     newBlockpageTestEndpoint(2, article, nil),
+		expect: true,
+	}, {
+		name: "the TH is redirected to the same blockpage",
+		probe: newBlockpageTestEndpoint(1, "", http.Header{
+			"Location": {"http://warning.rt.ru/"},
+		}),
+		th: newBlockpageTestEndpoint(2, "", http.Header{
+			"Location": {"http://warning.rt.ru/"},
+		}),
+		expect: true,
+	}}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fp, found := db.Match(tt.probe)
+			if !found {
+				t.Fatal("the probe's endpoint should match a fingerprint")
+			}
+			if got := fp.MatchTH(tt.probe, tt.th); got != tt.expect {
+				t.Fatal("expected", tt.expect, "got", got)
+			}
+		})
+	}
+}
@@ -105,11 +105,13 @@ func (sc *stepsCache) dnsLookup(mx measurex.AbstractMeasurer,
 			Addresses:       addrs,
 			CNAME:           "",
 			Domain:          domain,
+			ECHConfigList:   nil,
 			Failure:         "",
 			Finished:        now,
 			LookupType:      archival.DNSLookupTypeHTTPS,
 			NS:              []string{},
 			PTRs:            []string{},
+			Port:            0,
 			ResolverAddress: "",
 			ResolverNetwork: "dnscache",
 			Started:         now,
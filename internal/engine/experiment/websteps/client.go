@@ -10,6 +10,7 @@ import (
 	"context"
 	"fmt"
 	"math/rand"
+	"sync"
 	"time"
 
 	"github.com/bassosimone/websteps-illustrated/internal/archival"
@@ -17,6 +18,7 @@ import (
 	"github.com/bassosimone/websteps-illustrated/internal/logcat"
 	"github.com/bassosimone/websteps-illustrated/internal/measurex"
 	"github.com/bassosimone/websteps-illustrated/internal/model"
+	"github.com/bassosimone/websteps-illustrated/internal/traceroute"
 )
 
 // TestKeys contains the experiment test keys.
@@ -46,6 +48,24 @@ type TestKeysOrError struct {
 // a valid Client and then you can modify the public fields. You
 // MUST do that before starting the client loop.
 type Client struct {
+	// AnalysisRules contains the OPTIONAL rules used by the analysis
+	// to classify failures. If nil, we use DefaultAnalysisRuleset. If
+	// you set this field, you MUST set it before starting any
+	// background worker and you MUST NOT modify it afterwards.
+	AnalysisRules *AnalysisRuleset
+
+	// BlockpageDB contains the OPTIONAL blockpage fingerprints used
+	// by the analysis. If nil, we use DefaultBlockpageDB. The same
+	// restrictions of AnalysisRules apply to this field.
+	BlockpageDB *BlockpageDB
+
+	// DNSPingSuccessfulQueries is the OPTIONAL flag telling us to also
+	// send successful UDP queries again using dnsping, which allows us to
+	// detect injected replies that do not contain bogons. Because each step
+	// then waits for an additional dnsping query timeout, we don't do that
+	// by default. You MUST set this field before starting any worker.
+	DNSPingSuccessfulQueries bool
+
 	// Input is the MANDATORY channel for receiving Input.
 	Input chan string
 
@@ -61,12 +81,24 @@ type Client struct {
 	NewDNSPingEngine func(
 		idgen dnsping.IDGenerator, queryTimeout time.Duration) dnsping.AbstractEngine
 
+	// NewTracerouteEngine is the MANDATORY factory for creating
+	// new instances of the traceroute engine. You should set this
+	// field before starting any background worker.
+	NewTracerouteEngine func(
+		idgen traceroute.IDGenerator, maxTTL int) traceroute.AbstractEngine
+
 	// Output is the MANDATORY channel for emitting measurements.
 	Output chan *TestKeysOrError
 
 	// Resolvers contains the MANDATORY Resolvers to use.
 	Resolvers []*measurex.DNSResolverInfo
 
+	// SNIControlDomain is the OPTIONAL domain we use as the control
+	// SNI and as the known-good server when checking whether TLS blocking
+	// depends on the SNI. NewClient sets it to DefaultSNIControlDomain. If
+	// empty, we do not run the SNI blocking follow-up experiment.
+	SNIControlDomain string
+
 	// THMeasurementObserver is an OPTIONAL hook allowing
 	// the user to view/store the response from the TH.
 	//
@@ -74,6 +106,12 @@ type Client struct {
 	// most likely going to result in a data race.
 	THMeasurementObserver func(m *THResponse)
 
+	// TracerouteMaxTTL is the OPTIONAL maximum TTL we use when
+	// localizing the hop that interferes with TCP, TLS, or DNS. If
+	// zero, we do not run the traceroute follow-up experiment. You
+	// may want to use traceroute.DefaultMaxTTL.
+	TracerouteMaxTTL int
+
 	// dialerCleartext is the cleartext dialer to use.
 	dialerCleartext model.Dialer
 
@@ -83,6 +121,13 @@ type Client struct {
 	// options contains measurex options.
 	options *measurex.Options
 
+	// thMux is the persistent connection with the TH used
+	// by the websocket v2 protocol (if any).
+	thMux *thMuxConn
+
+	// thMuxMu protects thMux.
+	thMuxMu sync.Mutex
+
 	// thURL is the base URL of the test helper.
 	thURL string
 }
@@ -92,6 +137,10 @@ type THClient interface {
 	// THRequestAsync performs an async TH request posting the result on the out channel.
 	THRequestAsync(ctx context.Context, thReq *THRequest, out chan<- *THResponseOrError)
 
+	// THRequestStreamingAsync is like THRequestAsync but also posts partial results.
+	THRequestStreamingAsync(ctx context.Context, thReq *THRequest,
+		partial chan<- *THResponse, out chan<- *THResponseOrError)
+
 	// THRequest performs a sync TH request.
 	THRequest(ctx context.Context, req *THRequest) (*THResponse, error)
 }
@@ -110,18 +159,28 @@ func NewTHClientWithDefaultSettings(thURL string) THClient {
 func NewClient(dialer model.Dialer, tlsDialer model.TLSDialer, thURL string,
 	clientOptions *measurex.Options) *Client {
 	return &Client{
+		AnalysisRules:   nil, // meaning that we'll use the default rules
+		BlockpageDB:     nil, // meaning that we'll use the default DB
 		Input:           make(chan string),
 		MeasurerFactory: nil, // meaning that we'll use a default factory
 		NewDNSPingEngine: func(
 			idgen dnsping.IDGenerator, queryTimeout time.Duration) dnsping.AbstractEngine {
 			return dnsping.NewEngine(idgen, queryTimeout)
 		},
-		Output:          make(chan *TestKeysOrError),
-		dialerCleartext: dialer,
-		dialerTLS:       tlsDialer,
-		options:         clientOptions,
-		Resolvers:       defaultResolvers(),
-		thURL:           thURL,
+		NewTracerouteEngine: func(
+			idgen traceroute.IDGenerator, maxTTL int) traceroute.AbstractEngine {
+			return traceroute.NewEngine(idgen, maxTTL)
+		},
+		Output:           make(chan *TestKeysOrError),
+		dialerCleartext:  dialer,
+		dialerTLS:        tlsDialer,
+		options:          clientOptions,
+		Resolvers:        defaultResolvers(),
+		SNIControlDomain: DefaultSNIControlDomain,
+		TracerouteMaxTTL: 0, // meaning that we don't run traceroutes
+		thMux:            nil,
+		thMuxMu:          sync.Mutex{},
+		thURL:            thURL,
 	}
 }
 
@@ -142,6 +201,7 @@ func (c *Client) Loop(ctx context.Context, flags int64) {
 			c.steps(ctx, input, flags)
 		}
 	}
+	c.closeTHMuxConnection()
 	close(c.Output)
 }
 
@@ -200,7 +260,6 @@ func (c *Client) steps(ctx context.Context, input string, flags int64) {
 		redirects, _ := ssm.redirects(mx)
 		tkoe.TestKeys.Steps = append(tkoe.TestKeys.Steps, ssm)
 		q.Append(redirects...)
-		ssm.Flags = ssm.aggregateFlags()
 		if AnalysisFlagsContainAnomalies(ssm.Flags) && (flags&LoopFlagGreedy) != 0 {
 			logcat.Emit(logcat.NOTICE, logcat.SCRUTINIZE,
 				"greedy mode: stop as soon as we see anomalies")
@@ -352,28 +411,50 @@ func (c *Client) step(ctx context.Context, cache *stepsCache,
 	dc, pingRunning := c.dnsPingFollowUp(ctx, mx, cur)
 	ssm := newSingleStepMeasurement(cur)
 	epplan := c.newEndpointPlan(cur, cache)
-	thc := c.th(ctx, cur, epplan)
-	c.measureDiscoveredEndpoints(ctx, mx, cur, epplan)
-	c.measureAltSvcEndpoints(ctx, mx, cur)
+	thc, thch := c.th(ctx, cur, epplan)
+	thp := &thPartialResults{ch: thch, streamed: false}
+	c.measureDiscoveredEndpoints(ctx, mx, ssm, epplan, thp)
+	c.measureAltSvcEndpoints(ctx, mx, ssm, thp)
 	logcat.Substep("obtaining TH's measurements results")
+	c.consumePartialTHResults(ctx, mx, ssm, thp)
 	maybeTH := c.waitForTHC(thc)
-	if maybeTH.Err == nil {
+	switch {
+	case maybeTH.Err != nil && thp.streamed:
+		// We keep the partial results we received along with the analysis
+		// based on them, but we record that some TH results are missing.
+		ssm.TH.Incomplete = true
+	case maybeTH.Err == nil && !thp.streamed:
 		// Implementation note: the purpose of this "import" is to have
 		// timing and IDs compatible with our measurements.
 		ssm.TH = c.importTHMeasurement(mx, maybeTH.Resp, cur)
-		if c.THMeasurementObserver != nil {
-			c.THMeasurementObserver(ssm.TH)
-		}
+	}
+	if maybeTH.Err == nil && c.THMeasurementObserver != nil {
+		c.THMeasurementObserver(ssm.TH)
 	}
 	ssm.DNSPing = c.waitForDNSPing(dc, pingRunning)
 	c.measureAdditionalEndpoints(ctx, mx, ssm)
-	ssm.Analysis.DNS = ssm.dnsAnalysis(mx)
-	ssm.Analysis.Endpoint = ssm.endpointAnalysis(mx)
-	ssm.Analysis.TH = ssm.analyzeTHResults(mx)
-	// TODO(bassosimone): run follow-up experiments (e.g., SNI blocking)
+	ssm.analyze(mx, c.analysisRules(), c.blockpageDB())
+	c.sniFollowUp(ctx, mx, ssm)
+	c.tracerouteFollowUp(ctx, mx, ssm)
 	return ssm
 }
 
+// analysisRules returns the rules to use for the analysis.
+func (c *Client) analysisRules() *AnalysisRuleset {
+	if c.AnalysisRules != nil {
+		return c.AnalysisRules
+	}
+	return defaultAnalysisRuleset
+}
+
+// blockpageDB returns the blockpage DB to use for the analysis.
+func (c *Client) blockpageDB() *BlockpageDB {
+	if c.BlockpageDB != nil {
+		return c.BlockpageDB
+	}
+	return defaultBlockpageDB
+}
+
 func (c *Client) waitForTHC(thc <-chan *THResponseOrError) *THResponseOrError {
 	ol := measurex.NewOperationLogger("waiting for TH to complete")
 	out := <-thc
@@ -429,26 +510,50 @@ func (c *Client) newEndpointPlan(
 	return plan
 }
 
-func (c *Client) measureDiscoveredEndpoints(ctx context.Context,
-	mx measurex.AbstractMeasurer, cur *measurex.URLMeasurement, plan []*measurex.EndpointPlan) {
+func (c *Client) measureDiscoveredEndpoints(ctx context.Context, mx measurex.AbstractMeasurer,
+	ssm *SingleStepMeasurement, plan []*measurex.EndpointPlan, thp *thPartialResults) {
 	if len(plan) <= 0 {
 		logcat.Shrugf("unfortunately, there are no valid endpoints to test here")
 		return
 	}
 	logcat.Substepf("now testing %d HTTP/HTTPS/HTTP3 endpoints deriving from the discovered IP addresses", len(plan))
-	for m := range mx.MeasureEndpoints(ctx, plan...) {
-		cur.Endpoint = append(cur.Endpoint, m)
-	}
+	c.measureEndpointsWhileConsumingTH(ctx, mx, ssm, plan, thp)
 }
 
-func (c *Client) measureAltSvcEndpoints(ctx context.Context,
-	mx measurex.AbstractMeasurer, cur *measurex.URLMeasurement) {
-	epntPlan, _ := cur.NewEndpointPlan(measurex.EndpointPlanningOnlyHTTP3)
+func (c *Client) measureAltSvcEndpoints(ctx context.Context, mx measurex.AbstractMeasurer,
+	ssm *SingleStepMeasurement, thp *thPartialResults) {
+	epntPlan, _ := ssm.ProbeInitial.NewEndpointPlan(measurex.EndpointPlanningOnlyHTTP3)
 	if len(epntPlan) <= 0 {
 		return
 	}
-	for m := range mx.MeasureEndpoints(ctx, epntPlan...) {
-		cur.Endpoint = append(cur.Endpoint, m)
+	c.measureEndpointsWhileConsumingTH(ctx, mx, ssm, epntPlan, thp)
+}
+
+// measureEndpointsWhileConsumingTH measures the given endpoints and appends
+// the results to ssm.ProbeInitial. Meanwhile, we consume the partial results
+// streamed by the TH, so we can act on them as soon as they arrive. We do
+// both things in the same goroutine, so we don't need to lock ssm.
+func (c *Client) measureEndpointsWhileConsumingTH(ctx context.Context, mx measurex.AbstractMeasurer,
+	ssm *SingleStepMeasurement, plan []*measurex.EndpointPlan, thp *thPartialResults) {
+	epnts := mx.MeasureEndpoints(ctx, plan...)
+	for epnts != nil {
+		select {
+		case m, good := <-epnts:
+			if !good {
+				epnts = nil
+				continue
+			}
+			ssm.ProbeInitial.Endpoint = append(ssm.ProbeInitial.Endpoint, m)
+			if thp.streamed {
+				ssm.earlyEndpointAnalysisStep(mx, c.analysisRules(), c.blockpageDB())
+			}
+		case resp, good := <-thp.ch: // blocks forever once we set thp.ch to nil
+			if !good {
+				thp.ch = nil
+				continue
+			}
+			c.importPartialTHResult(ctx, mx, ssm, thp, resp)
+		}
 	}
 }
 
@@ -472,11 +577,13 @@ func (c *Client) importTHMeasurement(mx measurex.AbstractMeasurer, in *THRespons
 				Addresses:       e.Addresses(),
 				CNAME:           e.CNAME(),
 				Domain:          e.Domain(),
+				ECHConfigList:   e.ECHConfigList(),
 				Failure:         e.Failure(),
 				Finished:        now,
 				LookupType:      e.LookupType(),
 				NS:              e.NS(),
 				PTRs:            e.PTRs(),
+				Port:            e.Port(),
 				ResolverAddress: e.ResolverAddress(),
 				ResolverNetwork: e.ResolverNetwork(),
 				Started:         now,
@@ -502,6 +609,7 @@ func (c *Client) importTHMeasurement(mx measurex.AbstractMeasurer, in *THRespons
 			Location:         e.Location,
 			HTTPTitle:        e.HTTPTitle,
 			NetworkEvent:     []*archival.FlatNetworkEvent{},
+			SpeedSamples:     e.SpeedSamples,
 			TCPConnect:       nil,
 			QUICTLSHandshake: nil,
 			HTTPRoundTrip:    c.importHTTPRoundTripEvent(now, e.HTTPRoundTrip),
@@ -565,13 +673,66 @@ func (thm *THResponse) URLAddressList(domain string) (o []*measurex.URLAddress,
 	return
 }
 
+// thPartialResults contains the state of the partial results streamed by the TH.
+type thPartialResults struct {
+	// ch is the channel that receives the partial results. We set it to
+	// nil after the TH has closed it because it is done streaming.
+	ch <-chan *THResponse
+
+	// streamed indicates whether we received partial results, in which case
+	// ssm.TH already contains the whole final result when the TH succeeds.
+	streamed bool
+}
+
+// consumePartialTHResults consumes the partial results streamed by the TH
+// that we did not consume while measuring and returns when the TH is done
+// streaming. See importPartialTHResult for how we use them.
+func (c *Client) consumePartialTHResults(ctx context.Context,
+	mx measurex.AbstractMeasurer, ssm *SingleStepMeasurement, thp *thPartialResults) {
+	if thp.ch == nil {
+		return
+	}
+	for resp := range thp.ch {
+		c.importPartialTHResult(ctx, mx, ssm, thp, resp)
+	}
+	thp.ch = nil
+}
+
+// importPartialTHResult imports a partial result streamed by the TH into
+// ssm.TH, measures the additional endpoints it reveals, and analyzes the
+// probe's endpoints that we can now compare with the TH.
+func (c *Client) importPartialTHResult(ctx context.Context, mx measurex.AbstractMeasurer,
+	ssm *SingleStepMeasurement, thp *thPartialResults, resp *THResponse) {
+	thm := c.importTHMeasurement(mx, resp, ssm.ProbeInitial)
+	if !thp.streamed {
+		ssm.TH = thm
+		thp.streamed = true
+	} else {
+		ssm.TH.DNS = append(ssm.TH.DNS, thm.DNS...)
+		ssm.TH.Endpoint = append(ssm.TH.Endpoint, thm.Endpoint...)
+	}
+	if len(thm.Endpoint) <= 0 {
+		return // only endpoints may reveal additional addresses
+	}
+	c.measureAdditionalEndpointsFromTH(ctx, mx, ssm, ssm.TH)
+	ssm.earlyEndpointAnalysisStep(mx, c.analysisRules(), c.blockpageDB())
+}
+
 func (c *Client) measureAdditionalEndpoints(ctx context.Context,
 	mx measurex.AbstractMeasurer, ssm *SingleStepMeasurement) {
-	addrslist, _ := c.expandProbeKnowledge(ssm)
+	c.measureAdditionalEndpointsFromTH(ctx, mx, ssm, ssm.TH)
+}
+
+// measureAdditionalEndpointsFromTH measures the endpoints that the given
+// TH response reveals and that the probe has not measured yet.
+func (c *Client) measureAdditionalEndpointsFromTH(ctx context.Context,
+	mx measurex.AbstractMeasurer, ssm *SingleStepMeasurement, thm *THResponse) {
+	addrslist, _ := c.expandProbeKnowledge(ssm, thm)
 	// Here we need to specify "measure again" because the addresses appear to be
 	// already tested though it's the TH that has tested them, not us.
 	plan, _ := ssm.ProbeInitial.NewEndpointPlanWithAddressList(
 		addrslist, measurex.EndpointPlanningMeasureAgain)
+	plan = ssm.excludeMeasuredAdditionalEndpoints(plan)
 	if len(plan) > 0 {
 		logcat.Substep("checking for and testing additional addresses in TH results")
 		for m := range mx.MeasureEndpoints(ctx, plan...) {
@@ -580,6 +741,26 @@ func (c *Client) measureAdditionalEndpoints(ctx context.Context,
 	}
 }
 
+// excludeMeasuredAdditionalEndpoints returns the entries of the plan
+// that we have not already measured as additional endpoints, which may
+// happen when we act on partial TH results before the final result.
+func (ssm *SingleStepMeasurement) excludeMeasuredAdditionalEndpoints(
+	plan []*measurex.EndpointPlan) (out []*measurex.EndpointPlan) {
+	for _, e := range plan {
+		var measured bool
+		for _, m := range ssm.ProbeAdditional {
+			if m.CouldDeriveFrom(e) {
+				measured = true
+				break
+			}
+		}
+		if !measured {
+			out = append(out, e)
+		}
+	}
+	return
+}
+
 // expandProbeKnowledge returns a list of URL addresses that extends
 // the original list known to the probe by adding IP addresses that the
 // TH discovered and the probe didn't know about.
@@ -594,10 +775,10 @@ func (c *Client) measureAdditionalEndpoints(ctx context.Context,
 // list doesn't imply that the probe will end up testing it. Limitations
 // on the maximum number of addresses per family apply.
 func (c *Client) expandProbeKnowledge(
-	ssm *SingleStepMeasurement) ([]*measurex.URLAddress, bool) {
+	ssm *SingleStepMeasurement, thm *THResponse) ([]*measurex.URLAddress, bool) {
 	// 1. gather the lists for the probe and the th
 	pal, _ := ssm.probeInitialURLAddressList()
-	thal, _ := ssm.testHelperURLAddressList()
+	thal, _ := thm.URLAddressList(ssm.ProbeInitialDomain())
 	// 2. only keep new addresses
 	diff := measurex.NewURLAddressListDiff(thal, pal)
 	for _, e := range diff.NewEntries {
@@ -28,7 +28,16 @@ import (
 // to retry the query a bunch of times);
 //
 // 3. we see NXDOMAIN (in which case we also hope that dnsping allows us
-// to detect possible legit late or duplicate DNS responses).
+// to detect possible legit late or duplicate DNS responses);
+//
+// 4. we see a reply with ordinary addresses and Client.DNSPingSuccessfulQueries
+// is set (in which case we send the query once more to check whether we receive
+// a forged reply followed by a legit reply, because injectors do not always
+// use bogons).
+//
+// In the first three cases, we send the query several times. In the
+// fourth case, a single query is enough, because dnsping collects all
+// the replies it receives for each query.
 //
 // When we start a background dnsping, we return a valid channel
 // and true. Otherwise we return a nil channel and false.
@@ -38,7 +47,7 @@ import (
 //
 // The pointer returned by the channel is nil if there's no work that the
 // dnsping experiment has actually performed. This happens when none of
-// three above triggering conditions are actually met.
+// the four above triggering conditions are actually met.
 func (c *Client) dnsPingFollowUp(ctx context.Context, mx measurex.AbstractMeasurer,
 	current *measurex.URLMeasurement) (<-chan *dnsping.Result, bool) {
 	var overall []*dnsping.SinglePingPlan
@@ -74,24 +83,36 @@ func (c *Client) dnsPingSelectQueries(in []*measurex.DNSLookupMeasurement) (
 			logcat.Bugf("UDP query w/o resolver address")
 			continue // should not happen but #safetyNet
 		}
-		switch v := entry.Failure(); v {
-		case netxlite.FailureGenericTimeoutError,
-			netxlite.FailureDNSNXDOMAINError:
-			logcat.Noticef("query #%d failed with %s; I will investigate using dnsping", entry.ID, v)
+		switch v := entry.Failure(); {
+		case c.dnsPingShouldRetry(entry):
+			logcat.Noticef("query #%d failed with %s or contains bogons; I will investigate using dnsping",
+				entry.ID, archival.FlatFailureToStringOrOK(v))
+			out = append(out, entry)
+		case c.DNSPingSuccessfulQueries && v == "" && len(entry.Addresses()) > 0:
+			logcat.Noticef("query #%d succeeded; I will check for DNS injection using dnsping", entry.ID)
 			out = append(out, entry)
-		case "":
-			for _, addr := range entry.Addresses() {
-				if netxlite.IsBogon(addr) {
-					logcat.Noticef("query #%d contains bogons; I will investigate using dnsping", entry.ID)
-					out = append(out, entry)
-					break // one bogon is enough to warrant a retry
-				}
-			}
 		}
 	}
 	return
 }
 
+// dnsPingShouldRetry returns whether the given query failed with a timeout
+// or NXDOMAIN or contains bogons, in which case we send it several times.
+func (c *Client) dnsPingShouldRetry(entry *measurex.DNSLookupMeasurement) bool {
+	switch entry.Failure() {
+	case netxlite.FailureGenericTimeoutError,
+		netxlite.FailureDNSNXDOMAINError:
+		return true
+	case "":
+		for _, addr := range entry.Addresses() {
+			if netxlite.IsBogon(addr) {
+				return true // one bogon is enough to warrant a retry
+			}
+		}
+	}
+	return false
+}
+
 // dnsPingMakePlan returns a plan for retesting this query using dnsping.
 //
 // The general idea of the algorithm is that we cannot run a long
@@ -110,6 +131,9 @@ func (c *Client) dnsPingMakePlan(
 		200 * time.Millisecond,
 		500 * time.Millisecond,
 	}
+	if !c.dnsPingShouldRetry(dlm) {
+		delays = delays[:1] // just checking for DNS injection
+	}
 	for _, delay := range delays {
 		switch dlm.LookupType() {
 		case archival.DNSLookupTypeGetaddrinfo:
@@ -98,6 +98,18 @@ var analysisDescriptions = []*AnalysisDescription{{
 	Flag:     AnalysisHTTPEOF,
 	Hashtag:  "#httpEOF",
 	Severity: logcat.UNEXPECTED,
+}, {
+	Flag:     AnalysisThrottling,
+	Hashtag:  "#throttling",
+	Severity: logcat.UNEXPECTED,
+}, {
+	Flag:     AnalysisBlockpage,
+	Hashtag:  "#httpBlockpage",
+	Severity: logcat.CONFIRMED,
+}, {
+	Flag:     AnalysisDNSInjected,
+	Hashtag:  "#dnsInjection",
+	Severity: logcat.CONFIRMED,
 }, {
 	Flag:     AnalysisInconclusive,
 	Hashtag:  "#inconclusive",
@@ -130,6 +142,14 @@ var analysisDescriptions = []*AnalysisDescription{{
 	Flag:     AnalysisHTTPDiffTransparentProxy,
 	Hashtag:  "#httpDiffTransparentProxy",
 	Severity: 0,
+}, {
+	Flag:     AnalysisSNIBlocking,
+	Hashtag:  "#sniBlocking",
+	Severity: 0,
+}, {
+	Flag:     AnalysisIPBlocking,
+	Hashtag:  "#ipBlocking",
+	Severity: 0,
 }}
 
 // ExplainFlagsUsingTagsAndSeverity provides an explanation of a given set of flags
@@ -144,6 +164,26 @@ func ExplainFlagsUsingTagsAndSeverity(flags int64) (tags []string, severity int6
 	return
 }
 
+// ParseHashtags is the inverse of ExplainFlagsUsingTagsAndSeverity. It
+// maps the given hashtags to flags and returns the flags along with the
+// list of hashtags that do not correspond to any flag.
+func ParseHashtags(tags ...string) (flags int64, unknown []string) {
+	for _, tag := range tags {
+		var found bool
+		for _, e := range analysisDescriptions {
+			if e.Hashtag == tag {
+				flags |= e.Flag
+				found = true
+				break
+			}
+		}
+		if !found {
+			unknown = append(unknown, tag)
+		}
+	}
+	return
+}
+
 // Explainable is something for which we can explain a set of flags.
 type Explainable interface {
 	// Describe returns a description of the explainable.
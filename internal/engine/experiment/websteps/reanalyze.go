@@ -0,0 +1,123 @@
+package websteps
+
+//
+// Reanalyze
+//
+// Code to recompute the analysis of existing measurements.
+//
+
+import (
+	"github.com/bassosimone/websteps-illustrated/internal/logcat"
+	"github.com/bassosimone/websteps-illustrated/internal/measurex"
+)
+
+// Reanalyze recomputes the analysis of each step using the current
+// analysis code, the given rules, and the given blockpage DB, where nil
+// means using the defaults. This method replaces the Analysis and the
+// Flags of each step and updates the test keys Flags. The new analysis
+// results use IDs larger than all the IDs already contained inside the
+// test keys.
+func (tk *TestKeys) Reanalyze(rules *AnalysisRuleset, blockpages *BlockpageDB) {
+	if rules == nil {
+		rules = defaultAnalysisRuleset
+	}
+	if blockpages == nil {
+		blockpages = defaultBlockpageDB
+	}
+	idgen := &reanalyzeIDGenerator{id: tk.maxID()}
+	for _, ssm := range tk.Steps {
+		if ssm == nil {
+			logcat.Bug("Reanalyze passed test keys containing a nil step")
+			continue
+		}
+		logcat.Stepf("reanalyzing '%s'", ssm.describeURL())
+		ssm.analyze(idgen, rules, blockpages)
+	}
+	tk.Flags = tk.aggregateFlags()
+}
+
+// reanalyzeIDGenerator generates IDs for Reanalyze.
+type reanalyzeIDGenerator struct {
+	id int64
+}
+
+// NextID implements analysisIDGenerator.NextID.
+func (g *reanalyzeIDGenerator) NextID() int64 {
+	g.id++
+	return g.id
+}
+
+// maxID returns the largest ID contained inside the test keys.
+func (tk *TestKeys) maxID() (id int64) {
+	max := func(v int64) {
+		if v > id {
+			id = v
+		}
+	}
+	for _, ssm := range tk.Steps {
+		if ssm == nil {
+			continue
+		}
+		if ssm.ProbeInitial != nil {
+			max(ssm.ProbeInitial.ID)
+			for _, d := range ssm.ProbeInitial.DNS {
+				max(d.ID)
+			}
+			for _, e := range ssm.ProbeInitial.Endpoint {
+				max(e.ID)
+			}
+		}
+		if ssm.TH != nil {
+			for _, d := range ssm.TH.DNS {
+				max(d.ID)
+			}
+			for _, e := range ssm.TH.Endpoint {
+				max(e.ID)
+			}
+		}
+		if ssm.DNSPing != nil {
+			for _, p := range ssm.DNSPing.Pings {
+				max(p.ID)
+				for _, r := range p.Replies {
+					max(r.ID)
+				}
+			}
+		}
+		for _, e := range ssm.ProbeAdditional {
+			max(e.ID)
+		}
+		for _, m := range ssm.SNIFollowUp {
+			for _, e := range []*measurex.EndpointMeasurement{m.ControlSNI, m.NoSNI, m.ControlServer} {
+				if e != nil {
+					max(e.ID)
+				}
+			}
+		}
+		for _, r := range ssm.Traceroute {
+			max(r.ID)
+		}
+		if ssm.Analysis != nil {
+			for _, a := range ssm.Analysis.DNS {
+				max(a.ID)
+			}
+			for _, a := range ssm.Analysis.Endpoint {
+				max(a.ID)
+			}
+			for _, a := range ssm.Analysis.TH {
+				max(a.ID)
+			}
+			for _, a := range ssm.Analysis.SNI {
+				max(a.ID)
+			}
+		}
+	}
+	return
+}
+
+// describeURL returns the URL measured by this step.
+func (ssm *SingleStepMeasurement) describeURL() string {
+	if ssm.ProbeInitial != nil && ssm.ProbeInitial.URL != nil {
+		return ssm.ProbeInitial.URL.String()
+	}
+	return ""
+}
@@ -0,0 +1,62 @@
+package websteps
+
+import (
+	"testing"
+
+	"github.com/bassosimone/websteps-illustrated/internal/measurex"
+	"github.com/bassosimone/websteps-illustrated/internal/traceroute"
+)
+
+func TestTestKeysMaxID(t *testing.T) {
+	newTestKeys := func(ssm *SingleStepMeasurement) *TestKeys {
+		return &TestKeys{Steps: []*SingleStepMeasurement{nil, ssm}}
+	}
+	tests := []struct {
+		name   string
+		ssm    *SingleStepMeasurement
+		expect int64
+	}{{
+		name:   "empty step",
+		ssm:    &SingleStepMeasurement{},
+		expect: 0,
+	}, {
+		name: "largest ID in the probe endpoints",
+		ssm: &SingleStepMeasurement{
+			ProbeInitial: &measurex.URLMeasurement{
+				ID:       1,
+				Endpoint: []*measurex.EndpointMeasurement{{ID: 7}},
+			},
+			Traceroute: []*traceroute.Result{{ID: 3}},
+		},
+		expect: 7,
+	}, {
+		name: "largest ID in the SNI follow-up",
+		ssm: &SingleStepMeasurement{
+			ProbeInitial: &measurex.URLMeasurement{ID: 1},
+			SNIFollowUp: []*SNIFollowUpMeasurement{{
+				ControlSNI: &measurex.EndpointMeasurement{ID: 9},
+			}},
+		},
+		expect: 9,
+	}, {
+		name: "largest ID in the traceroute results",
+		ssm: &SingleStepMeasurement{
+			ProbeInitial: &measurex.URLMeasurement{
+				ID:       1,
+				Endpoint: []*measurex.EndpointMeasurement{{ID: 4}},
+			},
+			Analysis: &Analysis{
+				Endpoint: []*AnalysisEndpoint{{ID: 5, Refs: []int64{4}}},
+			},
+			Traceroute: []*traceroute.Result{{ID: 6, TargetID: 4}, {ID: 11, TargetID: 4}},
+		},
+		expect: 11,
+	}}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if id := newTestKeys(tt.ssm).maxID(); id != tt.expect {
+				t.Fatal("expected", tt.expect, "got", id)
+			}
+		})
+	}
+}
@@ -9,6 +9,7 @@ package websteps
 import (
 	"github.com/bassosimone/websteps-illustrated/internal/dnsping"
 	"github.com/bassosimone/websteps-illustrated/internal/measurex"
+	"github.com/bassosimone/websteps-illustrated/internal/traceroute"
 )
 
 // SingleStepMeasurement contains a a single-step measurement.
@@ -27,11 +28,23 @@ type SingleStepMeasurement struct {
 	// by the probe using extra info from the TH.
 	ProbeAdditional []*measurex.EndpointMeasurement `json:",omitempty"`
 
+	// SNIFollowUp contains the optional results of the
+	// SNI blocking follow-up experiment.
+	SNIFollowUp []*SNIFollowUpMeasurement `json:",omitempty"`
+
+	// Traceroute contains the optional results of the
+	// traceroute follow-up experiment.
+	Traceroute []*traceroute.Result `json:",omitempty"`
+
 	// Analysis contains the results analysis.
 	Analysis *Analysis
 
 	// Flags contains aggregate flags for this single step.
 	Flags int64
+
+	// earlyEndpointAnalysis maps the ID of a probe's endpoint measurement
+	// to its analysis, which we computed while receiving partial TH results.
+	earlyEndpointAnalysis map[int64]*AnalysisEndpoint
 }
 
 // ProbeInitialURLMeasurementID returns the ProbeInitial.ID value or zero.
@@ -58,6 +71,11 @@ func newSingleStepMeasurement(discover *measurex.URLMeasurement) *SingleStepMeas
 		TH:              &THResponse{},
 		DNSPing:         nil,
 		ProbeAdditional: []*measurex.EndpointMeasurement{},
+		SNIFollowUp:     []*SNIFollowUpMeasurement{},
+		Traceroute:      []*traceroute.Result{},
 		Analysis:        &Analysis{},
+		Flags:           0,
+
+		earlyEndpointAnalysis: map[int64]*AnalysisEndpoint{},
 	}
 }
@@ -0,0 +1,351 @@
+package websteps
+
+//
+// SNI follow-up
+//
+// Follow-up experiment to determine whether TLS blocking is SNI based.
+//
+// When a probe's endpoint fails with #tlsReset, #tlsTimeout, or #tlsEOF
+// and the TH succeeds, we perform the following TLS handshakes:
+//
+// 1. with the same IP address using a control SNI;
+//
+// 2. with the same IP address without SNI;
+//
+// 3. with a known-good server using the suspect SNI.
+//
+// We say that a handshake reaches the server when it succeeds or when
+// it fails because of the certificate (which is expected when the SNI
+// does not match the server). If neither (1) nor (2) reach the server,
+// the blocking is IP based (#ipBlocking). If either (1) or (2) reach the
+// server, or if (3) does not reach the known-good server, the blocking
+// is SNI based (#sniBlocking). Both flags may be set.
+//
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/bassosimone/websteps-illustrated/internal/archival"
+	"github.com/bassosimone/websteps-illustrated/internal/logcat"
+	"github.com/bassosimone/websteps-illustrated/internal/measurex"
+	"github.com/bassosimone/websteps-illustrated/internal/netxlite"
+)
+
+// DefaultSNIControlDomain is the default Client.SNIControlDomain.
+const DefaultSNIControlDomain = "example.com"
+
+// SNIFollowUpMeasurement contains the SNI follow-up measurements
+// for an endpoint whose TLS handshake failed.
+type SNIFollowUpMeasurement struct {
+	// EndpointID is the ID of the endpoint that failed.
+	EndpointID int64
+
+	// ControlSNI is the handshake with the same IP address
+	// using the control SNI.
+	ControlSNI *measurex.EndpointMeasurement `json:",omitempty"`
+
+	// NoSNI is the handshake with the same IP address without SNI.
+	NoSNI *measurex.EndpointMeasurement `json:",omitempty"`
+
+	// ControlServer is the handshake with a known-good server
+	// using the suspect SNI.
+	ControlServer *measurex.EndpointMeasurement `json:",omitempty"`
+}
+
+// ArchivalSNIFollowUpMeasurement is the archival format of SNIFollowUpMeasurement.
+type ArchivalSNIFollowUpMeasurement struct {
+	EndpointID    int64                                 `json:"endpoint_id"`
+	ControlSNI    *measurex.ArchivalEndpointMeasurement `json:"control_sni"`
+	NoSNI         *measurex.ArchivalEndpointMeasurement `json:"no_sni"`
+	ControlServer *measurex.ArchivalEndpointMeasurement `json:"control_server"`
+}
+
+// ToArchival converts SNIFollowUpMeasurement to the archival data format.
+func (m *SNIFollowUpMeasurement) ToArchival(begin time.Time) *ArchivalSNIFollowUpMeasurement {
+	const bodyFlags = 0
+	convert := func(em *measurex.EndpointMeasurement) *measurex.ArchivalEndpointMeasurement {
+		if em == nil {
+			return nil
+		}
+		v := em.ToArchival(begin, bodyFlags)
+		return &v
+	}
+	return &ArchivalSNIFollowUpMeasurement{
+		EndpointID:    m.EndpointID,
+		ControlSNI:    convert(m.ControlSNI),
+		NoSNI:         convert(m.NoSNI),
+		ControlServer: convert(m.ControlServer),
+	}
+}
+
+// sniFollowUp runs the SNI follow-up experiment for the endpoints that
+// failed the TLS handshake, stores the results into ssm.SNIFollowUp, and
+// updates the analysis and the flags of the step.
+func (c *Client) sniFollowUp(ctx context.Context,
+	mx measurex.AbstractMeasurer, ssm *SingleStepMeasurement) {
+	if c.SNIControlDomain == "" {
+		return
+	}
+	targets := ssm.sniFollowUpTargets()
+	if len(targets) <= 0 {
+		return
+	}
+	logcat.Substepf("checking whether TLS blocking of %d endpoint(s) depends on the SNI", len(targets))
+	controlAddrs := c.sniFollowUpResolveControlDomain(ctx, mx)
+	var (
+		plans []*measurex.EndpointPlan
+		runs  []*sniFollowUpRun
+	)
+	for _, target := range targets {
+		run := newSNIFollowUpRun(target, c.SNIControlDomain, controlAddrs)
+		plans = append(plans, run.plans()...)
+		runs = append(runs, run)
+	}
+	for m := range mx.MeasureEndpoints(ctx, plans...) {
+		for _, run := range runs {
+			run.maybeSave(m)
+		}
+	}
+	for _, run := range runs {
+		ssm.SNIFollowUp = append(ssm.SNIFollowUp, run.result)
+	}
+	ssm.Analysis.SNI = ssm.sniFollowUpAnalysis(mx)
+	ssm.Flags = ssm.aggregateFlags()
+}
+
+// sniFollowUpTargets returns the endpoints for which we should run the
+// SNI follow-up, i.e., the probe's TCP endpoints flagged because of TLS
+// failures, without duplicate IP address and domain pairs.
+func (ssm *SingleStepMeasurement) sniFollowUpTargets() (out []*measurex.EndpointMeasurement) {
+	if ssm.Analysis == nil {
+		return nil
+	}
+	const tlsFailures = AnalysisTLSReset | AnalysisTLSTimeout | AnalysisTLSEOF
+	uniq := map[string]bool{}
+	for _, score := range ssm.Analysis.Endpoint {
+		if (score.Flags&tlsFailures) == 0 || len(score.Refs) <= 0 {
+			continue
+		}
+		epnt, found := ssm.probeEndpointByID(score.Refs[0])
+		if !found || epnt.Network != archival.NetworkTypeTCP || epnt.URL == nil {
+			continue
+		}
+		key := epnt.Address + " " + epnt.URL.Hostname()
+		if uniq[key] {
+			continue
+		}
+		uniq[key] = true
+		out = append(out, epnt)
+	}
+	return
+}
+
+// probeEndpointByID returns the probe's endpoint with the given ID.
+func (ssm *SingleStepMeasurement) probeEndpointByID(id int64) (*measurex.EndpointMeasurement, bool) {
+	var epnts []*measurex.EndpointMeasurement
+	if ssm.ProbeInitial != nil {
+		epnts = append(epnts, ssm.ProbeInitial.Endpoint...)
+	}
+	epnts = append(epnts, ssm.ProbeAdditional...)
+	for _, epnt := range epnts {
+		if epnt.ID == id {
+			return epnt, true
+		}
+	}
+	return nil, false
+}
+
+// sniFollowUpResolveControlDomain resolves the control domain using
+// the system resolver and returns the non-bogon addresses.
+func (c *Client) sniFollowUpResolveControlDomain(
+	ctx context.Context, mx measurex.AbstractMeasurer) (out []string) {
+	um, err := mx.NewURLMeasurement("https://" + c.SNIControlDomain + "/")
+	if err != nil {
+		logcat.Bugf("cannot create URL measurement for the SNI control domain: %s", err.Error())
+		return nil
+	}
+	const flags = 0 // no extra queries
+	resolver := &measurex.DNSResolverInfo{
+		Network: "system",
+		Address: "",
+	}
+	for m := range mx.DNSLookups(ctx, um.NewDNSLookupPlans(flags, resolver)...) {
+		for _, addr := range m.Addresses() {
+			if !netxlite.IsBogon(addr) {
+				out = append(out, addr)
+			}
+		}
+	}
+	return
+}
+
+// sniFollowUpRun is the SNI follow-up for a single target.
+type sniFollowUpRun struct {
+	// controlServer is the plan for SNIFollowUpMeasurement.ControlServer.
+	controlServer *measurex.EndpointPlan
+
+	// controlSNI is the plan for SNIFollowUpMeasurement.ControlSNI.
+	controlSNI *measurex.EndpointPlan
+
+	// noSNI is the plan for SNIFollowUpMeasurement.NoSNI.
+	noSNI *measurex.EndpointPlan
+
+	// result contains the results.
+	result *SNIFollowUpMeasurement
+}
+
+// newSNIFollowUpRun creates a new sniFollowUpRun for the given target.
+func newSNIFollowUpRun(target *measurex.EndpointMeasurement,
+	controlDomain string, controlAddrs []string) *sniFollowUpRun {
+	run := &sniFollowUpRun{
+		controlServer: nil,
+		controlSNI:    nil,
+		noSNI:         nil,
+		result: &SNIFollowUpMeasurement{
+			EndpointID:    target.ID,
+			ControlSNI:    nil,
+			NoSNI:         nil,
+			ControlServer: nil,
+		},
+	}
+	addr, port, err := net.SplitHostPort(target.Address)
+	if err != nil {
+		logcat.Bugf("cannot split address of #%d: %s", target.ID, err.Error())
+		return run
+	}
+	suspectSNI := target.URL.Hostname()
+	run.controlSNI = newSNIFollowUpPlan(target, controlDomain, target.Address)
+	// Note: Go does not send the SNI extension when the server name is an IP address.
+	run.noSNI = newSNIFollowUpPlan(target, addr, target.Address)
+	usingIPv6 := target.UsingAddressIPv6()
+	for _, controlAddr := range controlAddrs {
+		if controlAddr == addr || isIPv6(controlAddr) != usingIPv6 {
+			continue
+		}
+		run.controlServer = newSNIFollowUpPlan(
+			target, suspectSNI, net.JoinHostPort(controlAddr, port))
+		break
+	}
+	return run
+}
+
+// plans returns the plans to measure.
+func (run *sniFollowUpRun) plans() (out []*measurex.EndpointPlan) {
+	for _, plan := range []*measurex.EndpointPlan{run.controlSNI, run.noSNI, run.controlServer} {
+		if plan != nil {
+			out = append(out, plan)
+		}
+	}
+	return
+}
+
+// maybeSave saves the given measurement if it derives from one of our plans.
+func (run *sniFollowUpRun) maybeSave(m *measurex.EndpointMeasurement) {
+	switch {
+	case run.controlSNI != nil && m.CouldDeriveFrom(run.controlSNI):
+		run.result.ControlSNI = m
+	case run.noSNI != nil && m.CouldDeriveFrom(run.noSNI):
+		run.result.NoSNI = m
+	case run.controlServer != nil && m.CouldDeriveFrom(run.controlServer):
+		run.result.ControlServer = m
+	}
+}
+
+// newSNIFollowUpPlan creates a plan for a TLS handshake with the given
+// address using the given SNI (the SNI is the URL's hostname).
+func newSNIFollowUpPlan(target *measurex.EndpointMeasurement,
+	sni, address string) *measurex.EndpointPlan {
+	_, port, _ := net.SplitHostPort(address)
+	return &measurex.EndpointPlan{
+		URLMeasurementID: target.URLMeasurementID,
+		Domain:           sni,
+		Network:          archival.NetworkTypeTCP,
+		Address:          address,
+		URL: &measurex.SimpleURL{
+			Scheme:   "tlshandshake",
+			Host:     net.JoinHostPort(sni, port),
+			Path:     "/",
+			RawQuery: "",
+		},
+		Options: &measurex.Options{
+			ALPN: measurex.ALPNForHTTPSEndpoint(archival.NetworkTypeTCP),
+		},
+		Cookies: []*http.Cookie{},
+	}
+}
+
+// sniFollowUpAnalysis analyzes the results of the SNI follow-up. This
+// function returns nil when there's no SNI follow-up data to analyze.
+func (ssm *SingleStepMeasurement) sniFollowUpAnalysis(idgen analysisIDGenerator) (out []*AnalysisEndpoint) {
+	if len(ssm.SNIFollowUp) <= 0 {
+		return nil
+	}
+	logcat.Substep("analyzing SNI follow-up results")
+	for _, m := range ssm.SNIFollowUp {
+		score := &AnalysisEndpoint{
+			ID:               idgen.NextID(),
+			URLMeasurementID: ssm.ProbeInitialURLMeasurementID(),
+			Refs:             []int64{m.EndpointID},
+			Flags:            0,
+			Blockpage:        "",
+		}
+		for _, em := range []*measurex.EndpointMeasurement{m.ControlSNI, m.NoSNI, m.ControlServer} {
+			if sniFollowUpMeasured(em) {
+				score.Refs = append(score.Refs, em.ID)
+			}
+		}
+		if !sniFollowUpMeasured(m.ControlSNI) && !sniFollowUpMeasured(m.NoSNI) {
+			logcat.Shrugf("[#%d] no SNI follow-up measurements for #%d", score.ID, m.EndpointID)
+			continue
+		}
+		sameIPReached := sniFollowUpReached(m.ControlSNI) || sniFollowUpReached(m.NoSNI)
+		if !sameIPReached {
+			logcat.Confirmedf("[#%d] #%d fails regardless of the SNI", score.ID, m.EndpointID)
+			score.Flags |= AnalysisIPBlocking
+		}
+		controlServerBlocked := sniFollowUpMeasured(m.ControlServer) &&
+			!sniFollowUpReached(m.ControlServer)
+		if controlServerBlocked {
+			logcat.Confirmedf("[#%d] #%d's SNI also fails with #%d",
+				score.ID, m.EndpointID, m.ControlServer.ID)
+		}
+		if sameIPReached || controlServerBlocked {
+			score.Flags |= AnalysisSNIBlocking
+		}
+		ExplainFlagsWithLogging(score, score.Flags)
+		out = append(out, score)
+	}
+	return endpointAnalysisRemoveUnflaggedResults(out)
+}
+
+// sniFollowUpMeasured returns whether we have actually performed the given
+// measurement. A cache configured not to use the network returns a
+// measurement with zero ID when it does not contain a measurement.
+func sniFollowUpMeasured(em *measurex.EndpointMeasurement) bool {
+	return em != nil && em.ID > 0
+}
+
+// sniFollowUpReached returns whether the given handshake reached the server.
+func sniFollowUpReached(em *measurex.EndpointMeasurement) bool {
+	if !sniFollowUpMeasured(em) {
+		return false
+	}
+	switch em.Failure {
+	case "",
+		netxlite.FailureSSLInvalidCertificate,
+		netxlite.FailureSSLInvalidHostname,
+		netxlite.FailureSSLUnknownAuthority:
+		return true
+	default:
+		return false
+	}
+}
+
+// isIPv6 returns whether the given IP address is an IPv6 address.
+func isIPv6(addr string) bool {
+	ip := net.ParseIP(addr)
+	return ip != nil && ip.To4() == nil
+}
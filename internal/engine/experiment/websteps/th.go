@@ -19,6 +19,7 @@ import (
 	"github.com/bassosimone/websteps-illustrated/internal/archival"
 	"github.com/bassosimone/websteps-illustrated/internal/logcat"
 	"github.com/bassosimone/websteps-illustrated/internal/measurex"
+	"github.com/bassosimone/websteps-illustrated/internal/metrics"
 	"github.com/bassosimone/websteps-illustrated/internal/netxlite"
 	"github.com/bassosimone/websteps-illustrated/internal/runtimex"
 	"github.com/gorilla/websocket"
@@ -48,6 +49,10 @@ type THResponse struct {
 
 	// Endpoint contains the endpoints.
 	Endpoint []*measurex.EndpointMeasurement
+
+	// Incomplete indicates that the TH failed after streaming some partial
+	// results, so this response only contains the results we received.
+	Incomplete bool `json:",omitempty"`
 }
 
 // ToArchival converts THResponse to its archival data format.
@@ -59,17 +64,22 @@ func (r *THResponse) ToArchival(begin time.Time) ArchivalTHResponse {
 		DNS: measurex.NewArchivalDNSLookupMeasurementList(begin, r.DNS),
 		Endpoint: measurex.NewArchivalEndpointMeasurementList(
 			begin, r.Endpoint, bodyFlags),
+		Incomplete: r.Incomplete,
 	}
 }
 
-// th runs the test helper client in a background goroutine.
+// th runs the test helper client in a background goroutine. The first
+// returned channel receives the final result. The second channel receives
+// the partial results streamed by the TH and is closed before we post
+// the final result on the first channel.
 func (c *Client) th(ctx context.Context, cur *measurex.URLMeasurement,
-	plan []*measurex.EndpointPlan) <-chan *THResponseOrError {
+	plan []*measurex.EndpointPlan) (<-chan *THResponseOrError, <-chan *THResponse) {
 	logcat.Substepf("while continuing to measure, I'll query the test helper (TH) in the background")
 	out := make(chan *THResponseOrError, 1)
+	partial := make(chan *THResponse)
 	thReq := c.newTHRequest(cur, plan)
-	go c.THRequestAsync(ctx, thReq, out)
-	return out
+	go c.THRequestStreamingAsync(ctx, thReq, partial, out)
+	return out, partial
 }
 
 // THRequest sends a THRequest to the TH and waits for a response.
@@ -136,10 +146,16 @@ func (c *Client) newTHRequestEndpointPlan(
 
 // THRequestAsync performs an async TH request posting the result on the out channel. The
 // output channel MUST be buffered with one place in the buffer.
+//
+// When the TH URL path is /websteps/v2/websocket, we use a persistent connection
+// with the TH that carries many concurrent requests (see thmux.go). Otherwise,
+// we create a new connection for each request.
 func (c *Client) THRequestAsync(
 	ctx context.Context, thReq *THRequest, out chan<- *THResponseOrError) {
-	// TODO(bassosimone): research keeping a persistent conn with
-	// the server to improve the TH performance.
+	if c.thUsesMux() {
+		c.thMuxRequestAsync(ctx, thReq, nil, out)
+		return
+	}
 	conn, err := c.websocketDial(ctx)
 	if err != nil {
 		out <- &THResponseOrError{Err: err}
@@ -160,6 +176,23 @@ func (c *Client) THRequestAsync(
 	}
 }
 
+// THRequestStreamingAsync is like THRequestAsync but also posts on the partial
+// channel the partial results streamed by the TH as soon as they are available. This
+// function closes the partial channel before posting the final result on the out
+// channel. When successful, the final result contains all the partial results.
+//
+// Streaming requires the websocket v2 protocol. With other protocols, we just close
+// the partial channel and the final result is the only result.
+func (c *Client) THRequestStreamingAsync(ctx context.Context, thReq *THRequest,
+	partial chan<- *THResponse, out chan<- *THResponseOrError) {
+	if c.thUsesMux() {
+		c.thMuxRequestAsync(ctx, thReq, partial, out)
+		return
+	}
+	close(partial)
+	c.THRequestAsync(ctx, thReq, out)
+}
+
 // websocketDial establishes a websocket conn with the test helper. The returned
 // conn has hard deadlines, so we can ensure liveness.
 func (c *Client) websocketDial(ctx context.Context) (*websocket.Conn, error) {
@@ -287,8 +320,24 @@ type THHandlerOptions struct {
 
 	// Saver saves measurements.
 	Saver THHandlerSaver
+
+	// Admission is the OPTIONAL admission controller. When
+	// it is nil, we admit all the incoming steps.
+	Admission *THAdmissionController
+
+	// MaxAddressesPerFamily is the OPTIONAL maximum number of
+	// addresses per family we measure in each step. When it is
+	// zero, we use DefaultTHMaxAddressesPerFamily.
+	MaxAddressesPerFamily int
+
+	// Metrics is the OPTIONAL registry where to collect metrics.
+	Metrics *metrics.Registry
 }
 
+// DefaultTHMaxAddressesPerFamily is the default maximum number of
+// addresses per family the TH measures in each step.
+const DefaultTHMaxAddressesPerFamily = 32
+
 // THHandler handles TH requests.
 type THHandler struct {
 	// Options contains the TH handler options.
@@ -296,6 +345,9 @@ type THHandler struct {
 
 	// IDGenerator generates the next ID.
 	IDGenerator *measurex.IDGenerator
+
+	// metrics contains the metrics.
+	metrics *thMetrics
 }
 
 // THHMaxAcceptableMessageSize is the maximum websocket/http message size.
@@ -320,6 +372,13 @@ func (thr *THRequestHandler) serveWithHTTP(w http.ResponseWriter, req *http.Requ
 		w.WriteHeader(400)
 		return
 	}
+	thr.metrics.requests.Inc("http")
+	release, err := thr.admit(req.Context(), thr.clientAddress(req))
+	if err != nil {
+		thr.rejectWithHTTP(w, err)
+		return // error already printed
+	}
+	defer release()
 	thRespOrError := <-thr.stepAsync(&thReq)
 	if thRespOrError.Err != nil {
 		logcat.Shrugf("[thh] TH goroutine failed: %s", thRespOrError.Err.Error())
@@ -350,8 +409,16 @@ func (thr *THRequestHandler) serveWithWebsocket(w http.ResponseWriter, req *http
 	if err != nil {
 		return // error already logged
 	}
+	thr.metrics.requests.Inc("websocket")
 	go thr.discardIncomingMessages(conn)
-	out := thr.waitForCompletion(conn, thr.stepAsync(thReq))
+	// Implementation note: we send status updates while the step waits
+	// inside the admission queue, so the client does not give up.
+	outch := thr.admitAndStepAsync(req.Context(), thr.clientAddress(req), thReq)
+	out := thr.waitForCompletion(conn, outch)
+	if isTHAdmissionError(out.Err) {
+		thr.rejectWithWebsocket(conn, out.Err)
+		return // error already printed
+	}
 	if out.Err != nil {
 		return // error already printed
 	}
@@ -388,6 +455,7 @@ func (thr *THRequestHandler) upgrade(
 	conn, err := upgrader.Upgrade(w, req, http.Header{})
 	if err != nil {
 		logcat.Shrugf("[thh] cannot upgrade to websocket: %s", err.Error())
+		thr.metrics.websocketErrors.Inc("upgrade")
 		return nil, err
 	}
 	const timeout = 90 * time.Second
@@ -402,6 +470,7 @@ func (thr *THRequestHandler) readMsg(conn *websocket.Conn) (*THRequest, error) {
 	mtype, reader, err := conn.NextReader()
 	if err != nil {
 		logcat.Shrugf("[thh] cannot read message header: %s", err.Error())
+		thr.metrics.websocketErrors.Inc("read")
 		return nil, err
 	}
 	if mtype != websocket.TextMessage {
@@ -433,6 +502,26 @@ func (thr *THRequestHandler) stepAsync(thReq *THRequest) <-chan *THResponseOrErr
 	return outch
 }
 
+// admitAndStepAsync is like stepAsync but first waits for the admission
+// controller to admit the step. If we do not admit the step, the returned
+// channel receives the admission error.
+func (thr *THRequestHandler) admitAndStepAsync(ctx context.Context,
+	address string, thReq *THRequest) <-chan *THResponseOrError {
+	outch := make(chan *THResponseOrError, 1) // don't block if the client is gone
+	go func() {
+		release, err := thr.admit(ctx, address)
+		if err != nil {
+			outch <- &THResponseOrError{Err: err} // error already printed
+			return
+		}
+		r := &THResponseOrError{}
+		r.Resp, r.Err = thr.step(context.Background(), thReq)
+		release()
+		outch <- r
+	}()
+	return outch
+}
+
 // discardIncomingMessages just discards incoming messages. We need to
 // be reading because of how gorilla/websocket works.
 func (thr *THRequestHandler) discardIncomingMessages(conn *websocket.Conn) {
@@ -475,6 +564,7 @@ func (thr *THRequestHandler) writeToClient(conn *websocket.Conn, thResp *THRespo
 	runtimex.PanicOnError(err, "json.Marshal failed")
 	if err := conn.WriteMessage(websocket.TextMessage, data); err != nil {
 		logcat.Shrugf("[thh] cannot write message: %s", err.Error())
+		thr.metrics.websocketErrors.Inc("write")
 		return err
 	}
 	return nil
@@ -487,6 +577,9 @@ type THRequestHandler struct {
 
 	// ID is the unique ID of this request.
 	ID int64
+
+	// metrics contains the metrics.
+	metrics *thMetrics
 }
 
 // resolvers returns the resolvers to use.
@@ -512,8 +605,28 @@ func (thr *THRequestHandler) measurerFactory(
 // step executes the TH step.
 func (thr *THRequestHandler) step(
 	ctx context.Context, req *THRequest) (*THResponse, error) {
+	return thr.stepWithPartialResults(ctx, req, nil)
+}
+
+// stepWithPartialResults is like step but, when partial is not nil, it also
+// calls partial with the serialized DNS lookup and endpoint measurements as
+// soon as they are available. The union of all the partial results is equal
+// to the returned response. The partial callback is always called by the
+// goroutine that is calling this function.
+func (thr *THRequestHandler) stepWithPartialResults(ctx context.Context,
+	req *THRequest, partial func(*THResponse)) (*THResponse, error) {
+	stepDone := thr.metrics.startStep()
+	resp, err := thr.doStepWithPartialResults(ctx, req, partial)
+	stepDone(err)
+	return resp, err
+}
+
+// doStepWithPartialResults implements stepWithPartialResults.
+func (thr *THRequestHandler) doStepWithPartialResults(ctx context.Context,
+	req *THRequest, partial func(*THResponse)) (*THResponse, error) {
 	options, err := thr.fillOrRejectOptions(req.Options)
 	if err != nil {
+		thr.metrics.rejectedOptions.Inc()
 		return nil, err
 	}
 	mx, err := thr.measurerFactory(options)
@@ -528,7 +641,9 @@ func (thr *THRequestHandler) step(
 	dnsplan := um.NewDNSLookupPlans(flags, thr.resolvers()...)
 	for m := range mx.DNSLookups(ctx, dnsplan...) {
 		thr.maybeGatherCNAME(m)
+		thr.metrics.observeDNSLookup(m)
 		um.DNS = append(um.DNS, m)
+		thr.emitPartial(partial, []*measurex.DNSLookupMeasurement{m}, nil)
 	}
 	probeAddrs := thr.addProbeDNS(mx, um, req.Plan)
 	revch := thr.reverseDNSLookupAsync(ctx, mx, um, probeAddrs)
@@ -537,19 +652,42 @@ func (thr *THRequestHandler) step(
 	epplan, _ := um.NewEndpointPlan(measurex.EndpointPlanningExcludeBogons)
 	epplan = thr.patchEndpointPlan(epplan, req, probeAddrs)
 	for m := range mx.MeasureEndpoints(ctx, epplan...) {
+		thr.metrics.observeEndpoint(m)
 		um.Endpoint = append(um.Endpoint, m)
+		thr.emitPartial(partial, nil, []*measurex.EndpointMeasurement{m})
 	}
 	// second round where we follow Alt-Svc leads
 	epplan, _ = um.NewEndpointPlan(
 		measurex.EndpointPlanningExcludeBogons | measurex.EndpointPlanningOnlyHTTP3)
 	for m := range mx.MeasureEndpoints(ctx, epplan...) {
+		thr.metrics.observeEndpoint(m)
 		um.Endpoint = append(um.Endpoint, m)
+		thr.emitPartial(partial, nil, []*measurex.EndpointMeasurement{m})
 	}
-	um.DNS = append(um.DNS, <-revch...) // merge async results of the reverse lookup
-	thr.saver().Save(um)                // allows saving the measurement for analysis
+	revs := <-revch
+	um.DNS = append(um.DNS, revs...) // merge async results of the reverse lookup
+	thr.emitPartial(partial, revs, nil)
+	thr.saver().Save(um) // allows saving the measurement for analysis
 	return thr.serialize(um), nil
 }
 
+// emitPartial serializes the given measurements and passes them to the
+// partial callback, unless the callback is nil or there's nothing to send.
+func (thr *THRequestHandler) emitPartial(partial func(*THResponse),
+	dns []*measurex.DNSLookupMeasurement, endpoint []*measurex.EndpointMeasurement) {
+	if partial == nil {
+		return
+	}
+	resp := &THResponse{
+		DNS:      thr.simplifyDNS(dns),
+		Endpoint: thr.simplifyEndpoints(endpoint),
+	}
+	if len(resp.DNS) <= 0 && len(resp.Endpoint) <= 0 {
+		return // e.g., we skip non-DoH lookups when serializing
+	}
+	partial(resp)
+}
+
 // reverseDNSLookupAsync performs a reverse DNS lookup for all the IP addresses we know.
 func (thr *THRequestHandler) reverseDNSLookupAsync(ctx context.Context, mx measurex.AbstractMeasurer,
 	um *measurex.URLMeasurement, probeAddrs []string) <-chan []*measurex.DNSLookupMeasurement {
@@ -710,11 +848,13 @@ func (thr *THRequestHandler) simplifyDNS(
 				Addresses:       entry.Addresses(),
 				CNAME:           entry.CNAME(),
 				Domain:          entry.Domain(),
+				ECHConfigList:   entry.ECHConfigList(),
 				Failure:         entry.Failure(),
 				Finished:        thhResponseTime,
 				LookupType:      entry.LookupType(),
 				NS:              entry.NS(),
 				PTRs:            entry.PTRs(),
+				Port:            entry.Port(),
 				ResolverAddress: entry.ResolverAddress(),
 				ResolverNetwork: entry.ResolverNetwork(),
 				Started:         thhResponseTime,
@@ -761,6 +901,7 @@ func (thr *THRequestHandler) simplifyEndpoints(
 			Location:         entry.Location,
 			HTTPTitle:        entry.HTTPTitle,
 			NetworkEvent:     []*archival.FlatNetworkEvent{},
+			SpeedSamples:     entry.SpeedSamples,
 			TCPConnect:       nil,
 			QUICTLSHandshake: nil,
 			HTTPRoundTrip:    thr.simplifyHTTPRoundTrip(entry.HTTPRoundTrip),
@@ -810,6 +951,7 @@ func (thr *THRequestHandler) fillOrRejectOptions(
 		ALPN:                 []string{},
 		DNSLookupTimeout:     0,
 		DNSParallelism:       0,
+		ECHConfigList:        nil,
 		EndpointParallelism:  0,
 		HTTPGetTimeout:       0,
 		HTTPHostHeader:       "",
@@ -820,13 +962,15 @@ func (thr *THRequestHandler) fillOrRejectOptions(
 		TLSHandshakeTimeout:  0,
 		SNI:                  "",
 		// options for which the defaults are not good enough
-		MaxAddressesPerFamily: 32,
+		MaxAddressesPerFamily: thr.maxAddressesPerFamily(),
 		// options for which we use clients settings if they're okay
 		HTTPRequestHeaders:                           map[string][]string{},
 		DoNotInitiallyForceHTTPAndHTTPS:              false,
 		MaxHTTPResponseBodySnapshotSize:              0,
 		MaxHTTPSResponseBodySnapshotSizeConnectivity: 0,
 		MaxHTTPSResponseBodySnapshotSizeThrottling:   0,
+		TLSClientHello:                               "",
+		UseHTTPSRR:                                   false,
 	}
 	// 1. HTTPRequestHeaders
 	copiedHeaders := []string{
@@ -857,9 +1001,25 @@ func (thr *THRequestHandler) fillOrRejectOptions(
 		return nil, ErrInvalidTHHOptions
 	}
 	tho.MaxHTTPSResponseBodySnapshotSizeThrottling = clnto.MaxHTTPSResponseBodySnapshotSizeThrottling
+	// 6. TLSClientHello
+	if !measurex.IsKnownTLSClientHello(clnto.TLSClientHello) {
+		return nil, ErrInvalidTHHOptions
+	}
+	tho.TLSClientHello = clnto.TLSClientHello
+	// 7. UseHTTPSRR
+	tho.UseHTTPSRR = clnto.UseHTTPSRR
 	return tho, nil
 }
 
+// maxAddressesPerFamily returns the maximum number of addresses
+// per family to measure in each step.
+func (thr *THRequestHandler) maxAddressesPerFamily() int64 {
+	if thr.Options != nil && thr.Options.MaxAddressesPerFamily > 0 {
+		return int64(thr.Options.MaxAddressesPerFamily)
+	}
+	return DefaultTHMaxAddressesPerFamily
+}
+
 // addProbeDNS extends a DNS measurement with fake measurements
 // generated from the client-supplied endpoints plan. This function
 // returns the IP addresses discovered by the probe.
@@ -880,9 +1040,14 @@ func (thr *THRequestHandler) addProbeDNS(mx measurex.AbstractMeasurer,
 
 // NewTHHandler creates a new TH handler with default settings.
 func NewTHHandler(options *THHandlerOptions) *THHandler {
+	var reg *metrics.Registry
+	if options != nil {
+		reg = options.Metrics
+	}
 	return &THHandler{
 		Options:     options,
 		IDGenerator: measurex.NewIDGenerator(),
+		metrics:     newTHMetrics(reg),
 	}
 }
 
@@ -891,7 +1056,16 @@ func (thh *THHandler) newTHRequestHandler() *THRequestHandler {
 	return &THRequestHandler{
 		Options: thh.Options,
 		ID:      thh.IDGenerator.NextID(),
+		metrics: thh.thMetrics(),
+	}
+}
+
+// thMetrics returns the metrics to update.
+func (thh *THHandler) thMetrics() *thMetrics {
+	if thh.metrics != nil {
+		return thh.metrics
 	}
+	return newTHMetrics(nil) // not created using NewTHHandler
 }
 
 // thhResolvers contains the static list of resolvers used by the THHandler.
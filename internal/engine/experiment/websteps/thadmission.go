@@ -0,0 +1,384 @@
+package websteps
+
+//
+// TH admission control
+//
+// Limits on the amount of work a TH performs on behalf of clients, so
+// that a public TH cannot be turned into a scanning amplifier.
+//
+// We admit each step (i.e., each THRequest) separately. A step is
+// rejected if the client already has too many running steps or if the
+// client has exhausted its token bucket of steps per minute. Otherwise,
+// the step runs immediately if the global concurrency limit allows it
+// or waits inside a bounded queue for a running step to complete. We
+// only consume a token when the step is admitted, so that steps that we
+// reject because the TH is overloaded do not count against the client.
+//
+// We identify clients using the address of the TCP peer or, when the
+// TH runs behind trusted reverse proxies, using the address that the
+// outermost trusted proxy added to the X-Forwarded-For header.
+//
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bassosimone/websteps-illustrated/internal/logcat"
+	"github.com/gorilla/websocket"
+)
+
+// THAdmissionConfig contains the THAdmissionController config. A zero
+// value for any limit means that such a limit is disabled.
+type THAdmissionConfig struct {
+	// MaxConcurrent is the maximum number of steps running at any
+	// given time regardless of the client that requested them.
+	MaxConcurrent int
+
+	// MaxConcurrentPerClient is the maximum number of steps that can
+	// be running or queued at any given time for a given client IP.
+	MaxConcurrentPerClient int
+
+	// MaxQueued is the maximum number of steps waiting to run when we
+	// have already reached MaxConcurrent running steps.
+	MaxQueued int
+
+	// MaxQueueWait is the maximum time a step waits inside the queue.
+	MaxQueueWait time.Duration
+
+	// StepsPerMinute is the rate at which we refill the token bucket
+	// of each client IP. Each step consumes a token.
+	StepsPerMinute int
+
+	// Burst is the size of the token bucket of each client IP. If zero,
+	// we use StepsPerMinute as the size of the bucket.
+	Burst int
+
+	// TrustedProxies is the number of reverse proxies in front of the TH
+	// that append the address of their peer to X-Forwarded-For. When zero,
+	// we use the address of the TCP peer. Otherwise, we use the address
+	// that the outermost trusted proxy appended, i.e., the TrustedProxies-th
+	// address from the end, because a client could forge any address that
+	// precedes it. If the header contains fewer addresses than expected, we
+	// fall back to using the address of the TCP peer.
+	TrustedProxies int
+}
+
+// DefaultTHAdmissionMaxQueueWait is the default MaxQueueWait.
+const DefaultTHAdmissionMaxQueueWait = 10 * time.Second
+
+// ErrTHOverloaded indicates that the TH is running too many steps and
+// the step could not enter or timed out inside the queue.
+var ErrTHOverloaded = errors.New("websteps: TH overloaded")
+
+// ErrTHRateLimited indicates that the client is running too many steps
+// or has exceeded the number of steps per minute.
+var ErrTHRateLimited = errors.New("websteps: TH rate limit exceeded")
+
+// THAdmissionController decides whether to admit steps. You MUST
+// use NewTHAdmissionController to create a new instance.
+type THAdmissionController struct {
+	// config is the config.
+	config *THAdmissionConfig
+
+	// buckets contains the token bucket of each client IP.
+	buckets map[string]*thTokenBucket
+
+	// lastSweep is the last time we removed unused token buckets.
+	lastSweep time.Time
+
+	// mu provides mutual exclusion.
+	mu sync.Mutex
+
+	// perClient contains the running or queued steps of each client IP.
+	perClient map[string]int
+
+	// queued is the number of queued steps.
+	queued int
+
+	// slots is the semaphore limiting the running steps. It is nil
+	// when we are not limiting the number of running steps.
+	slots chan bool
+}
+
+// NewTHAdmissionController creates a new THAdmissionController.
+func NewTHAdmissionController(config *THAdmissionConfig) *THAdmissionController {
+	ac := &THAdmissionController{
+		config:    config,
+		buckets:   map[string]*thTokenBucket{},
+		lastSweep: time.Now(),
+		mu:        sync.Mutex{},
+		perClient: map[string]int{},
+		queued:    0,
+		slots:     nil,
+	}
+	if config.MaxConcurrent > 0 {
+		ac.slots = make(chan bool, config.MaxConcurrent)
+	}
+	return ac
+}
+
+// ClientAddress returns the address identifying the client that sent
+// the given request, taking into account TrustedProxies. The return
+// value is suitable to be passed to Admit.
+func (ac *THAdmissionController) ClientAddress(req *http.Request) string {
+	if ac.config.TrustedProxies <= 0 {
+		return req.RemoteAddr
+	}
+	var addrs []string
+	for _, value := range req.Header.Values("X-Forwarded-For") {
+		for _, addr := range strings.Split(value, ",") {
+			addrs = append(addrs, strings.TrimSpace(addr))
+		}
+	}
+	idx := len(addrs) - ac.config.TrustedProxies
+	if idx < 0 || net.ParseIP(thAdmissionClientIP(addrs[idx])) == nil {
+		return req.RemoteAddr
+	}
+	return addrs[idx]
+}
+
+// Admit decides whether to admit a step for the given client address,
+// which may either be an IP address or an IP address and a port. This
+// function may block until a running step completes. On success, it
+// returns a function that you MUST call when the step is done. On
+// failure, it returns either ErrTHRateLimited, ErrTHOverloaded or the
+// error that caused the context to be done.
+func (ac *THAdmissionController) Admit(ctx context.Context, address string) (func(), error) {
+	clientIP := thAdmissionClientIP(address)
+	queued, err := ac.enter(clientIP)
+	if err != nil {
+		return nil, err
+	}
+	if queued {
+		if err := ac.wait(ctx); err != nil {
+			ac.leave(clientIP, queued)
+			return nil, err
+		}
+		queued = false
+	}
+	release := func() {
+		if ac.slots != nil {
+			<-ac.slots
+		}
+		ac.leave(clientIP, queued)
+	}
+	if !ac.takeToken(clientIP) {
+		release()
+		return nil, ErrTHRateLimited
+	}
+	var once sync.Once
+	return func() { once.Do(release) }, nil
+}
+
+// enter checks the per-client limits and attempts to obtain a running
+// slot. It returns true if the step must wait inside the queue. We
+// check whether the client has tokens left here, so that we don't
+// queue steps we would reject, but we only take a token once we have
+// admitted the step (see Admit).
+func (ac *THAdmissionController) enter(clientIP string) (bool, error) {
+	ac.mu.Lock()
+	defer ac.mu.Unlock()
+	now := time.Now()
+	ac.maybeSweep(now)
+	if limit := ac.config.MaxConcurrentPerClient; limit > 0 && ac.perClient[clientIP] >= limit {
+		return false, ErrTHRateLimited
+	}
+	if !ac.hasToken(clientIP, now) {
+		return false, ErrTHRateLimited
+	}
+	var queued bool
+	if ac.slots != nil {
+		select {
+		case ac.slots <- true:
+		default:
+			if ac.queued >= ac.config.MaxQueued {
+				return false, ErrTHOverloaded
+			}
+			ac.queued++
+			queued = true
+		}
+	}
+	ac.perClient[clientIP]++
+	return queued, nil
+}
+
+// wait waits inside the queue for a running slot.
+func (ac *THAdmissionController) wait(ctx context.Context) error {
+	timeout := ac.config.MaxQueueWait
+	if timeout <= 0 {
+		timeout = DefaultTHAdmissionMaxQueueWait
+	}
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case ac.slots <- true:
+		ac.mu.Lock()
+		ac.queued--
+		ac.mu.Unlock()
+		return nil
+	case <-timer.C:
+		return ErrTHOverloaded
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// leave updates the counters after a step is done or has given up
+// waiting inside the queue, in which case queued is true.
+func (ac *THAdmissionController) leave(clientIP string, queued bool) {
+	ac.mu.Lock()
+	defer ac.mu.Unlock()
+	if queued {
+		ac.queued--
+	}
+	if ac.perClient[clientIP]--; ac.perClient[clientIP] <= 0 {
+		delete(ac.perClient, clientIP)
+	}
+}
+
+// hasToken returns whether the client's bucket contains at least a
+// token. This function MUST be called while holding the mutex.
+func (ac *THAdmissionController) hasToken(clientIP string, now time.Time) bool {
+	if ac.config.StepsPerMinute <= 0 {
+		return true
+	}
+	return ac.bucket(clientIP, now).tokens >= 1
+}
+
+// takeToken takes a token from the client's bucket. It returns false
+// when other steps of the same client have taken the remaining tokens
+// while this step was waiting inside the queue.
+func (ac *THAdmissionController) takeToken(clientIP string) bool {
+	if ac.config.StepsPerMinute <= 0 {
+		return true
+	}
+	ac.mu.Lock()
+	defer ac.mu.Unlock()
+	bucket := ac.bucket(clientIP, time.Now())
+	if bucket.tokens < 1 {
+		return false
+	}
+	bucket.tokens--
+	return true
+}
+
+// bucket returns the refilled client's bucket, creating it if needed. This
+// function MUST be called while holding the mutex.
+func (ac *THAdmissionController) bucket(clientIP string, now time.Time) *thTokenBucket {
+	bucket, found := ac.buckets[clientIP]
+	if !found {
+		bucket = &thTokenBucket{tokens: float64(ac.burst()), updated: now}
+		ac.buckets[clientIP] = bucket
+	}
+	bucket.refill(now, ac.config.StepsPerMinute, ac.burst())
+	return bucket
+}
+
+// burst returns the size of the token bucket.
+func (ac *THAdmissionController) burst() int {
+	if ac.config.Burst > 0 {
+		return ac.config.Burst
+	}
+	return ac.config.StepsPerMinute
+}
+
+// maybeSweep removes full token buckets once per minute, since they are
+// equivalent to missing buckets. This function MUST be called while
+// holding the mutex.
+func (ac *THAdmissionController) maybeSweep(now time.Time) {
+	if now.Sub(ac.lastSweep) < time.Minute {
+		return
+	}
+	ac.lastSweep = now
+	for clientIP, bucket := range ac.buckets {
+		bucket.refill(now, ac.config.StepsPerMinute, ac.burst())
+		if bucket.tokens >= float64(ac.burst()) {
+			delete(ac.buckets, clientIP)
+		}
+	}
+}
+
+// thTokenBucket is the token bucket of a client IP.
+type thTokenBucket struct {
+	// tokens is the number of available tokens.
+	tokens float64
+
+	// updated is the last time we refilled the bucket.
+	updated time.Time
+}
+
+// refill adds the tokens accumulated since the last refill.
+func (tb *thTokenBucket) refill(now time.Time, perMinute, burst int) {
+	elapsed := now.Sub(tb.updated)
+	tb.updated = now
+	tb.tokens += elapsed.Minutes() * float64(perMinute)
+	if max := float64(burst); tb.tokens > max {
+		tb.tokens = max
+	}
+}
+
+// thAdmissionClientIP returns the IP address of a client given its
+// address, which may optionally include a port.
+func thAdmissionClientIP(address string) string {
+	if host, _, err := net.SplitHostPort(address); err == nil {
+		return host
+	}
+	return address
+}
+
+// admit admits a step using the configured admission controller. When
+// there's no controller, we admit all steps.
+func (thr *THRequestHandler) admit(ctx context.Context, address string) (func(), error) {
+	if thr.Options == nil || thr.Options.Admission == nil {
+		return func() {}, nil
+	}
+	release, err := thr.Options.Admission.Admit(ctx, address)
+	if err != nil {
+		logcat.Shrugf("[thh] not admitting step for %s: %s", address, err.Error())
+		thr.metrics.observeAdmissionRejected(err)
+		return nil, err
+	}
+	return release, nil
+}
+
+// clientAddress returns the address identifying the client that sent
+// the given request for the purpose of admission control.
+func (thr *THRequestHandler) clientAddress(req *http.Request) string {
+	if thr.Options == nil || thr.Options.Admission == nil {
+		return req.RemoteAddr
+	}
+	return thr.Options.Admission.ClientAddress(req)
+}
+
+// isTHAdmissionError returns whether err means we did not admit a step.
+func isTHAdmissionError(err error) bool {
+	return errors.Is(err, ErrTHRateLimited) || errors.Is(err, ErrTHOverloaded)
+}
+
+// rejectWithHTTP tells an HTTP client we did not admit its step.
+func (thr *THRequestHandler) rejectWithHTTP(w http.ResponseWriter, err error) {
+	w.Header().Set("Retry-After", thAdmissionRetryAfter)
+	switch {
+	case errors.Is(err, ErrTHRateLimited):
+		w.WriteHeader(http.StatusTooManyRequests)
+	default:
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+}
+
+// rejectWithWebsocket tells a websocket client we did not admit its step.
+func (thr *THRequestHandler) rejectWithWebsocket(conn *websocket.Conn, err error) {
+	const closeTimeout = time.Second
+	deadline := time.Now().Add(closeTimeout)
+	msg := websocket.FormatCloseMessage(websocket.CloseTryAgainLater, err.Error())
+	conn.WriteControl(websocket.CloseMessage, msg, deadline)
+}
+
+// thAdmissionRetryAfter is the Retry-After value, in seconds, we send
+// to HTTP clients when we do not admit their step.
+const thAdmissionRetryAfter = "10"
@@ -0,0 +1,102 @@
+package websteps
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestTHAdmissionControllerClientAddress(t *testing.T) {
+	tests := []struct {
+		name           string
+		trustedProxies int
+		xff            []string
+		expect         string
+	}{{
+		name:           "without trusted proxies we ignore the header",
+		trustedProxies: 0,
+		xff:            []string{"1.1.1.1"},
+		expect:         "10.0.0.1:54321",
+	}, {
+		name:           "with a trusted proxy we use the last address",
+		trustedProxies: 1,
+		xff:            []string{"1.1.1.1, 2.2.2.2"},
+		expect:         "2.2.2.2",
+	}, {
+		name:           "with two trusted proxies we skip the last address",
+		trustedProxies: 2,
+		xff:            []string{"1.1.1.1", "2.2.2.2, 3.3.3.3"},
+		expect:         "2.2.2.2",
+	}, {
+		name:           "with too few addresses we use the peer address",
+		trustedProxies: 2,
+		xff:            []string{"2.2.2.2"},
+		expect:         "10.0.0.1:54321",
+	}, {
+		name:           "with an invalid address we use the peer address",
+		trustedProxies: 1,
+		xff:            []string{"1.1.1.1, unknown"},
+		expect:         "10.0.0.1:54321",
+	}}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ac := NewTHAdmissionController(&THAdmissionConfig{
+				TrustedProxies: tt.trustedProxies,
+			})
+			req := &http.Request{
+				Header:     http.Header{"X-Forwarded-For": tt.xff},
+				RemoteAddr: "10.0.0.1:54321",
+			}
+			if got := ac.ClientAddress(req); got != tt.expect {
+				t.Fatal("expected", tt.expect, "got", got)
+			}
+		})
+	}
+}
+
+func TestTHAdmissionControllerTakesTokensOnlyWhenAdmitting(t *testing.T) {
+	ac := NewTHAdmissionController(&THAdmissionConfig{
+		MaxConcurrent:  1,
+		MaxQueued:      0,
+		StepsPerMinute: 2,
+	})
+	ctx := context.Background()
+	release, err := ac.Admit(ctx, "10.0.0.1:1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The TH is now overloaded, which must not consume tokens.
+	for i := 0; i < 4; i++ {
+		if _, err := ac.Admit(ctx, "10.0.0.1:2"); !errors.Is(err, ErrTHOverloaded) {
+			t.Fatal("unexpected error", err)
+		}
+	}
+	release()
+	release, err = ac.Admit(ctx, "10.0.0.1:3")
+	if err != nil {
+		t.Fatal(err)
+	}
+	release()
+	if _, err := ac.Admit(ctx, "10.0.0.1:4"); !errors.Is(err, ErrTHRateLimited) {
+		t.Fatal("unexpected error", err)
+	}
+}
+
+func TestTHAdmissionControllerQueueTimeout(t *testing.T) {
+	ac := NewTHAdmissionController(&THAdmissionConfig{
+		MaxConcurrent: 1,
+		MaxQueued:     1,
+		MaxQueueWait:  10 * time.Millisecond,
+	})
+	ctx := context.Background()
+	release, err := ac.Admit(ctx, "10.0.0.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer release()
+	if _, err := ac.Admit(ctx, "10.0.0.2"); !errors.Is(err, ErrTHOverloaded) {
+		t.Fatal("unexpected error", err)
+	}
+}
@@ -0,0 +1,139 @@
+package websteps
+
+//
+// TH metrics
+//
+// Metrics collected by the TH when THHandlerOptions.Metrics is set.
+//
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/bassosimone/websteps-illustrated/internal/archival"
+	"github.com/bassosimone/websteps-illustrated/internal/measurex"
+	"github.com/bassosimone/websteps-illustrated/internal/metrics"
+)
+
+// thMetrics contains the TH metrics. All the fields are nil when
+// we're not collecting metrics, which is fine because updating a
+// nil metric does nothing.
+type thMetrics struct {
+	// admissionRejected counts the steps we did not admit.
+	admissionRejected *metrics.Counter
+
+	// dnsLookupSeconds is the DNS lookup latency.
+	dnsLookupSeconds *metrics.Histogram
+
+	// dnsLookups counts the DNS lookups.
+	dnsLookups *metrics.Counter
+
+	// endpointConnectSeconds is the TCP connect or QUIC handshake latency.
+	endpointConnectSeconds *metrics.Histogram
+
+	// endpoints counts the endpoint measurements.
+	endpoints *metrics.Counter
+
+	// rejectedOptions counts the requests with unacceptable options.
+	rejectedOptions *metrics.Counter
+
+	// requests counts the incoming requests.
+	requests *metrics.Counter
+
+	// runningSteps is the number of running steps.
+	runningSteps *metrics.Gauge
+
+	// stepFailures counts the failed steps.
+	stepFailures *metrics.Counter
+
+	// stepSeconds is the time required to run a step.
+	stepSeconds *metrics.Histogram
+
+	// websocketErrors counts the websocket errors.
+	websocketErrors *metrics.Counter
+}
+
+// newTHMetrics creates the TH metrics using the given registry, which
+// may be nil if we're not collecting metrics.
+func newTHMetrics(reg *metrics.Registry) *thMetrics {
+	return &thMetrics{
+		admissionRejected: reg.NewCounter("websteps_th_admission_rejected_total",
+			"Number of steps not admitted by reason.", "reason"),
+		dnsLookupSeconds: reg.NewHistogram("websteps_th_dns_lookup_seconds",
+			"DNS lookup latency by lookup type.", nil, "lookup_type"),
+		dnsLookups: reg.NewCounter("websteps_th_dns_lookups_total",
+			"Number of DNS lookups by lookup type and result.", "lookup_type", "result"),
+		endpointConnectSeconds: reg.NewHistogram("websteps_th_endpoint_connect_seconds",
+			"TCP connect or QUIC handshake latency by network.", nil, "network"),
+		endpoints: reg.NewCounter("websteps_th_endpoint_measurements_total",
+			"Number of endpoint measurements by network and result.", "network", "result"),
+		rejectedOptions: reg.NewCounter("websteps_th_rejected_options_total",
+			"Number of requests rejected because of unacceptable options."),
+		requests: reg.NewCounter("websteps_th_requests_total",
+			"Number of incoming requests by API.", "api"),
+		runningSteps: reg.NewGauge("websteps_th_running_steps",
+			"Number of steps currently running."),
+		stepFailures: reg.NewCounter("websteps_th_step_failures_total",
+			"Number of steps that failed."),
+		stepSeconds: reg.NewHistogram("websteps_th_step_seconds",
+			"Time required to run a step.", []float64{1, 2.5, 5, 10, 20, 30, 45, 60, 90}),
+		websocketErrors: reg.NewCounter("websteps_th_websocket_errors_total",
+			"Number of websocket errors by operation.", "operation"),
+	}
+}
+
+// observeDNSLookup updates the metrics after a DNS lookup.
+func (m *thMetrics) observeDNSLookup(dlm *measurex.DNSLookupMeasurement) {
+	lookupType := string(dlm.LookupType())
+	m.dnsLookups.Inc(lookupType, thMetricsResult(dlm.Failure()))
+	m.dnsLookupSeconds.Observe(dlm.Runtime().Seconds(), lookupType)
+}
+
+// observeEndpoint updates the metrics after an endpoint measurement.
+func (m *thMetrics) observeEndpoint(em *measurex.EndpointMeasurement) {
+	network := string(em.Network)
+	m.endpoints.Inc(network, thMetricsResult(em.Failure))
+	if runtime := em.TCPQUICConnectRuntime(); runtime > 0 {
+		m.endpointConnectSeconds.Observe(runtime.Seconds(), network)
+	}
+}
+
+// observeAdmissionRejected updates the metrics after we did
+// not admit a step because of the given error.
+func (m *thMetrics) observeAdmissionRejected(err error) {
+	var reason string
+	switch {
+	case errors.Is(err, ErrTHRateLimited):
+		reason = "rate_limited"
+	case errors.Is(err, ErrTHOverloaded):
+		reason = "overloaded"
+	case errors.Is(err, context.DeadlineExceeded), errors.Is(err, context.Canceled):
+		reason = "canceled"
+	default:
+		reason = "other"
+	}
+	m.admissionRejected.Inc(reason)
+}
+
+// startStep updates the metrics when a step starts and returns the
+// function to call with the step error when the step is done.
+func (m *thMetrics) startStep() func(err error) {
+	begin := time.Now()
+	m.runningSteps.Inc()
+	return func(err error) {
+		m.runningSteps.Dec()
+		m.stepSeconds.Observe(time.Since(begin).Seconds())
+		if err != nil {
+			m.stepFailures.Inc()
+		}
+	}
+}
+
+// thMetricsResult returns the value of the "result" label.
+func thMetricsResult(failure archival.FlatFailure) string {
+	if failure != "" {
+		return "failure"
+	}
+	return "ok"
+}
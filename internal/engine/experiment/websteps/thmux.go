@@ -0,0 +1,689 @@
+package websteps
+
+//
+// TH mux
+//
+// Version 2 of the websocket protocol, where a single persistent
+// websocket connection carries many concurrent requests.
+//
+// The client sends THMuxRequest messages containing a unique ID and
+// the TH sends back THMuxResponse messages tagged with the same ID in
+// whatever order the requests complete. While the connection is
+// open, the TH periodically sends StillRunning responses with zero ID
+// to keep the connection alive. The TH closes the connection after
+// THMuxIdleTimeout without any running request.
+//
+// When the client is no longer interested in a request (e.g., because
+// it timed out), it sends a THMuxRequest with the same ID and the Cancel
+// flag set, so the TH interrupts the request and frees its resources.
+//
+// When a request has the Stream flag set, the TH also sends Partial
+// responses containing each DNS lookup and endpoint measurement as
+// soon as it completes. In such a case, the final response is empty
+// and the client merges the partial responses to obtain the complete
+// response. This allows the client to act on early TH results.
+//
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bassosimone/websteps-illustrated/internal/logcat"
+	"github.com/bassosimone/websteps-illustrated/internal/measurex"
+	"github.com/bassosimone/websteps-illustrated/internal/netxlite"
+	"github.com/bassosimone/websteps-illustrated/internal/runtimex"
+	"github.com/gorilla/websocket"
+)
+
+// THMuxRequest is a THRequest sent using the websocket v2 protocol.
+type THMuxRequest struct {
+	// ID is the unique ID of the request within the connection.
+	ID int64
+
+	// Stream indicates that the client wants partial responses.
+	Stream bool `json:",omitempty"`
+
+	// Cancel indicates that the client wants to cancel the
+	// running request with the same ID.
+	Cancel bool `json:",omitempty"`
+
+	// Request is the request (nil when Cancel is true).
+	Request *THRequest `json:",omitempty"`
+}
+
+// THMuxResponse is a THResponse sent using the websocket v2 protocol.
+type THMuxResponse struct {
+	// ID is the ID of the request this response refers to. It is
+	// zero for StillRunning responses sent as keepalives.
+	ID int64
+
+	// Failure is the failure that occurred (if any).
+	Failure string `json:",omitempty"`
+
+	// Partial indicates this is a partial response.
+	Partial bool `json:",omitempty"`
+
+	// Response is the response (if successful).
+	Response *THResponse `json:",omitempty"`
+}
+
+const (
+	// THMuxIdleTimeout is the time after which the TH closes a
+	// websocket v2 connection that is not running any request.
+	THMuxIdleTimeout = 60 * time.Second
+
+	// thMuxClientIdleTimeout is the time after which the client does
+	// not reuse an idle connection. It is smaller than THMuxIdleTimeout
+	// to avoid racing with the TH closing the connection.
+	thMuxClientIdleTimeout = 30 * time.Second
+
+	// thMuxKeepaliveInterval is the interval between keepalives.
+	thMuxKeepaliveInterval = 500 * time.Millisecond
+
+	// thMuxReadTimeout is the time after which the client considers
+	// the connection dead if it does not receive any message.
+	thMuxReadTimeout = 15 * time.Second
+
+	// thMuxRequestTimeout is the maximum time we allow a request to run.
+	thMuxRequestTimeout = 90 * time.Second
+
+	// thMuxWriteTimeout is the maximum time we allow a write to block.
+	thMuxWriteTimeout = 10 * time.Second
+)
+
+// ErrTHFailure indicates that the TH failed to handle a request.
+var ErrTHFailure = errors.New("websteps: the TH failed to handle the request")
+
+// ErrTHMuxTimeout indicates that a request took too much time.
+var ErrTHMuxTimeout = errors.New("websteps: timeout waiting for the TH response")
+
+//
+// Client side
+//
+
+// thUsesMux returns whether the TH URL uses the websocket v2 protocol.
+func (c *Client) thUsesMux() bool {
+	URL, err := url.Parse(c.thURL)
+	if err != nil {
+		return false
+	}
+	return strings.HasSuffix(URL.Path, "/websteps/v2/websocket")
+}
+
+// thMuxRequestAsync is like THRequestAsync but uses the
+// websocket v2 protocol. The output channel MUST be buffered
+// with one place in the buffer. When the partial channel is not
+// nil, we ask the TH to stream partial responses, we post them on
+// the partial channel, and we close the partial channel before
+// posting the merged response on the output channel. Posting on
+// the partial channel does not prevent us from honouring the
+// context and the request timeout if the consumer is slow.
+func (c *Client) thMuxRequestAsync(ctx context.Context, thReq *THRequest,
+	partial chan<- *THResponse, out chan<- *THResponseOrError) {
+	finish := func(m *THResponseOrError) {
+		if partial != nil {
+			close(partial)
+		}
+		out <- m
+	}
+	mc, err := c.thMuxConnection(ctx)
+	if err != nil {
+		finish(&THResponseOrError{Err: err})
+		return // error already printed
+	}
+	p := newTHMuxPending()
+	id, err := mc.send(thReq, partial != nil, p)
+	if err != nil {
+		finish(&THResponseOrError{Err: err})
+		return // error already printed
+	}
+	timer := time.NewTimer(thMuxRequestTimeout)
+	defer timer.Stop()
+	merged := &THResponse{
+		DNS:      []*measurex.DNSLookupMeasurement{},
+		Endpoint: []*measurex.EndpointMeasurement{},
+	}
+	forward := func() error {
+		for _, resp := range p.popPartials() {
+			merged.DNS = append(merged.DNS, resp.DNS...)
+			merged.Endpoint = append(merged.Endpoint, resp.Endpoint...)
+			if partial == nil {
+				continue
+			}
+			select {
+			case partial <- resp:
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-timer.C:
+				return ErrTHMuxTimeout
+			}
+		}
+		return nil
+	}
+	for {
+		var err error
+		select {
+		case <-ctx.Done():
+			err = ctx.Err()
+		case <-timer.C:
+			err = ErrTHMuxTimeout
+		case <-p.notify:
+			err = forward()
+		case m := <-p.final:
+			if err := forward(); err != nil { // partials always precede the final response
+				m = &THResponseOrError{Err: err}
+			}
+			if m.Err == nil && partial != nil {
+				m.Resp = merged
+			}
+			finish(m)
+			return
+		}
+		if err != nil {
+			mc.forget(id)
+			finish(&THResponseOrError{Err: err})
+			return
+		}
+	}
+}
+
+// thMuxPending is a request waiting for the TH response.
+type thMuxPending struct {
+	// final receives the final response.
+	final chan *THResponseOrError
+
+	// mu provides mutual exclusion.
+	mu sync.Mutex
+
+	// notify signals that there are new partials.
+	notify chan interface{}
+
+	// partials contains the partial responses not yet consumed.
+	partials []*THResponse
+}
+
+// newTHMuxPending creates a new thMuxPending.
+func newTHMuxPending() *thMuxPending {
+	return &thMuxPending{
+		final:    make(chan *THResponseOrError, 1), // buffered channel!
+		mu:       sync.Mutex{},
+		notify:   make(chan interface{}, 1), // buffered channel!
+		partials: []*THResponse{},
+	}
+}
+
+// pushPartial adds a partial response without blocking, so that a slow
+// consumer does not prevent us from reading from the connection.
+func (p *thMuxPending) pushPartial(resp *THResponse) {
+	p.mu.Lock()
+	p.partials = append(p.partials, resp)
+	p.mu.Unlock()
+	select {
+	case p.notify <- true:
+	default:
+	}
+}
+
+// popPartials removes and returns the partial responses.
+func (p *thMuxPending) popPartials() []*THResponse {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	out := p.partials
+	p.partials = []*THResponse{}
+	return out
+}
+
+// thMuxConnection returns the persistent connection with the TH
+// and establishes a new connection if needed.
+func (c *Client) thMuxConnection(ctx context.Context) (*thMuxConn, error) {
+	c.thMuxMu.Lock()
+	defer c.thMuxMu.Unlock()
+	if c.thMux != nil && c.thMux.reusable() {
+		return c.thMux, nil
+	}
+	if c.thMux != nil {
+		c.thMux.close()
+		c.thMux = nil
+	}
+	conn, err := c.websocketDial(ctx)
+	if err != nil {
+		return nil, err // error already printed
+	}
+	// Remove the hard deadlines set by websocketDial because the
+	// mux manages its own deadlines for each read and write.
+	conn.SetReadDeadline(time.Time{})
+	conn.SetWriteDeadline(time.Time{})
+	c.thMux = newTHMuxConn(conn)
+	go c.thMux.readLoop()
+	return c.thMux, nil
+}
+
+// closeTHMuxConnection closes the persistent connection with the TH (if any).
+func (c *Client) closeTHMuxConnection() {
+	c.thMuxMu.Lock()
+	defer c.thMuxMu.Unlock()
+	if c.thMux != nil {
+		c.thMux.close()
+		c.thMux = nil
+	}
+}
+
+// thMuxConn is the client side of a websocket v2 connection.
+type thMuxConn struct {
+	// conn is the underlying websocket conn.
+	conn *websocket.Conn
+
+	// err is the error that broke the connection (if any).
+	err error
+
+	// lastUsed is the last time we used the connection.
+	lastUsed time.Time
+
+	// mu provides mutual exclusion.
+	mu sync.Mutex
+
+	// nextID is the next request ID.
+	nextID int64
+
+	// pending maps request IDs to the requests waiting for responses.
+	pending map[int64]*thMuxPending
+
+	// writeMu serializes writes, as required by gorilla/websocket.
+	writeMu sync.Mutex
+}
+
+// newTHMuxConn creates a new thMuxConn.
+func newTHMuxConn(conn *websocket.Conn) *thMuxConn {
+	return &thMuxConn{
+		conn:     conn,
+		err:      nil,
+		lastUsed: time.Now(),
+		mu:       sync.Mutex{},
+		nextID:   0,
+		pending:  map[int64]*thMuxPending{},
+		writeMu:  sync.Mutex{},
+	}
+}
+
+// reusable returns whether we can send more requests using this conn.
+func (mc *thMuxConn) reusable() bool {
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+	if mc.err != nil {
+		return false
+	}
+	return len(mc.pending) > 0 || time.Since(mc.lastUsed) < thMuxClientIdleTimeout
+}
+
+// send sends a request and registers the pending request that will
+// receive the responses. The stream argument indicates whether we want
+// partial responses. This function returns the ID assigned to the request.
+func (mc *thMuxConn) send(thReq *THRequest, stream bool, p *thMuxPending) (int64, error) {
+	mc.mu.Lock()
+	if mc.err != nil {
+		err := mc.err
+		mc.mu.Unlock()
+		return 0, err
+	}
+	mc.nextID++
+	id := mc.nextID
+	mc.pending[id] = p
+	mc.lastUsed = time.Now()
+	mc.mu.Unlock()
+	thMuxReq := &THMuxRequest{
+		ID:      id,
+		Stream:  stream,
+		Cancel:  false,
+		Request: thReq,
+	}
+	if err := mc.write(thMuxReq); err != nil {
+		return 0, err // error already printed
+	}
+	return id, nil
+}
+
+// write writes a request to the TH and fails the conn on error.
+func (mc *thMuxConn) write(thMuxReq *THMuxRequest) error {
+	// The following call to json.Marshal cannot actually fail
+	data, err := json.Marshal(thMuxReq)
+	runtimex.PanicOnError(err, "json.Marshal failed")
+	mc.writeMu.Lock()
+	mc.conn.SetWriteDeadline(time.Now().Add(thMuxWriteTimeout))
+	err = mc.conn.WriteMessage(websocket.TextMessage, data)
+	mc.writeMu.Unlock()
+	if err != nil {
+		logcat.Shrugf("[thclient] cannot write: %s", err.Error())
+		mc.fail(err)
+		return err
+	}
+	return nil
+}
+
+// forget forgets about a pending request. If the request is still
+// running, we tell the TH to cancel it, so it stops measuring for us.
+func (mc *thMuxConn) forget(id int64) {
+	mc.mu.Lock()
+	_, running := mc.pending[id]
+	delete(mc.pending, id)
+	broken := mc.err != nil
+	mc.mu.Unlock()
+	if !running || broken {
+		return
+	}
+	thMuxReq := &THMuxRequest{
+		ID:      id,
+		Stream:  false,
+		Cancel:  true,
+		Request: nil,
+	}
+	go mc.write(thMuxReq) // error already printed
+}
+
+// readLoop reads responses and routes them to the pending requests.
+func (mc *thMuxConn) readLoop() {
+	for {
+		mc.conn.SetReadDeadline(time.Now().Add(thMuxReadTimeout))
+		mtype, reader, err := mc.conn.NextReader()
+		if err != nil {
+			mc.fail(err)
+			return
+		}
+		if mtype != websocket.TextMessage {
+			logcat.Bugf("[thclient] unexpected message type: %d", mtype)
+			mc.fail(ErrTHFailure)
+			return
+		}
+		reader = io.LimitReader(reader, THHMaxAcceptableMessageSize)
+		data, err := netxlite.ReadAllContext(context.Background(), reader)
+		if err != nil {
+			logcat.Shrugf("[thclient] cannot read message body: %s", err.Error())
+			mc.fail(err)
+			return
+		}
+		var resp THMuxResponse
+		if err := json.Unmarshal(data, &resp); err != nil {
+			logcat.Bugf("[thclient] cannot unmarshal message: %s", err.Error())
+			mc.fail(err)
+			return
+		}
+		if resp.ID == 0 {
+			continue // message sent to keep the connection alive
+		}
+		mc.dispatch(&resp)
+	}
+}
+
+// dispatch routes a response to the matching pending request.
+func (mc *thMuxConn) dispatch(resp *THMuxResponse) {
+	mc.mu.Lock()
+	p, found := mc.pending[resp.ID]
+	if !resp.Partial {
+		delete(mc.pending, resp.ID)
+	}
+	mc.lastUsed = time.Now()
+	mc.mu.Unlock()
+	if !found {
+		return // the request has been cancelled in the meanwhile
+	}
+	switch {
+	case resp.Partial && resp.Response != nil:
+		p.pushPartial(resp.Response)
+	case resp.Partial:
+		logcat.Bugf("[thclient] received empty partial response")
+	case resp.Failure != "":
+		p.final <- &THResponseOrError{Err: fmt.Errorf("%w: %s", ErrTHFailure, resp.Failure)}
+	case resp.Response == nil:
+		p.final <- &THResponseOrError{Err: fmt.Errorf("%w: empty response", ErrTHFailure)}
+	default:
+		p.final <- &THResponseOrError{Resp: resp.Response}
+	}
+}
+
+// fail marks the connection as broken and fails all pending requests.
+func (mc *thMuxConn) fail(err error) {
+	mc.mu.Lock()
+	if mc.err == nil {
+		mc.err = err
+	}
+	pending := mc.pending
+	mc.pending = map[int64]*thMuxPending{}
+	mc.mu.Unlock()
+	for _, p := range pending {
+		p.final <- &THResponseOrError{Err: err}
+	}
+	mc.conn.Close()
+}
+
+// close closes the connection gracefully.
+func (mc *thMuxConn) close() {
+	msg := websocket.FormatCloseMessage(websocket.CloseNormalClosure, "")
+	mc.writeMu.Lock()
+	mc.conn.WriteControl(websocket.CloseMessage, msg, time.Now().Add(time.Second))
+	mc.writeMu.Unlock()
+	mc.fail(net.ErrClosed)
+}
+
+//
+// Server side
+//
+
+// ServeWithWebsocketV2 serves clients that choose to use the websocket
+// v2 API, where a single connection carries many concurrent requests.
+func (thh *THHandler) ServeWithWebsocketV2(w http.ResponseWriter, req *http.Request) {
+	conn, err := thh.newTHRequestHandler().upgrade(w, req)
+	if err != nil {
+		return // error already logged
+	}
+	defer conn.Close()
+	// Remove the hard deadlines set by upgrade because here we
+	// manage deadlines for each read and write.
+	conn.SetReadDeadline(time.Time{})
+	conn.SetWriteDeadline(time.Time{})
+	thh.serveMux(req.Context(), conn, thh.newTHRequestHandler().clientAddress(req))
+}
+
+// serveMux is the main loop of a websocket v2 connection for the client
+// at the given address. The steps we run derive their context from ctx,
+// which we cancel when we're done with the connection, so that we don't
+// keep measuring for a client that went away. We also cancel the context
+// of a single step when the client asks us to cancel it.
+func (thh *THHandler) serveMux(ctx context.Context, conn *websocket.Conn, address string) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	reqs := make(chan *THMuxRequest)
+	go thh.readMuxRequests(ctx, conn, reqs)
+	cancels := map[int64]context.CancelFunc{}
+	resps := make(chan *THMuxResponse)
+	ticker := time.NewTicker(thMuxKeepaliveInterval)
+	defer ticker.Stop()
+	var running int
+	idleSince := time.Now()
+	for {
+		select {
+		case thReq, good := <-reqs:
+			if !good {
+				return // error already printed
+			}
+			if thReq.Cancel {
+				if stepCancel, found := cancels[thReq.ID]; found {
+					logcat.Noticef("[thh] the client cancelled request #%d", thReq.ID)
+					stepCancel()
+				}
+				continue
+			}
+			if _, found := cancels[thReq.ID]; found {
+				logcat.Shrugf("[thh] request #%d is already running", thReq.ID)
+				continue
+			}
+			stepCtx, stepCancel := context.WithCancel(ctx)
+			cancels[thReq.ID] = stepCancel
+			running++
+			go thh.muxStep(ctx, stepCtx, thReq, address, resps)
+		case thResp := <-resps:
+			if !thResp.Partial {
+				if stepCancel, found := cancels[thResp.ID]; found {
+					stepCancel()
+					delete(cancels, thResp.ID)
+				}
+				running--
+			}
+			if running <= 0 {
+				idleSince = time.Now()
+			}
+			if err := thh.writeMuxResponse(conn, thResp); err != nil {
+				return // error already printed
+			}
+		case <-ticker.C:
+			if running <= 0 && time.Since(idleSince) > THMuxIdleTimeout {
+				thh.newTHRequestHandler().gracefulClose(conn)
+				return
+			}
+			keepalive := &THMuxResponse{
+				ID:      0,
+				Failure: "",
+				Partial: false,
+				Response: &THResponse{
+					StillRunning: true,
+					DNS:          []*measurex.DNSLookupMeasurement{},
+					Endpoint:     []*measurex.EndpointMeasurement{},
+				},
+			}
+			if err := thh.writeMuxResponse(conn, keepalive); err != nil {
+				return // error already printed
+			}
+		}
+	}
+}
+
+// readMuxRequests reads requests from the client and posts them on
+// the reqs channel. It closes the channel when done. It also returns
+// when ctx is done, i.e., when serveMux is not reading anymore.
+func (thh *THHandler) readMuxRequests(ctx context.Context,
+	conn *websocket.Conn, reqs chan<- *THMuxRequest) {
+	defer close(reqs)
+	for {
+		mtype, reader, err := conn.NextReader()
+		if websocket.IsCloseError(err, websocket.CloseNormalClosure) {
+			return // the client is done with this connection
+		}
+		if err != nil {
+			logcat.Shrugf("[thh] cannot read message header: %s", err.Error())
+			thh.thMetrics().websocketErrors.Inc("read")
+			return
+		}
+		if mtype != websocket.TextMessage {
+			logcat.Shrugf("[thh] received non-text message")
+			return
+		}
+		reader = io.LimitReader(reader, THHMaxAcceptableMessageSize)
+		data, err := netxlite.ReadAllContext(context.Background(), reader)
+		if err != nil {
+			logcat.Shrugf("[thh] cannot read message body: %s", err.Error())
+			return
+		}
+		var thReq THMuxRequest
+		if err := json.Unmarshal(data, &thReq); err != nil {
+			logcat.Shrugf("[thh] cannot unmarshal message: %s", err.Error())
+			return
+		}
+		if thReq.ID == 0 || (thReq.Request == nil) != thReq.Cancel {
+			logcat.Shrugf("[thh] received invalid request")
+			return
+		}
+		select {
+		case reqs <- &thReq:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// muxStep runs a websteps step for the client at the given address and
+// posts the response on resps unless the connection context is done in
+// the meanwhile. The step context derives from stepCtx, which serveMux
+// cancels when the client cancels the request. When the client asked for
+// streaming, we also post partial responses and the final response is
+// empty because we have already sent all its content. If we do not admit
+// the step, we post a failure.
+func (thh *THHandler) muxStep(connCtx, stepCtx context.Context, thReq *THMuxRequest,
+	address string, resps chan<- *THMuxResponse) {
+	ctx, cancel := context.WithTimeout(stepCtx, thMuxRequestTimeout)
+	defer cancel()
+	thr := thh.newTHRequestHandler()
+	thr.metrics.requests.Inc("websocket_v2")
+	release, err := thr.admit(ctx, address)
+	if err != nil {
+		out := &THMuxResponse{
+			ID:       thReq.ID,
+			Failure:  err.Error(),
+			Partial:  false,
+			Response: nil,
+		}
+		select {
+		case resps <- out:
+		case <-connCtx.Done():
+		}
+		return // error already printed
+	}
+	defer release()
+	var partial func(*THResponse)
+	if thReq.Stream {
+		partial = func(resp *THResponse) {
+			out := &THMuxResponse{
+				ID:       thReq.ID,
+				Failure:  "",
+				Partial:  true,
+				Response: resp,
+			}
+			select {
+			case resps <- out:
+			case <-connCtx.Done():
+			}
+		}
+	}
+	resp, err := thr.stepWithPartialResults(ctx, thReq.Request, partial)
+	if resp != nil && thReq.Stream {
+		resp = &THResponse{
+			DNS:      []*measurex.DNSLookupMeasurement{},
+			Endpoint: []*measurex.EndpointMeasurement{},
+		}
+	}
+	out := &THMuxResponse{
+		ID:       thReq.ID,
+		Failure:  "",
+		Partial:  false,
+		Response: resp,
+	}
+	if err != nil {
+		logcat.Shrugf("[thh] TH goroutine failed: %s", err.Error())
+		out.Failure = err.Error()
+	}
+	select {
+	case resps <- out:
+	case <-connCtx.Done():
+	}
+}
+
+// writeMuxResponse writes a response to the client.
+func (thh *THHandler) writeMuxResponse(conn *websocket.Conn, thResp *THMuxResponse) error {
+	// We assume that the following call cannot fail because it's a
+	// clearly serializable data structure.
+	data, err := json.Marshal(thResp)
+	runtimex.PanicOnError(err, "json.Marshal failed")
+	conn.SetWriteDeadline(time.Now().Add(thMuxWriteTimeout))
+	if err := conn.WriteMessage(websocket.TextMessage, data); err != nil {
+		logcat.Shrugf("[thh] cannot write message: %s", err.Error())
+		thh.thMetrics().websocketErrors.Inc("write")
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,263 @@
+package websteps
+
+//
+// Traceroute follow-up
+//
+// Follow-up experiment to localize the network hop that interferes
+// with a TCP connect, a TLS handshake, or a DNS query.
+//
+// When the analysis flags an endpoint because of a RST during the TCP
+// connect or because of a RST or EOF during the TLS handshake, or when
+// it flags a UDP DNS lookup because of an unexpected reply, we repeat
+// the packet that triggered the interference with increasing TTLs (see
+// the traceroute package). The smallest TTL that receives a response is
+// the distance of the hop that responded. To tell the censor apart from
+// the server, we also measure the distance of the server using packets
+// that should not trigger censorship: a TCP connect for TLS and a DNS
+// query for a control domain for DNS. We link the traceroute results
+// from the analysis results using Refs. When several targets would use
+// the same packets (e.g., two endpoints with the same address), we only
+// run the traceroute once and link its results from all of them.
+//
+// We do not run this experiment for lookups using the system resolver,
+// because we don't know which resolver the system resolver used.
+//
+// We only run this experiment when Client.TracerouteMaxTTL is positive,
+// because sending a packet for each TTL is quite slow.
+//
+
+import (
+	"context"
+	"net"
+
+	"github.com/bassosimone/websteps-illustrated/internal/archival"
+	"github.com/bassosimone/websteps-illustrated/internal/logcat"
+	"github.com/bassosimone/websteps-illustrated/internal/measurex"
+	"github.com/bassosimone/websteps-illustrated/internal/traceroute"
+	"github.com/miekg/dns"
+)
+
+// tracerouteDNSControlDomain is the domain we query to measure
+// the distance of a DNS resolver.
+const tracerouteDNSControlDomain = "example.com"
+
+// tracerouteFollowUp runs the traceroute follow-up experiment for the
+// endpoints and the lookups with interference, stores the results into
+// ssm.Traceroute, and links them from the analysis.
+func (c *Client) tracerouteFollowUp(ctx context.Context,
+	mx measurex.AbstractMeasurer, ssm *SingleStepMeasurement) {
+	if c.TracerouteMaxTTL <= 0 {
+		return
+	}
+	plans, _ := ssm.tracerouteFollowUpPlans()
+	if len(plans) <= 0 {
+		return
+	}
+	logcat.Substepf("localizing the hop that interferes using %d traceroute(s)", len(plans))
+	engine := c.NewTracerouteEngine(mx, c.TracerouteMaxTTL)
+	ssm.Traceroute = append(ssm.Traceroute, engine.Run(ctx, plans...)...)
+	ssm.tracerouteAnalysis()
+}
+
+// tracerouteFollowUpPlans returns the traceroute plans. For each target,
+// we put the plan that should not trigger censorship first. The returned
+// map maps the ID of each target to the TargetID of the plans that we run
+// for it, which differ when several targets share the same plans.
+func (ssm *SingleStepMeasurement) tracerouteFollowUpPlans() (
+	out []*traceroute.Plan, targets map[int64]int64) {
+	if ssm.Analysis == nil {
+		return nil, nil
+	}
+	targets = map[int64]int64{}
+	uniq := map[string]int64{}
+	for _, score := range ssm.Analysis.Endpoint {
+		if len(score.Refs) <= 0 {
+			continue
+		}
+		epnt, found := ssm.probeEndpointByID(score.Refs[0])
+		if !found || epnt.Network != archival.NetworkTypeTCP || epnt.URL == nil {
+			continue
+		}
+		switch {
+		case (score.Flags & AnalysisTCPRefused) != 0:
+			key := "tcp " + epnt.Address
+			if tracerouteShouldPlan(uniq, targets, key, epnt.ID) {
+				out = append(out, newTraceroutePlan(epnt.ID, traceroute.ProbeTCPConnect,
+					epnt.Address, "", "", 0))
+			}
+		case (score.Flags & (AnalysisTLSReset | AnalysisTLSEOF)) != 0:
+			sni := epnt.URL.Hostname()
+			key := "tls " + epnt.Address + " " + sni
+			if tracerouteShouldPlan(uniq, targets, key, epnt.ID) {
+				out = append(out, newTraceroutePlan(epnt.ID, traceroute.ProbeTCPConnect,
+					epnt.Address, "", "", 0))
+				out = append(out, newTraceroutePlan(epnt.ID, traceroute.ProbeTLSHandshake,
+					epnt.Address, sni, "", 0))
+			}
+		}
+	}
+	const dnsFailures = AnalysisNXDOMAIN | AnalysisBogon | AnalysisDNSNoAnswer |
+		AnalysisDNSRefused | AnalysisDNSDiff | AnalysisDNSServfail | AnalysisDNSInjected
+	for _, score := range ssm.Analysis.DNS {
+		if (score.Flags&dnsFailures) == 0 || len(score.Refs) <= 0 {
+			continue
+		}
+		lookup, found := ssm.probeLookupByID(score.Refs[0])
+		if !found {
+			continue
+		}
+		resolver, found := tracerouteResolverAddress(lookup)
+		if !found {
+			continue
+		}
+		qtype := dns.TypeA
+		if lookup.LookupType() == archival.DNSLookupTypeHTTPS {
+			qtype = dns.TypeHTTPS
+		}
+		key := "dns " + resolver + " " + lookup.Domain() + " " + dns.TypeToString[qtype]
+		if tracerouteShouldPlan(uniq, targets, key, lookup.ID) {
+			out = append(out, newTraceroutePlan(lookup.ID, traceroute.ProbeDNSQuery,
+				resolver, "", tracerouteDNSControlDomain, qtype))
+			out = append(out, newTraceroutePlan(lookup.ID, traceroute.ProbeDNSQuery,
+				resolver, "", lookup.Domain(), qtype))
+		}
+	}
+	return
+}
+
+// tracerouteShouldPlan returns whether we should plan traceroutes for the
+// given key and target. When we have already planned traceroutes for the
+// same key, we map the target to the target of the existing plans.
+func tracerouteShouldPlan(uniq map[string]int64,
+	targets map[int64]int64, key string, targetID int64) bool {
+	if planned, found := uniq[key]; found {
+		targets[targetID] = planned
+		return false
+	}
+	uniq[key] = targetID
+	targets[targetID] = targetID
+	return true
+}
+
+// newTraceroutePlan creates a new traceroute.Plan.
+func newTraceroutePlan(targetID int64, probe, address,
+	sni, domain string, qtype uint16) *traceroute.Plan {
+	return &traceroute.Plan{
+		TargetID:  targetID,
+		Probe:     probe,
+		Address:   address,
+		SNI:       sni,
+		Domain:    domain,
+		QueryType: qtype,
+	}
+}
+
+// tracerouteResolverAddress returns the address of the UDP resolver used
+// by the given lookup. We don't know the address of the resolver used by
+// the system resolver, so we return false in such a case.
+func tracerouteResolverAddress(lookup *measurex.DNSLookupMeasurement) (string, bool) {
+	if lookup.ResolverNetwork() != archival.NetworkTypeUDP {
+		return "", false
+	}
+	if _, _, err := net.SplitHostPort(lookup.ResolverAddress()); err != nil {
+		return "", false
+	}
+	return lookup.ResolverAddress(), true
+}
+
+// probeLookupByID returns the probe's lookup with the given ID.
+func (ssm *SingleStepMeasurement) probeLookupByID(id int64) (*measurex.DNSLookupMeasurement, bool) {
+	if ssm.ProbeInitial != nil {
+		for _, lookup := range ssm.ProbeInitial.DNS {
+			if lookup.ID == id {
+				return lookup, true
+			}
+		}
+	}
+	return nil, false
+}
+
+// tracerouteAnalysis links the traceroute results from the DNS and
+// endpoint analysis results that caused us to run them and logs the
+// distance of the hop that interferes.
+func (ssm *SingleStepMeasurement) tracerouteAnalysis() {
+	if len(ssm.Traceroute) <= 0 || ssm.Analysis == nil {
+		return
+	}
+	_, targets := ssm.tracerouteFollowUpPlans()
+	logcat.Substep("analyzing traceroute follow-up results")
+	for _, score := range ssm.Analysis.DNS {
+		score.Refs = ssm.tracerouteAnalyzeTarget(score.ID, score.Refs, targets)
+	}
+	for _, score := range ssm.Analysis.Endpoint {
+		score.Refs = ssm.tracerouteAnalyzeTarget(score.ID, score.Refs, targets)
+	}
+}
+
+// tracerouteAnalyzeTarget analyzes the traceroute results for the
+// target in refs[0] and returns refs with the results IDs appended.
+func (ssm *SingleStepMeasurement) tracerouteAnalyzeTarget(
+	scoreID int64, refs []int64, targets map[int64]int64) []int64 {
+	if len(refs) <= 0 {
+		return refs
+	}
+	targetID, found := targets[refs[0]]
+	if !found {
+		return refs
+	}
+	var results []*traceroute.Result
+	for _, r := range ssm.Traceroute {
+		if r.TargetID == targetID && r.ID > 0 && !analysisRefsContain(refs, r.ID) {
+			refs = append(refs, r.ID)
+			results = append(results, r)
+		}
+	}
+	if len(results) <= 0 {
+		return refs
+	}
+	// The last result is the one using the packet that triggers
+	// censorship and the previous one (if any) is the baseline.
+	probe := results[len(results)-1]
+	hop, found := probe.ResponsiveTTL()
+	if !found {
+		logcat.Shrugf("[#%d] no response for #%d with TTL <= %d",
+			scoreID, refs[0], len(probe.Hops))
+		return refs
+	}
+	if len(results) < 2 {
+		logcat.Infof("[#%d] the hop at distance %d responds to #%d (%s)",
+			scoreID, hop.TTL, refs[0], tracerouteDescribeFailure(hop.Failure))
+		return refs
+	}
+	baseline, found := results[len(results)-2].ResponsiveTTL()
+	switch {
+	case !found:
+		logcat.Infof("[#%d] the hop at distance %d responds to #%d (%s) but we don't know the server distance",
+			scoreID, hop.TTL, refs[0], tracerouteDescribeFailure(hop.Failure))
+	case hop.TTL < baseline.TTL:
+		logcat.Confirmedf("[#%d] the hop at distance %d interferes with #%d (%s) and the server is at distance %d",
+			scoreID, hop.TTL, refs[0], tracerouteDescribeFailure(hop.Failure), baseline.TTL)
+	default:
+		logcat.Shrugf("[#%d] the response to #%d (%s) comes from the server's distance (%d)",
+			scoreID, refs[0], tracerouteDescribeFailure(hop.Failure), baseline.TTL)
+	}
+	return refs
+}
+
+// tracerouteDescribeFailure returns a description of the given failure.
+func tracerouteDescribeFailure(failure archival.FlatFailure) string {
+	if failure == "" {
+		return "success"
+	}
+	return string(failure)
+}
+
+// analysisRefsContain returns whether refs contains id.
+func analysisRefsContain(refs []int64, id int64) bool {
+	for _, ref := range refs {
+		if ref == id {
+			return true
+		}
+	}
+	return false
+}
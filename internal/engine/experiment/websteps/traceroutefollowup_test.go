@@ -0,0 +1,91 @@
+package websteps
+
+import (
+	"testing"
+
+	"github.com/bassosimone/websteps-illustrated/internal/archival"
+	"github.com/bassosimone/websteps-illustrated/internal/measurex"
+	"github.com/bassosimone/websteps-illustrated/internal/traceroute"
+)
+
+func TestTracerouteFollowUpPlans(t *testing.T) {
+	newEndpoint := func(id int64, address string) *measurex.EndpointMeasurement {
+		return &measurex.EndpointMeasurement{
+			ID:      id,
+			URL:     &measurex.SimpleURL{Scheme: "https", Host: "example.com", Path: "/"},
+			Network: archival.NetworkTypeTCP,
+			Address: address,
+		}
+	}
+	newLookup := func(id int64, network archival.NetworkType,
+		resolver string) *measurex.DNSLookupMeasurement {
+		return &measurex.DNSLookupMeasurement{
+			ID: id,
+			Lookup: archival.NewFakeFlatDNSLookupEvent(network, resolver,
+				archival.DNSLookupTypeGetaddrinfo, "example.com", nil, nil),
+		}
+	}
+	ssm := &SingleStepMeasurement{
+		ProbeInitial: &measurex.URLMeasurement{
+			DNS: []*measurex.DNSLookupMeasurement{
+				newLookup(1, archival.NetworkTypeSystem, ""),
+				newLookup(2, archival.NetworkTypeUDP, "8.8.8.8:53"),
+			},
+			Endpoint: []*measurex.EndpointMeasurement{
+				newEndpoint(3, "93.184.216.34:443"),
+				newEndpoint(4, "93.184.216.34:443"),
+			},
+		},
+		Analysis: &Analysis{
+			DNS: []*AnalysisDNS{
+				{ID: 5, Refs: []int64{1}, Flags: AnalysisDNSInjected},
+				{ID: 6, Refs: []int64{2}, Flags: AnalysisDNSInjected},
+			},
+			Endpoint: []*AnalysisEndpoint{
+				{ID: 7, Refs: []int64{3}, Flags: AnalysisTLSReset},
+				{ID: 8, Refs: []int64{4}, Flags: AnalysisTLSReset},
+			},
+		},
+	}
+	plans, targets := ssm.tracerouteFollowUpPlans()
+	var probes []string
+	for _, plan := range plans {
+		probes = append(probes, plan.Probe)
+		if plan.TargetID == 1 {
+			t.Fatal("we should not trace the system resolver")
+		}
+	}
+	expect := []string{
+		traceroute.ProbeTCPConnect, traceroute.ProbeTLSHandshake,
+		traceroute.ProbeDNSQuery, traceroute.ProbeDNSQuery,
+	}
+	if len(probes) != len(expect) {
+		t.Fatal("unexpected plans", probes)
+	}
+	for idx := range expect {
+		if probes[idx] != expect[idx] {
+			t.Fatal("unexpected plans", probes)
+		}
+	}
+	if targets[4] != 3 {
+		t.Fatal("the duplicate endpoint should share the plans of #3")
+	}
+	// Pretend we ran the plans and make sure both endpoints get the results.
+	for idx, plan := range plans {
+		ssm.Traceroute = append(ssm.Traceroute, &traceroute.Result{
+			ID:       int64(100 + idx),
+			TargetID: plan.TargetID,
+			Probe:    plan.Probe,
+			Address:  plan.Address,
+		})
+	}
+	ssm.tracerouteAnalysis()
+	for _, score := range ssm.Analysis.Endpoint {
+		if len(score.Refs) != 3 || score.Refs[1] != 100 || score.Refs[2] != 101 {
+			t.Fatal("unexpected refs for", score.ID, score.Refs)
+		}
+	}
+	if refs := ssm.Analysis.DNS[0].Refs; len(refs) != 1 {
+		t.Fatal("unexpected refs for the system resolver", refs)
+	}
+}
@@ -0,0 +1,105 @@
+package geolocate
+
+//
+// Echo
+//
+// Discovering the probe IP using an HTTP(S) echo service.
+//
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/bassosimone/websteps-illustrated/internal/engine/httpheader"
+	"github.com/bassosimone/websteps-illustrated/internal/model"
+	"github.com/bassosimone/websteps-illustrated/internal/netxlite"
+)
+
+const (
+	// maxEchoBodySize is the maximum body size we read from an echo service.
+	maxEchoBodySize = 1 << 10
+
+	// echoTimeout is the maximum time we wait for an echo service.
+	echoTimeout = 10 * time.Second
+)
+
+// EchoLookupper discovers the probe IP using an HTTP(S) service whose
+// response body is the client IP address as text (e.g., the service at
+// https://api64.ipify.org). The zero value is invalid; please, use
+// NewEchoLookupper to construct.
+type EchoLookupper struct {
+	// HTTPClient is the HTTP client to use.
+	HTTPClient model.HTTPClient
+
+	// URL is the URL of the echo service.
+	URL string
+}
+
+// NewEchoLookupper creates a new EchoLookupper for the given URL.
+func NewEchoLookupper(URL string) *EchoLookupper {
+	return &EchoLookupper{
+		HTTPClient: netxlite.NewHTTPClientStdlib(model.DiscardLogger),
+		URL:        URL,
+	}
+}
+
+// String implements IPLookupper.String.
+func (el *EchoLookupper) String() string {
+	return el.URL
+}
+
+// ErrEchoHTTPStatus indicates that the echo service did not return 200.
+var ErrEchoHTTPStatus = errors.New("geolocate: echo service returned non-200 status")
+
+// LookupIP implements IPLookupper.LookupIP.
+func (el *EchoLookupper) LookupIP(ctx context.Context) (string, error) {
+	ctx, cancel := context.WithTimeout(ctx, echoTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, "GET", el.URL, nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("User-Agent", httpheader.UserAgent())
+	resp, err := el.HTTPClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return "", ErrEchoHTTPStatus
+	}
+	reader := io.LimitReader(resp.Body, maxEchoBodySize)
+	data, err := netxlite.ReadAllContext(ctx, reader)
+	if err != nil {
+		return "", err
+	}
+	return canonicalIP(string(data))
+}
+
+// EchoHandler is a local fake of an IP echo service. It returns
+// the configured IP, if any, or the client IP otherwise. Configuring
+// the IP allows to pretend that the probe has a given public IP when
+// the probe and the service both run on the same host.
+type EchoHandler struct {
+	// IP is the OPTIONAL IP address to return.
+	IP string
+}
+
+// ServeHTTP implements http.Handler.
+func (eh *EchoHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	ip := eh.IP
+	if ip == "" {
+		addr, _, err := net.SplitHostPort(req.RemoteAddr)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		ip = addr
+	}
+	w.Header().Set("Content-Type", "text/plain")
+	w.Write([]byte(ip + "\n"))
+}
@@ -0,0 +1,96 @@
+package geolocate
+
+//
+// IP lookup
+//
+// Code to discover the probe's public IP addresses.
+//
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strings"
+
+	"github.com/bassosimone/websteps-illustrated/internal/logcat"
+)
+
+// IPLookupper discovers the probe's public IP address.
+type IPLookupper interface {
+	// LookupIP returns the probe's public IP address.
+	LookupIP(ctx context.Context) (string, error)
+
+	// String returns a description of the lookupper for logging.
+	String() string
+}
+
+// ErrInvalidIPAddress indicates that a lookupper returned a string
+// that is not the valid serialization of an IP address.
+var ErrInvalidIPAddress = errors.New("geolocate: invalid IP address")
+
+// ErrIPLookupFailed indicates that all the lookuppers failed.
+var ErrIPLookupFailed = errors.New("geolocate: all IP lookuppers failed")
+
+// DefaultSTUNServer is the default STUN server we use.
+const DefaultSTUNServer = "stun.l.google.com:19302"
+
+// NewIPLookupper creates a new IPLookupper from the given spec, which
+// is either a STUN server endpoint prefixed by "stun:" (in which case we
+// return a lookupper discovering both the IPv4 and the IPv6 address)
+// or the URL of an HTTP(S) service returning the probe IP as text.
+func NewIPLookupper(spec string) ([]IPLookupper, error) {
+	switch {
+	case strings.HasPrefix(spec, "stun:"):
+		server := strings.TrimPrefix(spec, "stun:")
+		if _, _, err := net.SplitHostPort(server); err != nil {
+			return nil, err
+		}
+		return []IPLookupper{
+			NewSTUNLookupper("udp4", server),
+			NewSTUNLookupper("udp6", server),
+		}, nil
+	case strings.HasPrefix(spec, "http://") || strings.HasPrefix(spec, "https://"):
+		return []IPLookupper{NewEchoLookupper(spec)}, nil
+	default:
+		return nil, ErrUnsupportedIPLookupper
+	}
+}
+
+// ErrUnsupportedIPLookupper indicates that NewIPLookupper does
+// not know how to handle the given spec.
+var ErrUnsupportedIPLookupper = errors.New("geolocate: unsupported IP lookupper")
+
+// LookupProbeIPs runs all the given lookuppers and returns the unique
+// IP addresses they discovered in canonical format. We expect some
+// lookuppers to fail (e.g., the IPv6 STUN lookupper when there is no
+// IPv6 connectivity) so we only fail when all of them fail.
+func LookupProbeIPs(ctx context.Context, lookuppers ...IPLookupper) ([]string, error) {
+	var out []string
+	uniq := map[string]bool{}
+	for _, lookupper := range lookuppers {
+		ip, err := lookupper.LookupIP(ctx)
+		if err != nil {
+			logcat.Shrugf("[geolocate] %s: %s", lookupper.String(), err.Error())
+			continue
+		}
+		if uniq[ip] {
+			continue
+		}
+		uniq[ip] = true
+		out = append(out, ip)
+	}
+	if len(out) <= 0 {
+		return nil, ErrIPLookupFailed
+	}
+	return out, nil
+}
+
+// canonicalIP returns the canonical representation of the
+// given IP address or an error if it's not an IP address.
+func canonicalIP(s string) (string, error) {
+	ip := net.ParseIP(strings.TrimSpace(s))
+	if ip == nil {
+		return "", ErrInvalidIPAddress
+	}
+	return ip.String(), nil
+}
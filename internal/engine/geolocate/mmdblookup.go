@@ -52,3 +52,8 @@ func (mmdbLookupper) LookupCC(ip string) (cc string, err error) {
 	}
 	return
 }
+
+// LookupCC returns the country code associated with the given IP address.
+func LookupCC(ip string) (cc string, err error) {
+	return (mmdbLookupper{}).LookupCC(ip)
+}
@@ -0,0 +1,203 @@
+package geolocate
+
+//
+// STUN
+//
+// Discovering the probe IP using a STUN binding request (RFC 5389).
+//
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/bassosimone/websteps-illustrated/internal/model"
+	"github.com/bassosimone/websteps-illustrated/internal/netxlite"
+)
+
+const (
+	// stunMagicCookie is the STUN magic cookie.
+	stunMagicCookie = 0x2112a442
+
+	// stunBindingRequest is the binding request message type.
+	stunBindingRequest = 0x0001
+
+	// stunBindingSuccess is the binding success response message type.
+	stunBindingSuccess = 0x0101
+
+	// stunAttrMappedAddress is the MAPPED-ADDRESS attribute.
+	stunAttrMappedAddress = 0x0001
+
+	// stunAttrXORMappedAddress is the XOR-MAPPED-ADDRESS attribute.
+	stunAttrXORMappedAddress = 0x0020
+
+	// stunHeaderLength is the length of the STUN header.
+	stunHeaderLength = 20
+
+	// stunInitialTimeout is the timeout of the first attempt.
+	stunInitialTimeout = 500 * time.Millisecond
+
+	// stunMaxAttempts is the maximum number of attempts.
+	stunMaxAttempts = 4
+)
+
+// STUNLookupper discovers the probe IP using a STUN server. The zero
+// value is invalid; please, use NewSTUNLookupper to construct.
+type STUNLookupper struct {
+	// Dialer is the dialer to use.
+	Dialer model.Dialer
+
+	// Network is the network to use ("udp4" or "udp6").
+	Network string
+
+	// Server is the STUN server endpoint (e.g., "stun.l.google.com:19302").
+	Server string
+}
+
+// NewSTUNLookupper creates a new STUNLookupper using the given network,
+// which determines the family of the discovered IP, and server.
+func NewSTUNLookupper(network, server string) *STUNLookupper {
+	return &STUNLookupper{
+		Dialer: netxlite.NewDialerWithResolver(
+			model.DiscardLogger, netxlite.NewResolverStdlib(model.DiscardLogger)),
+		Network: network,
+		Server:  server,
+	}
+}
+
+// String implements IPLookupper.String.
+func (sl *STUNLookupper) String() string {
+	return fmt.Sprintf("stun:%s/%s", sl.Server, sl.Network)
+}
+
+// ErrSTUNNoResponse indicates that the STUN server did not respond.
+var ErrSTUNNoResponse = errors.New("geolocate: no response from STUN server")
+
+// ErrSTUNInvalidResponse indicates that the STUN response is invalid.
+var ErrSTUNInvalidResponse = errors.New("geolocate: invalid STUN response")
+
+// LookupIP implements IPLookupper.LookupIP. We retransmit the request
+// doubling the timeout each time, as recommended by RFC 5389.
+func (sl *STUNLookupper) LookupIP(ctx context.Context) (string, error) {
+	conn, err := sl.Dialer.DialContext(ctx, sl.Network, sl.Server)
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+	txid := make([]byte, 12)
+	if _, err := rand.Read(txid); err != nil {
+		return "", err
+	}
+	request := newSTUNBindingRequest(txid)
+	timeout := stunInitialTimeout
+	buffer := make([]byte, 1500)
+	for attempt := 0; attempt < stunMaxAttempts; attempt++ {
+		if err := ctx.Err(); err != nil {
+			return "", err
+		}
+		if _, err := conn.Write(request); err != nil {
+			return "", err
+		}
+		deadline := time.Now().Add(timeout)
+		if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+			deadline = d
+		}
+		conn.SetReadDeadline(deadline)
+		for {
+			count, err := conn.Read(buffer)
+			if err != nil {
+				break // most likely a timeout, so let's retransmit
+			}
+			ip, err := parseSTUNBindingResponse(buffer[:count], txid)
+			if err != nil {
+				continue // not the response we're waiting for
+			}
+			return canonicalIP(ip.String())
+		}
+		timeout *= 2
+	}
+	return "", ErrSTUNNoResponse
+}
+
+// newSTUNBindingRequest creates a new binding request without attributes.
+func newSTUNBindingRequest(txid []byte) []byte {
+	out := make([]byte, 8, stunHeaderLength)
+	binary.BigEndian.PutUint16(out[0:], stunBindingRequest)
+	binary.BigEndian.PutUint16(out[2:], 0) // attributes length
+	binary.BigEndian.PutUint32(out[4:], stunMagicCookie)
+	return append(out, txid...)
+}
+
+// parseSTUNBindingResponse parses a binding success response with the
+// given transaction ID and returns the mapped address. We prefer the
+// XOR-MAPPED-ADDRESS but we also accept the legacy MAPPED-ADDRESS.
+func parseSTUNBindingResponse(data, txid []byte) (net.IP, error) {
+	if len(data) < stunHeaderLength ||
+		binary.BigEndian.Uint16(data[0:]) != stunBindingSuccess ||
+		binary.BigEndian.Uint32(data[4:]) != stunMagicCookie ||
+		!bytes.Equal(data[8:stunHeaderLength], txid) {
+		return nil, ErrSTUNInvalidResponse
+	}
+	length := int(binary.BigEndian.Uint16(data[2:]))
+	attrs := data[stunHeaderLength:]
+	if len(attrs) < length {
+		return nil, ErrSTUNInvalidResponse
+	}
+	attrs = attrs[:length]
+	var mapped net.IP
+	for len(attrs) >= 4 {
+		atype := binary.BigEndian.Uint16(attrs[0:])
+		alen := int(binary.BigEndian.Uint16(attrs[2:]))
+		padded := (alen + 3) &^ 3 // attributes are aligned to 4 bytes
+		if len(attrs) < 4+alen {
+			return nil, ErrSTUNInvalidResponse
+		}
+		value := attrs[4 : 4+alen]
+		switch atype {
+		case stunAttrXORMappedAddress:
+			return parseSTUNAddress(value, data[4:stunHeaderLength])
+		case stunAttrMappedAddress:
+			mapped, _ = parseSTUNAddress(value, nil)
+		}
+		if len(attrs) < 4+padded {
+			break
+		}
+		attrs = attrs[4+padded:]
+	}
+	if mapped == nil {
+		return nil, ErrSTUNInvalidResponse
+	}
+	return mapped, nil
+}
+
+// parseSTUNAddress parses the value of a (XOR-)MAPPED-ADDRESS attribute. When
+// key is not nil, we XOR the address with key (i.e., the magic cookie
+// followed by the transaction ID) as required by XOR-MAPPED-ADDRESS.
+func parseSTUNAddress(value, key []byte) (net.IP, error) {
+	if len(value) < 4 {
+		return nil, ErrSTUNInvalidResponse
+	}
+	var size int
+	switch value[1] { // value[0] is reserved
+	case 0x01:
+		size = net.IPv4len
+	case 0x02:
+		size = net.IPv6len
+	default:
+		return nil, ErrSTUNInvalidResponse
+	}
+	if len(value) != 4+size {
+		return nil, ErrSTUNInvalidResponse
+	}
+	ip := make(net.IP, size)
+	copy(ip, value[4:])
+	for idx := 0; key != nil && idx < size; idx++ {
+		ip[idx] ^= key[idx]
+	}
+	return ip, nil
+}
@@ -0,0 +1,219 @@
+package logcat
+
+//
+// JSON
+//
+// Logger emitting JSON lines and logger selection by name.
+//
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bassosimone/websteps-illustrated/internal/model"
+)
+
+// msgLogger is a model.Logger that wants to receive the full Msg
+// rather than a string possibly prefixed with the emoji.
+type msgLogger interface {
+	model.Logger
+
+	// LogMsg logs the given message.
+	LogMsg(m *Msg)
+}
+
+// JSONMsg is the structure of each JSON line emitted by JSONLogger.
+type JSONMsg struct {
+	// Time is the time when we collected the message.
+	Time time.Time `json:"time"`
+
+	// Level is the level name (e.g., "NOTICE").
+	Level string `json:"level"`
+
+	// Class is the emoji class name (e.g., "confirmed").
+	Class string `json:"class,omitempty"`
+
+	// Emoji is the emoji.
+	Emoji string `json:"emoji,omitempty"`
+
+	// Subsystem is the subsystem that emitted the message, which we
+	// obtain from prefixes like "[thh] " or "dnsping: ".
+	Subsystem string `json:"subsystem,omitempty"`
+
+	// ID is the measurement ID from the "[#N] " prefix.
+	ID int64 `json:"id,omitempty"`
+
+	// IDs contains all the "#N" measurement IDs in the message.
+	IDs []int64 `json:"ids,omitempty"`
+
+	// Tags contains all the "#tag" hashtags in the message.
+	Tags []string `json:"tags,omitempty"`
+
+	// Message is the message.
+	Message string `json:"message"`
+}
+
+// levelnames maps a level to its name.
+var levelnames = map[int64]string{
+	WARNING: "WARNING",
+	NOTICE:  "NOTICE",
+	INFO:    "INFO",
+	DEBUG:   "DEBUG",
+	TRACE:   "TRACE",
+}
+
+// classnames maps an emoji to its class name.
+var classnames = map[int64]string{
+	BUG:        "bug",
+	CACHE:      "cache",
+	SHRUG:      "shrug",
+	STEP:       "step",
+	SUBSTEP:    "substep",
+	NEW_INPUT:  "new_input",
+	SCRUTINIZE: "scrutinize",
+	CELEBRATE:  "celebrate",
+	UNEXPECTED: "unexpected",
+	CONFIRMED:  "confirmed",
+	INSPECT:    "inspect",
+}
+
+var (
+	// idPrefixPattern matches the "[#N] " prefix.
+	idPrefixPattern = regexp.MustCompile(`^\[#([0-9]+)\] `)
+
+	// subsystemPattern matches the "[name] " or "name: " prefix.
+	subsystemPattern = regexp.MustCompile(`^(?:\[([A-Za-z][A-Za-z0-9_.]*)\]|([A-Za-z][A-Za-z0-9_.]*):) `)
+
+	// idPattern matches "#N" measurement IDs.
+	idPattern = regexp.MustCompile(`(?:^|[^A-Za-z0-9_&])#([0-9]+)\b`)
+
+	// tagPattern matches "#tag" hashtags.
+	tagPattern = regexp.MustCompile(`(?:^|[^A-Za-z0-9_&])#([A-Za-z][A-Za-z0-9_]*)\b`)
+)
+
+// NewJSONMsg creates a JSONMsg from a Msg.
+func NewJSONMsg(m *Msg) *JSONMsg {
+	out := &JSONMsg{
+		Time:      m.Time,
+		Level:     levelnames[m.Level],
+		Class:     classnames[m.Emoji],
+		Emoji:     "",
+		Subsystem: "",
+		ID:        0,
+		IDs:       []int64{},
+		Tags:      []string{},
+		Message:   m.Message,
+	}
+	if out.Class != "" {
+		out.Emoji = strings.TrimSpace(emojimap[m.Emoji])
+	}
+	if v := idPrefixPattern.FindStringSubmatch(m.Message); v != nil {
+		out.ID, _ = strconv.ParseInt(v[1], 10, 64)
+		out.Subsystem = "analysis"
+	} else if v := subsystemPattern.FindStringSubmatch(m.Message); v != nil {
+		out.Subsystem = v[1] + v[2] // only one of them is not empty
+	}
+	for _, v := range idPattern.FindAllStringSubmatch(m.Message, -1) {
+		if id, err := strconv.ParseInt(v[1], 10, 64); err == nil {
+			out.IDs = append(out.IDs, id)
+		}
+	}
+	for _, v := range tagPattern.FindAllStringSubmatch(m.Message, -1) {
+		out.Tags = append(out.Tags, v[1])
+	}
+	return out
+}
+
+// JSONLogger returns a model.Logger that writes each message as a
+// JSON line (see JSONMsg) on the given io.Writer. When used with
+// StartConsumer, this logger ignores the emojis argument and always
+// includes the emoji and its class into the JSON line.
+func JSONLogger(w io.Writer) model.Logger {
+	return &jsonLogger{
+		mu: sync.Mutex{},
+		w:  w,
+	}
+}
+
+// jsonLogger is the logger returned by JSONLogger.
+type jsonLogger struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+var _ msgLogger = &jsonLogger{}
+
+// LogMsg implements msgLogger.LogMsg.
+func (jl *jsonLogger) LogMsg(m *Msg) {
+	// We assume that the following call cannot fail because it's a
+	// clearly serializable data structure.
+	data, _ := json.Marshal(NewJSONMsg(m))
+	data = append(data, '\n')
+	jl.mu.Lock()
+	jl.w.Write(data)
+	jl.mu.Unlock()
+}
+
+// logString logs a message received through the model.Logger interface.
+func (jl *jsonLogger) logString(level int64, msg string) {
+	jl.LogMsg(&Msg{
+		Level:   level,
+		Emoji:   0,
+		Message: msg,
+		Time:    time.Now(),
+	})
+}
+
+// Debug implements DebugLogger.Debug
+func (jl *jsonLogger) Debug(msg string) {
+	jl.logString(DEBUG, msg)
+}
+
+// Debugf implements DebugLogger.Debugf
+func (jl *jsonLogger) Debugf(format string, v ...interface{}) {
+	jl.logString(DEBUG, fmt.Sprintf(format, v...))
+}
+
+// Info implements InfoLogger.Info
+func (jl *jsonLogger) Info(msg string) {
+	jl.logString(INFO, msg)
+}
+
+// Infof implements InfoLogger.Infof
+func (jl *jsonLogger) Infof(format string, v ...interface{}) {
+	jl.logString(INFO, fmt.Sprintf(format, v...))
+}
+
+// Warn implements Logger.Warn
+func (jl *jsonLogger) Warn(msg string) {
+	jl.logString(WARNING, msg)
+}
+
+// Warnf implements Logger.Warnf
+func (jl *jsonLogger) Warnf(format string, v ...interface{}) {
+	jl.logString(WARNING, fmt.Sprintf(format, v...))
+}
+
+// ErrUnknownLogFormat indicates that NewLogger does not know the format.
+var ErrUnknownLogFormat = errors.New("logcat: unknown log format")
+
+// NewLogger returns the model.Logger for the given format, which is
+// either "text" (or empty) for DefaultLogger or "json" for JSONLogger. The
+// flags argument only applies to DefaultLogger.
+func NewLogger(format string, w io.Writer, flags int64) (model.Logger, error) {
+	switch format {
+	case "", "text":
+		return DefaultLogger(w, flags), nil
+	case "json":
+		return JSONLogger(w), nil
+	default:
+		return nil, fmt.Errorf("%w: %s", ErrUnknownLogFormat, format)
+	}
+}
@@ -327,6 +327,10 @@ func StartConsumer(ctx context.Context, logger model.Logger, emojis bool, wg *sy
 
 // consumerWriteLogMessage writes a log message.
 func consumerWriteLogMessage(m *Msg, logger model.Logger, emojis bool) {
+	if ml, good := logger.(msgLogger); good {
+		ml.LogMsg(m)
+		return
+	}
 	var prefix string
 	if emojis {
 		prefix = emojimap[m.Emoji]
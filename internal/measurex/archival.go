@@ -39,6 +39,12 @@ type ArchivalDNSLookupMeasurement struct {
 
 	// Queries contains the DNS lookup events.
 	Queries []model.ArchivalDNSLookupResult `json:"queries"`
+
+	// TCPConnect contains the TCP connect events (if any).
+	TCPConnect []model.ArchivalTCPConnectResult `json:"tcp_connect,omitempty"`
+
+	// TLSHandshakes contains the TLS handshake events (if any).
+	TLSHandshakes []model.ArchivalTLSOrQUICHandshakeResult `json:"tls_handshakes,omitempty"`
 }
 
 // ToArchival converts a DNSLookupMeasurement to ArchivalDNSLookupMeasurement.
@@ -52,6 +58,9 @@ func (m *DNSLookupMeasurement) ToArchival(begin time.Time) ArchivalDNSLookupMeas
 		Failure:         m.Failure().ToArchivalFailure(),
 		Addresses:       m.Addresses(),
 		Queries:         m.queries(begin),
+		TCPConnect:      archival.NewArchivalTCPConnectResultList(begin, m.TCPConnect),
+		TLSHandshakes: archival.NewArchivalTLSOrQUICHandshakeResultList(
+			begin, m.QUICTLSHandshake),
 	}
 }
 
@@ -101,6 +110,9 @@ type ArchivalEndpointMeasurement struct {
 	// NetworkEvent contains network events (if any).
 	NetworkEvents []model.ArchivalNetworkEvent `json:"network_events"`
 
+	// SpeedSamples contains the download speed samples (if any).
+	SpeedSamples []ArchivalSpeedSample `json:"speed_samples"`
+
 	// TCPConnect contains the TCP connect event (if any).
 	TCPConnect *model.ArchivalTCPConnectResult `json:"tcp_connect"`
 
@@ -127,6 +139,7 @@ func (m *EndpointMeasurement) ToArchival(
 		BodyLength:       m.BodyLength(),
 		Title:            m.HTTPTitle,
 		NetworkEvents:    archival.NewArchivalNetworkEventList(begin, m.NetworkEvent),
+		SpeedSamples:     NewArchivalSpeedSampleList(m.SpeedSamples),
 		TCPConnect:       m.toArchivalTCPConnectResult(begin),
 		QUICTLSHandshake: m.toArchivalTLSOrQUICHandshakeResult(begin),
 		HTTPRoundTrip:    m.toArchivalHTTPRequestResult(begin, bodyFlags),
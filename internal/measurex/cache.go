@@ -17,13 +17,13 @@ import (
 	"context"
 	"encoding/json"
 	"net/http"
-	"path"
 	"sort"
 	"time"
 
 	"github.com/bassosimone/websteps-illustrated/internal/archival"
 	"github.com/bassosimone/websteps-illustrated/internal/caching"
 	"github.com/bassosimone/websteps-illustrated/internal/logcat"
+	"github.com/bassosimone/websteps-illustrated/internal/metrics"
 )
 
 // Cache is a cache for measurex DNS and endpoint measurements.
@@ -32,20 +32,57 @@ type Cache struct {
 	DisableNetwork bool
 
 	// DNS is a reference to the underlying DNS cache.
-	DNS *caching.FSCache
+	DNS caching.Store
 
 	// Endpoint is a reference to the underlying endpoint cache.
-	Endpoint *caching.FSCache
+	Endpoint caching.Store
+
+	// lookups counts the CachingMeasurer lookups.
+	lookups *metrics.Counter
 }
 
-// NewCache creates a new cache inside the given directory.
+// NewCache creates a new cache inside the given directory or, when
+// caching.IsDBPath(dirpath) is true, inside the given DB file.
 func NewCache(dirpath string) *Cache {
-	ddp := path.Join(dirpath, "dns")
-	edp := path.Join(dirpath, "endpoint")
 	return &Cache{
 		DisableNetwork: false,
-		DNS:            caching.NewFSCache(ddp),
-		Endpoint:       caching.NewFSCache(edp),
+		DNS:            caching.NewStore(dirpath, "dns"),
+		Endpoint:       caching.NewStore(dirpath, "endpoint"),
+		lookups:        nil,
+	}
+}
+
+// SetMetrics configures the registry where to collect metrics about the
+// cache and about the CachingMeasurers using it. You MUST call this
+// function before using the cache.
+func (c *Cache) SetMetrics(reg *metrics.Registry) {
+	c.DNS.SetMetrics(reg, "dns")
+	c.Endpoint.SetMetrics(reg, "endpoint")
+	c.lookups = reg.NewCounter("measurex_cache_lookups_total",
+		"Number of CachingMeasurer lookups by kind and result.", "kind", "result")
+}
+
+// SetMaxBytes sets the maximum size of each of the DNS and endpoint
+// caches. When a cache grows beyond such a size, we remove its least
+// recently used entries. A zero or negative value means no limit.
+func (c *Cache) SetMaxBytes(maxBytes int64) {
+	c.DNS.SetMaxBytes(maxBytes)
+	c.Endpoint.SetMaxBytes(maxBytes)
+}
+
+// SetKeepUnused sets whether Trim should keep the DNS and endpoint
+// cache entries that have not been used recently, which is what we
+// want when using the CachingForeverPolicy.
+func (c *Cache) SetKeepUnused(keepUnused bool) {
+	c.DNS.SetKeepUnused(keepUnused)
+	c.Endpoint.SetKeepUnused(keepUnused)
+}
+
+// Stats returns the statistics of the DNS and endpoint caches.
+func (c *Cache) Stats() map[string]caching.Stats {
+	return map[string]caching.Stats{
+		"dns":      c.DNS.Stats(),
+		"endpoint": c.Endpoint.Stats(),
 	}
 }
 
@@ -72,7 +109,9 @@ func (c *Cache) StartTrimmer(ctx context.Context) {
 	}()
 }
 
-// CachingPolicy allows to customize che CachingMeasurer policy.
+// CachingPolicy allows to customize che CachingMeasurer policy. The
+// CachingMeasurer does not store measurements that are already stale
+// when they are created (see also NewConfigurableCachingPolicy).
 type CachingPolicy interface {
 	// StaleDNSLookupMeasurement returns whether a DNSLookupMeasurement is stale.
 	StaleDNSLookupMeasurement(m *CachedDNSLookupMeasurement) bool
@@ -216,6 +255,7 @@ func (mx *CachingMeasurer) dnsLookups(ctx context.Context,
 	)
 	for _, plan := range dnsLookups {
 		meas, found := mx.cache.FindDNSLookupMeasurement(plan, mx.policy)
+		mx.cache.lookups.Inc("dns", cacheLookupResult(found))
 		if !found {
 			if mx.cache.DisableNetwork {
 				logcat.Shrugf("measurex: cache miss for: %s", plan.Summary())
@@ -225,6 +265,8 @@ func (mx *CachingMeasurer) dnsLookups(ctx context.Context,
 					ReverseAddress:   "",
 					Lookup:           &archival.FlatDNSLookupEvent{},
 					RoundTrip:        []*archival.FlatDNSRoundTripEvent{},
+					TCPConnect:       []*archival.FlatNetworkEvent{},
+					QUICTLSHandshake: []*archival.FlatQUICTLSHandshakeEvent{},
 				})
 				continue
 			}
@@ -248,11 +290,21 @@ func (mx *CachingMeasurer) dnsLookups(ctx context.Context,
 	}
 	// 4. perform non-cached measurements and store them in cache
 	for meas := range mx.measurer.DNSLookups(ctx, todo...) {
-		_ = mx.cache.StoreDNSLookupMeasurement(meas)
+		if !mx.policy.StaleDNSLookupMeasurement(&CachedDNSLookupMeasurement{T: time.Now(), M: meas}) {
+			_ = mx.cache.StoreDNSLookupMeasurement(meas) // skip what we would never use
+		}
 		out <- meas
 	}
 }
 
+// cacheLookupResult returns the value of the "result" label of a lookup.
+func cacheLookupResult(found bool) string {
+	if found {
+		return "hit"
+	}
+	return "miss"
+}
+
 // CachedDNSLookupMeasurement is the cached form of a DNSLookupMeasurement.
 type CachedDNSLookupMeasurement struct {
 	T time.Time
@@ -338,6 +390,7 @@ func (mx *CachingMeasurer) measureEndpoints(ctx context.Context,
 	)
 	for _, plan := range epnts {
 		meas, found := mx.cache.FindEndpointMeasurement(plan, mx.policy)
+		mx.cache.lookups.Inc("endpoint", cacheLookupResult(found))
 		if !found {
 			if mx.cache.DisableNetwork {
 				logcat.Shrugf("measurex: cache miss for: %s", plan.Summary())
@@ -355,6 +408,7 @@ func (mx *CachingMeasurer) measureEndpoints(ctx context.Context,
 					Location:         &SimpleURL{},
 					HTTPTitle:        "",
 					NetworkEvent:     []*archival.FlatNetworkEvent{},
+					SpeedSamples:     []*SpeedSample{},
 					TCPConnect:       &archival.FlatNetworkEvent{},
 					QUICTLSHandshake: &archival.FlatQUICTLSHandshakeEvent{},
 					HTTPRoundTrip:    &archival.FlatHTTPRoundTripEvent{},
@@ -381,7 +435,9 @@ func (mx *CachingMeasurer) measureEndpoints(ctx context.Context,
 	}
 	// 4. perform non-cached measurements and store them in cache
 	for meas := range mx.measurer.MeasureEndpoints(ctx, todo...) {
-		_ = mx.cache.StoreEndpointMeasurement(meas)
+		if !mx.policy.StaleEndpointMeasurement(&CachedEndpointMeasurement{T: time.Now(), M: meas}) {
+			_ = mx.cache.StoreEndpointMeasurement(meas) // skip what we would never use
+		}
 		out <- meas
 	}
 }
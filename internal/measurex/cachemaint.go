@@ -0,0 +1,159 @@
+package measurex
+
+//
+// Cache maintenance
+//
+// Code to walk, edit, and merge the content of a Cache.
+//
+// Because the underlying caching.Store only knows the digests of
+// the keys, we derive the key of each list of cached measurements from
+// the measurements themselves, the same way Store*Measurement does.
+//
+
+import (
+	"encoding/json"
+	"sort"
+
+	"github.com/bassosimone/websteps-illustrated/internal/caching"
+	"github.com/bassosimone/websteps-illustrated/internal/logcat"
+)
+
+// WalkDNSLookupEntries calls fx for each list of cached DNS lookup
+// measurements along with the key we use for the list. We skip the
+// lists we cannot parse and the lists whose key we cannot derive. The
+// fx function may use the cache, e.g., to replace the list.
+func (c *Cache) WalkDNSLookupEntries(
+	fx func(key string, elist []CachedDNSLookupMeasurement) error) error {
+	return c.DNS.Walk(func(entry *caching.Entry) error {
+		var elist []CachedDNSLookupMeasurement
+		if err := json.Unmarshal(entry.Value, &elist); err != nil {
+			logcat.Shrugf("cache: cannot parse DNS entry %s: %s", entry.Digest, err.Error())
+			return nil
+		}
+		for _, e := range elist {
+			if e.M != nil {
+				return fx(e.M.Domain(), elist)
+			}
+		}
+		logcat.Shrugf("cache: cannot derive the key of DNS entry %s", entry.Digest)
+		return nil
+	})
+}
+
+// WalkEndpointEntries is like WalkDNSLookupEntries for endpoints.
+func (c *Cache) WalkEndpointEntries(
+	fx func(key string, elist []CachedEndpointMeasurement) error) error {
+	return c.Endpoint.Walk(func(entry *caching.Entry) error {
+		var elist []CachedEndpointMeasurement
+		if err := json.Unmarshal(entry.Value, &elist); err != nil {
+			logcat.Shrugf("cache: cannot parse endpoint entry %s: %s", entry.Digest, err.Error())
+			return nil
+		}
+		for _, e := range elist {
+			if e.M != nil {
+				return fx(e.M.Summary(), elist)
+			}
+		}
+		logcat.Shrugf("cache: cannot derive the key of endpoint entry %s", entry.Digest)
+		return nil
+	})
+}
+
+// ReplaceDNSLookupEntry replaces the list of cached DNS lookup
+// measurements with the given key. If the new list is empty, we
+// remove the key from the cache. When removing many keys, it's
+// better to use DeleteDNSLookupEntries, because a DB-backed cache
+// rewrites the whole file for each deletion.
+func (c *Cache) ReplaceDNSLookupEntry(key string, elist []CachedDNSLookupMeasurement) error {
+	if len(elist) <= 0 {
+		return c.DNS.Delete(key)
+	}
+	return c.writeDNSLookupEntry(key, elist)
+}
+
+// ReplaceEndpointEntry is like ReplaceDNSLookupEntry for endpoints.
+func (c *Cache) ReplaceEndpointEntry(key string, elist []CachedEndpointMeasurement) error {
+	if len(elist) <= 0 {
+		return c.Endpoint.Delete(key)
+	}
+	return c.writeEndpointEntry(key, elist)
+}
+
+// DeleteDNSLookupEntries removes the lists of cached DNS lookup
+// measurements with the given keys using a single deletion.
+func (c *Cache) DeleteDNSLookupEntries(keys ...string) error {
+	if len(keys) <= 0 {
+		return nil
+	}
+	return c.DNS.Delete(keys...)
+}
+
+// DeleteEndpointEntries is like DeleteDNSLookupEntries for endpoints.
+func (c *Cache) DeleteEndpointEntries(keys ...string) error {
+	if len(keys) <= 0 {
+		return nil
+	}
+	return c.Endpoint.Delete(keys...)
+}
+
+// MergeDNSLookupEntry merges the given list of cached DNS lookup
+// measurements into the list with the same key. When both lists contain
+// an instance of the same measurement, we keep the most recent one. Like
+// StoreDNSLookupMeasurement, we put the most recent entries first.
+func (c *Cache) MergeDNSLookupEntry(key string, elist []CachedDNSLookupMeasurement) error {
+	current, _ := c.readDNSLookupEntry(key)
+	all := append(current, elist...)
+	sort.SliceStable(all, func(i, j int) bool {
+		return all[i].T.After(all[j].T)
+	})
+	var out []CachedDNSLookupMeasurement
+	for _, entry := range all {
+		if entry.M == nil {
+			continue // remove this corrupted entry
+		}
+		if !containsDNSLookupInstance(out, entry.M) {
+			out = append(out, entry)
+		}
+	}
+	return c.ReplaceDNSLookupEntry(key, out)
+}
+
+// containsDNSLookupInstance returns whether elist contains
+// another instance of the given measurement.
+func containsDNSLookupInstance(elist []CachedDNSLookupMeasurement, m *DNSLookupMeasurement) bool {
+	for _, entry := range elist {
+		if entry.M.IsAnotherInstanceOf(m) {
+			return true
+		}
+	}
+	return false
+}
+
+// MergeEndpointEntry is like MergeDNSLookupEntry for endpoints.
+func (c *Cache) MergeEndpointEntry(key string, elist []CachedEndpointMeasurement) error {
+	current, _ := c.readEndpointEntry(key)
+	all := append(current, elist...)
+	sort.SliceStable(all, func(i, j int) bool {
+		return all[i].T.After(all[j].T)
+	})
+	var out []CachedEndpointMeasurement
+	for _, entry := range all {
+		if entry.M == nil {
+			continue // remove this corrupted entry
+		}
+		if !containsEndpointInstance(out, entry.M) {
+			out = append(out, entry)
+		}
+	}
+	return c.ReplaceEndpointEntry(key, out)
+}
+
+// containsEndpointInstance is like containsDNSLookupInstance for endpoints.
+func containsEndpointInstance(elist []CachedEndpointMeasurement, m *EndpointMeasurement) bool {
+	for _, entry := range elist {
+		if entry.M.IsAnotherInstanceOf(m) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,321 @@
+package measurex
+
+//
+// Caching policy
+//
+// Configurable caching policy.
+//
+// A CachingPolicyConfig contains rules for DNS and endpoint measurements.
+// Each rule matches some properties of a cached measurement (an empty
+// list matches any value) and tells for how long the measurement remains
+// fresh. We evaluate the rules in order and the first matching rule
+// wins. When no rule matches, the measurement is stale.
+//
+// DefaultCachingPolicyConfig contains the default rules, which are also
+// in testdata/cachingpolicy.yaml. You can load alternative rules from YAML
+// or JSON using LoadCachingPolicyConfig. Because a bare integer max_age
+// would be a number of nanoseconds, we require max_age to include units.
+//
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/bassosimone/websteps-illustrated/internal/archival"
+	"github.com/bassosimone/websteps-illustrated/internal/netxlite"
+	"github.com/miekg/dns"
+	"gopkg.in/yaml.v3"
+)
+
+// CachingPolicyConfig contains the rules of a configurable CachingPolicy.
+type CachingPolicyConfig struct {
+	// DNS contains rules for DNS lookup measurements.
+	DNS []*CachingDNSRule `json:"dns" yaml:"dns"`
+
+	// Endpoint contains rules for endpoint measurements.
+	Endpoint []*CachingEndpointRule `json:"endpoint" yaml:"endpoint"`
+}
+
+// CachingDNSRule is a caching rule for DNS lookup measurements.
+type CachingDNSRule struct {
+	// Name is the OPTIONAL name of the rule.
+	Name string `json:"name,omitempty" yaml:"name,omitempty"`
+
+	// Failure contains the failures matched by this rule. Use
+	// "ok" to match successful lookups.
+	Failure []string `json:"failure,omitempty" yaml:"failure,omitempty"`
+
+	// LookupType contains the lookup types matched by this rule.
+	LookupType []string `json:"lookup_type,omitempty" yaml:"lookup_type,omitempty"`
+
+	// MaxAge is the maximum age of a fresh measurement (e.g., "15m"). A
+	// zero value means that we should never use cached measurements. A
+	// nonzero value smaller than one second is invalid because it's most
+	// likely a bare integer without units (i.e., nanoseconds).
+	MaxAge time.Duration `json:"max_age" yaml:"max_age"`
+
+	// UseTTL indicates that we should use the TTL of the DNS replies
+	// as the maximum age when it is smaller than MaxAge. For replies
+	// without answers, we use the SOA negative caching TTL.
+	UseTTL bool `json:"use_ttl,omitempty" yaml:"use_ttl,omitempty"`
+}
+
+// CachingEndpointRule is a caching rule for endpoint measurements.
+type CachingEndpointRule struct {
+	// Name is the OPTIONAL name of the rule.
+	Name string `json:"name,omitempty" yaml:"name,omitempty"`
+
+	// FailedOperation contains the failed operations matched by this rule.
+	FailedOperation []string `json:"failed_operation,omitempty" yaml:"failed_operation,omitempty"`
+
+	// Failure contains the failures matched by this rule. Use
+	// "ok" to match successful measurements.
+	Failure []string `json:"failure,omitempty" yaml:"failure,omitempty"`
+
+	// Network contains the networks matched by this rule.
+	Network []string `json:"network,omitempty" yaml:"network,omitempty"`
+
+	// MaxAge is like CachingDNSRule.MaxAge.
+	MaxAge time.Duration `json:"max_age" yaml:"max_age"`
+}
+
+// ErrInvalidCachingPolicyConfig indicates that the config is not valid.
+var ErrInvalidCachingPolicyConfig = errors.New("measurex: invalid caching policy config")
+
+// LoadCachingPolicyConfig loads a CachingPolicyConfig from the given
+// YAML or JSON file and validates it.
+func LoadCachingPolicyConfig(filename string) (*CachingPolicyConfig, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	return ParseCachingPolicyConfig(data)
+}
+
+// ParseCachingPolicyConfig parses a CachingPolicyConfig from YAML or
+// JSON (which is a subset of YAML) and validates it.
+func ParseCachingPolicyConfig(data []byte) (*CachingPolicyConfig, error) {
+	var config CachingPolicyConfig
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	decoder.KnownFields(true)
+	if err := decoder.Decode(&config); err != nil && !errors.Is(err, io.EOF) {
+		return nil, fmt.Errorf("%w: %s", ErrInvalidCachingPolicyConfig, err.Error())
+	}
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
+	return &config, nil
+}
+
+// Validate returns an error if any rule has a negative maximum age or
+// a maximum age smaller than one second, which most likely means that
+// the config contains a bare integer without units (e.g., 300).
+func (c *CachingPolicyConfig) Validate() error {
+	for idx, rule := range c.DNS {
+		if err := validateCachingMaxAge(rule.MaxAge); err != nil {
+			return fmt.Errorf("%w: dns rule %d: %s", ErrInvalidCachingPolicyConfig, idx, err.Error())
+		}
+	}
+	for idx, rule := range c.Endpoint {
+		if err := validateCachingMaxAge(rule.MaxAge); err != nil {
+			return fmt.Errorf("%w: endpoint rule %d: %s", ErrInvalidCachingPolicyConfig, idx, err.Error())
+		}
+	}
+	return nil
+}
+
+// validateCachingMaxAge validates the max_age of a rule.
+func validateCachingMaxAge(maxAge time.Duration) error {
+	switch {
+	case maxAge < 0:
+		return errors.New("negative max_age")
+	case maxAge > 0 && maxAge < time.Second:
+		return fmt.Errorf("max_age %s is too small (did you forget the units?)", maxAge)
+	default:
+		return nil
+	}
+}
+
+// MatchDNS returns the first rule matching the given lookup.
+func (c *CachingPolicyConfig) MatchDNS(dlm *DNSLookupMeasurement) (*CachingDNSRule, bool) {
+	for _, rule := range c.DNS {
+		if rule.Match(dlm) {
+			return rule, true
+		}
+	}
+	return nil, false
+}
+
+// MatchEndpoint returns the first rule matching the given endpoint.
+func (c *CachingPolicyConfig) MatchEndpoint(em *EndpointMeasurement) (*CachingEndpointRule, bool) {
+	for _, rule := range c.Endpoint {
+		if rule.Match(em) {
+			return rule, true
+		}
+	}
+	return nil, false
+}
+
+// Match returns whether this rule matches the given lookup.
+func (r *CachingDNSRule) Match(dlm *DNSLookupMeasurement) bool {
+	return cachingRuleMatch(r.Failure, archival.FlatFailureToStringOrOK(dlm.Failure())) &&
+		cachingRuleMatch(r.LookupType, string(dlm.LookupType()))
+}
+
+// Match returns whether this rule matches the given endpoint.
+func (r *CachingEndpointRule) Match(em *EndpointMeasurement) bool {
+	return cachingRuleMatch(r.FailedOperation, string(em.FailedOperation)) &&
+		cachingRuleMatch(r.Failure, archival.FlatFailureToStringOrOK(em.Failure)) &&
+		cachingRuleMatch(r.Network, string(em.Network))
+}
+
+// cachingRuleMatch returns true if patterns is empty or contains value.
+func cachingRuleMatch(patterns []string, value string) bool {
+	if len(patterns) <= 0 {
+		return true
+	}
+	for _, pattern := range patterns {
+		if pattern == value {
+			return true
+		}
+	}
+	return false
+}
+
+// DefaultCachingPolicyConfig returns a new instance of the default config,
+// which caches successes longer than failures, caches timeouts for a short
+// time because they may be transient, and never uses cached endpoint
+// measurements failing in operations other than the ones that we expect
+// to fail while measuring an endpoint (see cachingExpectedFailedOperations),
+// because we cannot tell for how long such failures remain valid.
+func DefaultCachingPolicyConfig() *CachingPolicyConfig {
+	ok := []string{"ok"}
+	timeout := []string{netxlite.FailureGenericTimeoutError}
+	return &CachingPolicyConfig{
+		DNS: []*CachingDNSRule{{
+			Name:       "successful NS lookup",
+			Failure:    ok,
+			LookupType: []string{string(archival.DNSLookupTypeNS)},
+			MaxAge:     time.Hour,
+			UseTTL:     true,
+		}, {
+			Name:    "successful lookup",
+			Failure: ok,
+			MaxAge:  15 * time.Minute,
+			UseTTL:  true,
+		}, {
+			Name:    "timeout",
+			Failure: timeout,
+			MaxAge:  2 * time.Minute,
+		}, {
+			Name:   "other failure",
+			MaxAge: 5 * time.Minute,
+			UseTTL: true,
+		}},
+		Endpoint: []*CachingEndpointRule{{
+			Name:    "success",
+			Failure: ok,
+			MaxAge:  15 * time.Minute,
+		}, {
+			Name:            "timeout",
+			FailedOperation: cachingExpectedFailedOperations,
+			Failure:         timeout,
+			MaxAge:          2 * time.Minute,
+		}, {
+			Name:            "other failure",
+			FailedOperation: cachingExpectedFailedOperations,
+			MaxAge:          5 * time.Minute,
+		}, {
+			Name:   "unexpected failed operation",
+			MaxAge: 0,
+		}},
+	}
+}
+
+// cachingExpectedFailedOperations contains the operations that
+// may fail when we're measuring an endpoint.
+var cachingExpectedFailedOperations = []string{
+	netxlite.ConnectOperation,
+	netxlite.TLSHandshakeOperation,
+	netxlite.QUICHandshakeOperation,
+	netxlite.HTTPRoundTripOperation,
+}
+
+// NewConfigurableCachingPolicy returns a policy using the given config.
+func NewConfigurableCachingPolicy(config *CachingPolicyConfig) CachingPolicy {
+	return &configurableCachingPolicy{config}
+}
+
+type configurableCachingPolicy struct {
+	config *CachingPolicyConfig
+}
+
+var _ CachingPolicy = &configurableCachingPolicy{}
+
+func (p *configurableCachingPolicy) StaleDNSLookupMeasurement(m *CachedDNSLookupMeasurement) bool {
+	if m == nil || m.M == nil {
+		return true
+	}
+	rule, found := p.config.MatchDNS(m.M)
+	if !found {
+		return true
+	}
+	maxAge := rule.MaxAge
+	if rule.UseTTL {
+		if ttl, found := dnsLookupMinTTL(m.M); found && ttl < maxAge {
+			maxAge = ttl
+		}
+	}
+	return time.Since(m.T) >= maxAge
+}
+
+func (p *configurableCachingPolicy) StaleEndpointMeasurement(m *CachedEndpointMeasurement) bool {
+	if m == nil || m.M == nil {
+		return true
+	}
+	rule, found := p.config.MatchEndpoint(m.M)
+	if !found {
+		return true
+	}
+	return time.Since(m.T) >= rule.MaxAge
+}
+
+// dnsLookupMinTTL returns the minimum TTL of the answers in the replies
+// of the given lookup. For replies without answers, we use the negative
+// caching TTL of the SOA record, if any (see RFC 2308 Sect. 5).
+func dnsLookupMinTTL(dlm *DNSLookupMeasurement) (ttl time.Duration, found bool) {
+	update := func(value uint32) {
+		if v := time.Duration(value) * time.Second; !found || v < ttl {
+			ttl, found = v, true
+		}
+	}
+	for _, rtinfo := range dlm.RoundTrip {
+		if rtinfo == nil || len(rtinfo.Reply) <= 0 {
+			continue
+		}
+		reply := &dns.Msg{}
+		if err := reply.Unpack(rtinfo.Reply); err != nil {
+			continue
+		}
+		for _, answer := range reply.Answer {
+			update(answer.Header().Ttl)
+		}
+		if len(reply.Answer) > 0 {
+			continue
+		}
+		for _, rr := range reply.Ns {
+			if soa, ok := rr.(*dns.SOA); ok {
+				if soa.Minttl < soa.Hdr.Ttl {
+					update(soa.Minttl)
+					continue
+				}
+				update(soa.Hdr.Ttl)
+			}
+		}
+	}
+	return
+}
@@ -0,0 +1,223 @@
+package measurex
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/bassosimone/websteps-illustrated/internal/archival"
+	"github.com/bassosimone/websteps-illustrated/internal/netxlite"
+	"github.com/miekg/dns"
+)
+
+func TestDefaultCachingPolicyConfigMatchesYAML(t *testing.T) {
+	// Implementation note: we compare the JSON serialization because
+	// the YAML parser produces nil lists where the code uses empty lists.
+	config, err := LoadCachingPolicyConfig(filepath.Join("..", "..", "testdata", "cachingpolicy.yaml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect, err := json.MarshalIndent(DefaultCachingPolicyConfig(), "", "  ")
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := json.MarshalIndent(config, "", "  ")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(expect) != string(got) {
+		t.Fatalf("testdata/cachingpolicy.yaml differs from DefaultCachingPolicyConfig\nexpected:\n%s\ngot:\n%s",
+			string(expect), string(got))
+	}
+}
+
+func TestParseCachingPolicyConfigMaxAge(t *testing.T) {
+	tests := []struct {
+		name    string
+		data    string
+		wantErr bool
+	}{{
+		name:    "duration with units",
+		data:    "dns:\n  - max_age: 15m\n",
+		wantErr: false,
+	}, {
+		name:    "zero",
+		data:    "dns:\n  - max_age: 0s\n",
+		wantErr: false,
+	}, {
+		name:    "bare integer",
+		data:    "dns:\n  - max_age: 300\n",
+		wantErr: true,
+	}, {
+		name:    "bare integer in JSON",
+		data:    `{"endpoint": [{"max_age": 300}]}`,
+		wantErr: true,
+	}, {
+		name:    "too small",
+		data:    "dns:\n  - max_age: 300ns\n",
+		wantErr: true,
+	}, {
+		name:    "negative",
+		data:    "endpoint:\n  - max_age: -1m\n",
+		wantErr: true,
+	}}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := ParseCachingPolicyConfig([]byte(tt.data))
+			if tt.wantErr != errors.Is(err, ErrInvalidCachingPolicyConfig) {
+				t.Fatal("unexpected error", err)
+			}
+		})
+	}
+}
+
+func TestDefaultCachingPolicyConfigRules(t *testing.T) {
+	config := DefaultCachingPolicyConfig()
+	newLookup := func(lookupType archival.DNSLookupType, failure string) *DNSLookupMeasurement {
+		lookup := archival.NewFakeFlatDNSLookupEvent(archival.NetworkTypeSystem, "",
+			lookupType, "example.com", nil, nil)
+		lookup.Failure = archival.FlatFailure(failure)
+		return &DNSLookupMeasurement{Lookup: lookup}
+	}
+	dnsTests := []struct {
+		lookup *DNSLookupMeasurement
+		expect string
+	}{
+		{newLookup(archival.DNSLookupTypeNS, ""), "successful NS lookup"},
+		{newLookup(archival.DNSLookupTypeGetaddrinfo, ""), "successful lookup"},
+		{newLookup(archival.DNSLookupTypeNS, netxlite.FailureGenericTimeoutError), "timeout"},
+		{newLookup(archival.DNSLookupTypeGetaddrinfo, netxlite.FailureDNSNXDOMAINError), "other failure"},
+	}
+	for _, tt := range dnsTests {
+		rule, found := config.MatchDNS(tt.lookup)
+		if !found || rule.Name != tt.expect {
+			t.Fatal("expected", tt.expect, "got", rule)
+		}
+	}
+	newEndpoint := func(operation, failure string) *EndpointMeasurement {
+		return &EndpointMeasurement{
+			Network:         archival.NetworkTypeTCP,
+			Failure:         archival.FlatFailure(failure),
+			FailedOperation: FlatFailedOperation(operation),
+		}
+	}
+	endpointTests := []struct {
+		epnt   *EndpointMeasurement
+		expect string
+	}{
+		{newEndpoint("", ""), "success"},
+		{newEndpoint(netxlite.ConnectOperation, netxlite.FailureGenericTimeoutError), "timeout"},
+		{newEndpoint(netxlite.TLSHandshakeOperation, netxlite.FailureConnectionReset), "other failure"},
+		{newEndpoint(netxlite.ResolveOperation, netxlite.FailureGenericTimeoutError), "unexpected failed operation"},
+	}
+	for _, tt := range endpointTests {
+		rule, found := config.MatchEndpoint(tt.epnt)
+		if !found || rule.Name != tt.expect {
+			t.Fatal("expected", tt.expect, "got", rule)
+		}
+	}
+}
+
+// newCachePolicyTestReply returns a serialized reply containing the given records.
+func newCachePolicyTestReply(t *testing.T, answers, authority []string) []byte {
+	msg := &dns.Msg{}
+	msg.SetQuestion("example.com.", dns.TypeA)
+	msg.Response = true
+	for _, s := range answers {
+		rr, err := dns.NewRR(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		msg.Answer = append(msg.Answer, rr)
+	}
+	for _, s := range authority {
+		rr, err := dns.NewRR(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		msg.Ns = append(msg.Ns, rr)
+	}
+	data, err := msg.Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func TestDNSLookupMinTTL(t *testing.T) {
+	const soa = "example.com. %d IN SOA ns.example.com. root.example.com. 1 7200 3600 1209600 %d"
+	tests := []struct {
+		name    string
+		replies [][]byte
+		expect  time.Duration
+		found   bool
+	}{{
+		name:    "no replies",
+		replies: nil,
+		expect:  0,
+		found:   false,
+	}, {
+		name:    "unparseable reply",
+		replies: [][]byte{{0xde, 0xad}},
+		expect:  0,
+		found:   false,
+	}, {
+		name: "minimum TTL across answers and replies",
+		replies: [][]byte{
+			newCachePolicyTestReply(t, []string{
+				"example.com. 300 IN A 93.184.216.34",
+				"example.com. 60 IN A 93.184.216.35",
+			}, nil),
+			newCachePolicyTestReply(t, []string{"example.com. 120 IN A 93.184.216.36"}, nil),
+		},
+		expect: 60 * time.Second,
+		found:  true,
+	}, {
+		name: "negative caching using the SOA minimum",
+		replies: [][]byte{
+			newCachePolicyTestReply(t, nil, []string{fmt.Sprintf(soa, 3600, 900)}),
+		},
+		expect: 900 * time.Second,
+		found:  true,
+	}, {
+		name: "negative caching using the SOA TTL",
+		replies: [][]byte{
+			newCachePolicyTestReply(t, nil, []string{fmt.Sprintf(soa, 600, 900)}),
+		},
+		expect: 600 * time.Second,
+		found:  true,
+	}, {
+		name: "we ignore the SOA when there are answers",
+		replies: [][]byte{
+			newCachePolicyTestReply(t, []string{"example.com. 300 IN A 93.184.216.34"},
+				[]string{fmt.Sprintf(soa, 60, 60)}),
+		},
+		expect: 300 * time.Second,
+		found:  true,
+	}}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dlm := &DNSLookupMeasurement{}
+			for _, reply := range tt.replies {
+				dlm.RoundTrip = append(dlm.RoundTrip, &archival.FlatDNSRoundTripEvent{Reply: reply})
+			}
+			ttl, found := dnsLookupMinTTL(dlm)
+			if ttl != tt.expect || found != tt.found {
+				t.Fatal("expected", tt.expect, tt.found, "got", ttl, found)
+			}
+		})
+	}
+}
+
+func TestCachingPolicyConfigValidateRejectsMissingUnits(t *testing.T) {
+	config := &CachingPolicyConfig{
+		DNS:      []*CachingDNSRule{{MaxAge: 300}}, // i.e., 300ns
+		Endpoint: []*CachingEndpointRule{},
+	}
+	if err := config.Validate(); !errors.Is(err, ErrInvalidCachingPolicyConfig) {
+		t.Fatal("unexpected error", err)
+	}
+}
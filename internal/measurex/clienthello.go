@@ -0,0 +1,91 @@
+package measurex
+
+//
+// ClientHello
+//
+// Code to select the TLS ClientHello fingerprint. Some censors
+// fingerprint the ClientHello sent by Go's TLS stack, so measuring
+// with several fingerprints allows us to tell apart "blocks Go"
+// from "blocks the website".
+//
+
+import (
+	"crypto/tls"
+	"errors"
+
+	"github.com/bassosimone/websteps-illustrated/internal/model"
+	"github.com/bassosimone/websteps-illustrated/internal/netxlite"
+	utls "gitlab.com/yawning/utls.git"
+)
+
+const (
+	// TLSClientHelloGo uses the ClientHello of the Go standard library.
+	TLSClientHelloGo = "go"
+
+	// TLSClientHelloChrome parrots the ClientHello of Chrome.
+	TLSClientHelloChrome = "chrome"
+
+	// TLSClientHelloFirefox parrots the ClientHello of Firefox.
+	TLSClientHelloFirefox = "firefox"
+
+	// TLSClientHelloIOS parrots the ClientHello of iOS.
+	TLSClientHelloIOS = "ios"
+
+	// TLSClientHelloRandomized uses a randomized ClientHello.
+	TLSClientHelloRandomized = "randomized"
+
+	// TLSClientHelloECH is the ClientHello of Chrome with the ECH
+	// extension. You cannot select it using Options.TLSClientHello
+	// because we use it when Options.ECHConfigList is not empty.
+	TLSClientHelloECH = "chrome+ech"
+)
+
+// ErrUnknownTLSClientHello means that Options.TLSClientHello
+// contains a ClientHello fingerprint that we don't know.
+var ErrUnknownTLSClientHello = errors.New("unknown Options.TLSClientHello")
+
+// tlsClientHelloIDs maps the TLSClientHello constants that use
+// utls to the corresponding utls ClientHelloID.
+var tlsClientHelloIDs = map[string]*utls.ClientHelloID{
+	TLSClientHelloChrome:     &utls.HelloChrome_Auto,
+	TLSClientHelloFirefox:    &utls.HelloFirefox_Auto,
+	TLSClientHelloIOS:        &utls.HelloIOS_Auto,
+	TLSClientHelloRandomized: &utls.HelloRandomized,
+}
+
+// IsKnownTLSClientHello returns whether the given name is one of the
+// ClientHello fingerprints that you can use with Options.TLSClientHello.
+func IsKnownTLSClientHello(name string) bool {
+	_, found := tlsClientHelloIDs[name]
+	return found || name == TLSClientHelloGo
+}
+
+// newTLSHandshaker returns the TLS handshaker for the given ClientHello.
+func (mx *Measurer) newTLSHandshaker(clientHello string) (model.TLSHandshaker, error) {
+	if clientHello == TLSClientHelloGo {
+		return mx.TLSHandshaker, nil
+	}
+	id, found := tlsClientHelloIDs[clientHello]
+	if !found {
+		return nil, ErrUnknownTLSClientHello
+	}
+	return mx.Library.NewTLSHandshakerUTLS(id), nil
+}
+
+// newTLSHandshakerForEndpointPlan returns the TLS handshaker for the given
+// endpoint plan and the name of the ClientHello it uses. When the plan uses
+// ECH, this function sets the config's ServerName to the ECH public name.
+func (mx *Measurer) newTLSHandshakerForEndpointPlan(
+	epnt *EndpointPlan, config *tls.Config) (model.TLSHandshaker, string, error) {
+	if ech := epnt.Options.echConfigList(); len(ech) > 0 {
+		echConfig, err := netxlite.ParseECHConfigList(ech)
+		if err != nil {
+			return nil, TLSClientHelloECH, err
+		}
+		config.ServerName = echConfig.PublicName
+		return mx.Library.NewTLSHandshakerECH(echConfig), TLSClientHelloECH, nil
+	}
+	clientHello := epnt.Options.tlsClientHello()
+	thx, err := mx.newTLSHandshaker(clientHello)
+	return thx, clientHello, err
+}
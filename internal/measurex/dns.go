@@ -72,6 +72,31 @@ func NewResolversUDP(endpoints ...string) []*DNSResolverInfo {
 	return out
 }
 
+// NewResolversTCP creates a list of TCP resolvers from a list of endpoints.
+func NewResolversTCP(endpoints ...string) []*DNSResolverInfo {
+	out := []*DNSResolverInfo{}
+	for _, epnt := range endpoints {
+		out = append(out, &DNSResolverInfo{
+			Network: archival.NetworkTypeTCP,
+			Address: epnt,
+		})
+	}
+	return out
+}
+
+// NewResolversDoT creates a list of DNS-over-TLS resolvers from a list
+// of endpoints (e.g., "dns.google:853", "1.1.1.1:853").
+func NewResolversDoT(endpoints ...string) []*DNSResolverInfo {
+	out := []*DNSResolverInfo{}
+	for _, epnt := range endpoints {
+		out = append(out, &DNSResolverInfo{
+			Network: archival.NetworkTypeDoT,
+			Address: epnt,
+		})
+	}
+	return out
+}
+
 // DNSLookupPlan is a plan for performing a DNS lookup.
 type DNSLookupPlan struct {
 	// URLMeasurementID is the ID of the original URLMeasurement.
@@ -145,6 +170,9 @@ func NewDNSLookupPlans(domain string, options *Options,
 // for constructing plans associated with an URLMeasurement.
 func newDNSLookupPlans(urlMeasurementID int64, domain string,
 	options *Options, flags int64, ri ...*DNSResolverInfo) []*DNSLookupPlan {
+	if options.useHTTPSRR() {
+		flags |= DNSLookupFlagHTTPS
+	}
 	out := []*DNSLookupPlan{}
 	for _, r := range ri {
 		basePlan := &DNSLookupPlan{
@@ -242,6 +270,14 @@ type DNSLookupMeasurement struct {
 	// fakes out a round trip with query type ANY and all the info
 	// that we could gather from calling getaddrinfo (or equivalent).
 	RoundTrip []*archival.FlatDNSRoundTripEvent `json:",omitempty"`
+
+	// TCPConnect contains the TCP connect events. Only resolvers using
+	// TCP (i.e., "tcp" and "dot") generate these events.
+	TCPConnect []*archival.FlatNetworkEvent `json:",omitempty"`
+
+	// QUICTLSHandshake contains the TLS handshake events. Only
+	// the "dot" resolver generates these events.
+	QUICTLSHandshake []*archival.FlatQUICTLSHandshakeEvent `json:",omitempty"`
 }
 
 // FinishedUnixNano returns the time when this measurement finished
@@ -427,6 +463,24 @@ func (dlm *DNSLookupMeasurement) ALPNs() []string {
 	return nil
 }
 
+// ECHConfigList returns the ECH configuration we discovered during
+// an HTTPS lookup. The return value is empty if there's no such config.
+func (dlm *DNSLookupMeasurement) ECHConfigList() []byte {
+	if dlm.Lookup != nil {
+		return dlm.Lookup.ECHConfigList
+	}
+	return nil
+}
+
+// Port returns the alternative port we discovered during an HTTPS
+// lookup. The return value is zero if there's no such port.
+func (dlm *DNSLookupMeasurement) Port() uint16 {
+	if dlm.Lookup != nil {
+		return dlm.Lookup.Port
+	}
+	return 0
+}
+
 // NS returns the list of NS we discovered during the lookup.
 func (dlm *DNSLookupMeasurement) NS() []string {
 	if dlm.Lookup != nil {
@@ -566,6 +620,18 @@ func (mx *Measurer) dnsLookup(ctx context.Context,
 		default:
 			logcat.Bugf("asked the UDP resolver for %s lookup type", t.LookupType)
 		}
+	case archival.NetworkTypeTCP, archival.NetworkTypeDoT:
+		switch t.LookupType {
+		case archival.DNSLookupTypeGetaddrinfo:
+			output <- mx.lookupHostTCPOrDoT(ctx, t)
+		case archival.DNSLookupTypeHTTPS:
+			output <- mx.lookupHTTPSSvcTCPOrDoT(ctx, t)
+		case archival.DNSLookupTypeNS:
+			output <- mx.lookupNSTCPOrDoT(ctx, t)
+		default:
+			logcat.Bugf("asked the %s resolver for %s lookup type",
+				t.ResolverNetwork(), t.LookupType)
+		}
 	case archival.NetworkTypeDoH, archival.NetworkTypeDoH3:
 		switch t.LookupType {
 		case archival.DNSLookupTypeGetaddrinfo:
@@ -604,6 +670,28 @@ func (mx *Measurer) lookupHostUDP(
 	return mx.newDNSLookupMeasurement(id, t, saver.MoveOutTrace())
 }
 
+// lookupHostTCPOrDoT queries for A and AAAA using a TCP or DoT resolver.
+func (mx *Measurer) lookupHostTCPOrDoT(
+	ctx context.Context, t *DNSLookupPlan) *DNSLookupMeasurement {
+	saver := archival.NewSaver()
+	r := mx.newResolverTCPOrDoT(saver, t)
+	defer r.CloseIdleConnections()
+	id := mx.NextID()
+	_, _ = mx.doLookupHost(ctx, t.Domain, r, t, id)
+	return mx.newDNSLookupMeasurement(id, t, saver.MoveOutTrace())
+}
+
+// newResolverTCPOrDoT returns a TCP or a DoT resolver depending
+// on the network used by the given DNS lookup plan.
+func (mx *Measurer) newResolverTCPOrDoT(saver *archival.Saver, t *DNSLookupPlan) model.Resolver {
+	switch t.ResolverNetwork() {
+	case archival.NetworkTypeDoT:
+		return mx.Library.NewResolverDoT(saver, t.ResolverAddress())
+	default:
+		return mx.Library.NewResolverTCP(saver, t.ResolverAddress())
+	}
+}
+
 // lookupHostDoH queries for A and AAAA using a DoH resolver.
 func (mx *Measurer) lookupHostDoH(
 	ctx context.Context, t *DNSLookupPlan) *DNSLookupMeasurement {
@@ -640,6 +728,17 @@ func (mx *Measurer) lookupHTTPSSvcUDP(
 	return mx.newDNSLookupMeasurement(id, t, saver.MoveOutTrace())
 }
 
+// lookupHTTPSSvcTCPOrDoT performs an HTTPSSvc lookup using a TCP or DoT resolver.
+func (mx *Measurer) lookupHTTPSSvcTCPOrDoT(
+	ctx context.Context, t *DNSLookupPlan) *DNSLookupMeasurement {
+	saver := archival.NewSaver()
+	r := mx.newResolverTCPOrDoT(saver, t)
+	defer r.CloseIdleConnections()
+	id := mx.NextID()
+	_, _ = mx.doLookupHTTPSSvc(ctx, t.Domain, r, t, id)
+	return mx.newDNSLookupMeasurement(id, t, saver.MoveOutTrace())
+}
+
 // lookupHTTPSvcDoH performs an HTTPSSvc lookup using a DoH resolver.
 func (mx *Measurer) lookupHTTPSSvcDoH(
 	ctx context.Context, t *DNSLookupPlan) *DNSLookupMeasurement {
@@ -665,6 +764,17 @@ func (mx *Measurer) lookupNSUDP(
 	return mx.newDNSLookupMeasurement(id, t, saver.MoveOutTrace())
 }
 
+// lookupNSTCPOrDoT uses a TCP or DoT resolver to send a NS query.
+func (mx *Measurer) lookupNSTCPOrDoT(
+	ctx context.Context, t *DNSLookupPlan) *DNSLookupMeasurement {
+	saver := archival.NewSaver()
+	r := mx.newResolverTCPOrDoT(saver, t)
+	defer r.CloseIdleConnections()
+	id := mx.NextID()
+	_, _ = mx.doLookupNS(ctx, t.Domain, r, t, id)
+	return mx.newDNSLookupMeasurement(id, t, saver.MoveOutTrace())
+}
+
 // lookupNSDoH uses a DoH resolver to send a DoH query.
 func (mx *Measurer) lookupNSDoH(
 	ctx context.Context, t *DNSLookupPlan) *DNSLookupMeasurement {
@@ -754,6 +864,8 @@ func (mx *Measurer) newDNSLookupMeasurement(id int64,
 		ReverseAddress:   t.ReverseAddress,
 		Lookup:           nil,
 		RoundTrip:        nil,
+		TCPConnect:       nil,
+		QUICTLSHandshake: nil,
 	}
 	if len(trace.DNSLookup) != 1 {
 		logcat.Bugf("expected a single DNSLookup entry: %+v", trace.DNSLookup)
@@ -762,6 +874,8 @@ func (mx *Measurer) newDNSLookupMeasurement(id int64,
 		out.Lookup = trace.DNSLookup[0]
 	}
 	out.RoundTrip = trace.DNSRoundTrip
+	out.TCPConnect = trace.TCPConnect
+	out.QUICTLSHandshake = trace.QUICTLSHandshake
 	return out
 }
 
@@ -791,6 +905,8 @@ func newFakeHTTPSSvcDNSLookupMeasurement(urlMeasurementID int64, mx AbstractMeas
 			resolverNetwork, resolverAddress, archival.DNSLookupTypeHTTPS,
 			domain, alpns, addresses,
 		),
-		RoundTrip: []*archival.FlatDNSRoundTripEvent{},
+		RoundTrip:        []*archival.FlatDNSRoundTripEvent{},
+		TCPConnect:       []*archival.FlatNetworkEvent{},
+		QUICTLSHandshake: []*archival.FlatQUICTLSHandshakeEvent{},
 	}
 }
@@ -151,6 +151,10 @@ type EndpointMeasurement struct {
 	// NetworkEvent contains network events (if any).
 	NetworkEvent []*archival.FlatNetworkEvent `json:",omitempty"`
 
+	// SpeedSamples contains the HTTP response body download speed
+	// samples (if any), which we use to detect throttling.
+	SpeedSamples []*SpeedSample `json:",omitempty"`
+
 	// TCPConnect contains the TCP connect event (if any).
 	TCPConnect *archival.FlatNetworkEvent `json:",omitempty"`
 
@@ -364,6 +368,17 @@ func endpointSummary(URL *SimpleURL, network archival.NetworkType,
 	d = append(d, ao("max_https_response_body_snapshot_size_connectivity", o.maxHTTPSResponseBodySnapshotSizeConnectivity()))
 	d = append(d, ao("max_https_response_body_snapshot_size_throttling", o.maxHTTPSResponseBodySnapshotSizeThrottling()))
 	d = append(d, ao("sni", o.sni()))
+	// We only include a non-default ClientHello to keep the summary
+	// of existing measurements (and hence the cache keys) unchanged.
+	if v := o.tlsClientHello(); v != DefaultTLSClientHello {
+		d = append(d, ao("tls_client_hello", v))
+	}
+	// Likewise, we only include whether we're using ECH. We don't include
+	// the ECH config because it changes frequently and the probe and the
+	// TH may see distinct configs and we want their measurements to match.
+	if v := o.echConfigList(); len(v) > 0 {
+		d = append(d, ao("ech", true))
+	}
 	d = append(d, SortedSerializedCookiesNames(cookies)...)
 	return strings.Join(d, " ")
 }
@@ -570,6 +585,7 @@ func (mx *Measurer) newEndpointMeasurement(id int64, epnt *EndpointPlan,
 		Location:         NewSimpleURL(location),
 		HTTPTitle:        "",
 		NetworkEvent:     nil,
+		SpeedSamples:     nil,
 		TCPConnect:       nil,
 		QUICTLSHandshake: nil,
 		HTTPRoundTrip:    nil,
@@ -581,6 +597,7 @@ func (mx *Measurer) newEndpointMeasurement(id int64, epnt *EndpointPlan,
 	if len(trace.HTTPRoundTrip) == 1 {
 		out.HTTPRoundTrip = trace.HTTPRoundTrip[0]
 		out.HTTPTitle = GetWebPageTitle(out.HTTPRoundTrip.ResponseBody)
+		out.SpeedSamples = NewSpeedSampleList(out.HTTPRoundTrip.Started, trace.Network)
 	}
 
 	if len(trace.QUICTLSHandshake) > 1 {
@@ -748,13 +765,18 @@ func (mx *Measurer) tlsEndpointHandshakeWithSaver(ctx context.Context,
 	if err != nil {
 		return nil, operation, err
 	}
-	timeout := epnt.Options.tlsHandshakeTimeout()
 	tlsConfig := epnt.tlsConfig()
-	ol := NewOperationLogger("[#%d] TLSHandshake %s with sni=%s",
-		id, epnt.Address, tlsConfig.ServerName)
+	thx, clientHello, err := mx.newTLSHandshakerForEndpointPlan(epnt, tlsConfig)
+	if err != nil {
+		conn.Close()
+		return nil, netxlite.TopLevelOperation, err
+	}
+	timeout := epnt.Options.tlsHandshakeTimeout()
+	ol := NewOperationLogger("[#%d] TLSHandshake %s with sni=%s clientHello=%s",
+		id, epnt.Address, tlsConfig.ServerName, clientHello)
 	ctx, cancel := context.WithTimeout(ctx, timeout)
 	defer cancel()
-	th := saver.WrapTLSHandshaker(mx.TLSHandshaker)
+	th := saver.WrapTLSHandshakerWithClientHello(thx, clientHello)
 	tlsConn, _, err := th.Handshake(ctx, conn, tlsConfig)
 	ol.Stop(err)
 	if err != nil {
@@ -13,6 +13,7 @@ import (
 	"github.com/bassosimone/websteps-illustrated/internal/model"
 	"github.com/bassosimone/websteps-illustrated/internal/netxlite"
 	"github.com/lucas-clemente/quic-go"
+	utls "gitlab.com/yawning/utls.git"
 )
 
 /*
@@ -27,6 +28,12 @@ type NetxliteLibrary interface {
 	// NewDNSOverUDPTransport creates a new DNS-over-UDP DNS transport.
 	NewDNSOverUDPTransport(dialer model.Dialer, address string) model.DNSTransport
 
+	// NewDNSOverTCPTransport creates a new DNS-over-TCP DNS transport.
+	NewDNSOverTCPTransport(dialer model.Dialer, address string) model.DNSTransport
+
+	// NewDNSOverTLSTransport creates a new DNS-over-TLS DNS transport.
+	NewDNSOverTLSTransport(dialer model.TLSDialer, address string) model.DNSTransport
+
 	// NewDNSOverHTTPSTransport creates a new DNS-over-HTTPS DNS transport. The
 	// network argument should be one of "doh" and "doh3".
 	NewDNSOverHTTPSTransport(clnt model.HTTPClient, network, address string) model.DNSTransport
@@ -75,9 +82,20 @@ type NetxliteLibrary interface {
 	// NewSingleUseTLSDialer creates a new "single use" TLS dialer.
 	NewSingleUseTLSDialer(conn model.TLSConn) model.TLSDialer
 
+	// NewTLSDialer creates a new TLSDialer using the given dialer and handshaker.
+	NewTLSDialer(dialer model.Dialer, handshaker model.TLSHandshaker) model.TLSDialer
+
 	// NewTLSHandshakerStdlib creates a new TLS handshaker using the stdlib.
 	NewTLSHandshakerStdlib() model.TLSHandshaker
 
+	// NewTLSHandshakerUTLS creates a new TLS handshaker using
+	// utls and the given ClientHello fingerprint.
+	NewTLSHandshakerUTLS(id *utls.ClientHelloID) model.TLSHandshaker
+
+	// NewTLSHandshakerECH creates a new TLS handshaker that uses
+	// a ClientHello containing the ECH extension for the given config.
+	NewTLSHandshakerECH(config *netxlite.ECHConfig) model.TLSHandshaker
+
 	// WrapHTTPClient wraps an HTTP client.
 	WrapHTTPClient(clnt model.HTTPClient) model.HTTPClient
 
@@ -112,6 +130,16 @@ func (lib *Library) newDialerWithSystemResolver(saver *archival.Saver) model.Dia
 	return saver.WrapDialer(lib.netxlite.NewDialerWithResolver(r))
 }
 
+// newDialerWithUnsavedSystemResolver is like newDialerWithSystemResolver
+// except that the system resolver does not save any event into the saver. We
+// use this dialer when we need to resolve the domain of a DNS server and we
+// don't want the bootstrap lookup to appear among the measured lookups.
+func (lib *Library) newDialerWithUnsavedSystemResolver(saver *archival.Saver) model.Dialer {
+	r := lib.netxlite.WrapResolver(
+		lib.netxlite.NewDNSSystemResolver(lib.netxlite.NewDNSSystemTransport()))
+	return saver.WrapDialer(lib.netxlite.NewDialerWithResolver(r))
+}
+
 // NewDialerWithoutResolver is a convenience factory for creating
 // a dialer that saves measurements into the saver and that is not attached
 // to any resolver (hence only works when passed IP addresses).
@@ -189,6 +217,45 @@ func (lib *Library) NewResolverUDP(saver *archival.Saver, address string) model.
 					)))))
 }
 
+// NewResolverTCP is a convenience factory for creating a Resolver
+// using DNS-over-TCP that saves measurements into the Saver.
+//
+// Because this resolver creates a new connection for each query, the
+// Saver will also contain a TCP connect event for each query.
+func (lib *Library) NewResolverTCP(saver *archival.Saver, address string) model.Resolver {
+	return saver.WrapResolver(
+		lib.netxlite.WrapResolver(
+			lib.netxlite.NewUnwrappedParallelResolver(
+				saver.WrapDNSTransport(
+					lib.netxlite.NewDNSOverTCPTransport(
+						lib.newDialerWithUnsavedSystemResolver(saver),
+						address,
+					)))))
+}
+
+// NewResolverDoT is a convenience factory for creating a Resolver
+// using DNS-over-TLS that saves measurements into the Saver.
+//
+// Because this resolver creates a new connection for each query, the
+// Saver will also contain a TCP connect event and a TLS handshake
+// event for each query. We use the domain or the IP address inside
+// of the address argument as the SNI (e.g., "dns.google:853" implies
+// using "dns.google" as the SNI) and, when the port is 853, we use
+// "dot" as the ALPN.
+func (lib *Library) NewResolverDoT(saver *archival.Saver, address string) model.Resolver {
+	return saver.WrapResolver(
+		lib.netxlite.WrapResolver(
+			lib.netxlite.NewUnwrappedParallelResolver(
+				saver.WrapDNSTransport(
+					lib.netxlite.NewDNSOverTLSTransport(
+						lib.netxlite.NewTLSDialer(
+							lib.newDialerWithUnsavedSystemResolver(saver),
+							saver.WrapTLSHandshaker(lib.netxlite.NewTLSHandshakerStdlib()),
+						),
+						address,
+					)))))
+}
+
 // NewResolverDoH is a convenience factory for creating a Resolver
 // using DNS-over-HTTPS that saves measurements into the Saver.
 //
@@ -217,6 +284,18 @@ func (lib *Library) NewTLSHandshakerStdlib() model.TLSHandshaker {
 	return lib.netxlite.NewTLSHandshakerStdlib()
 }
 
+// NewTLSHandshakerUTLS creates a new TLS handshaker that uses utls
+// with the given ClientHello by invoking the underlying netxlite library.
+func (lib *Library) NewTLSHandshakerUTLS(id *utls.ClientHelloID) model.TLSHandshaker {
+	return lib.netxlite.NewTLSHandshakerUTLS(id)
+}
+
+// NewTLSHandshakerECH creates a new TLS handshaker that uses the ECH
+// extension by invoking the underlying netxlite library.
+func (lib *Library) NewTLSHandshakerECH(config *netxlite.ECHConfig) model.TLSHandshaker {
+	return lib.netxlite.NewTLSHandshakerECH(config)
+}
+
 // WrapHTTPClient wraps an HTTP client using the underlying netxlite library.
 func (lib *Library) WrapHTTPClient(clnt model.HTTPClient) model.HTTPClient {
 	return lib.netxlite.WrapHTTPClient(clnt)
@@ -230,6 +309,16 @@ func (nl *netxliteLibrary) NewDNSOverUDPTransport(
 	return netxlite.NewDNSOverUDPTransport(dialer, address)
 }
 
+func (nl *netxliteLibrary) NewDNSOverTCPTransport(
+	dialer model.Dialer, address string) model.DNSTransport {
+	return netxlite.NewDNSOverTCPTransport(dialer.DialContext, address)
+}
+
+func (nl *netxliteLibrary) NewDNSOverTLSTransport(
+	dialer model.TLSDialer, address string) model.DNSTransport {
+	return netxlite.NewDNSOverTLS(dialer.DialTLSContext, address)
+}
+
 func (nl *netxliteLibrary) NewDNSOverHTTPSTransport(
 	clnt model.HTTPClient, network, address string) model.DNSTransport {
 	return &netxlite.DNSOverHTTPSTransport{
@@ -298,10 +387,23 @@ func (nl *netxliteLibrary) NewSingleUseTLSDialer(conn model.TLSConn) model.TLSDi
 	return netxlite.NewSingleUseTLSDialer(conn)
 }
 
+func (nl *netxliteLibrary) NewTLSDialer(
+	dialer model.Dialer, handshaker model.TLSHandshaker) model.TLSDialer {
+	return netxlite.NewTLSDialer(dialer, handshaker)
+}
+
 func (nl *netxliteLibrary) NewTLSHandshakerStdlib() model.TLSHandshaker {
 	return netxlite.NewTLSHandshakerStdlib(model.DiscardLogger)
 }
 
+func (nl *netxliteLibrary) NewTLSHandshakerUTLS(id *utls.ClientHelloID) model.TLSHandshaker {
+	return netxlite.NewTLSHandshakerUTLS(model.DiscardLogger, id)
+}
+
+func (nl *netxliteLibrary) NewTLSHandshakerECH(config *netxlite.ECHConfig) model.TLSHandshaker {
+	return netxlite.NewTLSHandshakerECH(model.DiscardLogger, config)
+}
+
 func (nl *netxliteLibrary) WrapHTTPClient(clnt model.HTTPClient) model.HTTPClient {
 	return netxlite.WrapHTTPClient(clnt)
 }
@@ -52,6 +52,14 @@ type Options struct {
 	// find a better name that is even more explanatory).
 	DoNotInitiallyForceHTTPAndHTTPS bool `json:",omitempty"`
 
+	// ECHConfigList is the ECH configuration advertised by the ech
+	// parameter of an HTTPS RR. When it's not empty, we use a ClientHello
+	// containing the ECH extension and the config's public name as the
+	// SNI for TLS handshakes over TCP (see netxlite.NewTLSHandshakerECH),
+	// regardless of TLSClientHello. You don't typically set this option
+	// directly: we set it for the endpoints planned using UseHTTPSRR.
+	ECHConfigList []byte `json:",omitempty"`
+
 	// MaxAddressesPerFamily controls the maximum number of IP addresses
 	// per family (i.e., A and AAAA) we'll test.
 	MaxAddressesPerFamily int64 `json:",omitempty"`
@@ -87,10 +95,21 @@ type Options struct {
 	// for any TCP connect attempt to complete.
 	TCPconnectTimeout time.Duration `json:",omitempty"`
 
+	// TLSClientHello selects the ClientHello fingerprint we'll use for
+	// TLS handshakes over TCP (one of the TLSClientHello constants). The
+	// default is using the ClientHello of the Go standard library. QUIC
+	// handshakes always use the ClientHello of the QUIC library.
+	TLSClientHello string `json:",omitempty"`
+
 	// TLSHandshakeTimeout is the maximum time we're willing to wait
 	// for any TLS handshake to complete.
 	TLSHandshakeTimeout time.Duration `json:",omitempty"`
 
+	// UseHTTPSRR controls whether we're going to issue HTTPS lookups
+	// and use the port and ech parameters of the HTTPS RR when planning
+	// HTTPS endpoints. (We always use the IPv4 and IPv6 hints.)
+	UseHTTPSRR bool `json:",omitempty"`
+
 	// SNI allows to override the QUIC/TLS SNI we'll use.
 	SNI string `json:",omitempty"`
 }
@@ -153,6 +172,9 @@ const (
 	// DefaultTCPConnectTimeout is the default Options.TCPConnectTimeout value.
 	DefaultTCPConnectTimeout = 15 * time.Second
 
+	// DefaultTLSClientHello is the default Options.TLSClientHello value.
+	DefaultTLSClientHello = TLSClientHelloGo
+
 	// DefaultTLSHandshakeTimeout is the default Options.TLSHandshakeTimeout value.
 	DefaultTLSHandshakeTimeout = 10 * time.Second
 )
@@ -225,6 +247,17 @@ func (opt *Options) doNotInitiallyForceHTTPAndHTTPS() (v bool) {
 	return
 }
 
+// echConfigList returns the ECH config list or an empty list.
+func (opt *Options) echConfigList() (v []byte) {
+	if opt != nil {
+		v = opt.ECHConfigList
+	}
+	if len(v) <= 0 && opt != nil && opt.Parent != nil {
+		v = opt.Parent.echConfigList()
+	}
+	return
+}
+
 // endpointParallelism returns the desired level of Endpoint parallelism.
 func (opt *Options) endpointParallelism() (v int64) {
 	if opt != nil {
@@ -413,6 +446,20 @@ func (opt *Options) tcpConnectTimeout() (v time.Duration) {
 	return
 }
 
+// tlsClientHello returns the desired TLS ClientHello fingerprint.
+func (opt *Options) tlsClientHello() (v string) {
+	if opt != nil {
+		v = opt.TLSClientHello
+	}
+	if v == "" && opt != nil && opt.Parent != nil {
+		v = opt.Parent.tlsClientHello()
+	}
+	if v == "" {
+		v = DefaultTLSClientHello
+	}
+	return
+}
+
 // tlsHandshakeTimeout returns the desired TLS handshake timeout.
 func (opt *Options) tlsHandshakeTimeout() (v time.Duration) {
 	if opt != nil {
@@ -427,6 +474,17 @@ func (opt *Options) tlsHandshakeTimeout() (v time.Duration) {
 	return
 }
 
+// useHTTPSRR returns whether we should use the HTTPS RR.
+func (opt *Options) useHTTPSRR() (v bool) {
+	if opt != nil {
+		v = opt.UseHTTPSRR
+	}
+	if !v && opt != nil && opt.Parent != nil {
+		v = opt.Parent.useHTTPSRR()
+	}
+	return
+}
+
 // Flatten generates a new Options that contains all the currently
 // configured options (or default values) inside it.
 func (cur *Options) Flatten() *Options {
@@ -439,6 +497,7 @@ func (cur *Options) Flatten() *Options {
 		HTTPHostHeader:                  cur.httpHostHeader(),
 		HTTPRequestHeaders:              cur.httpClonedRequestHeaders(),
 		DoNotInitiallyForceHTTPAndHTTPS: cur.doNotInitiallyForceHTTPAndHTTPS(),
+		ECHConfigList:                   cur.echConfigList(),
 		MaxAddressesPerFamily:           cur.maxAddressesPerFamily(),
 		MaxCrawlerDepth:                 cur.maxCrawlerDepth(),
 		MaxHTTPResponseBodySnapshotSize: cur.maxHTTPResponseBodySnapshotSize(),
@@ -447,7 +506,9 @@ func (cur *Options) Flatten() *Options {
 		Parent:               nil,
 		QUICHandshakeTimeout: cur.quicHandshakeTimeout(),
 		TCPconnectTimeout:    cur.tcpConnectTimeout(),
+		TLSClientHello:       cur.tlsClientHello(),
 		TLSHandshakeTimeout:  cur.tlsHandshakeTimeout(),
+		UseHTTPSRR:           cur.useHTTPSRR(),
 		SNI:                  cur.sni(),
 	}
 }
@@ -0,0 +1,86 @@
+package measurex
+
+//
+// Speed
+//
+// Download speed samples collected while reading HTTP response bodies,
+// which we use to detect throttling.
+//
+
+import (
+	"time"
+
+	"github.com/bassosimone/websteps-illustrated/internal/archival"
+)
+
+// SpeedSample is a sample of the cumulative number of bytes received
+// by an endpoint measurement while reading the HTTP response body.
+type SpeedSample struct {
+	// T is the time elapsed since the beginning of the HTTP round trip.
+	T time.Duration
+
+	// Count is the cumulative number of bytes received.
+	Count int64
+}
+
+// NewSpeedSampleList builds the list of speed samples using the
+// archival.BytesReadOperation events that archival.Saver emits every
+// 250 ms once it starts aggregating network events, i.e., after the
+// HTTP round trip. The started argument is the time when the HTTP round
+// trip started. Note that the first sample also accounts for the bytes
+// received before the HTTP round trip (e.g., during the TLS handshake).
+func NewSpeedSampleList(started time.Time,
+	events []*archival.FlatNetworkEvent) (out []*SpeedSample) {
+	var count int64
+	for _, ev := range events {
+		if ev.Operation != archival.BytesReadOperation {
+			continue
+		}
+		count += ev.Count
+		out = append(out, &SpeedSample{
+			T:     ev.Finished.Sub(started),
+			Count: count,
+		})
+	}
+	return
+}
+
+// DownloadSpeed returns the speed at which we received the HTTP response
+// body in bytes per second and the number of samples we used to compute
+// it. To exclude the bytes received before the HTTP round trip, we compute
+// the speed between the first sample and the last sample that received
+// data. When we cannot compute the speed, we return zero samples.
+func (em *EndpointMeasurement) DownloadSpeed() (speed float64, samples int) {
+	if len(em.SpeedSamples) < 2 {
+		return 0, 0
+	}
+	first, last := em.SpeedSamples[0], em.SpeedSamples[0]
+	for idx, s := range em.SpeedSamples {
+		if s.Count > last.Count {
+			last, samples = s, idx+1
+		}
+	}
+	if elapsed := last.T - first.T; elapsed > 0 {
+		speed = float64(last.Count-first.Count) / elapsed.Seconds()
+		return speed, samples
+	}
+	return 0, 0
+}
+
+// ArchivalSpeedSample is the archival format of SpeedSample.
+type ArchivalSpeedSample struct {
+	T     float64 `json:"t"`
+	Count int64   `json:"count"`
+}
+
+// NewArchivalSpeedSampleList converts a list of SpeedSample to
+// a list of ArchivalSpeedSample.
+func NewArchivalSpeedSampleList(in []*SpeedSample) (out []ArchivalSpeedSample) {
+	for _, s := range in {
+		out = append(out, ArchivalSpeedSample{
+			T:     s.T.Seconds(),
+			Count: s.Count,
+		})
+	}
+	return
+}
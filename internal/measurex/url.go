@@ -7,6 +7,7 @@ import (
 	"net/http"
 	"net/url"
 	"sort"
+	"strconv"
 	"strings"
 	"sync"
 
@@ -518,10 +519,16 @@ func (um *URLMeasurement) NewEndpointPlan(flags int64) ([]*EndpointPlan, bool) {
 // The flags argument allows to specify flags that modify the planning
 // algorithm. The EndpointPlanningExcludeBogons flag is such that we
 // will not include any bogon IP address into the returned plan.
+//
+// When Options.UseHTTPSRR is set, we use the port parameter of the HTTPS
+// RR for HTTPS and HTTP3 plans, unless the URL contains an explicit port,
+// and, if the HTTPS RR contains an ech parameter, we also include an extra
+// HTTPS plan for each address that uses ECH (see Options.ECHConfigList).
 func (um *URLMeasurement) NewEndpointPlanWithAddressList(
 	addrs []*URLAddress, flags int64) ([]*EndpointPlan, bool) {
 	out := make([]*EndpointPlan, 0, 8)
 	familyCounter := make(map[string]int64)
+	rr := um.httpsRRParams()
 	for _, addr := range addrs {
 		if (flags&EndpointPlanningExcludeBogons) != 0 && netxlite.IsBogon(addr.Address) {
 			logcat.Scrutinizef("excluding bogon %s as requested", addr.Address)
@@ -564,7 +571,7 @@ func (um *URLMeasurement) NewEndpointPlanWithAddressList(
 					logcat.Shrugf("[mx] cannot make plan: %s", err.Error())
 					continue
 				}
-				out = append(out, plan)
+				out = append(out, rr.apply(plan)...)
 			}
 
 			// Even if it has already been measured, this address still counts
@@ -579,7 +586,7 @@ func (um *URLMeasurement) NewEndpointPlanWithAddressList(
 					logcat.Shrugf("[mx] cannot make plan: %s", err.Error())
 					continue
 				}
-				out = append(out, plan)
+				out = append(out, rr.apply(plan)...)
 			}
 
 			// Even if it has already been measured, this address still counts
@@ -614,6 +621,68 @@ func (um *URLMeasurement) newEndpointPlan(
 	return out, nil
 }
 
+// urlHTTPSRRParams contains the HTTPS RR parameters that modify
+// the planning of HTTPS and HTTP3 endpoints.
+type urlHTTPSRRParams struct {
+	// port is the port to use or empty.
+	port string
+
+	// ech is the ECH config list or empty.
+	ech []byte
+}
+
+// httpsRRParams returns the HTTPS RR parameters we should use for planning
+// HTTPS and HTTP3 endpoints. We use the first port and the first valid ECH
+// config list we see inside successful HTTPS lookups for the URL's domain. We
+// return nil when Options.UseHTTPSRR is false.
+func (um *URLMeasurement) httpsRRParams() *urlHTTPSRRParams {
+	if !um.Options.useHTTPSRR() {
+		return nil
+	}
+	out := &urlHTTPSRRParams{}
+	for _, dns := range um.DNS {
+		if dns.Domain() != um.Domain() || dns.LookupType() != archival.DNSLookupTypeHTTPS ||
+			dns.Failure() != "" {
+			continue
+		}
+		if out.port == "" && dns.Port() != 0 && um.URL.Port() == "" {
+			out.port = strconv.Itoa(int(dns.Port()))
+		}
+		if len(out.ech) <= 0 && len(dns.ECHConfigList()) > 0 {
+			if _, err := netxlite.ParseECHConfigList(dns.ECHConfigList()); err != nil {
+				logcat.Shrugf("[mx] ignoring ECH config for %s: %s", um.Domain(), err.Error())
+				continue
+			}
+			out.ech = dns.ECHConfigList()
+		}
+	}
+	return out
+}
+
+// apply applies the HTTPS RR parameters to an HTTPS or HTTP3 plan and returns
+// the resulting list of plans, which includes an ECH plan when applicable.
+func (rr *urlHTTPSRRParams) apply(plan *EndpointPlan) (out []*EndpointPlan) {
+	if rr == nil {
+		return []*EndpointPlan{plan}
+	}
+	if rr.port != "" {
+		plan.Address = net.JoinHostPort(plan.IPAddress(), rr.port)
+	}
+	out = append(out, plan)
+	if len(rr.ech) > 0 && plan.Network == archival.NetworkTypeTCP {
+		out = append(out, &EndpointPlan{
+			URLMeasurementID: plan.URLMeasurementID,
+			Domain:           plan.Domain,
+			Network:          plan.Network,
+			Address:          plan.Address,
+			URL:              plan.URL,
+			Options:          plan.Options.Chain(&Options{ECHConfigList: rr.ech}),
+			Cookies:          plan.Cookies,
+		})
+	}
+	return
+}
+
 // newURLWithScheme creates a copy of an URL with a different scheme.
 func newURLWithScheme(URL *SimpleURL, scheme string) *SimpleURL {
 	return &SimpleURL{
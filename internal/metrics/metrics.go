@@ -0,0 +1,390 @@
+// Package metrics implements a minimal metrics registry that exports
+// metrics using the Prometheus text exposition format.
+//
+// All the methods work with nil receivers. A nil *Registry creates nil
+// metrics and updating a nil metric does nothing. Therefore, code can
+// unconditionally update metrics and the caller decides whether to
+// collect metrics by passing a non-nil registry.
+package metrics
+
+//
+// Registry
+//
+// The registry and the text exposition format.
+//
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Registry contains metrics. You MUST use NewRegistry to create
+// a new instance. Registry implements http.Handler and serves the
+// metrics using the Prometheus text exposition format.
+type Registry struct {
+	// metrics maps a metric name to the metric.
+	metrics map[string]metric
+
+	// mu provides mutual exclusion.
+	mu sync.Mutex
+}
+
+// NewRegistry creates a new Registry.
+func NewRegistry() *Registry {
+	return &Registry{
+		metrics: map[string]metric{},
+		mu:      sync.Mutex{},
+	}
+}
+
+// metric is the generic metric.
+type metric interface {
+	// write writes the metric using the text exposition format.
+	write(w io.Writer)
+}
+
+// register returns the metric with the given name if it exists and
+// otherwise registers the metric created by the given factory.
+func (r *Registry) register(name string, factory func() metric) metric {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if m, found := r.metrics[name]; found {
+		return m
+	}
+	m := factory()
+	r.metrics[name] = m
+	return m
+}
+
+// NewCounter returns the counter with the given name, creating it if
+// needed. The labels argument contains the names of the labels. It
+// panics if a metric with the same name but a different type exists.
+func (r *Registry) NewCounter(name, help string, labels ...string) *Counter {
+	if r == nil {
+		return nil
+	}
+	return r.register(name, func() metric {
+		return &Counter{newVec(name, help, "counter", labels)}
+	}).(*Counter)
+}
+
+// NewGauge is like NewCounter but for gauges.
+func (r *Registry) NewGauge(name, help string, labels ...string) *Gauge {
+	if r == nil {
+		return nil
+	}
+	return r.register(name, func() metric {
+		return &Gauge{newVec(name, help, "gauge", labels)}
+	}).(*Gauge)
+}
+
+// DefaultBuckets contains the default histogram buckets, which are
+// suitable for measuring network operations latencies in seconds.
+var DefaultBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// NewHistogram is like NewCounter but for histograms. The buckets argument
+// contains the sorted upper bounds of the buckets. If nil, we use DefaultBuckets.
+func (r *Registry) NewHistogram(name, help string, buckets []float64, labels ...string) *Histogram {
+	if r == nil {
+		return nil
+	}
+	if buckets == nil {
+		buckets = DefaultBuckets
+	}
+	return r.register(name, func() metric {
+		return &Histogram{
+			buckets: buckets,
+			vec:     newVec(name, help, "histogram", labels),
+		}
+	}).(*Histogram)
+}
+
+// WriteTo writes all the metrics using the text exposition format.
+func (r *Registry) WriteTo(w io.Writer) (int64, error) {
+	if r == nil {
+		return 0, nil
+	}
+	r.mu.Lock()
+	names := make([]string, 0, len(r.metrics))
+	for name := range r.metrics {
+		names = append(names, name)
+	}
+	metrics := make([]metric, 0, len(names))
+	sort.Strings(names)
+	for _, name := range names {
+		metrics = append(metrics, r.metrics[name])
+	}
+	r.mu.Unlock()
+	cw := &countingWriter{w: bufio.NewWriter(w)}
+	for _, m := range metrics {
+		m.write(cw)
+	}
+	if cw.err == nil {
+		cw.err = cw.w.Flush()
+	}
+	return cw.count, cw.err
+}
+
+// ServeHTTP implements http.Handler.
+func (r *Registry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	r.WriteTo(w)
+}
+
+// countingWriter counts the written bytes and remembers the first error.
+type countingWriter struct {
+	count int64
+	err   error
+	w     *bufio.Writer
+}
+
+// Write implements io.Writer.
+func (cw *countingWriter) Write(b []byte) (int, error) {
+	if cw.err != nil {
+		return 0, cw.err
+	}
+	count, err := cw.w.Write(b)
+	cw.count += int64(count)
+	cw.err = err
+	return count, err
+}
+
+// vec is the common implementation of all metrics.
+type vec struct {
+	// help is the help string.
+	help string
+
+	// labels contains the label names.
+	labels []string
+
+	// mu provides mutual exclusion.
+	mu sync.Mutex
+
+	// name is the metric name.
+	name string
+
+	// kind is the metric type.
+	kind string
+
+	// series maps the joined label values to the series.
+	series map[string]*series
+}
+
+// series is a series of a metric with specific label values.
+type series struct {
+	// buckets contains the histogram buckets counts.
+	buckets []uint64
+
+	// count is the number of histogram observations.
+	count uint64
+
+	// values contains the label values.
+	values []string
+
+	// value is the counter or gauge value or the histogram sum.
+	value float64
+}
+
+// newVec creates a new vec.
+func newVec(name, help, kind string, labels []string) *vec {
+	return &vec{
+		help:   help,
+		labels: labels,
+		mu:     sync.Mutex{},
+		name:   name,
+		kind:   kind,
+		series: map[string]*series{},
+	}
+}
+
+// get returns the series with the given label values, creating it if
+// needed. This function MUST be called while holding the mutex.
+func (v *vec) get(values []string) *series {
+	if len(values) != len(v.labels) {
+		panic(fmt.Sprintf("metrics: %s: expected %d label values, got %d",
+			v.name, len(v.labels), len(values)))
+	}
+	key := strings.Join(values, "\xff")
+	s, found := v.series[key]
+	if !found {
+		s = &series{values: append([]string{}, values...)}
+		v.series[key] = s
+	}
+	return s
+}
+
+// sorted returns the series sorted by label values. This function
+// MUST be called while holding the mutex.
+func (v *vec) sorted() []*series {
+	keys := make([]string, 0, len(v.series))
+	for key := range v.series {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	out := make([]*series, 0, len(keys))
+	for _, key := range keys {
+		out = append(out, v.series[key])
+	}
+	return out
+}
+
+// writeHeader writes the HELP and TYPE lines.
+func (v *vec) writeHeader(w io.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n", v.name, escapeHelp(v.help))
+	fmt.Fprintf(w, "# TYPE %s %s\n", v.name, v.kind)
+}
+
+// write writes a counter or a gauge.
+func (v *vec) write(w io.Writer) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	v.writeHeader(w)
+	for _, s := range v.sorted() {
+		fmt.Fprintf(w, "%s%s %s\n", v.name, formatLabels(v.labels, s.values), formatValue(s.value))
+	}
+}
+
+// Counter is a metric that can only increase.
+type Counter struct {
+	*vec
+}
+
+// Inc increments by one the series with the given label values.
+func (c *Counter) Inc(values ...string) {
+	c.Add(1, values...)
+}
+
+// Add adds delta to the series with the given label values. The
+// delta MUST NOT be negative.
+func (c *Counter) Add(delta float64, values ...string) {
+	if c == nil || delta < 0 {
+		return
+	}
+	c.mu.Lock()
+	c.get(values).value += delta
+	c.mu.Unlock()
+}
+
+// Gauge is a metric that can increase and decrease.
+type Gauge struct {
+	*vec
+}
+
+// Set sets the value of the series with the given label values.
+func (g *Gauge) Set(value float64, values ...string) {
+	if g == nil {
+		return
+	}
+	g.mu.Lock()
+	g.get(values).value = value
+	g.mu.Unlock()
+}
+
+// Add adds delta to the series with the given label values.
+func (g *Gauge) Add(delta float64, values ...string) {
+	if g == nil {
+		return
+	}
+	g.mu.Lock()
+	g.get(values).value += delta
+	g.mu.Unlock()
+}
+
+// Inc increments by one the series with the given label values.
+func (g *Gauge) Inc(values ...string) {
+	g.Add(1, values...)
+}
+
+// Dec decrements by one the series with the given label values.
+func (g *Gauge) Dec(values ...string) {
+	g.Add(-1, values...)
+}
+
+// Histogram counts observations inside buckets.
+type Histogram struct {
+	// buckets contains the buckets upper bounds.
+	buckets []float64
+
+	// vec is the underlying vec.
+	vec *vec
+}
+
+// Observe adds an observation to the series with the given label values.
+func (h *Histogram) Observe(value float64, values ...string) {
+	if h == nil {
+		return
+	}
+	h.vec.mu.Lock()
+	defer h.vec.mu.Unlock()
+	s := h.vec.get(values)
+	if s.buckets == nil {
+		s.buckets = make([]uint64, len(h.buckets))
+	}
+	for idx, bound := range h.buckets {
+		if value <= bound {
+			s.buckets[idx]++
+		}
+	}
+	s.count++
+	s.value += value
+}
+
+// write implements metric.write.
+func (h *Histogram) write(w io.Writer) {
+	v := h.vec
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	v.writeHeader(w)
+	labels := append(append([]string{}, v.labels...), "le")
+	for _, s := range v.sorted() {
+		for idx, bound := range h.buckets {
+			values := append(append([]string{}, s.values...), formatValue(bound))
+			fmt.Fprintf(w, "%s_bucket%s %d\n", v.name, formatLabels(labels, values), s.buckets[idx])
+		}
+		values := append(append([]string{}, s.values...), "+Inf")
+		fmt.Fprintf(w, "%s_bucket%s %d\n", v.name, formatLabels(labels, values), s.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", v.name, formatLabels(v.labels, s.values), formatValue(s.value))
+		fmt.Fprintf(w, "%s_count%s %d\n", v.name, formatLabels(v.labels, s.values), s.count)
+	}
+}
+
+// formatLabels formats the labels using the text exposition format.
+func formatLabels(labels, values []string) string {
+	if len(labels) <= 0 {
+		return ""
+	}
+	var parts []string
+	for idx, label := range labels {
+		parts = append(parts, fmt.Sprintf("%s=\"%s\"", label, escapeLabelValue(values[idx])))
+	}
+	return "{" + strings.Join(parts, ",") + "}"
+}
+
+// formatValue formats a value using the text exposition format.
+func formatValue(value float64) string {
+	switch {
+	case math.IsInf(value, +1):
+		return "+Inf"
+	case math.IsInf(value, -1):
+		return "-Inf"
+	default:
+		return strconv.FormatFloat(value, 'g', -1, 64)
+	}
+}
+
+// escapeHelp escapes the help string.
+func escapeHelp(s string) string {
+	return strings.NewReplacer(`\`, `\\`, "\n", `\n`).Replace(s)
+}
+
+// escapeLabelValue escapes a label value.
+func escapeLabelValue(s string) string {
+	return strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`).Replace(s)
+}
@@ -188,6 +188,7 @@ type ArchivalTCPConnectStatus struct {
 type ArchivalTLSOrQUICHandshakeResult struct {
 	Address            string                    `json:"address"`
 	CipherSuite        string                    `json:"cipher_suite"`
+	ClientHello        string                    `json:"client_hello,omitempty"`
 	Failure            *string                   `json:"failure"`
 	NegotiatedProtocol string                    `json:"negotiated_protocol"`
 	NoTLSVerify        bool                      `json:"no_tls_verify"`
@@ -186,6 +186,12 @@ type HTTPSSvc struct {
 
 	// IPv6 contains the IPv6 hints (which may be empty).
 	IPv6 []string
+
+	// Port contains the alternative port (zero if not present).
+	Port uint16
+
+	// ECHConfigList contains the ECH configuration (which may be empty).
+	ECHConfigList []byte
 }
 
 // UDPListener creates a bound UDP socket.
@@ -319,3 +325,32 @@ type UnderlyingNetworkLibrary interface {
 	// NewSimpleDialer returns a new SimpleDialer.
 	NewSimpleDialer(timeout time.Duration) SimpleDialer
 }
+
+// UnderlyingCryptoLibrary is an OPTIONAL interface that an UnderlyingNetworkLibrary
+// may implement to control the TLS and QUIC handshakes performed using the conns
+// it creates. For example, netrecord uses it to record the handshake results and
+// the plaintext, because the encrypted bytes cannot be replayed.
+type UnderlyingCryptoLibrary interface {
+	// TLSHandshake performs a TLS handshake over conn, which wraps a conn
+	// created using NewSimpleDialer. Calling handshake performs the actual
+	// handshake, whose errors are already wrapped and classified.
+	TLSHandshake(ctx context.Context, conn net.Conn, config *tls.Config,
+		handshake TLSHandshakeFunc) (TLSConn, error)
+
+	// QUICDial dials a QUIC session with the given remote address using
+	// pconn, which wraps a conn created using ListenUDP. Calling dial
+	// performs the actual dial, whose errors are already wrapped and
+	// classified. The address argument is the dialed endpoint.
+	QUICDial(ctx context.Context, pconn UDPLikeConn, remoteAddr *net.UDPAddr,
+		address string, tlsConfig *tls.Config, quicConfig *quic.Config,
+		dial QUICDialFunc) (quic.EarlySession, error)
+}
+
+// TLSHandshakeFunc is the func performing a TLS handshake
+// that UnderlyingCryptoLibrary.TLSHandshake may call.
+type TLSHandshakeFunc func(ctx context.Context, conn net.Conn, config *tls.Config) (TLSConn, error)
+
+// QUICDialFunc is the func dialing a QUIC session that
+// UnderlyingCryptoLibrary.QUICDial may call.
+type QUICDialFunc func(ctx context.Context, pconn UDPLikeConn, remoteAddr *net.UDPAddr,
+	address string, tlsConfig *tls.Config, quicConfig *quic.Config) (quic.EarlySession, error)
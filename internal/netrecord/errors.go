@@ -0,0 +1,79 @@
+package netrecord
+
+//
+// Errors
+//
+// Mapping between errors and the failures we record.
+//
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"os"
+
+	"github.com/bassosimone/websteps-illustrated/internal/netxlite"
+)
+
+// ErrNotRecorded indicates that we cannot find a recorded lookup
+// or flow for an operation we're asked to replay.
+var ErrNotRecorded = errors.New("netrecord: not recorded")
+
+// isTimeout returns whether err is caused by an expired deadline. We do
+// not record such errors because we replay timeouts by blocking.
+func isTimeout(err error) bool {
+	return errors.Is(err, os.ErrDeadlineExceeded)
+}
+
+// isClosed returns whether err is caused by using a closed conn. We do
+// not record such errors because they do not depend on the network.
+func isClosed(err error) bool {
+	return errors.Is(err, net.ErrClosed)
+}
+
+// newFailure returns the failure string for the given error.
+func newFailure(err error) string {
+	if err == nil {
+		return ""
+	}
+	return netxlite.NewTopLevelGenericErrWrapper(err).Failure
+}
+
+// newError returns an error that netxlite classifies as the given
+// failure. Where possible, we return the same error we would get from
+// the network. Otherwise, we return an already classified error.
+func newError(failure, operation string) error {
+	switch failure {
+	case netxlite.FailureConnectionRefused:
+		return netxlite.ECONNREFUSED
+	case netxlite.FailureConnectionReset:
+		return netxlite.ECONNRESET
+	case netxlite.FailureDNSNXDOMAINError:
+		return netxlite.ErrOODNSNoSuchHost
+	case netxlite.FailureDNSNoAnswer:
+		return netxlite.ErrOODNSNoAnswer
+	case netxlite.FailureDNSRefusedError:
+		return netxlite.ErrOODNSRefused
+	case netxlite.FailureDNSServerMisbehaving:
+		return netxlite.ErrOODNSMisbehaving
+	case netxlite.FailureDNSServfailError:
+		return netxlite.ErrOODNSServfail
+	case netxlite.FailureEOFError:
+		return io.EOF
+	case netxlite.FailureGenericTimeoutError:
+		return os.ErrDeadlineExceeded
+	case netxlite.FailureHostUnreachable:
+		return netxlite.EHOSTUNREACH
+	case netxlite.FailureInterrupted:
+		return context.Canceled
+	case netxlite.FailureNetworkUnreachable:
+		return netxlite.ENETUNREACH
+	default:
+		return &netxlite.ErrWrapper{
+			Failure:    failure,
+			Operation:  operation,
+			WrappedErr: errors.New(failure),
+		}
+	}
+}
@@ -0,0 +1,398 @@
+package netrecord
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/bassosimone/websteps-illustrated/internal/model"
+	"github.com/bassosimone/websteps-illustrated/internal/netxlite"
+	"github.com/lucas-clemente/quic-go/http3"
+	"github.com/miekg/dns"
+)
+
+// newTestReplayer saves what rec recorded and loads it into a new Replayer.
+func newTestReplayer(t *testing.T, rec *Recorder) *Replayer {
+	filename := filepath.Join(t.TempDir(), "session.json")
+	if err := rec.WriteFile(filename); err != nil {
+		t.Fatal(err)
+	}
+	session, err := LoadSession(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return NewReplayer(session)
+}
+
+// startTCPServer starts a TCP server that reads the request, sends the
+// response, and closes the conn. It returns the server address.
+func startTCPServer(t *testing.T, response []byte) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			buffer := make([]byte, 1024)
+			if _, err := conn.Read(buffer); err == nil {
+				conn.Write(response)
+			}
+			conn.Close()
+		}
+	}()
+	return listener.Addr().String()
+}
+
+// dialAndExchange dials address using lib, writes request, and
+// reads until the conn fails. It returns what it read and the error.
+func dialAndExchange(t *testing.T, lib model.UnderlyingNetworkLibrary,
+	address string, request []byte) ([]byte, error) {
+	conn, err := lib.NewSimpleDialer(time.Second).DialContext(context.Background(), "tcp", address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if err := conn.SetDeadline(time.Now().Add(5 * time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := conn.Write(request); err != nil {
+		return nil, err
+	}
+	var data []byte
+	buffer := make([]byte, 1024)
+	for {
+		count, err := conn.Read(buffer)
+		data = append(data, buffer[:count]...)
+		if err != nil {
+			return data, err
+		}
+	}
+}
+
+func TestRecordAndReplayTCP(t *testing.T) {
+	address := startTCPServer(t, []byte("WORLD"))
+	rec := NewRecorder(netxlite.TProxy)
+	data, err := dialAndExchange(t, rec, address, []byte("HELLO"))
+	if !errors.Is(err, io.EOF) || string(data) != "WORLD" {
+		t.Fatalf("recording: unexpected result: %q, %v", data, err)
+	}
+	rep := newTestReplayer(t, rec)
+	data, err = dialAndExchange(t, rep, address, []byte("HELLO"))
+	if !errors.Is(err, io.EOF) || string(data) != "WORLD" {
+		t.Fatalf("replaying: unexpected result: %q, %v", data, err)
+	}
+	_, err = rep.NewSimpleDialer(time.Second).DialContext(context.Background(), "tcp", address)
+	if !errors.Is(err, ErrNotRecorded) {
+		t.Fatal("we replayed the same flow twice", err)
+	}
+}
+
+// startUDPServer starts a UDP server that answers DNS queries with
+// address unless reply is false. It returns the server address.
+func startUDPServer(t *testing.T, address string, reply bool) *net.UDPAddr {
+	pconn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { pconn.Close() })
+	go func() {
+		buffer := make([]byte, 1024)
+		for {
+			count, addr, err := pconn.ReadFrom(buffer)
+			if err != nil {
+				return
+			}
+			query := &dns.Msg{}
+			if err := query.Unpack(buffer[:count]); err != nil || !reply {
+				continue
+			}
+			resp := &dns.Msg{}
+			resp.SetReply(query)
+			resp.Answer = append(resp.Answer, &dns.A{
+				Hdr: dns.RR_Header{
+					Name:   query.Question[0].Name,
+					Rrtype: dns.TypeA,
+					Class:  dns.ClassINET,
+					Ttl:    300,
+				},
+				A: net.ParseIP(address),
+			})
+			data, err := resp.Pack()
+			if err != nil {
+				continue
+			}
+			pconn.WriteTo(data, addr)
+		}
+	}()
+	return pconn.LocalAddr().(*net.UDPAddr)
+}
+
+// queryDNS sends a query for example.com with the given ID to address
+// using a socket created by lib and returns the reply.
+func queryDNS(t *testing.T, lib model.UnderlyingNetworkLibrary,
+	address *net.UDPAddr, id uint16, timeout time.Duration) (*dns.Msg, error) {
+	pconn, err := lib.ListenUDP("udp", &net.UDPAddr{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pconn.Close()
+	query := &dns.Msg{}
+	query.SetQuestion("example.com.", dns.TypeA)
+	query.Id = id
+	data, err := query.Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := pconn.SetDeadline(time.Now().Add(timeout)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := pconn.WriteTo(data, address); err != nil {
+		t.Fatal(err)
+	}
+	buffer := make([]byte, 1024)
+	count, _, err := pconn.ReadFrom(buffer)
+	if err != nil {
+		return nil, err
+	}
+	reply := &dns.Msg{}
+	if err := reply.Unpack(buffer[:count]); err != nil {
+		t.Fatal(err)
+	}
+	return reply, nil
+}
+
+func TestRecordAndReplayDNSOverUDP(t *testing.T) {
+	address := startUDPServer(t, "93.184.216.34", true)
+	rec := NewRecorder(netxlite.TProxy)
+	if _, err := queryDNS(t, rec, address, 1, 5*time.Second); err != nil {
+		t.Fatal(err)
+	}
+	rep := newTestReplayer(t, rec)
+	reply, err := queryDNS(t, rep, address, 2, 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reply.Id != 2 {
+		t.Fatal("we did not fix the query ID", reply.Id)
+	}
+	if len(reply.Answer) != 1 || reply.Answer[0].(*dns.A).A.String() != "93.184.216.34" {
+		t.Fatal("unexpected answer", reply.Answer)
+	}
+}
+
+func TestRecordAndReplayTimeout(t *testing.T) {
+	const timeout = 300 * time.Millisecond
+	address := startUDPServer(t, "", false)
+	rec := NewRecorder(netxlite.TProxy)
+	if _, err := queryDNS(t, rec, address, 1, timeout); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatal("recording: unexpected error", err)
+	}
+	rep := newTestReplayer(t, rec)
+	started := time.Now()
+	_, err := queryDNS(t, rep, address, 2, timeout)
+	var opErr *net.OpError
+	if !errors.As(err, &opErr) || !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatal("replaying: unexpected error", err)
+	}
+	if elapsed := time.Since(started); elapsed < timeout {
+		t.Fatal("we did not block until the deadline", elapsed)
+	}
+}
+
+func TestReplayDifferentHandshake(t *testing.T) {
+	tests := []struct {
+		name     string
+		network  string
+		recorded []byte
+		data     []byte
+		want     error
+	}{{
+		name:     "TLS ClientHello",
+		network:  "tcp",
+		recorded: []byte{0x16, 0x03, 0x01, 0x00, 0x02, 0x01, 0x00},
+		data:     []byte{0x16, 0x03, 0x01, 0x00, 0x02, 0x01, 0x01},
+		want:     ErrNotRecorded,
+	}, {
+		name:     "QUIC Initial",
+		network:  "udp",
+		recorded: []byte{0xc3, 0x00, 0x00, 0x00, 0x01, 0x08, 0x00},
+		data:     []byte{0xc3, 0x00, 0x00, 0x00, 0x01, 0x08, 0x01},
+		want:     ErrNotRecorded,
+	}, {
+		name:     "cleartext",
+		network:  "tcp",
+		recorded: []byte("GET / HTTP/1.1\r\n\r\n"),
+		data:     []byte("GET /robots.txt HTTP/1.1\r\n\r\n"),
+		want:     nil,
+	}}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			const address = "93.184.216.34:443"
+			flow := &Flow{
+				Type:       FlowDial,
+				Network:    tt.network,
+				Address:    address,
+				LocalAddr:  "",
+				RemoteAddr: address,
+				Started:    time.Now(),
+				Elapsed:    0,
+				Failure:    "",
+				Events: []*Event{{
+					Operation: netxlite.WriteOperation,
+					T:         0,
+					Address:   "",
+					Data:      tt.recorded,
+					Failure:   "",
+				}, {
+					Operation: netxlite.ReadOperation,
+					T:         0,
+					Address:   "",
+					Data:      nil,
+					Failure:   netxlite.FailureConnectionReset,
+				}},
+				Handshake: nil,
+				Streams:   []*Stream{},
+			}
+			rep := NewReplayer(&Session{Lookups: []*Lookup{}, Flows: []*Flow{flow}})
+			conn, err := rep.NewSimpleDialer(time.Second).DialContext(
+				context.Background(), tt.network, address)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			if _, err := conn.Write(tt.data); !errors.Is(err, tt.want) {
+				t.Fatal("unexpected error", err)
+			}
+		})
+	}
+}
+
+// fetchHTTPS fetches URL using netxlite with lib as netxlite.TProxy and
+// trusting the given certificate. It returns the response and the body.
+func fetchHTTPS(t *testing.T, lib model.UnderlyingNetworkLibrary,
+	URL string, cert *x509.Certificate) (*http.Response, []byte, error) {
+	saved := netxlite.TProxy
+	netxlite.TProxy = lib
+	defer func() { netxlite.TProxy = saved }()
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+	dialer := netxlite.NewDialerWithoutResolver(model.DiscardLogger)
+	tlsDialer := netxlite.NewTLSDialerWithConfig(dialer,
+		netxlite.NewTLSHandshakerStdlib(model.DiscardLogger), &tls.Config{RootCAs: pool})
+	txp := netxlite.NewHTTPTransport(model.DiscardLogger, dialer, tlsDialer)
+	defer txp.CloseIdleConnections()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, "GET", URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := txp.RoundTrip(req)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	return resp, body, err
+}
+
+func TestRecordAndReplayHTTPS(t *testing.T) {
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("WORLD"))
+	}))
+	defer srv.Close()
+	rec := NewRecorder(netxlite.TProxy)
+	resp, body, err := fetchHTTPS(t, rec, srv.URL, srv.Certificate())
+	if err != nil || resp.StatusCode != 200 || string(body) != "WORLD" {
+		t.Fatalf("recording: unexpected result: %+v, %q, %v", resp, body, err)
+	}
+	rep := newTestReplayer(t, rec)
+	srv.Close() // make sure we do not touch the network
+	resp, body, err = fetchHTTPS(t, rep, srv.URL, srv.Certificate())
+	if err != nil || resp.StatusCode != 200 || string(body) != "WORLD" {
+		t.Fatalf("replaying: unexpected result: %+v, %q, %v", resp, body, err)
+	}
+	if resp.TLS == nil || len(resp.TLS.PeerCertificates) != 1 ||
+		!resp.TLS.PeerCertificates[0].Equal(srv.Certificate()) {
+		t.Fatal("we did not replay the peer certificates")
+	}
+	_, _, err = fetchHTTPS(t, rep, srv.URL, srv.Certificate())
+	if !errors.Is(err, ErrNotRecorded) {
+		t.Fatal("we replayed the same flow twice", err)
+	}
+}
+
+// startHTTP3Server starts an HTTP/3 server using the certificate of
+// srv and the handler of srv. It returns the server and its URL.
+func startHTTP3Server(t *testing.T, srv *httptest.Server) (*http3.Server, string) {
+	pconn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &http3.Server{Server: &http.Server{
+		Handler:   srv.Config.Handler,
+		TLSConfig: srv.TLS,
+	}}
+	go server.Serve(pconn)
+	t.Cleanup(func() { server.Close() })
+	return server, "https://" + pconn.LocalAddr().String() + "/"
+}
+
+// fetchHTTP3 is like fetchHTTPS but uses HTTP/3.
+func fetchHTTP3(t *testing.T, lib model.UnderlyingNetworkLibrary,
+	URL string, cert *x509.Certificate) (*http.Response, []byte, error) {
+	saved := netxlite.TProxy
+	netxlite.TProxy = lib
+	defer func() { netxlite.TProxy = saved }()
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+	dialer := netxlite.NewQUICDialerWithoutResolver(netxlite.NewUDPListener(), model.DiscardLogger)
+	txp := netxlite.NewHTTP3Transport(model.DiscardLogger, dialer, &tls.Config{RootCAs: pool})
+	defer txp.CloseIdleConnections()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, "GET", URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := txp.RoundTrip(req)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	return resp, body, err
+}
+
+func TestRecordAndReplayHTTP3(t *testing.T) {
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("WORLD"))
+	}))
+	defer srv.Close()
+	server, URL := startHTTP3Server(t, srv)
+	rec := NewRecorder(netxlite.TProxy)
+	resp, body, err := fetchHTTP3(t, rec, URL, srv.Certificate())
+	if err != nil || resp.StatusCode != 200 || string(body) != "WORLD" {
+		t.Fatalf("recording: unexpected result: %+v, %q, %v", resp, body, err)
+	}
+	rep := newTestReplayer(t, rec)
+	server.Close() // make sure we do not touch the network
+	resp, body, err = fetchHTTP3(t, rep, URL, srv.Certificate())
+	if err != nil || resp.StatusCode != 200 || string(body) != "WORLD" {
+		t.Fatalf("replaying: unexpected result: %+v, %q, %v", resp, body, err)
+	}
+}
@@ -0,0 +1,300 @@
+package netrecord
+
+//
+// Record crypto
+//
+// Implementation of model.UnderlyingCryptoLibrary that records.
+//
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"time"
+
+	"github.com/bassosimone/websteps-illustrated/internal/model"
+	"github.com/bassosimone/websteps-illustrated/internal/netxlite"
+	"github.com/lucas-clemente/quic-go"
+)
+
+var _ model.UnderlyingCryptoLibrary = &Recorder{}
+
+// TLSHandshake implements model.UnderlyingCryptoLibrary.TLSHandshake. We
+// record the result of the handshake and then the plaintext. When conn
+// was not created using this Recorder, we just perform the handshake.
+func (r *Recorder) TLSHandshake(ctx context.Context, conn net.Conn,
+	config *tls.Config, handshake model.TLSHandshakeFunc) (model.TLSConn, error) {
+	flow, found := r.findConn(conn.LocalAddr())
+	if !found {
+		return handshake(ctx, conn, config)
+	}
+	started := time.Now()
+	hs := r.startHandshake(flow, "", config)
+	tlsconn, err := handshake(ctx, conn, config)
+	if err != nil {
+		r.finishHandshake(hs, started, tls.ConnectionState{}, err)
+		return nil, err
+	}
+	r.finishHandshake(hs, started, tlsconn.ConnectionState(), nil)
+	return &recordedTLSConn{
+		TLSConn: tlsconn,
+		flow:    flow,
+		rec:     r,
+	}, nil
+}
+
+// QUICDial implements model.UnderlyingCryptoLibrary.QUICDial. We record
+// the result of the handshake and then the plaintext of each stream. When
+// pconn was not created using this Recorder, we just dial.
+func (r *Recorder) QUICDial(ctx context.Context, pconn model.UDPLikeConn,
+	remoteAddr *net.UDPAddr, address string, tlsConfig *tls.Config,
+	quicConfig *quic.Config, dial model.QUICDialFunc) (quic.EarlySession, error) {
+	flow, found := r.findConn(pconn.LocalAddr())
+	if !found {
+		return dial(ctx, pconn, remoteAddr, address, tlsConfig, quicConfig)
+	}
+	started := time.Now()
+	hs := r.startHandshake(flow, address, tlsConfig)
+	sess, err := dial(ctx, pconn, remoteAddr, address, tlsConfig, quicConfig)
+	if err != nil {
+		r.finishHandshake(hs, started, tls.ConnectionState{}, err)
+		return nil, err
+	}
+	r.finishHandshake(hs, started, sess.ConnectionState().TLS.ConnectionState, nil)
+	return &recordedQUICSession{
+		EarlySession: sess,
+		flow:         flow,
+		rec:          r,
+	}, nil
+}
+
+// startHandshake adds a new handshake to the given flow, which stops the
+// recording of the raw events. For QUIC, address is the dialed address.
+func (r *Recorder) startHandshake(flow *Flow, address string, config *tls.Config) *Handshake {
+	hs := &Handshake{
+		ServerName:         config.ServerName,
+		NextProtos:         append([]string{}, config.NextProtos...),
+		T:                  time.Since(flow.Started),
+		Elapsed:            0,
+		Failure:            "",
+		Version:            0,
+		CipherSuite:        0,
+		NegotiatedProtocol: "",
+		PeerCertificates:   [][]byte{},
+	}
+	r.mu.Lock()
+	if address != "" {
+		flow.Address = address
+	}
+	flow.Handshake = hs
+	r.mu.Unlock()
+	return hs
+}
+
+// finishHandshake records the result of the given handshake.
+func (r *Recorder) finishHandshake(
+	hs *Handshake, started time.Time, state tls.ConnectionState, err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	hs.Elapsed = time.Since(started)
+	hs.Failure = newFailure(err)
+	hs.Version = state.Version
+	hs.CipherSuite = state.CipherSuite
+	hs.NegotiatedProtocol = state.NegotiatedProtocol
+	for _, cert := range state.PeerCertificates {
+		hs.PeerCertificates = append(hs.PeerCertificates, cert.Raw)
+	}
+}
+
+// recordedTLSConn is a model.TLSConn that records the plaintext.
+type recordedTLSConn struct {
+	// TLSConn is the underlying conn.
+	model.TLSConn
+
+	// flow is the flow we're recording.
+	flow *Flow
+
+	// rec is the recorder.
+	rec *Recorder
+}
+
+// Read implements net.Conn.Read.
+func (c *recordedTLSConn) Read(b []byte) (int, error) {
+	count, err := c.TLSConn.Read(b)
+	c.rec.appendPlaintextEvent(c.flow, &c.flow.Events, netxlite.ReadOperation, b[:count], err)
+	return count, err
+}
+
+// Write implements net.Conn.Write.
+func (c *recordedTLSConn) Write(b []byte) (int, error) {
+	count, err := c.TLSConn.Write(b)
+	c.rec.appendPlaintextEvent(c.flow, &c.flow.Events, netxlite.WriteOperation, b[:count], err)
+	return count, err
+}
+
+// recordedQUICSession is a quic.EarlySession that records the streams.
+type recordedQUICSession struct {
+	// EarlySession is the underlying session.
+	quic.EarlySession
+
+	// flow is the flow we're recording.
+	flow *Flow
+
+	// rec is the recorder.
+	rec *Recorder
+}
+
+// AcceptStream implements quic.Session.AcceptStream. We do not record
+// failures to accept streams, which happen when the session is closed,
+// because we replay them by blocking until the session is closed.
+func (s *recordedQUICSession) AcceptStream(ctx context.Context) (quic.Stream, error) {
+	stream, err := s.EarlySession.AcceptStream(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return s.newStream(StreamAccept, stream.StreamID(), nil, stream), nil
+}
+
+// AcceptUniStream implements quic.Session.AcceptUniStream. We do not record
+// failures like we do in AcceptStream.
+func (s *recordedQUICSession) AcceptUniStream(ctx context.Context) (quic.ReceiveStream, error) {
+	stream, err := s.EarlySession.AcceptUniStream(ctx)
+	if err != nil {
+		return nil, err
+	}
+	rs := s.newStream(StreamAcceptUni, stream.StreamID(), nil, nil)
+	return &recordedQUICReceiveStream{ReceiveStream: stream, rs: rs}, nil
+}
+
+// OpenStream implements quic.Session.OpenStream.
+func (s *recordedQUICSession) OpenStream() (quic.Stream, error) {
+	stream, err := s.EarlySession.OpenStream()
+	return s.newStreamOrError(stream, err)
+}
+
+// OpenStreamSync implements quic.Session.OpenStreamSync.
+func (s *recordedQUICSession) OpenStreamSync(ctx context.Context) (quic.Stream, error) {
+	stream, err := s.EarlySession.OpenStreamSync(ctx)
+	return s.newStreamOrError(stream, err)
+}
+
+// OpenUniStream implements quic.Session.OpenUniStream.
+func (s *recordedQUICSession) OpenUniStream() (quic.SendStream, error) {
+	stream, err := s.EarlySession.OpenUniStream()
+	return s.newSendStreamOrError(stream, err)
+}
+
+// OpenUniStreamSync implements quic.Session.OpenUniStreamSync.
+func (s *recordedQUICSession) OpenUniStreamSync(ctx context.Context) (quic.SendStream, error) {
+	stream, err := s.EarlySession.OpenUniStreamSync(ctx)
+	return s.newSendStreamOrError(stream, err)
+}
+
+// newStreamOrError records the result of opening a bidirectional stream.
+func (s *recordedQUICSession) newStreamOrError(stream quic.Stream, err error) (quic.Stream, error) {
+	if err != nil {
+		s.newStream(StreamOpen, 0, err, nil)
+		return nil, err
+	}
+	return s.newStream(StreamOpen, stream.StreamID(), nil, stream), nil
+}
+
+// newSendStreamOrError records the result of opening a unidirectional stream.
+func (s *recordedQUICSession) newSendStreamOrError(
+	stream quic.SendStream, err error) (quic.SendStream, error) {
+	if err != nil {
+		s.newStream(StreamOpenUni, 0, err, nil)
+		return nil, err
+	}
+	rs := s.newStream(StreamOpenUni, stream.StreamID(), nil, nil)
+	return &recordedQUICSendStream{SendStream: stream, rs: rs}, nil
+}
+
+// newStream adds a new stream to the flow and returns a wrapper recording
+// the plaintext of stream, which is nil for unidirectional streams, whose
+// wrappers only use the wrapper to append events, and for failures.
+func (s *recordedQUICSession) newStream(kind string, id quic.StreamID,
+	err error, stream quic.Stream) *recordedQUICStream {
+	record := &Stream{
+		Type:    kind,
+		ID:      int64(id),
+		T:       time.Since(s.flow.Started),
+		Failure: newFailure(err),
+		Events:  []*Event{},
+	}
+	s.rec.mu.Lock()
+	s.flow.Streams = append(s.flow.Streams, record)
+	s.rec.mu.Unlock()
+	return &recordedQUICStream{
+		Stream: stream,
+		flow:   s.flow,
+		rec:    s.rec,
+		record: record,
+	}
+}
+
+// recordedQUICStream is a quic.Stream that records the plaintext.
+type recordedQUICStream struct {
+	// Stream is the underlying stream (possibly nil).
+	quic.Stream
+
+	// flow is the flow we're recording.
+	flow *Flow
+
+	// rec is the recorder.
+	rec *Recorder
+
+	// record is the stream we're recording.
+	record *Stream
+}
+
+// Read implements quic.Stream.Read.
+func (s *recordedQUICStream) Read(b []byte) (int, error) {
+	count, err := s.Stream.Read(b)
+	s.appendEvent(netxlite.ReadOperation, b[:count], err)
+	return count, err
+}
+
+// Write implements quic.Stream.Write.
+func (s *recordedQUICStream) Write(b []byte) (int, error) {
+	count, err := s.Stream.Write(b)
+	s.appendEvent(netxlite.WriteOperation, b[:count], err)
+	return count, err
+}
+
+// appendEvent appends an event to the stream.
+func (s *recordedQUICStream) appendEvent(op string, data []byte, err error) {
+	s.rec.appendPlaintextEvent(s.flow, &s.record.Events, op, data, err)
+}
+
+// recordedQUICReceiveStream is a quic.ReceiveStream that records the plaintext.
+type recordedQUICReceiveStream struct {
+	// ReceiveStream is the underlying stream.
+	quic.ReceiveStream
+
+	// rs records the events.
+	rs *recordedQUICStream
+}
+
+// Read implements quic.ReceiveStream.Read.
+func (s *recordedQUICReceiveStream) Read(b []byte) (int, error) {
+	count, err := s.ReceiveStream.Read(b)
+	s.rs.appendEvent(netxlite.ReadOperation, b[:count], err)
+	return count, err
+}
+
+// recordedQUICSendStream is a quic.SendStream that records the plaintext.
+type recordedQUICSendStream struct {
+	// SendStream is the underlying stream.
+	quic.SendStream
+
+	// rs records the events.
+	rs *recordedQUICStream
+}
+
+// Write implements quic.SendStream.Write.
+func (s *recordedQUICSendStream) Write(b []byte) (int, error) {
+	count, err := s.SendStream.Write(b)
+	s.rs.appendEvent(netxlite.WriteOperation, b[:count], err)
+	return count, err
+}
@@ -0,0 +1,302 @@
+package netrecord
+
+//
+// Recorder
+//
+// Implementation of model.UnderlyingNetworkLibrary that records.
+//
+
+import (
+	"context"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/bassosimone/websteps-illustrated/internal/model"
+	"github.com/bassosimone/websteps-illustrated/internal/netxlite"
+)
+
+// Recorder records the network operations performed using the
+// underlying library. You MUST use NewRecorder to create a new instance.
+type Recorder struct {
+	// conns maps the local address of each open conn to its flow.
+	conns map[string]*Flow
+
+	// mu provides mutual exclusion.
+	mu sync.Mutex
+
+	// session is the session we're recording.
+	session *Session
+
+	// underlying is the underlying library.
+	underlying model.UnderlyingNetworkLibrary
+}
+
+// NewRecorder creates a new Recorder using the given
+// underlying network library (e.g., netxlite.TProxy).
+func NewRecorder(underlying model.UnderlyingNetworkLibrary) *Recorder {
+	return &Recorder{
+		conns: map[string]*Flow{},
+		mu:    sync.Mutex{},
+		session: &Session{
+			Lookups: []*Lookup{},
+			Flows:   []*Flow{},
+		},
+		underlying: underlying,
+	}
+}
+
+// WriteFile writes what we recorded so far into the given JSON file.
+func (r *Recorder) WriteFile(filename string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.session.WriteFile(filename)
+}
+
+var _ model.UnderlyingNetworkLibrary = &Recorder{}
+
+// ListenUDP implements model.UnderlyingNetworkLibrary.ListenUDP.
+func (r *Recorder) ListenUDP(network string, laddr *net.UDPAddr) (model.UDPLikeConn, error) {
+	started := time.Now()
+	pconn, err := r.underlying.ListenUDP(network, laddr)
+	if err != nil {
+		return nil, err // we only record the network, not local failures
+	}
+	flow := &Flow{
+		Type:       FlowListen,
+		Network:    network,
+		Address:    "",
+		LocalAddr:  pconn.LocalAddr().String(),
+		RemoteAddr: "",
+		Started:    started,
+		Elapsed:    time.Since(started),
+		Failure:    "",
+		Events:     []*Event{},
+		Handshake:  nil,
+		Streams:    []*Stream{},
+	}
+	r.appendFlow(flow)
+	r.registerConn(pconn.LocalAddr(), flow)
+	return &recordedUDPConn{
+		UDPLikeConn: pconn,
+		flow:        flow,
+		rec:         r,
+	}, nil
+}
+
+// LookupHost implements model.UnderlyingNetworkLibrary.LookupHost.
+func (r *Recorder) LookupHost(ctx context.Context, domain string) ([]string, error) {
+	started := time.Now()
+	addrs, err := r.underlying.LookupHost(ctx, domain)
+	lookup := &Lookup{
+		Domain:    domain,
+		Started:   started,
+		Elapsed:   time.Since(started),
+		Addresses: addrs,
+		Failure:   "",
+	}
+	if err != nil {
+		lookup.Failure = netxlite.ClassifyResolverError(err)
+	}
+	r.mu.Lock()
+	r.session.Lookups = append(r.session.Lookups, lookup)
+	r.mu.Unlock()
+	return addrs, err
+}
+
+// NewSimpleDialer implements model.UnderlyingNetworkLibrary.NewSimpleDialer.
+func (r *Recorder) NewSimpleDialer(timeout time.Duration) model.SimpleDialer {
+	return &recorderDialer{
+		dialer: r.underlying.NewSimpleDialer(timeout),
+		rec:    r,
+	}
+}
+
+// recorderDialer is the model.SimpleDialer returned by NewSimpleDialer.
+type recorderDialer struct {
+	// dialer is the underlying dialer.
+	dialer model.SimpleDialer
+
+	// rec is the recorder.
+	rec *Recorder
+}
+
+// DialContext implements model.SimpleDialer.DialContext.
+func (d *recorderDialer) DialContext(
+	ctx context.Context, network, address string) (net.Conn, error) {
+	started := time.Now()
+	conn, err := d.dialer.DialContext(ctx, network, address)
+	flow := &Flow{
+		Type:       FlowDial,
+		Network:    network,
+		Address:    address,
+		LocalAddr:  "",
+		RemoteAddr: "",
+		Started:    started,
+		Elapsed:    time.Since(started),
+		Failure:    newFailure(err),
+		Events:     []*Event{},
+		Handshake:  nil,
+		Streams:    []*Stream{},
+	}
+	if err != nil {
+		d.rec.appendFlow(flow)
+		return nil, err
+	}
+	flow.LocalAddr = conn.LocalAddr().String()
+	flow.RemoteAddr = conn.RemoteAddr().String()
+	d.rec.appendFlow(flow)
+	d.rec.registerConn(conn.LocalAddr(), flow)
+	return &recordedConn{
+		Conn: conn,
+		flow: flow,
+		rec:  d.rec,
+	}, nil
+}
+
+// appendFlow appends a flow to the session.
+func (r *Recorder) appendFlow(flow *Flow) {
+	r.mu.Lock()
+	r.session.Flows = append(r.session.Flows, flow)
+	r.mu.Unlock()
+}
+
+// registerConn registers the flow of the conn using the given local
+// address, so we can find it when the conn is used for a handshake.
+func (r *Recorder) registerConn(addr net.Addr, flow *Flow) {
+	r.mu.Lock()
+	r.conns[connKey(addr)] = flow
+	r.mu.Unlock()
+}
+
+// unregisterConn undoes registerConn when the conn is closed.
+func (r *Recorder) unregisterConn(addr net.Addr) {
+	r.mu.Lock()
+	delete(r.conns, connKey(addr))
+	r.mu.Unlock()
+}
+
+// findConn returns the flow of the open conn using the given local address.
+func (r *Recorder) findConn(addr net.Addr) (*Flow, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	flow, found := r.conns[connKey(addr)]
+	return flow, found
+}
+
+// connKey returns the key identifying the conn using the given local address.
+func connKey(addr net.Addr) string {
+	return addr.Network() + "/" + addr.String()
+}
+
+// appendEvent appends an event to the given flow unless the error
+// is caused by an expired deadline or by closing the conn. Once the
+// flow has a handshake, we only record the plaintext events (see
+// appendPlaintextEvent) and we ignore the events of the raw conn.
+func (r *Recorder) appendEvent(flow *Flow, op string, addr net.Addr, data []byte, err error) {
+	ev, good := newEvent(flow, op, addr, data, err)
+	if !good {
+		return
+	}
+	r.mu.Lock()
+	if flow.Handshake == nil {
+		flow.Events = append(flow.Events, ev)
+	}
+	r.mu.Unlock()
+}
+
+// appendPlaintextEvent is like appendEvent but appends the event to the
+// given events, which belong to flow, regardless of the handshake.
+func (r *Recorder) appendPlaintextEvent(flow *Flow, events *[]*Event,
+	op string, data []byte, err error) {
+	ev, good := newEvent(flow, op, nil, data, err)
+	if !good {
+		return
+	}
+	r.mu.Lock()
+	*events = append(*events, ev)
+	r.mu.Unlock()
+}
+
+// newEvent returns a new event for the given flow unless the error
+// is caused by an expired deadline or by closing the conn.
+func newEvent(flow *Flow, op string, addr net.Addr, data []byte, err error) (*Event, bool) {
+	if isTimeout(err) || isClosed(err) {
+		return nil, false
+	}
+	ev := &Event{
+		Operation: op,
+		T:         time.Since(flow.Started),
+		Address:   "",
+		Data:      append([]byte{}, data...),
+		Failure:   newFailure(err),
+	}
+	if addr != nil {
+		ev.Address = addr.String()
+	}
+	return ev, true
+}
+
+// recordedConn is a net.Conn that records I/O events.
+type recordedConn struct {
+	// Conn is the underlying conn.
+	net.Conn
+
+	// flow is the flow we're recording.
+	flow *Flow
+
+	// rec is the recorder.
+	rec *Recorder
+}
+
+// Read implements net.Conn.Read.
+func (c *recordedConn) Read(b []byte) (int, error) {
+	count, err := c.Conn.Read(b)
+	c.rec.appendEvent(c.flow, netxlite.ReadOperation, nil, b[:count], err)
+	return count, err
+}
+
+// Write implements net.Conn.Write.
+func (c *recordedConn) Write(b []byte) (int, error) {
+	count, err := c.Conn.Write(b)
+	c.rec.appendEvent(c.flow, netxlite.WriteOperation, nil, b[:count], err)
+	return count, err
+}
+
+// Close implements net.Conn.Close.
+func (c *recordedConn) Close() error {
+	c.rec.unregisterConn(c.Conn.LocalAddr())
+	return c.Conn.Close()
+}
+
+// recordedUDPConn is a model.UDPLikeConn that records I/O events.
+type recordedUDPConn struct {
+	// UDPLikeConn is the underlying conn.
+	model.UDPLikeConn
+
+	// flow is the flow we're recording.
+	flow *Flow
+
+	// rec is the recorder.
+	rec *Recorder
+}
+
+// ReadFrom implements model.UDPLikeConn.ReadFrom.
+func (c *recordedUDPConn) ReadFrom(p []byte) (int, net.Addr, error) {
+	count, addr, err := c.UDPLikeConn.ReadFrom(p)
+	c.rec.appendEvent(c.flow, netxlite.ReadOperation, addr, p[:count], err)
+	return count, addr, err
+}
+
+// WriteTo implements model.UDPLikeConn.WriteTo.
+func (c *recordedUDPConn) WriteTo(p []byte, addr net.Addr) (int, error) {
+	count, err := c.UDPLikeConn.WriteTo(p, addr)
+	c.rec.appendEvent(c.flow, netxlite.WriteOperation, addr, p[:count], err)
+	return count, err
+}
+
+// Close implements model.UDPLikeConn.Close.
+func (c *recordedUDPConn) Close() error {
+	c.rec.unregisterConn(c.UDPLikeConn.LocalAddr())
+	return c.UDPLikeConn.Close()
+}
@@ -0,0 +1,524 @@
+package netrecord
+
+//
+// Replay conn
+//
+// Conns serving back the bytes of a recorded flow.
+//
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/bassosimone/websteps-illustrated/internal/model"
+	"github.com/bassosimone/websteps-illustrated/internal/netxlite"
+)
+
+// player replays a recorded flow. We bind the player to a flow when
+// the client writes for the first time, so we can choose the flow
+// where the client sent the same bytes. Until then, reads block.
+type player struct {
+	// address is the address we dialed (empty when listening).
+	address string
+
+	// closed indicates that the client closed the conn.
+	closed bool
+
+	// dnsIDs maps the IDs of the recorded DNS queries to the IDs
+	// of the queries sent by the client, so we can fix the replies.
+	dnsIDs map[[2]byte][2]byte
+
+	// flow is the flow we're replaying (nil until we bind).
+	flow *Flow
+
+	// mu provides mutual exclusion.
+	mu sync.Mutex
+
+	// network is the network we're using.
+	network string
+
+	// readDeadline is the read deadline.
+	readDeadline time.Time
+
+	// readIdx is the index of the next read event.
+	readIdx int
+
+	// readOff is the offset inside the data of the next read event.
+	readOff int
+
+	// reads contains the read events of flow.
+	reads []*Event
+
+	// rep is the replayer.
+	rep *Replayer
+
+	// started is when the client started dialing or listening.
+	started time.Time
+
+	// wakeup is closed and replaced when the state changes.
+	wakeup chan struct{}
+
+	// writeDeadline is the write deadline.
+	writeDeadline time.Time
+
+	// writes contains the write events of flow.
+	writes []*Event
+
+	// wrote contains the time of each write by the client.
+	wrote []time.Time
+}
+
+// newPlayer creates a new player instance.
+func newPlayer(rep *Replayer, network, address string, started time.Time) *player {
+	return &player{
+		address:       address,
+		closed:        false,
+		dnsIDs:        map[[2]byte][2]byte{},
+		flow:          nil,
+		mu:            sync.Mutex{},
+		network:       network,
+		readDeadline:  time.Time{},
+		readIdx:       0,
+		readOff:       0,
+		reads:         []*Event{},
+		rep:           rep,
+		started:       started,
+		wakeup:        make(chan struct{}),
+		writeDeadline: time.Time{},
+		writes:        []*Event{},
+		wrote:         []time.Time{},
+	}
+}
+
+// read reads from the flow. With stream semantics, we serve each recorded
+// chunk using as many reads as needed. Otherwise, we truncate it like
+// we would do for datagrams. We also return the source address.
+func (p *player) read(b []byte, stream bool) (int, string, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for {
+		if p.closed {
+			return 0, "", p.newOpError(netxlite.ReadOperation, net.ErrClosed)
+		}
+		if !p.readDeadline.IsZero() && !time.Now().Before(p.readDeadline) {
+			return 0, "", p.newOpError(netxlite.ReadOperation, os.ErrDeadlineExceeded)
+		}
+		due, ready := p.nextReadLocked()
+		if ready {
+			return p.consumeReadLocked(b, stream)
+		}
+		p.sleepLocked(due, p.readDeadline)
+	}
+}
+
+// nextReadLocked returns when the next read event is due and whether
+// it is ready. A zero due time means that we should wait for a state
+// change, e.g., because the client did not send the bytes that preceded
+// the next read event yet or because there are no more read events.
+func (p *player) nextReadLocked() (time.Time, bool) {
+	if p.flow == nil || p.readIdx >= len(p.reads) {
+		return time.Time{}, false
+	}
+	ev := p.reads[p.readIdx]
+	var count int // number of recorded writes preceding ev
+	for count < len(p.writes) && p.writes[count].T <= ev.T {
+		count++
+	}
+	if count > len(p.wrote) {
+		return time.Time{}, false
+	}
+	due := p.started.Add(ev.T)
+	if count > 0 {
+		due = p.wrote[count-1].Add(ev.T - p.writes[count-1].T)
+	}
+	return due, !time.Now().Before(due)
+}
+
+// consumeReadLocked consumes the next read event, which must be ready. If
+// the event contains both data and a failure, we first return the data. With
+// stream semantics, the failure is final, as it happens with real conns.
+func (p *player) consumeReadLocked(b []byte, stream bool) (int, string, error) {
+	ev := p.reads[p.readIdx]
+	if p.readOff < len(ev.Data) {
+		count := copy(b, ev.Data[p.readOff:])
+		p.readOff += count
+		if !stream {
+			p.readOff = len(ev.Data) // truncate like we would do for datagrams
+		}
+		if isDatagram(p.network) && count >= 2 {
+			if id, found := p.dnsIDs[[2]byte{ev.Data[0], ev.Data[1]}]; found {
+				copy(b, id[:])
+			}
+		}
+		if p.readOff >= len(ev.Data) && ev.Failure == "" {
+			p.readIdx, p.readOff = p.readIdx+1, 0
+		}
+		return count, ev.Address, nil
+	}
+	if ev.Failure != "" {
+		if !stream {
+			p.readIdx, p.readOff = p.readIdx+1, 0
+		}
+		return 0, ev.Address, p.newOpError(netxlite.ReadOperation,
+			newError(ev.Failure, netxlite.ReadOperation))
+	}
+	p.readIdx, p.readOff = p.readIdx+1, 0
+	return 0, ev.Address, nil
+}
+
+// write writes to the flow. We bind the flow on the first write, which
+// is why we need to know the destination address.
+func (p *player) write(b []byte, address string) (int, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.closed {
+		return 0, p.newOpError(netxlite.WriteOperation, net.ErrClosed)
+	}
+	if !p.writeDeadline.IsZero() && !time.Now().Before(p.writeDeadline) {
+		return 0, p.newOpError(netxlite.WriteOperation, os.ErrDeadlineExceeded)
+	}
+	if p.flow == nil {
+		if err := p.bindLocked(b, address); err != nil {
+			return 0, err
+		}
+	}
+	idx := len(p.wrote)
+	p.wrote = append(p.wrote, time.Now())
+	p.notifyLocked()
+	if idx >= len(p.writes) {
+		return len(b), nil // the recorded flow is over but writes still succeed
+	}
+	ev := p.writes[idx]
+	if isDNSQuery(p.network, ev.Data) && isDNSQuery(p.network, b) {
+		p.dnsIDs[[2]byte{ev.Data[0], ev.Data[1]}] = [2]byte{b[0], b[1]}
+	}
+	if ev.Failure != "" {
+		return len(ev.Data), p.newOpError(netxlite.WriteOperation,
+			newError(ev.Failure, netxlite.WriteOperation))
+	}
+	return len(b), nil
+}
+
+// newOpError wraps an error like the stdlib does, which matters because
+// some code (e.g., the DNS resolver) only retries on net.OpError timeouts.
+func (p *player) newOpError(op string, err error) error {
+	if errors.Is(err, io.EOF) {
+		return err // the stdlib does not wrap io.EOF
+	}
+	return newOpError(op, p.network, p.address, err)
+}
+
+// bindLocked binds the player to the flow to replay.
+func (p *player) bindLocked(b []byte, address string) error {
+	var (
+		flow  *Flow
+		found bool
+	)
+	if p.address != "" {
+		flow, found = p.rep.bindDialFlow(p.network, p.address, b)
+	} else {
+		flow, found = p.rep.bindListenFlow(p.network, address, b)
+	}
+	if !found {
+		return fmt.Errorf("%w: write to %s/%s", ErrNotRecorded, address, p.network)
+	}
+	p.setFlowLocked(flow)
+	return nil
+}
+
+// bindHandshake binds the player to the flow to replay for a handshake
+// with the given address (see Replayer.bindHandshakeFlow). We fail if
+// the player is already bound, i.e., the client already wrote raw bytes.
+func (p *player) bindHandshake(address string, config *tls.Config) (*Flow, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.flow != nil {
+		return nil, false
+	}
+	flow, found := p.rep.bindHandshakeFlow(p.network, address, p.address == "", config)
+	if !found {
+		return nil, false
+	}
+	p.setFlowLocked(flow)
+	return flow, true
+}
+
+// setFlowLocked sets the flow we're replaying.
+func (p *player) setFlowLocked(flow *Flow) {
+	p.flow = flow
+	for _, ev := range flow.Events {
+		switch ev.Operation {
+		case netxlite.ReadOperation:
+			p.reads = append(p.reads, ev)
+		case netxlite.WriteOperation:
+			p.writes = append(p.writes, ev)
+		}
+	}
+	p.notifyLocked()
+}
+
+// sleepLocked releases the mutex and sleeps until the earliest of the
+// given times (a zero time meaning forever) or until the state changes.
+func (p *player) sleepLocked(due, deadline time.Time) {
+	if due.IsZero() || (!deadline.IsZero() && deadline.Before(due)) {
+		due = deadline
+	}
+	wakeup := p.wakeup
+	p.mu.Unlock()
+	defer p.mu.Lock()
+	if due.IsZero() {
+		<-wakeup
+		return
+	}
+	timer := time.NewTimer(time.Until(due))
+	defer timer.Stop()
+	select {
+	case <-wakeup:
+	case <-timer.C:
+	}
+}
+
+// notifyLocked wakes up the goroutines waiting for a state change.
+func (p *player) notifyLocked() {
+	close(p.wakeup)
+	p.wakeup = make(chan struct{})
+}
+
+// close closes the player.
+func (p *player) close() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.closed {
+		return net.ErrClosed
+	}
+	p.closed = true
+	p.notifyLocked()
+	return nil
+}
+
+// setDeadlines sets the read and/or the write deadline.
+func (p *player) setDeadlines(t time.Time, read, write bool) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if read {
+		p.readDeadline = t
+	}
+	if write {
+		p.writeDeadline = t
+	}
+	p.notifyLocked()
+	return nil
+}
+
+// replayConn is the net.Conn returned by the replayer dialer.
+type replayConn struct {
+	// flow is the flow we used to decide that dialing succeeds.
+	flow *Flow
+
+	// laddr is the unique local address (see Replayer.registerPlayer).
+	laddr net.Addr
+
+	// p is the player.
+	p *player
+}
+
+// newReplayConn creates a new replayConn instance.
+func newReplayConn(rep *Replayer, network, address string,
+	flow *Flow, started time.Time) *replayConn {
+	p := newPlayer(rep, network, address, started)
+	return &replayConn{
+		flow:  flow,
+		laddr: rep.registerPlayer(network, flow.LocalAddr, p),
+		p:     p,
+	}
+}
+
+var _ net.Conn = &replayConn{}
+
+// Read implements net.Conn.Read.
+func (c *replayConn) Read(b []byte) (int, error) {
+	count, _, err := c.p.read(b, !isDatagram(c.p.network))
+	return count, err
+}
+
+// Write implements net.Conn.Write.
+func (c *replayConn) Write(b []byte) (int, error) {
+	return c.p.write(b, c.p.address)
+}
+
+// Close implements net.Conn.Close.
+func (c *replayConn) Close() error {
+	c.p.rep.unregisterPlayer(c.laddr)
+	return c.p.close()
+}
+
+// LocalAddr implements net.Conn.LocalAddr. Because we don't know the
+// flow until the first write, we use the recorded IP address with
+// a unique port (see Replayer.registerPlayer).
+func (c *replayConn) LocalAddr() net.Addr {
+	return c.laddr
+}
+
+// RemoteAddr implements net.Conn.RemoteAddr.
+func (c *replayConn) RemoteAddr() net.Addr {
+	return newAddr(c.p.network, c.flow.RemoteAddr)
+}
+
+// SetDeadline implements net.Conn.SetDeadline.
+func (c *replayConn) SetDeadline(t time.Time) error {
+	return c.p.setDeadlines(t, true, true)
+}
+
+// SetReadDeadline implements net.Conn.SetReadDeadline.
+func (c *replayConn) SetReadDeadline(t time.Time) error {
+	return c.p.setDeadlines(t, true, false)
+}
+
+// SetWriteDeadline implements net.Conn.SetWriteDeadline.
+func (c *replayConn) SetWriteDeadline(t time.Time) error {
+	return c.p.setDeadlines(t, false, true)
+}
+
+// replayUDPConn is the model.UDPLikeConn returned by ListenUDP.
+type replayUDPConn struct {
+	// laddr is the unique local address (see Replayer.registerPlayer).
+	laddr net.Addr
+
+	// p is the player.
+	p *player
+}
+
+// newReplayUDPConn creates a new replayUDPConn instance.
+func newReplayUDPConn(rep *Replayer, network string) *replayUDPConn {
+	p := newPlayer(rep, network, "", time.Now())
+	return &replayUDPConn{
+		laddr: rep.registerPlayer(network, "", p),
+		p:     p,
+	}
+}
+
+var _ model.UDPLikeConn = &replayUDPConn{}
+
+// ReadFrom implements model.UDPLikeConn.ReadFrom.
+func (c *replayUDPConn) ReadFrom(p []byte) (int, net.Addr, error) {
+	count, address, err := c.p.read(p, false)
+	if err != nil {
+		return 0, nil, err
+	}
+	return count, newAddr(c.p.network, address), nil
+}
+
+// WriteTo implements model.UDPLikeConn.WriteTo.
+func (c *replayUDPConn) WriteTo(p []byte, addr net.Addr) (int, error) {
+	return c.p.write(p, addr.String())
+}
+
+// Close implements model.UDPLikeConn.Close.
+func (c *replayUDPConn) Close() error {
+	c.p.rep.unregisterPlayer(c.laddr)
+	return c.p.close()
+}
+
+// LocalAddr implements model.UDPLikeConn.LocalAddr. Because we don't
+// know the flow until the first write, we use the unspecified address
+// with a unique port (see Replayer.registerPlayer).
+func (c *replayUDPConn) LocalAddr() net.Addr {
+	return c.laddr
+}
+
+// SetDeadline implements model.UDPLikeConn.SetDeadline.
+func (c *replayUDPConn) SetDeadline(t time.Time) error {
+	return c.p.setDeadlines(t, true, true)
+}
+
+// SetReadDeadline implements model.UDPLikeConn.SetReadDeadline.
+func (c *replayUDPConn) SetReadDeadline(t time.Time) error {
+	return c.p.setDeadlines(t, true, false)
+}
+
+// SetWriteDeadline implements model.UDPLikeConn.SetWriteDeadline.
+func (c *replayUDPConn) SetWriteDeadline(t time.Time) error {
+	return c.p.setDeadlines(t, false, true)
+}
+
+// SetReadBuffer implements model.UDPLikeConn.SetReadBuffer.
+func (c *replayUDPConn) SetReadBuffer(bytes int) error {
+	return nil
+}
+
+// errNoSyscallConn indicates that we cannot return a syscall.RawConn.
+var errNoSyscallConn = errors.New("netrecord: SyscallConn not supported")
+
+// SyscallConn implements model.UDPLikeConn.SyscallConn.
+func (c *replayUDPConn) SyscallConn() (syscall.RawConn, error) {
+	return nil, errNoSyscallConn
+}
+
+// isDatagram returns whether the network uses datagrams.
+func isDatagram(network string) bool {
+	switch network {
+	case "udp", "udp4", "udp6":
+		return true
+	default:
+		return false
+	}
+}
+
+// newAddr returns the net.Addr for the given network and address.
+func newAddr(network, address string) net.Addr {
+	addr, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return &replayAddr{network: network, address: address}
+	}
+	ip := net.ParseIP(addr)
+	portnum, err := strconv.Atoi(port)
+	if ip == nil || err != nil {
+		return &replayAddr{network: network, address: address}
+	}
+	if isDatagram(network) {
+		return &net.UDPAddr{IP: ip, Port: portnum}
+	}
+	return &net.TCPAddr{IP: ip, Port: portnum}
+}
+
+// newOpError returns a new *net.OpError.
+func newOpError(op, network, address string, err error) *net.OpError {
+	operr := &net.OpError{
+		Op:     op,
+		Net:    network,
+		Source: nil,
+		Addr:   nil,
+		Err:    err,
+	}
+	if address != "" {
+		operr.Addr = newAddr(network, address)
+	}
+	return operr
+}
+
+// replayAddr is a net.Addr we cannot represent as an UDP or TCP address.
+type replayAddr struct {
+	// address is the address.
+	address string
+
+	// network is the network.
+	network string
+}
+
+// Network implements net.Addr.Network.
+func (a *replayAddr) Network() string {
+	return a.network
+}
+
+// String implements net.Addr.String.
+func (a *replayAddr) String() string {
+	return a.address
+}
@@ -0,0 +1,421 @@
+package netrecord
+
+//
+// Replay crypto
+//
+// Implementation of model.UnderlyingCryptoLibrary that replays.
+//
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/bassosimone/websteps-illustrated/internal/model"
+	"github.com/bassosimone/websteps-illustrated/internal/netxlite"
+	"github.com/lucas-clemente/quic-go"
+)
+
+var _ model.UnderlyingCryptoLibrary = &Replayer{}
+
+// TLSHandshake implements model.UnderlyingCryptoLibrary.TLSHandshake. We
+// replay the recorded handshake result without performing any handshake
+// and we return a conn replaying the recorded plaintext. When we cannot
+// find a recorded handshake, we perform the handshake, which only works
+// for sessions recorded without crypto hooks (see bindFlow).
+func (r *Replayer) TLSHandshake(ctx context.Context, conn net.Conn,
+	config *tls.Config, handshake model.TLSHandshakeFunc) (model.TLSConn, error) {
+	p, found := r.findPlayer(conn.LocalAddr())
+	if !found {
+		return handshake(ctx, conn, config)
+	}
+	flow, found := p.bindHandshake(p.address, config)
+	if !found {
+		return handshake(ctx, conn, config)
+	}
+	state, err := replayHandshake(ctx, flow.Handshake, config, netxlite.TLSHandshakeOperation)
+	if err != nil {
+		return nil, err
+	}
+	return &replayTLSConn{Conn: conn, state: state}, nil
+}
+
+// QUICDial implements model.UnderlyingCryptoLibrary.QUICDial. We replay
+// the recorded handshake result and we return a session replaying the
+// recorded streams. When we cannot find a recorded handshake, we dial,
+// which only works for sessions recorded without crypto hooks.
+func (r *Replayer) QUICDial(ctx context.Context, pconn model.UDPLikeConn,
+	remoteAddr *net.UDPAddr, address string, tlsConfig *tls.Config,
+	quicConfig *quic.Config, dial model.QUICDialFunc) (quic.EarlySession, error) {
+	p, found := r.findPlayer(pconn.LocalAddr())
+	if !found {
+		return dial(ctx, pconn, remoteAddr, address, tlsConfig, quicConfig)
+	}
+	flow, found := p.bindHandshake(address, tlsConfig)
+	if !found {
+		return dial(ctx, pconn, remoteAddr, address, tlsConfig, quicConfig)
+	}
+	state, err := replayHandshake(ctx, flow.Handshake, tlsConfig, netxlite.QUICHandshakeOperation)
+	if err != nil {
+		return nil, err
+	}
+	return newReplayQUICSession(r, pconn.LocalAddr(), remoteAddr, address,
+		flow, p.started, state), nil
+}
+
+// replayHandshake waits for the recorded handshake to complete and then
+// returns either the recorded failure or the recorded connection state.
+func replayHandshake(ctx context.Context, hs *Handshake,
+	config *tls.Config, operation string) (tls.ConnectionState, error) {
+	if err := sleepContext(ctx, hs.Elapsed); err != nil {
+		return tls.ConnectionState{}, err
+	}
+	if hs.Failure != "" {
+		return tls.ConnectionState{}, newError(hs.Failure, operation)
+	}
+	var certs []*x509.Certificate
+	for _, data := range hs.PeerCertificates {
+		cert, err := x509.ParseCertificate(data)
+		if err != nil {
+			return tls.ConnectionState{}, err
+		}
+		certs = append(certs, cert)
+	}
+	return tls.ConnectionState{
+		Version:                    hs.Version,
+		HandshakeComplete:          true,
+		CipherSuite:                hs.CipherSuite,
+		NegotiatedProtocol:         hs.NegotiatedProtocol,
+		NegotiatedProtocolIsMutual: true,
+		ServerName:                 config.ServerName,
+		PeerCertificates:           certs,
+	}, nil
+}
+
+// replayTLSConn is the model.TLSConn returned by Replayer.TLSHandshake. The
+// underlying conn replays the plaintext because we bound its player to
+// the flow containing the handshake.
+type replayTLSConn struct {
+	// Conn is the underlying conn.
+	net.Conn
+
+	// state is the recorded connection state.
+	state tls.ConnectionState
+}
+
+// ConnectionState implements model.TLSConn.ConnectionState.
+func (c *replayTLSConn) ConnectionState() tls.ConnectionState {
+	return c.state
+}
+
+// HandshakeContext implements model.TLSConn.HandshakeContext.
+func (c *replayTLSConn) HandshakeContext(ctx context.Context) error {
+	return nil // we already replayed the handshake
+}
+
+// errDatagramsNotSupported indicates that we cannot replay QUIC datagrams.
+var errDatagramsNotSupported = errors.New("netrecord: QUIC datagrams not supported")
+
+// replayQUICSession is the quic.EarlySession returned by Replayer.QUICDial.
+type replayQUICSession struct {
+	// address is the address we dialed.
+	address string
+
+	// cancel closes the session.
+	cancel context.CancelFunc
+
+	// ctx is done when the session is closed.
+	ctx context.Context
+
+	// laddr is the local address.
+	laddr net.Addr
+
+	// mu provides mutual exclusion.
+	mu sync.Mutex
+
+	// players contains the players of the streams we created.
+	players []*player
+
+	// raddr is the remote address.
+	raddr net.Addr
+
+	// rep is the replayer.
+	rep *Replayer
+
+	// started is when the client started listening.
+	started time.Time
+
+	// state is the recorded connection state.
+	state tls.ConnectionState
+
+	// streams contains the streams we have not replayed yet.
+	streams []*Stream
+}
+
+// newReplayQUICSession creates a new replayQUICSession instance.
+func newReplayQUICSession(rep *Replayer, laddr, raddr net.Addr, address string,
+	flow *Flow, started time.Time, state tls.ConnectionState) *replayQUICSession {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &replayQUICSession{
+		address: address,
+		cancel:  cancel,
+		ctx:     ctx,
+		laddr:   laddr,
+		mu:      sync.Mutex{},
+		players: []*player{},
+		raddr:   raddr,
+		rep:     rep,
+		started: started,
+		state:   state,
+		streams: append([]*Stream{}, flow.Streams...),
+	}
+}
+
+var _ quic.EarlySession = &replayQUICSession{}
+
+// AcceptStream implements quic.Session.AcceptStream.
+func (s *replayQUICSession) AcceptStream(ctx context.Context) (quic.Stream, error) {
+	return s.acceptStream(ctx, StreamAccept)
+}
+
+// AcceptUniStream implements quic.Session.AcceptUniStream.
+func (s *replayQUICSession) AcceptUniStream(ctx context.Context) (quic.ReceiveStream, error) {
+	return s.acceptStream(ctx, StreamAcceptUni)
+}
+
+// acceptStream waits until the next recorded stream of the given type was
+// accepted. When there are no more such streams, we block until the context
+// is done or the session is closed, like we would do with a real session.
+func (s *replayQUICSession) acceptStream(ctx context.Context, kind string) (quic.Stream, error) {
+	record, found := s.popStream(kind)
+	if !found {
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-s.ctx.Done():
+			return nil, net.ErrClosed
+		}
+	}
+	timer := time.NewTimer(time.Until(s.started.Add(record.T)))
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-s.ctx.Done():
+		return nil, net.ErrClosed
+	case <-timer.C:
+		return s.newStream(record), nil
+	}
+}
+
+// OpenStream implements quic.Session.OpenStream.
+func (s *replayQUICSession) OpenStream() (quic.Stream, error) {
+	return s.openStream(StreamOpen)
+}
+
+// OpenStreamSync implements quic.Session.OpenStreamSync.
+func (s *replayQUICSession) OpenStreamSync(ctx context.Context) (quic.Stream, error) {
+	return s.openStream(StreamOpen)
+}
+
+// OpenUniStream implements quic.Session.OpenUniStream.
+func (s *replayQUICSession) OpenUniStream() (quic.SendStream, error) {
+	return s.openStream(StreamOpenUni)
+}
+
+// OpenUniStreamSync implements quic.Session.OpenUniStreamSync.
+func (s *replayQUICSession) OpenUniStreamSync(ctx context.Context) (quic.SendStream, error) {
+	return s.openStream(StreamOpenUni)
+}
+
+// openStream opens the next recorded stream of the given type.
+func (s *replayQUICSession) openStream(kind string) (quic.Stream, error) {
+	record, found := s.popStream(kind)
+	if !found {
+		return nil, fmt.Errorf("%w: %s stream with %s/udp", ErrNotRecorded, kind, s.address)
+	}
+	if record.Failure != "" {
+		return nil, newError(record.Failure, netxlite.TopLevelOperation)
+	}
+	return s.newStream(record), nil
+}
+
+// popStream removes and returns the oldest stream of the given type.
+func (s *replayQUICSession) popStream(kind string) (*Stream, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for idx, record := range s.streams {
+		if record.Type == kind {
+			s.streams = append(s.streams[:idx], s.streams[idx+1:]...)
+			return record, true
+		}
+	}
+	return nil, false
+}
+
+// newStream creates a stream replaying the given recorded stream.
+func (s *replayQUICSession) newStream(record *Stream) *replayQUICStream {
+	p := newPlayer(s.rep, "quic", s.address, s.started)
+	p.mu.Lock()
+	p.setFlowLocked(&Flow{
+		Type:       FlowListen,
+		Network:    "quic",
+		Address:    s.address,
+		LocalAddr:  s.laddr.String(),
+		RemoteAddr: s.raddr.String(),
+		Started:    s.started,
+		Elapsed:    0,
+		Failure:    "",
+		Events:     record.Events,
+		Handshake:  nil,
+		Streams:    []*Stream{},
+	})
+	p.mu.Unlock()
+	s.mu.Lock()
+	s.players = append(s.players, p)
+	s.mu.Unlock()
+	ctx, cancel := context.WithCancel(s.ctx)
+	return &replayQUICStream{
+		cancel: cancel,
+		ctx:    ctx,
+		id:     quic.StreamID(record.ID),
+		p:      p,
+	}
+}
+
+// LocalAddr implements quic.Session.LocalAddr.
+func (s *replayQUICSession) LocalAddr() net.Addr {
+	return s.laddr
+}
+
+// RemoteAddr implements quic.Session.RemoteAddr.
+func (s *replayQUICSession) RemoteAddr() net.Addr {
+	return s.raddr
+}
+
+// CloseWithError implements quic.Session.CloseWithError. We close
+// all the streams, which unblocks the goroutines reading from them.
+func (s *replayQUICSession) CloseWithError(code quic.ApplicationErrorCode, reason string) error {
+	s.cancel()
+	s.mu.Lock()
+	players := s.players
+	s.players = []*player{}
+	s.mu.Unlock()
+	for _, p := range players {
+		p.close()
+	}
+	return nil
+}
+
+// Context implements quic.Session.Context.
+func (s *replayQUICSession) Context() context.Context {
+	return s.ctx
+}
+
+// ConnectionState implements quic.Session.ConnectionState.
+func (s *replayQUICSession) ConnectionState() quic.ConnectionState {
+	var state quic.ConnectionState
+	state.TLS.ConnectionState = s.state
+	return state
+}
+
+// SendMessage implements quic.Session.SendMessage.
+func (s *replayQUICSession) SendMessage(b []byte) error {
+	return errDatagramsNotSupported
+}
+
+// ReceiveMessage implements quic.Session.ReceiveMessage.
+func (s *replayQUICSession) ReceiveMessage() ([]byte, error) {
+	return nil, errDatagramsNotSupported
+}
+
+// HandshakeComplete implements quic.EarlySession.HandshakeComplete. We
+// return a done context because we already replayed the handshake.
+func (s *replayQUICSession) HandshakeComplete() context.Context {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	return ctx
+}
+
+// NextSession implements quic.EarlySession.NextSession.
+func (s *replayQUICSession) NextSession() quic.Session {
+	return s
+}
+
+// replayQUICStream is the quic.Stream returned by replayQUICSession. We
+// use the same type for unidirectional streams because quic.Stream
+// implements both quic.ReceiveStream and quic.SendStream.
+type replayQUICStream struct {
+	// cancel closes the write side of the stream.
+	cancel context.CancelFunc
+
+	// ctx is done when the write side of the stream is closed.
+	ctx context.Context
+
+	// id is the stream ID.
+	id quic.StreamID
+
+	// p is the player.
+	p *player
+}
+
+var _ quic.Stream = &replayQUICStream{}
+
+// StreamID implements quic.Stream.StreamID.
+func (s *replayQUICStream) StreamID() quic.StreamID {
+	return s.id
+}
+
+// Read implements quic.Stream.Read.
+func (s *replayQUICStream) Read(b []byte) (int, error) {
+	count, _, err := s.p.read(b, true)
+	return count, err
+}
+
+// CancelRead implements quic.Stream.CancelRead. We do nothing because
+// the client does not read anymore after canceling.
+func (s *replayQUICStream) CancelRead(code quic.StreamErrorCode) {
+	// nothing
+}
+
+// SetReadDeadline implements quic.Stream.SetReadDeadline.
+func (s *replayQUICStream) SetReadDeadline(t time.Time) error {
+	return s.p.setDeadlines(t, true, false)
+}
+
+// Write implements quic.Stream.Write.
+func (s *replayQUICStream) Write(b []byte) (int, error) {
+	return s.p.write(b, s.p.address)
+}
+
+// Close implements quic.Stream.Close. We only close the write side of
+// the stream, so the client can still read the response.
+func (s *replayQUICStream) Close() error {
+	s.cancel()
+	return nil
+}
+
+// CancelWrite implements quic.Stream.CancelWrite.
+func (s *replayQUICStream) CancelWrite(code quic.StreamErrorCode) {
+	s.cancel()
+}
+
+// Context implements quic.Stream.Context.
+func (s *replayQUICStream) Context() context.Context {
+	return s.ctx
+}
+
+// SetWriteDeadline implements quic.Stream.SetWriteDeadline.
+func (s *replayQUICStream) SetWriteDeadline(t time.Time) error {
+	return s.p.setDeadlines(t, false, true)
+}
+
+// SetDeadline implements quic.Stream.SetDeadline.
+func (s *replayQUICStream) SetDeadline(t time.Time) error {
+	return s.p.setDeadlines(t, true, true)
+}
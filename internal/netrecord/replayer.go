@@ -0,0 +1,330 @@
+package netrecord
+
+//
+// Replayer
+//
+// Implementation of model.UnderlyingNetworkLibrary that replays.
+//
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/bassosimone/websteps-illustrated/internal/logcat"
+	"github.com/bassosimone/websteps-illustrated/internal/model"
+	"github.com/bassosimone/websteps-illustrated/internal/netxlite"
+	"github.com/miekg/dns"
+)
+
+// Replayer replays a recorded session. You MUST use NewReplayer
+// to create a new instance.
+type Replayer struct {
+	// flows contains the flows we have not replayed yet.
+	flows []*Flow
+
+	// lastPort is the port of the last local address we created.
+	lastPort int
+
+	// lookups contains the lookups we have not replayed yet.
+	lookups []*Lookup
+
+	// mu provides mutual exclusion.
+	mu sync.Mutex
+
+	// players maps the local address of each open conn to its player.
+	players map[string]*player
+}
+
+// NewReplayer creates a new Replayer for the given session.
+func NewReplayer(session *Session) *Replayer {
+	return &Replayer{
+		flows:    append([]*Flow{}, session.Flows...),
+		lastPort: 0,
+		lookups:  append([]*Lookup{}, session.Lookups...),
+		mu:       sync.Mutex{},
+		players:  map[string]*player{},
+	}
+}
+
+var _ model.UnderlyingNetworkLibrary = &Replayer{}
+
+// ListenUDP implements model.UnderlyingNetworkLibrary.ListenUDP. We bind
+// the returned conn to a recorded flow when the client sends the first
+// datagram, because we need to know its destination.
+func (r *Replayer) ListenUDP(network string, laddr *net.UDPAddr) (model.UDPLikeConn, error) {
+	return newReplayUDPConn(r, network), nil
+}
+
+// LookupHost implements model.UnderlyingNetworkLibrary.LookupHost.
+func (r *Replayer) LookupHost(ctx context.Context, domain string) ([]string, error) {
+	lookup, found := r.popLookup(domain)
+	if !found {
+		return nil, fmt.Errorf("%w: getaddrinfo %s", ErrNotRecorded, domain)
+	}
+	if err := sleepContext(ctx, lookup.Elapsed); err != nil {
+		return nil, err
+	}
+	if lookup.Failure != "" {
+		return nil, newError(lookup.Failure, netxlite.ResolveOperation)
+	}
+	return lookup.Addresses, nil
+}
+
+// popLookup removes and returns the oldest lookup for the given domain.
+func (r *Replayer) popLookup(domain string) (*Lookup, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for idx, lookup := range r.lookups {
+		if lookup.Domain == domain {
+			r.lookups = append(r.lookups[:idx], r.lookups[idx+1:]...)
+			return lookup, true
+		}
+	}
+	return nil, false
+}
+
+// NewSimpleDialer implements model.UnderlyingNetworkLibrary.NewSimpleDialer.
+func (r *Replayer) NewSimpleDialer(timeout time.Duration) model.SimpleDialer {
+	return &replayerDialer{r}
+}
+
+// replayerDialer is the model.SimpleDialer returned by NewSimpleDialer.
+type replayerDialer struct {
+	// rep is the replayer.
+	rep *Replayer
+}
+
+// DialContext implements model.SimpleDialer.DialContext. If the oldest
+// matching flow failed to dial, we replay its failure. Otherwise, we
+// return a conn that we bind to a recorded flow when the client first
+// sends some bytes (see Replayer.bindDialFlow).
+func (d *replayerDialer) DialContext(
+	ctx context.Context, network, address string) (net.Conn, error) {
+	started := time.Now()
+	flow, found := d.rep.peekDialFlow(network, address)
+	if !found {
+		return nil, fmt.Errorf("%w: dial %s/%s", ErrNotRecorded, address, network)
+	}
+	if err := sleepContext(ctx, flow.Elapsed); err != nil {
+		return nil, err
+	}
+	if !flow.succeeded() {
+		return nil, newOpError("dial", network, address,
+			newError(flow.Failure, netxlite.ConnectOperation))
+	}
+	return newReplayConn(d.rep, network, address, flow, started), nil
+}
+
+// peekDialFlow returns the oldest flow dialing the given address. If
+// such a flow failed to dial, we also remove it from the flows to replay.
+func (r *Replayer) peekDialFlow(network, address string) (*Flow, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for idx, flow := range r.flows {
+		if flow.Type == FlowDial && flow.Network == network && flow.Address == address {
+			if !flow.succeeded() {
+				r.flows = append(r.flows[:idx], r.flows[idx+1:]...)
+			}
+			return flow, true
+		}
+	}
+	return nil, false
+}
+
+// bindDialFlow removes and returns the flow to replay for a conn dialing
+// the given address whose first write is data. We prefer the oldest flow
+// where the client wrote the same data and otherwise use the oldest flow,
+// unless data is a TLS or QUIC handshake. Replaying the server's response
+// to another handshake would only cause fake failures, so in such a case
+// we do not bind any flow and the caller fails with ErrNotRecorded.
+func (r *Replayer) bindDialFlow(network, address string, data []byte) (*Flow, bool) {
+	return r.bindFlow(network, address, data, func(flow *Flow) bool {
+		return flow.Type == FlowDial && flow.succeeded() &&
+			flow.Network == network && flow.Address == address
+	})
+}
+
+// bindListenFlow is like bindDialFlow for a conn created using ListenUDP
+// whose first write is data sent to the given address.
+func (r *Replayer) bindListenFlow(network, address string, data []byte) (*Flow, bool) {
+	return r.bindFlow(network, address, data, func(flow *Flow) bool {
+		if flow.Type != FlowListen || flow.Network != network {
+			return false
+		}
+		ev, found := firstWrite(flow)
+		return found && ev.Address == address
+	})
+}
+
+// bindHandshakeFlow removes and returns the oldest flow containing a
+// successful handshake with the given address and TLS config. With
+// listen set, we're dialing a QUIC session, otherwise a TLS conn.
+func (r *Replayer) bindHandshakeFlow(network, address string,
+	listen bool, config *tls.Config) (*Flow, bool) {
+	kind := FlowDial
+	if listen {
+		kind = FlowListen
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for idx, flow := range r.flows {
+		hs := flow.Handshake
+		if flow.Type != kind || !flow.succeeded() || flow.Network != network ||
+			flow.Address != address || hs == nil || hs.ServerName != config.ServerName ||
+			!sameStrings(hs.NextProtos, config.NextProtos) {
+			continue
+		}
+		r.flows = append(r.flows[:idx], r.flows[idx+1:]...)
+		return flow, true
+	}
+	return nil, false
+}
+
+// sameStrings returns whether a and b contain the same strings.
+func sameStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for idx := range a {
+		if a[idx] != b[idx] {
+			return false
+		}
+	}
+	return true
+}
+
+// bindFlow implements bindDialFlow and bindListenFlow using the
+// given function to select the candidate flows.
+func (r *Replayer) bindFlow(network, address string,
+	data []byte, match func(flow *Flow) bool) (*Flow, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	found := -1
+	for idx, flow := range r.flows {
+		if flow.Handshake != nil || !match(flow) {
+			continue // we cannot replay the raw bytes of a recorded handshake
+		}
+		if found < 0 {
+			found = idx
+		}
+		if ev, good := firstWrite(flow); good && sameData(network, ev.Data, data) {
+			found = idx
+			break
+		}
+	}
+	if found < 0 {
+		return nil, false
+	}
+	flow := r.flows[found]
+	if ev, good := firstWrite(flow); good && !sameData(network, ev.Data, data) {
+		if isEncryptedHandshake(network, data) {
+			logcat.Emitf(logcat.DEBUG, logcat.UNEXPECTED,
+				"netrecord: cannot replay %s/%s because the client sent a different handshake",
+				address, network)
+			return nil, false
+		}
+		logcat.Emitf(logcat.DEBUG, logcat.UNEXPECTED,
+			"netrecord: replaying %s/%s although the client sent different bytes",
+			address, network)
+	}
+	r.flows = append(r.flows[:found], r.flows[found+1:]...)
+	return flow, true
+}
+
+// registerPlayer creates a unique local address for a new conn and
+// registers its player, so we can find it when the conn is used for a
+// handshake. We use the IP address of the given recorded local address,
+// if any, and otherwise the unspecified address.
+func (r *Replayer) registerPlayer(network, template string, p *player) net.Addr {
+	ip := net.IPv4zero
+	if addr, _, err := net.SplitHostPort(template); err == nil && net.ParseIP(addr) != nil {
+		ip = net.ParseIP(addr)
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.lastPort = r.lastPort%65535 + 1
+	laddr := newAddr(network, net.JoinHostPort(ip.String(), strconv.Itoa(r.lastPort)))
+	r.players[connKey(laddr)] = p
+	return laddr
+}
+
+// unregisterPlayer undoes registerPlayer when the conn is closed.
+func (r *Replayer) unregisterPlayer(laddr net.Addr) {
+	r.mu.Lock()
+	delete(r.players, connKey(laddr))
+	r.mu.Unlock()
+}
+
+// findPlayer returns the player of the open conn using the given local address.
+func (r *Replayer) findPlayer(laddr net.Addr) (*player, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	p, found := r.players[connKey(laddr)]
+	return p, found
+}
+
+// firstWrite returns the first write event of the given flow.
+func firstWrite(flow *Flow) (*Event, bool) {
+	for _, ev := range flow.Events {
+		if ev.Operation == netxlite.WriteOperation {
+			return ev, true
+		}
+	}
+	return nil, false
+}
+
+// sameData returns whether the client sent the same data. For DNS
+// queries over UDP, we ignore the query ID, which is random.
+func sameData(network string, recorded, data []byte) bool {
+	if isDNSQuery(network, recorded) && isDNSQuery(network, data) {
+		return bytes.Equal(recorded[2:], data[2:])
+	}
+	return bytes.Equal(recorded, data)
+}
+
+// isDNSQuery returns whether data is a DNS query sent over UDP. We
+// parse the data rather than checking the port because the user may
+// configure resolvers using any port.
+func isDNSQuery(network string, data []byte) bool {
+	if !isDatagram(network) {
+		return false
+	}
+	query := &dns.Msg{}
+	if err := query.Unpack(data); err != nil {
+		return false
+	}
+	return !query.Response && len(query.Question) == 1
+}
+
+// isEncryptedHandshake returns whether data is the first message of
+// a TLS handshake (over TCP) or a QUIC long header packet (over UDP).
+func isEncryptedHandshake(network string, data []byte) bool {
+	if !isDatagram(network) {
+		// TLS handshake record: content type 22, version 3.x
+		return len(data) >= 5 && data[0] == 0x16 && data[1] == 0x03
+	}
+	if isDNSQuery(network, data) {
+		return false
+	}
+	// QUIC long header: form bit and fixed bit set, nonzero version
+	return len(data) >= 5 && data[0]&0xc0 == 0xc0 &&
+		(data[1] != 0 || data[2] != 0 || data[3] != 0 || data[4] != 0)
+}
+
+// sleepContext sleeps for the given duration unless the context is done.
+func sleepContext(ctx context.Context, delay time.Duration) error {
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
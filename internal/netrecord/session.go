@@ -0,0 +1,240 @@
+// Package netrecord records and replays network sessions.
+//
+// The Recorder implements model.UnderlyingNetworkLibrary by wrapping
+// another library (e.g., netxlite.TProxy). It records the result of each
+// getaddrinfo lookup and the bytes, timing, and errors of each TCP, UDP,
+// and QUIC flow. You can save what you recorded into a JSON file.
+//
+// The Replayer also implements model.UnderlyingNetworkLibrary but does
+// not touch the network. It serves back a recorded session, so you can
+// run modified measurement code (e.g., using another plan) against the
+// network conditions that you observed when recording.
+//
+// We match each new flow with the recorded flows using the same network
+// and address (for dialed flows) or the same destination of the first
+// datagram (for UDP sockets). When more flows match, we prefer the one
+// where the client sent the same first bytes and otherwise we use the
+// oldest one. Each recorded flow is only replayed once. For DNS over UDP,
+// we ignore the query ID, which is random, and we fix it in the replies.
+//
+// We replay the bytes sent by the server in the same chunks as they were
+// received and we delay them to respect the recorded timing with respect
+// to the bytes sent by the client. We replay I/O errors (e.g., connection
+// reset, EOF) and we block until the deadline when we did not record any
+// further bytes, which is how we replay timeouts.
+//
+// Because the client picks random keys, we cannot replay the encrypted
+// bytes of TLS and QUIC handshakes. For this reason, the Recorder also
+// implements model.UnderlyingCryptoLibrary, which netxlite uses to let
+// us control the handshakes. For each handshake, we record its result
+// (i.e., the failure or the connection state) and then the plaintext
+// rather than the encrypted bytes. For QUIC, we record the plaintext
+// of each stream. The Replayer serves back the recorded handshake result
+// without performing any handshake and then replays the plaintext. We
+// match handshakes using the SNI and the ALPN. When we cannot find a
+// recorded handshake (e.g., because the session was recorded without
+// using netxlite), we fall back to replaying the encrypted bytes. In
+// such a case, when the client's first bytes differ from the recorded
+// ones and they are a TLS ClientHello or a QUIC Initial, we do not
+// replay the flow, which would only produce fake failures, and we fail
+// with ErrNotRecorded instead.
+//
+// We only replay the operations performed using netxlite.TProxy,
+// which means, for example, that we don't replay the test helper.
+package netrecord
+
+//
+// Session
+//
+// Data structures describing a recorded session.
+//
+
+import (
+	"encoding/json"
+	"os"
+	"time"
+)
+
+// These are the types of flows.
+const (
+	// FlowDial is a flow created using a dialer.
+	FlowDial = "dial"
+
+	// FlowListen is a flow created using ListenUDP.
+	FlowListen = "listen"
+)
+
+// Session is a recorded network session.
+type Session struct {
+	// Lookups contains the getaddrinfo lookups.
+	Lookups []*Lookup `json:"lookups"`
+
+	// Flows contains the TCP, UDP, and QUIC flows.
+	Flows []*Flow `json:"flows"`
+}
+
+// Lookup is a recorded getaddrinfo lookup.
+type Lookup struct {
+	// Domain is the domain we resolved.
+	Domain string `json:"domain"`
+
+	// Started is when we started the lookup.
+	Started time.Time `json:"started"`
+
+	// Elapsed is the time it took to complete the lookup.
+	Elapsed time.Duration `json:"elapsed"`
+
+	// Addresses contains the resolved addresses.
+	Addresses []string `json:"addresses,omitempty"`
+
+	// Failure is the OPTIONAL failure.
+	Failure string `json:"failure,omitempty"`
+}
+
+// Flow is a recorded flow.
+type Flow struct {
+	// Type is either FlowDial or FlowListen.
+	Type string `json:"type"`
+
+	// Network is the network (e.g., "tcp", "udp").
+	Network string `json:"network"`
+
+	// Address is the address we dialed (for FlowDial and for
+	// FlowListen when we used the flow to dial a QUIC session).
+	Address string `json:"address,omitempty"`
+
+	// LocalAddr is the OPTIONAL local address.
+	LocalAddr string `json:"local_addr,omitempty"`
+
+	// RemoteAddr is the OPTIONAL remote address (only for FlowDial).
+	RemoteAddr string `json:"remote_addr,omitempty"`
+
+	// Started is when we started dialing or listening.
+	Started time.Time `json:"started"`
+
+	// Elapsed is the time it took to dial.
+	Elapsed time.Duration `json:"elapsed"`
+
+	// Failure is the OPTIONAL dial failure.
+	Failure string `json:"failure,omitempty"`
+
+	// Events contains the I/O events. If the flow has a Handshake, these
+	// are the plaintext events following a TLS handshake.
+	Events []*Event `json:"events,omitempty"`
+
+	// Handshake is the OPTIONAL TLS or QUIC handshake.
+	Handshake *Handshake `json:"handshake,omitempty"`
+
+	// Streams contains the QUIC streams (only for QUIC).
+	Streams []*Stream `json:"streams,omitempty"`
+}
+
+// Handshake is a recorded TLS or QUIC handshake.
+type Handshake struct {
+	// ServerName is the SNI we used.
+	ServerName string `json:"server_name"`
+
+	// NextProtos contains the ALPNs we offered.
+	NextProtos []string `json:"next_protos,omitempty"`
+
+	// T is the time when the handshake started relative to Flow.Started.
+	T time.Duration `json:"t"`
+
+	// Elapsed is the time it took to complete the handshake.
+	Elapsed time.Duration `json:"elapsed"`
+
+	// Failure is the OPTIONAL handshake failure.
+	Failure string `json:"failure,omitempty"`
+
+	// Version is the negotiated TLS version.
+	Version uint16 `json:"version,omitempty"`
+
+	// CipherSuite is the negotiated cipher suite.
+	CipherSuite uint16 `json:"cipher_suite,omitempty"`
+
+	// NegotiatedProtocol is the negotiated ALPN.
+	NegotiatedProtocol string `json:"negotiated_protocol,omitempty"`
+
+	// PeerCertificates contains the DER certificates sent by the server.
+	PeerCertificates [][]byte `json:"peer_certificates,omitempty"`
+}
+
+// These are the types of QUIC streams.
+const (
+	// StreamOpen is a bidirectional stream opened by the client.
+	StreamOpen = "open"
+
+	// StreamOpenUni is a unidirectional stream opened by the client.
+	StreamOpenUni = "open_uni"
+
+	// StreamAccept is a bidirectional stream opened by the server.
+	StreamAccept = "accept"
+
+	// StreamAcceptUni is a unidirectional stream opened by the server.
+	StreamAcceptUni = "accept_uni"
+)
+
+// Stream is a recorded QUIC stream.
+type Stream struct {
+	// Type is one of StreamOpen, StreamOpenUni, StreamAccept,
+	// and StreamAcceptUni.
+	Type string `json:"type"`
+
+	// ID is the stream ID.
+	ID int64 `json:"id"`
+
+	// T is the time when we opened or accepted the stream relative
+	// to Flow.Started.
+	T time.Duration `json:"t"`
+
+	// Failure is the OPTIONAL failure to open the stream.
+	Failure string `json:"failure,omitempty"`
+
+	// Events contains the plaintext I/O events.
+	Events []*Event `json:"events,omitempty"`
+}
+
+// Event is an I/O event of a Flow.
+type Event struct {
+	// Operation is either netxlite.ReadOperation or netxlite.WriteOperation.
+	Operation string `json:"operation"`
+
+	// T is the time when the operation completed relative to Flow.Started.
+	T time.Duration `json:"t"`
+
+	// Address is the remote address (only for FlowListen).
+	Address string `json:"address,omitempty"`
+
+	// Data contains the bytes we read or wrote.
+	Data []byte `json:"data,omitempty"`
+
+	// Failure is the OPTIONAL failure.
+	Failure string `json:"failure,omitempty"`
+}
+
+// succeeded returns whether we successfully dialed this flow.
+func (f *Flow) succeeded() bool {
+	return f.Failure == ""
+}
+
+// LoadSession loads a Session from the given JSON file.
+func LoadSession(filename string) (*Session, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	var session Session
+	if err := json.Unmarshal(data, &session); err != nil {
+		return nil, err
+	}
+	return &session, nil
+}
+
+// WriteFile writes the session into the given JSON file.
+func (s *Session) WriteFile(filename string) error {
+	data, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filename, data, 0600)
+}
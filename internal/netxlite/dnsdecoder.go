@@ -108,6 +108,10 @@ func (d *DNSDecoderMiekg) DecodeReplyLookupHTTPS(reply *dns.Msg) (*model.HTTPSSv
 					for _, ip := range extv.Hint {
 						out.IPv6 = append(out.IPv6, ip.String())
 					}
+				case *dns.SVCBPort:
+					out.Port = extv.Port
+				case *dns.SVCBECHConfig:
+					out.ECHConfigList = extv.ECH
 				}
 			}
 		}
@@ -0,0 +1,329 @@
+package netxlite
+
+//
+// Encrypted ClientHello (ECH)
+//
+// We cannot implement ECH with the TLS libraries we use because they
+// lack support for HPKE and for ECH. What we can do is to parrot the
+// ClientHello that a client supporting ECH would send, i.e., a Chrome
+// ClientHello that includes an ECH extension whose outer SNI is the
+// public name of the ECH configuration advertised by the server.
+//
+// The ECH extension uses a config ID and a cipher suite taken from the
+// server's configuration but contains random enc and payload fields. So,
+// the inner ClientHello is NOT encrypted and the server will reject the
+// ECH extension and continue the handshake using the outer ClientHello,
+// just as it would with a GREASE ECH extension. This is still enough
+// to detect censors that interfere with the handshake because of the
+// presence of the ECH extension or of the public name.
+//
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"net"
+
+	"github.com/bassosimone/websteps-illustrated/internal/model"
+	utls "gitlab.com/yawning/utls.git"
+)
+
+const (
+	// ECHExtensionType is the code point of the ECH extension as well
+	// as the version of the ECHConfig we know how to parse.
+	ECHExtensionType = 0xfe0d
+
+	// echKEMX25519 is the DHKEM(X25519, HKDF-SHA256) KEM ID.
+	echKEMX25519 = 0x0020
+
+	// echPayloadLength is the length of the random payload we include
+	// into the ECH extension, which mimics the length of the encrypted
+	// inner ClientHello sent by common browsers.
+	echPayloadLength = 176
+)
+
+// ECHCipherSuite is an HPKE symmetric cipher suite.
+type ECHCipherSuite struct {
+	// KDFID is the HPKE KDF ID.
+	KDFID uint16
+
+	// AEADID is the HPKE AEAD ID.
+	AEADID uint16
+}
+
+// ECHConfig is an ECH configuration (draft-ietf-tls-esni-13).
+type ECHConfig struct {
+	// ConfigID is the configuration ID.
+	ConfigID uint8
+
+	// KEMID is the HPKE KEM ID.
+	KEMID uint16
+
+	// PublicKey is the HPKE public key.
+	PublicKey []byte
+
+	// CipherSuites contains the supported HPKE cipher suites.
+	CipherSuites []ECHCipherSuite
+
+	// MaximumNameLength is the maximum length of the inner SNI.
+	MaximumNameLength uint8
+
+	// PublicName is the SNI to use in the outer ClientHello.
+	PublicName string
+}
+
+// ErrInvalidECHConfigList indicates that we cannot parse an ECHConfigList
+// or that it does not contain any configuration we support.
+var ErrInvalidECHConfigList = errors.New("netxlite: invalid ECHConfigList")
+
+// ParseECHConfigList parses the ECHConfigList contained by the ech
+// parameter of an HTTPS RR and returns the first ECHConfig whose version
+// we know, skipping the configurations using other versions.
+func ParseECHConfigList(data []byte) (*ECHConfig, error) {
+	r := &echReader{data: data}
+	list, ok := r.readVector16()
+	if !ok || !r.empty() {
+		return nil, ErrInvalidECHConfigList
+	}
+	for !list.empty() {
+		version, ok := list.readUint16()
+		if !ok {
+			return nil, ErrInvalidECHConfigList
+		}
+		contents, ok := list.readVector16()
+		if !ok {
+			return nil, ErrInvalidECHConfigList
+		}
+		if version != ECHExtensionType {
+			continue
+		}
+		config, ok := contents.readECHConfigContents()
+		if !ok {
+			return nil, ErrInvalidECHConfigList
+		}
+		return config, nil
+	}
+	return nil, ErrInvalidECHConfigList
+}
+
+// echReader helps to parse ECH data structures.
+type echReader struct {
+	data []byte
+}
+
+// empty returns whether we've consumed all the data.
+func (r *echReader) empty() bool {
+	return len(r.data) <= 0
+}
+
+// readBytes reads exactly count bytes.
+func (r *echReader) readBytes(count int) ([]byte, bool) {
+	if count < 0 || len(r.data) < count {
+		return nil, false
+	}
+	out := r.data[:count]
+	r.data = r.data[count:]
+	return out, true
+}
+
+// readUint8 reads an uint8.
+func (r *echReader) readUint8() (uint8, bool) {
+	v, ok := r.readBytes(1)
+	if !ok {
+		return 0, false
+	}
+	return v[0], true
+}
+
+// readUint16 reads a network-byte-order uint16.
+func (r *echReader) readUint16() (uint16, bool) {
+	v, ok := r.readBytes(2)
+	if !ok {
+		return 0, false
+	}
+	return binary.BigEndian.Uint16(v), true
+}
+
+// readVector8 reads a vector prefixed by an uint8 length.
+func (r *echReader) readVector8() (*echReader, bool) {
+	length, ok := r.readUint8()
+	if !ok {
+		return nil, false
+	}
+	v, ok := r.readBytes(int(length))
+	if !ok {
+		return nil, false
+	}
+	return &echReader{data: v}, true
+}
+
+// readVector16 reads a vector prefixed by an uint16 length.
+func (r *echReader) readVector16() (*echReader, bool) {
+	length, ok := r.readUint16()
+	if !ok {
+		return nil, false
+	}
+	v, ok := r.readBytes(int(length))
+	if !ok {
+		return nil, false
+	}
+	return &echReader{data: v}, true
+}
+
+// readECHConfigContents reads the ECHConfigContents structure.
+func (r *echReader) readECHConfigContents() (*ECHConfig, bool) {
+	out := &ECHConfig{}
+	var ok bool
+	if out.ConfigID, ok = r.readUint8(); !ok {
+		return nil, false
+	}
+	if out.KEMID, ok = r.readUint16(); !ok {
+		return nil, false
+	}
+	publicKey, ok := r.readVector16()
+	if !ok || publicKey.empty() {
+		return nil, false
+	}
+	out.PublicKey = publicKey.data
+	suites, ok := r.readVector16()
+	if !ok {
+		return nil, false
+	}
+	for !suites.empty() {
+		kdf, ok := suites.readUint16()
+		if !ok {
+			return nil, false
+		}
+		aead, ok := suites.readUint16()
+		if !ok {
+			return nil, false
+		}
+		out.CipherSuites = append(out.CipherSuites, ECHCipherSuite{KDFID: kdf, AEADID: aead})
+	}
+	if len(out.CipherSuites) <= 0 {
+		return nil, false
+	}
+	if out.MaximumNameLength, ok = r.readUint8(); !ok {
+		return nil, false
+	}
+	publicName, ok := r.readVector8()
+	if !ok || publicName.empty() {
+		return nil, false
+	}
+	out.PublicName = string(publicName.data)
+	// We ignore the extensions because there are no extensions
+	// defined yet and we don't need to interpret them.
+	if _, ok := r.readVector16(); !ok || !r.empty() {
+		return nil, false
+	}
+	return out, true
+}
+
+// NewTLSHandshakerECH creates a new TLS handshaker that parrots the
+// ClientHello of Chrome and adds an ECH extension using the given config.
+//
+// The caller is responsible for setting the tls.Config ServerName to
+// the config's PublicName (the outer SNI). The certificate will also be
+// verified against such a name, because we're not really using ECH and
+// hence the server will authenticate as the public name.
+//
+// The handshaker guarantees:
+//
+// 1. logging
+//
+// 2. error wrapping
+//
+// Passing a nil `config` will make this function panic.
+func NewTLSHandshakerECH(logger model.DebugLogger, config *ECHConfig) model.TLSHandshaker {
+	if config == nil {
+		panic("netxlite: passed a nil ECHConfig")
+	}
+	return newTLSHandshaker(&tlsHandshakerConfigurable{
+		NewConn: newConnECH(config),
+	}, logger)
+}
+
+// echConn is an utlsConn that adds the ECH extension to the ClientHello.
+type echConn struct {
+	*utlsConn
+	config *ECHConfig
+}
+
+// newConnECH returns a NewConn function for creating echConn instances.
+func newConnECH(config *ECHConfig) func(conn net.Conn, tlsConfig *tls.Config) TLSConn {
+	newConn := newConnUTLS(&utls.HelloChrome_Auto)
+	return func(conn net.Conn, tlsConfig *tls.Config) TLSConn {
+		return &echConn{
+			utlsConn: newConn(conn, tlsConfig).(*utlsConn),
+			config:   config,
+		}
+	}
+}
+
+// HandshakeContext adds the ECH extension and performs the handshake.
+func (c *echConn) HandshakeContext(ctx context.Context) error {
+	if err := c.addECHExtension(); err != nil {
+		return err
+	}
+	return c.utlsConn.HandshakeContext(ctx)
+}
+
+// addECHExtension builds the ClientHello and adds the ECH extension
+// right before the padding extension, as Chrome does.
+func (c *echConn) addECHExtension() error {
+	if err := c.UConn.BuildHandshakeState(); err != nil {
+		return err
+	}
+	data, err := newECHOuterExtensionData(c.config)
+	if err != nil {
+		return err
+	}
+	ext := &utls.GenericExtension{Id: ECHExtensionType, Data: data}
+	var out []utls.TLSExtension
+	for _, e := range c.UConn.Extensions {
+		if _, found := e.(*utls.UtlsPaddingExtension); found && ext != nil {
+			out = append(out, ext)
+			ext = nil
+		}
+		out = append(out, e)
+	}
+	if ext != nil {
+		out = append(out, ext)
+	}
+	c.UConn.Extensions = out
+	return nil
+}
+
+// newECHOuterExtensionData creates the body of an outer ECH extension
+// with random enc and payload fields for the given config.
+func newECHOuterExtensionData(config *ECHConfig) ([]byte, error) {
+	encLength := 32 // the length of an X25519 public key
+	if config.KEMID != echKEMX25519 {
+		encLength = len(config.PublicKey)
+	}
+	enc := make([]byte, encLength)
+	if _, err := rand.Read(enc); err != nil {
+		return nil, err
+	}
+	payload := make([]byte, echPayloadLength)
+	if _, err := rand.Read(payload); err != nil {
+		return nil, err
+	}
+	suite := config.CipherSuites[0]
+	out := []byte{0} // ECHClientHelloType.outer
+	out = echAppendUint16(out, suite.KDFID)
+	out = echAppendUint16(out, suite.AEADID)
+	out = append(out, config.ConfigID)
+	out = echAppendUint16(out, uint16(len(enc)))
+	out = append(out, enc...)
+	out = echAppendUint16(out, uint16(len(payload)))
+	out = append(out, payload...)
+	return out, nil
+}
+
+// echAppendUint16 appends v to out using the network byte order.
+func echAppendUint16(out []byte, v uint16) []byte {
+	return append(out, byte(v>>8), byte(v))
+}
@@ -0,0 +1,144 @@
+package netxlite
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+// newTestECHConfig returns the serialized ECHConfig using the given version
+// and containing the given ECHConfigContents.
+func newTestECHConfig(version uint16, contents []byte) []byte {
+	out := echAppendUint16(nil, version)
+	out = echAppendUint16(out, uint16(len(contents)))
+	return append(out, contents...)
+}
+
+// newTestECHConfigList returns an ECHConfigList containing the given configs.
+func newTestECHConfigList(configs ...[]byte) []byte {
+	var body []byte
+	for _, config := range configs {
+		body = append(body, config...)
+	}
+	out := echAppendUint16(nil, uint16(len(body)))
+	return append(out, body...)
+}
+
+// newTestECHConfigContents returns a valid ECHConfigContents whose public
+// name is public.example.com and whose config ID is configID.
+func newTestECHConfigContents(configID uint8) []byte {
+	publicKey := bytes.Repeat([]byte{0x11}, 32)
+	out := []byte{configID}
+	out = echAppendUint16(out, echKEMX25519)
+	out = echAppendUint16(out, uint16(len(publicKey)))
+	out = append(out, publicKey...)
+	out = echAppendUint16(out, 4)    // cipher suites length
+	out = echAppendUint16(out, 0x01) // HKDF-SHA256
+	out = echAppendUint16(out, 0x01) // AES-128-GCM
+	out = append(out, 0)             // maximum name length
+	publicName := []byte("public.example.com")
+	out = append(out, uint8(len(publicName)))
+	out = append(out, publicName...)
+	return echAppendUint16(out, 0) // extensions length
+}
+
+func TestParseECHConfigList(t *testing.T) {
+	valid := newTestECHConfigList(newTestECHConfig(
+		ECHExtensionType, newTestECHConfigContents(7)))
+	tests := []struct {
+		name         string
+		data         []byte
+		wantErr      error
+		wantConfigID uint8
+	}{{
+		name:         "valid list",
+		data:         valid,
+		wantErr:      nil,
+		wantConfigID: 7,
+	}, {
+		name: "skips configs using other versions",
+		data: newTestECHConfigList(
+			newTestECHConfig(0xfe0a, []byte{0xde, 0xad}),
+			newTestECHConfig(ECHExtensionType, newTestECHConfigContents(9)),
+		),
+		wantErr:      nil,
+		wantConfigID: 9,
+	}, {
+		name:    "empty input",
+		data:    nil,
+		wantErr: ErrInvalidECHConfigList,
+	}, {
+		name:    "empty list",
+		data:    newTestECHConfigList(),
+		wantErr: ErrInvalidECHConfigList,
+	}, {
+		name:    "only unknown versions",
+		data:    newTestECHConfigList(newTestECHConfig(0xfe0a, []byte{0xde, 0xad})),
+		wantErr: ErrInvalidECHConfigList,
+	}, {
+		name:    "truncated list",
+		data:    valid[:len(valid)-1],
+		wantErr: ErrInvalidECHConfigList,
+	}, {
+		name:    "truncated list length",
+		data:    valid[:1],
+		wantErr: ErrInvalidECHConfigList,
+	}, {
+		name: "truncated config contents",
+		data: newTestECHConfigList(newTestECHConfig(
+			ECHExtensionType, newTestECHConfigContents(7)[:10])),
+		wantErr: ErrInvalidECHConfigList,
+	}, {
+		name:    "trailing data after the list",
+		data:    append(append([]byte{}, valid...), 0x00),
+		wantErr: ErrInvalidECHConfigList,
+	}, {
+		name: "trailing data after the config contents",
+		data: newTestECHConfigList(newTestECHConfig(ECHExtensionType,
+			append(newTestECHConfigContents(7), 0x00))),
+		wantErr: ErrInvalidECHConfigList,
+	}, {
+		name: "config length larger than the list",
+		data: func() []byte {
+			out := append([]byte{}, valid...)
+			out[4], out[5] = 0xff, 0xff // config contents length
+			return out
+		}(),
+		wantErr: ErrInvalidECHConfigList,
+	}, {
+		name: "list length larger than the input",
+		data: func() []byte {
+			out := append([]byte{}, valid...)
+			out[0], out[1] = 0xff, 0xff // list length
+			return out
+		}(),
+		wantErr: ErrInvalidECHConfigList,
+	}}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config, err := ParseECHConfigList(tt.data)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatal("expected", tt.wantErr, "got", err)
+			}
+			if err != nil {
+				if config != nil {
+					t.Fatal("expected nil config on error")
+				}
+				return
+			}
+			if config.ConfigID != tt.wantConfigID {
+				t.Fatal("unexpected config ID", config.ConfigID)
+			}
+			if config.KEMID != echKEMX25519 || len(config.PublicKey) != 32 {
+				t.Fatal("unexpected KEM", config.KEMID, config.PublicKey)
+			}
+			if len(config.CipherSuites) != 1 || config.CipherSuites[0].KDFID != 0x01 ||
+				config.CipherSuites[0].AEADID != 0x01 {
+				t.Fatal("unexpected cipher suites", config.CipherSuites)
+			}
+			if config.PublicName != "public.example.com" {
+				t.Fatal("unexpected public name", config.PublicName)
+			}
+		})
+	}
+}
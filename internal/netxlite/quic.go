@@ -123,6 +123,9 @@ func ParseUDPAddr(address string) (*net.UDPAddr, error) {
 //
 // 2. if tlsConfig.NextProtos is empty _and_ the port is 443 or 8853,
 // then we configure, respectively, "h3" and "dq".
+//
+// When TProxy implements the model.UnderlyingCryptoLibrary interface,
+// we let it control the dial (e.g., to record or replay it).
 func (d *quicDialerQUICGo) DialContext(ctx context.Context, network string,
 	address string, tlsConfig *tls.Config, quicConfig *quic.Config) (
 	quic.EarlySession, error) {
@@ -135,8 +138,12 @@ func (d *quicDialerQUICGo) DialContext(ctx context.Context, network string,
 		return nil, err
 	}
 	tlsConfig = d.maybeApplyTLSDefaults(tlsConfig, udpAddr.Port)
-	sess, err := d.dialEarlyContext(
-		ctx, pconn, udpAddr, address, tlsConfig, quicConfig)
+	var sess quic.EarlySession
+	if cl, ok := TProxy.(model.UnderlyingCryptoLibrary); ok {
+		sess, err = cl.QUICDial(ctx, pconn, udpAddr, address, tlsConfig, quicConfig, d.dial)
+	} else {
+		sess, err = d.dial(ctx, pconn, udpAddr, address, tlsConfig, quicConfig)
+	}
 	if err != nil {
 		pconn.Close() // we own it on failure
 		return nil, err
@@ -144,6 +151,17 @@ func (d *quicDialerQUICGo) DialContext(ctx context.Context, network string,
 	return &quicSessionOwnsConn{EarlySession: sess, conn: pconn}, nil
 }
 
+// dial dials a QUIC session using pconn.
+func (d *quicDialerQUICGo) dial(ctx context.Context, pconn model.UDPLikeConn,
+	remoteAddr *net.UDPAddr, address string, tlsConfig *tls.Config,
+	quicConfig *quic.Config) (quic.EarlySession, error) {
+	sess, err := d.dialEarlyContext(ctx, pconn, remoteAddr, address, tlsConfig, quicConfig)
+	if err != nil {
+		return nil, NewErrWrapper(classifyQUICHandshakeError, QUICHandshakeOperation, err)
+	}
+	return sess, nil
+}
+
 func (d *quicDialerQUICGo) dialEarlyContext(ctx context.Context,
 	pconn net.PacketConn, remoteAddr net.Addr, address string,
 	tlsConfig *tls.Config, quicConfig *quic.Config) (quic.EarlySession, error) {
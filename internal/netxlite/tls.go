@@ -168,7 +168,9 @@ var defaultCertPool = NewDefaultCertPool()
 
 // Handshake implements Handshaker.Handshake. This function will
 // configure the code to use the built-in Mozilla CA if the config
-// field contains a nil RootCAs field.
+// field contains a nil RootCAs field. When TProxy implements the
+// model.UnderlyingCryptoLibrary interface, we let it control the
+// handshake (e.g., to record or replay it).
 func (h *tlsHandshakerConfigurable) Handshake(
 	ctx context.Context, conn net.Conn, config *tls.Config,
 ) (net.Conn, tls.ConnectionState, error) {
@@ -182,13 +184,31 @@ func (h *tlsHandshakerConfigurable) Handshake(
 		config = config.Clone()
 		config.RootCAs = defaultCertPool
 	}
-	tlsconn := h.newConn(conn, config)
-	if err := tlsconn.HandshakeContext(ctx); err != nil {
+	var (
+		tlsconn TLSConn
+		err     error
+	)
+	if cl, ok := TProxy.(model.UnderlyingCryptoLibrary); ok {
+		tlsconn, err = cl.TLSHandshake(ctx, conn, config, h.handshake)
+	} else {
+		tlsconn, err = h.handshake(ctx, conn, config)
+	}
+	if err != nil {
 		return nil, tls.ConnectionState{}, err
 	}
 	return tlsconn, tlsconn.ConnectionState(), nil
 }
 
+// handshake creates a new TLSConn and performs the handshake.
+func (h *tlsHandshakerConfigurable) handshake(
+	ctx context.Context, conn net.Conn, config *tls.Config) (TLSConn, error) {
+	tlsconn := h.newConn(conn, config)
+	if err := tlsconn.HandshakeContext(ctx); err != nil {
+		return nil, NewErrWrapper(classifyTLSHandshakeError, TLSHandshakeOperation, err)
+	}
+	return tlsconn, nil
+}
+
 // newConn creates a new TLSConn.
 func (h *tlsHandshakerConfigurable) newConn(conn net.Conn, config *tls.Config) TLSConn {
 	if h.NewConn != nil {
@@ -1,2 +1,3 @@
-// Package scrubber contains part of probe-cli's internal/scrubber.
+// Package scrubber contains part of probe-cli's internal/scrubber as well
+// as code to redact the probe IP addresses from measurements.
 package scrubber
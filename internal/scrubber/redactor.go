@@ -0,0 +1,336 @@
+package scrubber
+
+//
+// Redactor
+//
+// Removes the probe IP addresses from measurements.
+//
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"net"
+	"reflect"
+	"strings"
+)
+
+// Redacted is the string that replaces the probe IP addresses.
+const Redacted = "[redacted]"
+
+// Redactor removes known IP addresses (i.e., the probe's public IP
+// addresses) from measurements. Scrub, instead, removes any IP address
+// but only from error strings. The zero value is an empty redactor
+// that does nothing; please, use NewRedactor to construct.
+type Redactor struct {
+	ips []redactorIP
+}
+
+// redactorIP is an IP address that the Redactor removes.
+type redactorIP struct {
+	// binary is the IP address in network byte order.
+	binary []byte
+
+	// texts contains the textual representations of the IP address.
+	texts []string
+
+	// v6 indicates whether this is an IPv6 address.
+	v6 bool
+}
+
+// NewRedactor creates a new Redactor for the given IP addresses. We
+// ignore the strings that are not valid IP addresses.
+func NewRedactor(ips ...string) *Redactor {
+	r := &Redactor{}
+	for _, s := range ips {
+		ip := net.ParseIP(s)
+		if ip == nil {
+			continue
+		}
+		if ipv4 := ip.To4(); ipv4 != nil {
+			r.ips = append(r.ips, redactorIP{
+				binary: ipv4,
+				texts:  []string{ipv4.String()},
+				v6:     false,
+			})
+			continue
+		}
+		text := ip.String()
+		r.ips = append(r.ips, redactorIP{
+			binary: ip,
+			texts:  []string{text, strings.ToUpper(text), expandIPv6(ip)},
+			v6:     true,
+		})
+	}
+	return r
+}
+
+// expandIPv6 returns the uncompressed representation of an IPv6 address.
+func expandIPv6(ip net.IP) string {
+	var parts []string
+	for idx := 0; idx < net.IPv6len; idx += 2 {
+		parts = append(parts, hexByte(ip[idx])+hexByte(ip[idx+1]))
+	}
+	return strings.Join(parts, ":")
+}
+
+// hexByte returns the two-digits lowercase hex representation of b.
+func hexByte(b byte) string {
+	const digits = "0123456789abcdef"
+	return string([]byte{digits[b>>4], digits[b&0x0f]})
+}
+
+// Empty returns whether this redactor does not know any IP address.
+func (r *Redactor) Empty() bool {
+	return len(r.ips) <= 0
+}
+
+// RedactString replaces the IP addresses inside s with Redacted.
+func (r *Redactor) RedactString(s string) string {
+	return string(r.redactText([]byte(s)))
+}
+
+// redactText replaces the textual IP addresses inside data with Redacted. We
+// make sure we only replace whole addresses: for example, when redacting
+// 10.0.0.1, we do not want to redact the prefix of 10.0.0.11.
+func (r *Redactor) redactText(data []byte) []byte {
+	for _, ip := range r.ips {
+		for _, text := range ip.texts {
+			data = replaceWholeAddress(data, []byte(text), []byte(Redacted), ip.v6)
+		}
+	}
+	return data
+}
+
+// replaceWholeAddress replaces the occurrences of addr inside data
+// that are not part of a longer address with replacement.
+func replaceWholeAddress(data, addr, replacement []byte, v6 bool) []byte {
+	if bytes.Count(data, addr) <= 0 {
+		return data // the common case should be that there's no match
+	}
+	var out []byte
+	for {
+		idx := bytes.Index(data, addr)
+		if idx < 0 {
+			return append(out, data...)
+		}
+		end := idx + len(addr)
+		if isAddressBoundary(data, idx-1, -1, v6) && isAddressBoundary(data, end, 1, v6) {
+			out = append(out, data[:idx]...)
+			out = append(out, replacement...)
+		} else {
+			out = append(out, data[:end]...)
+		}
+		data = data[end:]
+	}
+}
+
+// isAddressBoundary returns whether data[idx] (where idx may be out of
+// bounds) cannot be part of the address. The dir argument tells us in
+// which direction we should look for more characters of the address.
+func isAddressBoundary(data []byte, idx, dir int, v6 bool) bool {
+	if idx < 0 || idx >= len(data) {
+		return true
+	}
+	c := data[idx]
+	if v6 {
+		return !isHexDigit(c) && c != ':'
+	}
+	if c == '.' {
+		// Allow for "... is 10.0.0.1." but not for "10.0.0.1.5".
+		next := idx + dir
+		return next < 0 || next >= len(data) || !isDigit(data[next])
+	}
+	return !isDigit(c)
+}
+
+// isDigit returns whether c is a decimal digit.
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+// isHexDigit returns whether c is an hexadecimal digit.
+func isHexDigit(c byte) bool {
+	return isDigit(c) || (c >= 'a' && c <= 'f') || (c >= 'A' && c <= 'F')
+}
+
+// redactBinary redacts the IP addresses inside binary data. Changing the
+// length would make binary data (e.g., a raw DNS message) unparseable, so
+// we replace the textual representation of an IP address with as many
+// asterisks and the network-byte-order representation with zeros. Because
+// we're dealing with arbitrary binary data, we may occasionally zero
+// bytes that just happen to look like an IP address.
+func (r *Redactor) redactBinary(data []byte) []byte {
+	for _, ip := range r.ips {
+		for _, text := range ip.texts {
+			mask := bytes.Repeat([]byte("*"), len(text))
+			data = replaceWholeAddress(data, []byte(text), mask, ip.v6)
+		}
+		if bytes.Count(data, ip.binary) > 0 {
+			data = bytes.ReplaceAll(data, ip.binary, make([]byte, len(ip.binary)))
+		}
+	}
+	return data
+}
+
+// RedactJSON redacts the IP addresses in every field of the given JSON
+// document, including map keys and the binary data serialized using the
+// `{"format":"base64","data":"..."}` format. When there's nothing to
+// redact, this function returns the original document. Otherwise, it
+// returns a semantically equivalent document where object keys are sorted.
+func (r *Redactor) RedactJSON(data []byte) ([]byte, error) {
+	return r.redactJSON(data, nil)
+}
+
+// redactJSON is like RedactJSON but also redacts as binary data the
+// strings that belong to the given set of base64 encoded strings.
+func (r *Redactor) redactJSON(data []byte, binaries map[string]bool) ([]byte, error) {
+	if r.Empty() {
+		return data, nil
+	}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber() // don't lose precision for large integers
+	var root interface{}
+	if err := decoder.Decode(&root); err != nil {
+		return nil, err
+	}
+	root, changed := r.redactValue(root, binaries)
+	if !changed {
+		return data, nil
+	}
+	return json.Marshal(root)
+}
+
+// Redact serializes v to JSON and redacts the result like RedactJSON. Because
+// encoding/json serializes []byte as a base64 string, we also collect the
+// encoding of each []byte inside v and redact the strings that match it
+// as binary data (e.g., a raw DNS reply containing the probe IP).
+func (r *Redactor) Redact(v interface{}) ([]byte, error) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	if r.Empty() {
+		return data, nil
+	}
+	binaries := map[string]bool{}
+	collectBinaryData(reflect.ValueOf(v), binaries, map[uintptr]bool{})
+	return r.redactJSON(data, binaries)
+}
+
+// rawMessageType is the type of json.RawMessage, which is a []byte that
+// encoding/json does not serialize using base64.
+var rawMessageType = reflect.TypeOf(json.RawMessage{})
+
+// collectBinaryData adds to out the base64 encoding of every []byte
+// reachable from v through exported fields. We use visited to avoid
+// walking the same pointer more than once.
+func collectBinaryData(v reflect.Value, out map[string]bool, visited map[uintptr]bool) {
+	switch v.Kind() {
+	case reflect.Ptr:
+		if v.IsNil() || visited[v.Pointer()] {
+			return
+		}
+		visited[v.Pointer()] = true
+		collectBinaryData(v.Elem(), out, visited)
+	case reflect.Interface:
+		if !v.IsNil() {
+			collectBinaryData(v.Elem(), out, visited)
+		}
+	case reflect.Struct:
+		for idx := 0; idx < v.NumField(); idx++ {
+			if field := v.Type().Field(idx); field.PkgPath == "" || field.Anonymous {
+				collectBinaryData(v.Field(idx), out, visited)
+			}
+		}
+	case reflect.Map:
+		iter := v.MapRange()
+		for iter.Next() {
+			collectBinaryData(iter.Value(), out, visited)
+		}
+	case reflect.Slice:
+		if v.Type().Elem().Kind() == reflect.Uint8 {
+			if v.Len() > 0 && v.Type() != rawMessageType {
+				out[base64.StdEncoding.EncodeToString(v.Bytes())] = true
+			}
+			return
+		}
+		fallthrough
+	case reflect.Array:
+		for idx := 0; idx < v.Len(); idx++ {
+			collectBinaryData(v.Index(idx), out, visited)
+		}
+	}
+}
+
+// redactValue redacts a value of a JSON document parsed using UseNumber
+// and returns the redacted value and whether we changed it. We redact
+// the strings inside binaries as base64 encoded binary data.
+func (r *Redactor) redactValue(v interface{}, binaries map[string]bool) (interface{}, bool) {
+	switch value := v.(type) {
+	case string:
+		if binaries[value] {
+			return r.maybeRedactBase64(value)
+		}
+		out := r.RedactString(value)
+		return out, out != value
+	case []interface{}:
+		var changed bool
+		for idx, entry := range value {
+			out, modified := r.redactValue(entry, binaries)
+			value[idx] = out
+			changed = changed || modified
+		}
+		return value, changed
+	case map[string]interface{}:
+		if out, ok := r.maybeRedactBinaryData(value); ok {
+			return out, true
+		}
+		out := map[string]interface{}{}
+		var changed bool
+		for key, entry := range value {
+			redactedKey := r.RedactString(key)
+			redactedEntry, modified := r.redactValue(entry, binaries)
+			out[redactedKey] = redactedEntry
+			changed = changed || modified || redactedKey != key
+		}
+		return out, changed
+	default:
+		return v, false
+	}
+}
+
+// maybeRedactBinaryData returns the redacted copy of value and true if
+// value is binary data containing IP addresses. Otherwise, it returns
+// nil and false and the caller should process value as any other map.
+func (r *Redactor) maybeRedactBinaryData(value map[string]interface{}) (interface{}, bool) {
+	if len(value) != 2 || value["format"] != "base64" {
+		return nil, false
+	}
+	encoded, ok := value["data"].(string)
+	if !ok {
+		return nil, false
+	}
+	redacted, changed := r.maybeRedactBase64(encoded)
+	if !changed {
+		return nil, false
+	}
+	return map[string]interface{}{
+		"format": "base64",
+		"data":   redacted,
+	}, true
+}
+
+// maybeRedactBase64 decodes the given base64 string, redacts the decoded
+// binary data, and returns the encoded result and whether we changed it.
+func (r *Redactor) maybeRedactBase64(encoded string) (string, bool) {
+	data, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return encoded, false
+	}
+	redacted := r.redactBinary(data)
+	if bytes.Equal(data, redacted) {
+		return encoded, false
+	}
+	return base64.StdEncoding.EncodeToString(redacted), true
+}
@@ -0,0 +1,82 @@
+package scrubber
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"net"
+	"strings"
+	"testing"
+)
+
+// redactorTestReply mimics a dnsping reply containing raw bytes.
+type redactorTestReply struct {
+	Reply []byte
+}
+
+// redactorTestKeys mimics test keys containing raw bytes.
+type redactorTestKeys struct {
+	Address      string
+	Replies      []*redactorTestReply
+	ResponseBody []byte
+	Extra        map[string]interface{}
+	Raw          json.RawMessage
+}
+
+func TestRedactorRedactsBinaryFields(t *testing.T) {
+	const probeIP = "130.192.91.211"
+	body := []byte("<html><body>Your IP address is " + probeIP + ".</body></html>")
+	reply := append([]byte{0x11, 0x22, 0x81, 0x80}, net.ParseIP(probeIP).To4()...)
+	tk := &redactorTestKeys{
+		Address:      probeIP + ":443",
+		Replies:      []*redactorTestReply{{Reply: reply}},
+		ResponseBody: body,
+		Extra:        map[string]interface{}{"query": []byte(probeIP)},
+		Raw:          json.RawMessage(`{"ip":"` + probeIP + `"}`),
+	}
+	data, err := NewRedactor(probeIP).Redact(tk)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(data), probeIP) {
+		t.Fatal("the probe IP is still there", string(data))
+	}
+	var out redactorTestKeys
+	if err := json.Unmarshal(data, &out); err != nil {
+		t.Fatal(err)
+	}
+	if out.Address != Redacted+":443" {
+		t.Fatal("unexpected address", out.Address)
+	}
+	if strings.Contains(string(out.ResponseBody), probeIP) {
+		t.Fatal("the probe IP is still in the body", string(out.ResponseBody))
+	}
+	if len(out.ResponseBody) != len(body) {
+		t.Fatal("redacting should not change the body length")
+	}
+	if len(out.Replies) != 1 || strings.Contains(string(out.Replies[0].Reply),
+		string(net.ParseIP(probeIP).To4())) {
+		t.Fatal("the probe IP is still in the reply", out.Replies)
+	}
+	if encoded := out.Extra["query"].(string); encoded != base64.StdEncoding.EncodeToString(
+		[]byte(strings.Repeat("*", len(probeIP)))) {
+		t.Fatal("unexpected query", encoded)
+	}
+}
+
+func TestRedactorLeavesUnrelatedBinaryFieldsAlone(t *testing.T) {
+	tk := &redactorTestKeys{
+		Address:      "8.8.8.8:53",
+		ResponseBody: []byte("<html></html>"),
+	}
+	expect, err := json.Marshal(tk)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := NewRedactor("130.192.91.211").Redact(tk)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != string(expect) {
+		t.Fatal("unexpected output", string(data))
+	}
+}
@@ -0,0 +1,123 @@
+package testcase
+
+//
+// Replay
+//
+// Code to replay a test case without using the network.
+//
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/bassosimone/websteps-illustrated/internal/dnsping"
+	"github.com/bassosimone/websteps-illustrated/internal/engine/experiment/websteps"
+	"github.com/bassosimone/websteps-illustrated/internal/logcat"
+	"github.com/bassosimone/websteps-illustrated/internal/measurex"
+)
+
+// ErrNoTestKeys indicates that the client did not emit any test keys.
+var ErrNoTestKeys = errors.New("testcase: the client did not emit any test keys")
+
+// Replay replays the test case using the given directory to store
+// the probe and TH caches. This function will start a THHandler
+// listening on the loopback interface and run a websteps client using
+// such a TH. Both the TH and the client use the caches with
+// networking disabled, so this function is fully deterministic. It
+// returns the test keys emitted by the client or an error.
+func (tc *Testcase) Replay(ctx context.Context, dirpath string) (*websteps.TestKeys, error) {
+	return tc.ReplayWithAnalysisRules(ctx, dirpath, nil)
+}
+
+// ReplayWithAnalysisRules is like Replay but the client uses the given
+// analysis rules. A nil rules argument means using the default rules.
+func (tc *Testcase) ReplayWithAnalysisRules(ctx context.Context, dirpath string,
+	rules *websteps.AnalysisRuleset) (*websteps.TestKeys, error) {
+	if err := tc.WriteCache(dirpath); err != nil {
+		return nil, err
+	}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	thh := newTHHandler(THCacheDir(dirpath))
+	mux := http.NewServeMux()
+	mux.Handle("/websteps/v2/websocket", http.HandlerFunc(thh.ServeWithWebsocketV2))
+	srv := &http.Server{Handler: mux}
+	go srv.Serve(listener)
+	defer shutdown(srv)
+	thURL := fmt.Sprintf("ws://%s/websteps/v2/websocket", listener.Addr().String())
+	logcat.Noticef("testcase: replaying %s using TH at %s", tc.Filepath, thURL)
+	clnt := newClient(ProbeCacheDir(dirpath), thURL)
+	clnt.AnalysisRules = rules
+	go clnt.Loop(ctx, websteps.LoopFlagGreedy)
+	clnt.Input <- tc.Manifest.URL
+	close(clnt.Input)
+	var tkoe *websteps.TestKeysOrError
+	for entry := range clnt.Output {
+		tkoe = entry // there should be just one entry
+	}
+	if tkoe == nil {
+		return nil, ErrNoTestKeys
+	}
+	return tkoe.TestKeys, tkoe.Err
+}
+
+// newTHHandler creates a THHandler using the given cache with
+// networking disabled and a forever caching policy.
+func newTHHandler(cachedir string) *websteps.THHandler {
+	cache := measurex.NewCache(cachedir)
+	cache.DisableNetwork = true
+	thOptions := &websteps.THHandlerOptions{
+		MeasurerFactory: func(options *measurex.Options) (measurex.AbstractMeasurer, error) {
+			lib := measurex.NewDefaultLibrary()
+			mx := measurex.NewMeasurerWithOptions(lib, options)
+			cmx := measurex.NewCachingMeasurer(mx, cache, measurex.CachingForeverPolicy())
+			return cmx, nil
+		},
+		Resolvers:             nil,
+		Saver:                 nil,
+		Admission:             nil,
+		MaxAddressesPerFamily: 0,
+		Metrics:               nil,
+	}
+	return websteps.NewTHHandler(thOptions)
+}
+
+// newClient creates a websteps client using the given cache with
+// networking disabled and predictable DNS resolvers.
+func newClient(cachedir string, thURL string) *websteps.Client {
+	clientOptions := &measurex.Options{
+		MaxAddressesPerFamily: measurex.DefaultMaxAddressPerFamily,
+		MaxCrawlerDepth:       measurex.DefaultMaxCrawlerDepth,
+	}
+	clnt := websteps.NewClient(nil, nil, thURL, clientOptions)
+	mxCache := measurex.NewCache(cachedir)
+	mxCache.DisableNetwork = true
+	clnt.MeasurerFactory = func(options *measurex.Options) (measurex.AbstractMeasurer, error) {
+		library := measurex.NewDefaultLibrary()
+		var mx measurex.AbstractMeasurer = measurex.NewMeasurer(library)
+		mx = measurex.NewCachingMeasurer(mx, mxCache, measurex.CachingForeverPolicy())
+		return mx, nil
+	}
+	dnspingCache := dnsping.NewCache(cachedir)
+	dnspingCache.DisableNetwork = true
+	clnt.NewDNSPingEngine = func(
+		idgen dnsping.IDGenerator, queryTimeout time.Duration) dnsping.AbstractEngine {
+		e := dnsping.NewEngine(idgen, queryTimeout)
+		return dnsping.NewCachingMeasurer(e, dnspingCache)
+	}
+	clnt.Resolvers = websteps.PredictableDNSResolvers()
+	return clnt
+}
+
+// shutdown shuts down the HTTP server.
+func shutdown(srv *http.Server) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	srv.Shutdown(ctx)
+}
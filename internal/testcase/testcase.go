@@ -0,0 +1,219 @@
+// Package testcase allows to load and replay websteps test cases.
+//
+// A test case is a YAML file containing a serialized version of the
+// probe and TH caches generated by a previous run of websteps, along
+// with a manifest that identifies and explains the test case. See
+// testdata/testcase for examples and python/ooni/dataformat/testcase.py
+// for the code that generates test cases from tarballs.
+package testcase
+
+//
+// Testcase
+//
+// Code to load test cases from YAML files.
+//
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/bassosimone/websteps-illustrated/internal/engine/experiment/websteps"
+	"gopkg.in/yaml.v3"
+)
+
+// Version is the test case data format version we support.
+const Version = 1
+
+// Manifest is the manifest of a test case.
+type Manifest struct {
+	// Command is the command line used to create the test case.
+	Command []string `yaml:"command"`
+
+	// Created is the time when the test case was created.
+	Created string `yaml:"created"`
+
+	// Description is the human-written description of the test case.
+	Description string `yaml:"description"`
+
+	// ExpectedFlags contains the hashtags of the analysis flags we
+	// expect (e.g., "#bogon"). When empty, we expect no flags.
+	ExpectedFlags []string `yaml:"expected_flags"`
+
+	// Imported is the time when the test case was imported.
+	Imported string `yaml:"imported"`
+
+	// KnownFailure is the OPTIONAL reason why we know that the analysis
+	// does not produce the ExpectedFlags (e.g., a known false positive).
+	KnownFailure string `yaml:"known_failure"`
+
+	// ProbeASN is the ASN of the probe.
+	ProbeASN string `yaml:"probe_asn"`
+
+	// ProbeCC is the country code of the probe.
+	ProbeCC string `yaml:"probe_cc"`
+
+	// URL is the URL measured by the test case.
+	URL string `yaml:"url"`
+}
+
+// Testcase is a test case loaded from a YAML file.
+type Testcase struct {
+	// Filepath is the file from which we loaded the test case.
+	Filepath string
+
+	// Manifest is the test case manifest.
+	Manifest *Manifest
+
+	// Entries maps each cache entry path to its content.
+	Entries map[string]interface{}
+}
+
+// cacheEntryPattern is the pattern that each cache entry path must match.
+var cacheEntryPattern = regexp.MustCompile(
+	`^testcase/cache/(probe|th)/(dns|dnsping|endpoint)/[0-9a-f]{2}/[0-9a-f]{64}-d$`)
+
+// ErrInvalidTestcase indicates that a test case is not valid.
+var ErrInvalidTestcase = errors.New("testcase: invalid testcase")
+
+// Load loads a test case from the given YAML file.
+func Load(filepath string) (*Testcase, error) {
+	filep, err := os.Open(filepath)
+	if err != nil {
+		return nil, err
+	}
+	defer filep.Close()
+	return load(filepath, filep)
+}
+
+// load is the internal implementation of Load.
+func load(filepath string, r io.Reader) (*Testcase, error) {
+	decoder := yaml.NewDecoder(r)
+	var version int64
+	if err := decoder.Decode(&version); err != nil {
+		return nil, err
+	}
+	if version != Version {
+		return nil, fmt.Errorf("%w: unsupported version: %d", ErrInvalidTestcase, version)
+	}
+	var manifest Manifest
+	if err := decoder.Decode(&manifest); err != nil {
+		return nil, err
+	}
+	if manifest.URL == "" {
+		return nil, fmt.Errorf("%w: empty URL in manifest", ErrInvalidTestcase)
+	}
+	var entries map[string]interface{}
+	if err := decoder.Decode(&entries); err != nil {
+		return nil, err
+	}
+	if len(entries) <= 0 {
+		return nil, fmt.Errorf("%w: empty cache", ErrInvalidTestcase)
+	}
+	for key := range entries {
+		if !cacheEntryPattern.MatchString(key) {
+			return nil, fmt.Errorf("%w: invalid cache entry: %s", ErrInvalidTestcase, key)
+		}
+	}
+	tc := &Testcase{
+		Filepath: filepath,
+		Manifest: &manifest,
+		Entries:  entries,
+	}
+	return tc, nil
+}
+
+// WriteCache writes the cache entries inside the given directory using
+// the same layout used by measurex.Cache and dnsping.Cache. After you
+// have called this function, you can use ProbeCacheDir and THCacheDir
+// to obtain the directories containing the probe and TH caches.
+func (tc *Testcase) WriteCache(dirpath string) error {
+	for key, value := range tc.Entries {
+		data, err := json.Marshal(value)
+		if err != nil {
+			return err
+		}
+		fullpath := filepath.Join(dirpath, filepath.FromSlash(key))
+		if err := os.MkdirAll(filepath.Dir(fullpath), 0700); err != nil {
+			return err
+		}
+		if err := os.WriteFile(fullpath, data, 0600); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ProbeCacheDir returns the probe cache dir inside dirpath.
+func ProbeCacheDir(dirpath string) string {
+	return filepath.Join(dirpath, "testcase", "cache", "probe")
+}
+
+// THCacheDir returns the TH cache dir inside dirpath.
+func THCacheDir(dirpath string) string {
+	return filepath.Join(dirpath, "testcase", "cache", "th")
+}
+
+// ErrUnknownHashtags indicates that the expected flags contain hashtags
+// not corresponding to any analysis flag, which usually is a typo.
+var ErrUnknownHashtags = errors.New("testcase: unknown hashtags")
+
+// ExpectedFlags returns the analysis flags we expect to see when replaying
+// this test case. When the manifest does not list any expected flag, we
+// expect the analysis not to set any flag. This function fails if the
+// manifest lists hashtags not corresponding to analysis flags.
+func (tc *Testcase) ExpectedFlags() (int64, error) {
+	flags, unknown := websteps.ParseHashtags(tc.Manifest.ExpectedFlags...)
+	if len(unknown) > 0 {
+		return 0, fmt.Errorf("%w: %s", ErrUnknownHashtags, strings.Join(unknown, " "))
+	}
+	return flags, nil
+}
+
+// ErrUnexpectedFlags indicates that the flags differ from the expected ones.
+var ErrUnexpectedFlags = errors.New("testcase: unexpected flags")
+
+// ErrKnownFailure indicates that the flags differ from the expected ones
+// and the manifest tells us that this is a known failure.
+var ErrKnownFailure = errors.New("testcase: known failure")
+
+// ErrUnexpectedPass indicates that a known failure has been fixed, so
+// we should remove the known_failure field from the manifest.
+var ErrUnexpectedPass = errors.New("testcase: known failure unexpectedly passed")
+
+// Check checks whether the given test keys match the expectations of
+// the test case. We only check the expected flags and we ignore any other
+// flag that the analysis may set, except when there are no expected flags,
+// where we expect no flags. When the manifest marks the test case as a
+// known failure, we fail with ErrKnownFailure when the flags do not match
+// and with ErrUnexpectedPass when they match.
+func (tc *Testcase) Check(tk *websteps.TestKeys) error {
+	err := tc.checkFlags(tk)
+	if tc.Manifest.KnownFailure == "" || errors.Is(err, ErrUnknownHashtags) {
+		return err
+	}
+	if err == nil {
+		return fmt.Errorf("%w: %s", ErrUnexpectedPass, tc.Manifest.KnownFailure)
+	}
+	return fmt.Errorf("%w: %s: %s", ErrKnownFailure, tc.Manifest.KnownFailure, err.Error())
+}
+
+// checkFlags implements Check.
+func (tc *Testcase) checkFlags(tk *websteps.TestKeys) error {
+	expected, err := tc.ExpectedFlags()
+	if err != nil {
+		return err
+	}
+	if (expected == 0 && tk.Flags != 0) || (tk.Flags&expected) != expected {
+		expectedTags, _ := websteps.ExplainFlagsUsingTagsAndSeverity(expected)
+		gotTags, _ := websteps.ExplainFlagsUsingTagsAndSeverity(tk.Flags)
+		return fmt.Errorf("%w: expected '%s' but got '%s'", ErrUnexpectedFlags,
+			strings.Join(expectedTags, " "), strings.Join(gotTags, " "))
+	}
+	return nil
+}
@@ -0,0 +1,102 @@
+package testcase
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"testing"
+
+	"github.com/bassosimone/websteps-illustrated/internal/engine/experiment/websteps"
+)
+
+func TestReplayTestcases(t *testing.T) {
+	files, err := filepath.Glob(filepath.Join("..", "..", "testdata", "testcase", "*.yaml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) <= 0 {
+		t.Fatal("no test cases")
+	}
+	for _, file := range files {
+		file := file
+		t.Run(filepath.Base(file), func(t *testing.T) {
+			tc, err := Load(file)
+			if err != nil {
+				t.Fatal(err)
+			}
+			tk, err := tc.Replay(context.Background(), t.TempDir())
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = tc.Check(tk)
+			if errors.Is(err, ErrKnownFailure) {
+				t.Skip(err)
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+func TestCheck(t *testing.T) {
+	newTestcase := func(knownFailure string, hashtags ...string) *Testcase {
+		return &Testcase{Manifest: &Manifest{
+			ExpectedFlags: hashtags,
+			KnownFailure:  knownFailure,
+		}}
+	}
+	t.Run("unknown hashtags", func(t *testing.T) {
+		tc := newTestcase("", "#bogon", "#blockpage")
+		err := tc.Check(&websteps.TestKeys{Flags: websteps.AnalysisBogon})
+		if !errors.Is(err, ErrUnknownHashtags) {
+			t.Fatal("unexpected error", err)
+		}
+	})
+	t.Run("missing flag", func(t *testing.T) {
+		tc := newTestcase("", "#bogon", "#tlsTimeout")
+		err := tc.Check(&websteps.TestKeys{Flags: websteps.AnalysisBogon})
+		if !errors.Is(err, ErrUnexpectedFlags) {
+			t.Fatal("unexpected error", err)
+		}
+	})
+	t.Run("extra flags", func(t *testing.T) {
+		tc := newTestcase("", "#bogon")
+		flags := int64(websteps.AnalysisBogon | websteps.AnalysisTLSTimeout)
+		if err := tc.Check(&websteps.TestKeys{Flags: flags}); err != nil {
+			t.Fatal(err)
+		}
+	})
+	t.Run("no expected flags and no flags", func(t *testing.T) {
+		tc := newTestcase("")
+		if err := tc.Check(&websteps.TestKeys{}); err != nil {
+			t.Fatal(err)
+		}
+	})
+	t.Run("no expected flags but some flags", func(t *testing.T) {
+		tc := newTestcase("")
+		err := tc.Check(&websteps.TestKeys{Flags: websteps.AnalysisBogon})
+		if !errors.Is(err, ErrUnexpectedFlags) {
+			t.Fatal("unexpected error", err)
+		}
+	})
+	t.Run("known failure", func(t *testing.T) {
+		tc := newTestcase("false positive")
+		err := tc.Check(&websteps.TestKeys{Flags: websteps.AnalysisBogon})
+		if !errors.Is(err, ErrKnownFailure) {
+			t.Fatal("unexpected error", err)
+		}
+	})
+	t.Run("known failure that passes", func(t *testing.T) {
+		tc := newTestcase("false positive")
+		if err := tc.Check(&websteps.TestKeys{}); !errors.Is(err, ErrUnexpectedPass) {
+			t.Fatal("unexpected error", err)
+		}
+	})
+	t.Run("known failure with unknown hashtags", func(t *testing.T) {
+		tc := newTestcase("false negative", "#blockpage")
+		if err := tc.Check(&websteps.TestKeys{}); !errors.Is(err, ErrUnknownHashtags) {
+			t.Fatal("unexpected error", err)
+		}
+	})
+}
@@ -0,0 +1,74 @@
+package traceroute
+
+//
+// Archival
+//
+// Converting results to the archival format.
+//
+
+import (
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// ArchivalHopResult is the archival format of HopResult.
+type ArchivalHopResult struct {
+	Failure   *string `json:"failure"`
+	Responded bool    `json:"responded"`
+	T0        float64 `json:"t0"`
+	T         float64 `json:"t"`
+	TTL       int     `json:"ttl"`
+}
+
+// ToArchival returns the archival representation
+func (hr *HopResult) ToArchival(begin time.Time) *ArchivalHopResult {
+	return &ArchivalHopResult{
+		Failure:   hr.Failure.ToArchivalFailure(),
+		Responded: hr.Responded,
+		T0:        hr.Started.Sub(begin).Seconds(),
+		T:         hr.Finished.Sub(begin).Seconds(),
+		TTL:       hr.TTL,
+	}
+}
+
+// ArchivalResult is the archival format of Result.
+type ArchivalResult struct {
+	Address       string               `json:"address"`
+	Domain        string               `json:"domain,omitempty"`
+	Hops          []*ArchivalHopResult `json:"hops"`
+	ID            int64                `json:"id"`
+	Probe         string               `json:"probe"`
+	QueryType     string               `json:"query_type,omitempty"`
+	ResponsiveTTL int                  `json:"responsive_ttl"`
+	SNI           string               `json:"sni,omitempty"`
+	T             float64              `json:"t"`
+	TargetID      int64                `json:"target_id"`
+}
+
+// ToArchival returns the archival representation. The ResponsiveTTL
+// field is zero when no TTL received a response.
+func (r *Result) ToArchival(begin time.Time) *ArchivalResult {
+	out := &ArchivalResult{
+		Address:       r.Address,
+		Domain:        r.Domain,
+		Hops:          []*ArchivalHopResult{},
+		ID:            r.ID,
+		Probe:         r.Probe,
+		QueryType:     "",
+		ResponsiveTTL: 0,
+		SNI:           r.SNI,
+		T:             r.Started.Sub(begin).Seconds(),
+		TargetID:      r.TargetID,
+	}
+	if r.QueryType != 0 {
+		out.QueryType = dns.TypeToString[r.QueryType]
+	}
+	if hop, found := r.ResponsiveTTL(); found {
+		out.ResponsiveTTL = hop.TTL
+	}
+	for _, hop := range r.Hops {
+		out.Hops = append(out.Hops, hop.ToArchival(begin))
+	}
+	return out
+}
@@ -0,0 +1,4 @@
+// Package traceroute contains code for localizing the network hop that
+// interferes with a TCP connect, a TLS handshake, or a DNS query by repeating
+// the triggering packet with increasing IP TTLs.
+package traceroute
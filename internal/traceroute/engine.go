@@ -0,0 +1,466 @@
+package traceroute
+
+//
+// Engine
+//
+// The traceroute engine.
+//
+// We do not require privileges, so we cannot read the ICMP time exceeded
+// messages sent by the routers along the path. Rather, for each TTL we
+// check whether we receive a response to the triggering packet. When a
+// packet with a small TTL receives a response, such a response cannot
+// come from a server that is farther away. Therefore, the smallest TTL
+// receiving a response is the distance of the hop that responded.
+//
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"syscall"
+	"time"
+
+	"github.com/bassosimone/websteps-illustrated/internal/archival"
+	"github.com/bassosimone/websteps-illustrated/internal/logcat"
+	"github.com/bassosimone/websteps-illustrated/internal/model"
+	"github.com/bassosimone/websteps-illustrated/internal/netxlite"
+	"github.com/miekg/dns"
+)
+
+const (
+	// ProbeTCPConnect repeats the TCP SYN with increasing TTLs.
+	ProbeTCPConnect = "tcp_connect"
+
+	// ProbeTLSHandshake connects normally and then sends the ClientHello
+	// with increasing TTLs.
+	ProbeTLSHandshake = "tls_handshake"
+
+	// ProbeDNSQuery sends the UDP DNS query with increasing TTLs.
+	ProbeDNSQuery = "dns_query"
+)
+
+const (
+	// DefaultMaxTTL is the default maximum TTL.
+	DefaultMaxTTL = 30
+
+	// DefaultHopTimeout is the default time we wait for
+	// a response to the packet sent with a given TTL.
+	DefaultHopTimeout = 2 * time.Second
+)
+
+// ErrUnknownProbe indicates that Plan.Probe is not valid.
+var ErrUnknownProbe = errors.New("traceroute: unknown probe type")
+
+// ErrCannotSetTTL indicates that the dialer returned by netxlite.TProxy
+// does not allow us to set the TTL before connecting.
+var ErrCannotSetTTL = errors.New("traceroute: cannot set the TTL using this dialer")
+
+// Plan is the plan to localize the hop that responds to a packet.
+type Plan struct {
+	// TargetID is the OPTIONAL ID of the measurement that
+	// failed and caused us to run this plan.
+	TargetID int64
+
+	// Probe is the MANDATORY type of probe (e.g., ProbeTCPConnect).
+	Probe string
+
+	// Address is the MANDATORY endpoint address (e.g., 8.8.8.8:53).
+	Address string
+
+	// SNI is the SNI to use with ProbeTLSHandshake.
+	SNI string
+
+	// Domain is the domain to query with ProbeDNSQuery.
+	Domain string
+
+	// QueryType is the query type to use with ProbeDNSQuery.
+	QueryType uint16
+}
+
+// HopResult is the result of sending the packet with a given TTL.
+type HopResult struct {
+	// TTL is the TTL we used.
+	TTL int
+
+	// Failure is the failure that occurred (if any).
+	Failure archival.FlatFailure
+
+	// Responded indicates whether we received a response (e.g., a SYN-ACK,
+	// a RST, or a DNS reply) to the packet sent using this TTL.
+	Responded bool
+
+	// Started is when we sent the packet.
+	Started time.Time
+
+	// Finished is when we received a response or gave up.
+	Finished time.Time
+}
+
+// Result is the result of running a Plan.
+type Result struct {
+	// ID is the unique ID of this result.
+	ID int64
+
+	// TargetID is the ID of the measurement that caused us to run the plan.
+	TargetID int64
+
+	// Probe is the type of probe we used.
+	Probe string
+
+	// Address is the endpoint address.
+	Address string
+
+	// SNI is the SNI we used with ProbeTLSHandshake.
+	SNI string `json:",omitempty"`
+
+	// Domain is the domain we queried with ProbeDNSQuery.
+	Domain string `json:",omitempty"`
+
+	// QueryType is the query type we used with ProbeDNSQuery.
+	QueryType uint16 `json:",omitempty"`
+
+	// Started is when we started running the plan.
+	Started time.Time
+
+	// Hops contains a result for each TTL, sorted by TTL. We stop
+	// after the first TTL that receives a response.
+	Hops []*HopResult
+}
+
+// Describe returns a human readable description.
+func (r *Result) Describe() string {
+	switch r.Probe {
+	case ProbeTLSHandshake:
+		return fmt.Sprintf("#%d %s with %s using SNI %s", r.ID, r.Probe, r.Address, r.SNI)
+	case ProbeDNSQuery:
+		return fmt.Sprintf("#%d %s %s for %s using %s", r.ID, r.Probe,
+			dns.TypeToString[r.QueryType], r.Domain, r.Address)
+	default:
+		return fmt.Sprintf("#%d %s with %s", r.ID, r.Probe, r.Address)
+	}
+}
+
+// ResponsiveTTL returns the smallest TTL that received a response and
+// the corresponding hop. It returns false if no TTL received a response.
+func (r *Result) ResponsiveTTL() (*HopResult, bool) {
+	for _, hop := range r.Hops {
+		if hop.Responded {
+			return hop, true
+		}
+	}
+	return nil, false
+}
+
+// IDGenerator is a generic unique-IDs generator.
+type IDGenerator interface {
+	NextID() int64
+}
+
+// AbstractEngine is an abstract version of the Engine type.
+type AbstractEngine interface {
+	// Run behaves like Engine.Run.
+	Run(ctx context.Context, plans ...*Plan) []*Result
+}
+
+// Engine is the traceroute engine. To initialize, fill all the fields
+// marked as MANDATORY, or just use the NewEngine constructor.
+type Engine struct {
+	// Encoder is the MANDATORY DNSEncoder to use.
+	Encoder model.DNSEncoder
+
+	// HopTimeout is the MANDATORY time we wait for a response
+	// to the packet sent with a given TTL.
+	HopTimeout time.Duration
+
+	// IDGenerator is the MANDATORY IDGenerator to use.
+	IDGenerator IDGenerator
+
+	// MaxTTL is the MANDATORY maximum TTL.
+	MaxTTL int
+
+	// TLSHandshaker is the MANDATORY TLSHandshaker to use.
+	TLSHandshaker model.TLSHandshaker
+}
+
+var _ AbstractEngine = &Engine{}
+
+// NewEngine creates a new engine instance using the given
+// generator and maximum TTL, and typical values for other fields.
+func NewEngine(idgen IDGenerator, maxTTL int) *Engine {
+	return &Engine{
+		Encoder:       &netxlite.DNSEncoderMiekg{},
+		HopTimeout:    DefaultHopTimeout,
+		IDGenerator:   idgen,
+		MaxTTL:        maxTTL,
+		TLSHandshaker: netxlite.NewTLSHandshakerStdlib(model.DiscardLogger),
+	}
+}
+
+// Run runs the given plans and returns the results. We run the plans
+// sequentially and in order, because some censors keep blocking an
+// endpoint for some time after they have seen a triggering packet, so
+// running plans in parallel could cause results to interfere. For the
+// same reason, callers should put the plans that could trigger censorship
+// after the plans that cannot trigger censorship.
+func (e *Engine) Run(ctx context.Context, plans ...*Plan) (out []*Result) {
+	for _, plan := range plans {
+		r, err := e.run(ctx, plan)
+		if err != nil {
+			logcat.Bugf("traceroute: cannot run plan: %s", err.Error())
+			continue
+		}
+		out = append(out, r)
+	}
+	return
+}
+
+// run runs a single plan.
+func (e *Engine) run(ctx context.Context, plan *Plan) (*Result, error) {
+	var hop func(ctx context.Context, plan *Plan, ttl int) (*HopResult, bool)
+	switch plan.Probe {
+	case ProbeTCPConnect:
+		hop = e.tcpConnect
+	case ProbeTLSHandshake:
+		hop = e.tlsHandshake
+	case ProbeDNSQuery:
+		hop = e.dnsQuery
+	default:
+		return nil, ErrUnknownProbe
+	}
+	result := &Result{
+		ID:        e.IDGenerator.NextID(),
+		TargetID:  plan.TargetID,
+		Probe:     plan.Probe,
+		Address:   plan.Address,
+		SNI:       plan.SNI,
+		Domain:    plan.Domain,
+		QueryType: plan.QueryType,
+		Started:   time.Now(),
+		Hops:      []*HopResult{},
+	}
+	logcat.Infof("traceroute: %s", result.Describe())
+	for ttl := 1; ttl <= e.MaxTTL && ctx.Err() == nil; ttl++ {
+		r, keepGoing := hop(ctx, plan, ttl)
+		result.Hops = append(result.Hops, r)
+		if r.Responded {
+			logcat.Noticef("[#%d] traceroute: response with TTL %d (%s)",
+				result.ID, ttl, describeFailure(r.Failure))
+			break
+		}
+		logcat.Infof("[#%d] traceroute: no response with TTL %d (%s)",
+			result.ID, ttl, describeFailure(r.Failure))
+		if !keepGoing {
+			break
+		}
+	}
+	return result, nil
+}
+
+// tcpConnect sends the SYN using the given TTL. The returned bool
+// tells the caller whether to continue with the next TTL.
+func (e *Engine) tcpConnect(ctx context.Context, plan *Plan, ttl int) (*HopResult, bool) {
+	hop := newHopResult(ttl)
+	// We need to set the TTL before sending the SYN, which we can only
+	// do when netxlite.TProxy gives us the stdlib dialer.
+	dialer, ok := netxlite.TProxy.NewSimpleDialer(e.HopTimeout).(*net.Dialer)
+	if !ok {
+		hop.Finished = time.Now()
+		hop.Failure = newFlatFailure(ErrCannotSetTTL)
+		return hop, false
+	}
+	dialer = &net.Dialer{
+		Timeout: dialer.Timeout,
+		Control: func(network, address string, c syscall.RawConn) error {
+			return setTTL(c, isIPv6(address), ttl)
+		},
+	}
+	conn, err := dialer.DialContext(ctx, "tcp", plan.Address)
+	hop.Finished = time.Now()
+	if err != nil {
+		hop.Failure = newFlatFailure(err)
+		switch hop.Failure {
+		case netxlite.FailureConnectionRefused:
+			hop.Responded = true // we received a RST
+		}
+		return hop, true
+	}
+	conn.Close()
+	hop.Responded = true // we received a SYN-ACK
+	return hop, true
+}
+
+// tlsHandshake connects using the default TTL and then sends the ClientHello
+// using the given TTL. The returned bool tells the caller whether to continue
+// with the next TTL, which is false if we cannot connect.
+func (e *Engine) tlsHandshake(ctx context.Context, plan *Plan, ttl int) (*HopResult, bool) {
+	hop := newHopResult(ttl)
+	dialer := netxlite.TProxy.NewSimpleDialer(e.HopTimeout)
+	conn, err := dialer.DialContext(ctx, "tcp", plan.Address)
+	if err != nil {
+		hop.Finished = time.Now()
+		hop.Failure = newFlatFailure(err)
+		return hop, false
+	}
+	defer conn.Close()
+	if err := setConnTTL(conn, isIPv6(plan.Address), ttl); err != nil {
+		hop.Finished = time.Now()
+		hop.Failure = newFlatFailure(err)
+		return hop, false
+	}
+	hop.Started = time.Now() // the ClientHello starts now
+	ctx, cancel := context.WithTimeout(ctx, e.HopTimeout)
+	defer cancel()
+	config := &tls.Config{
+		NextProtos: []string{"h2", "http/1.1"},
+		RootCAs:    netxlite.NewDefaultCertPool(),
+		ServerName: plan.SNI,
+	}
+	tconn, _, err := e.TLSHandshaker.Handshake(ctx, conn, config)
+	hop.Finished = time.Now()
+	if err != nil {
+		hop.Failure = newFlatFailure(err)
+		switch hop.Failure {
+		case netxlite.FailureConnectionReset,
+			netxlite.FailureEOFError,
+			netxlite.FailureSSLInvalidCertificate,
+			netxlite.FailureSSLInvalidHostname,
+			netxlite.FailureSSLUnknownAuthority:
+			hop.Responded = true // someone answered our ClientHello
+		}
+		return hop, true
+	}
+	tconn.Close()
+	hop.Responded = true // we completed the handshake
+	return hop, true
+}
+
+// dnsQuery sends the DNS query using the given TTL. The returned bool
+// tells the caller whether to continue with the next TTL.
+func (e *Engine) dnsQuery(ctx context.Context, plan *Plan, ttl int) (*HopResult, bool) {
+	hop := newHopResult(ttl)
+	rawQuery, _, err := e.Encoder.EncodeQuery(plan.Domain, plan.QueryType, false)
+	if err != nil {
+		hop.Finished = time.Now()
+		hop.Failure = newFlatFailure(err)
+		return hop, false
+	}
+	raddr, err := net.ResolveUDPAddr("udp", plan.Address)
+	if err != nil {
+		hop.Finished = time.Now()
+		hop.Failure = newFlatFailure(err)
+		return hop, false
+	}
+	network := "udp4"
+	if isIPv6(plan.Address) {
+		network = "udp6"
+	}
+	pconn, err := netxlite.TProxy.ListenUDP(network, &net.UDPAddr{})
+	if err != nil {
+		hop.Finished = time.Now()
+		hop.Failure = newFlatFailure(err)
+		return hop, false
+	}
+	defer pconn.Close()
+	if err := setPacketConnTTL(pconn, isIPv6(plan.Address), ttl); err != nil {
+		hop.Finished = time.Now()
+		hop.Failure = newFlatFailure(err)
+		return hop, false
+	}
+	hop.Started = time.Now()
+	pconn.SetDeadline(hop.Started.Add(e.HopTimeout))
+	if _, err := pconn.WriteTo(rawQuery, raddr); err != nil {
+		hop.Finished = time.Now()
+		hop.Failure = newFlatFailure(err)
+		return hop, true
+	}
+	buffer := make([]byte, 1<<17)
+	for {
+		var addr net.Addr
+		_, addr, err = pconn.ReadFrom(buffer)
+		if err != nil || addr.String() == raddr.String() {
+			break
+		}
+		// We ignore the datagrams coming from other addresses.
+	}
+	hop.Finished = time.Now()
+	if err != nil {
+		hop.Failure = newFlatFailure(err)
+		switch hop.Failure {
+		case netxlite.FailureConnectionRefused:
+			hop.Responded = true // we received ICMP port unreachable
+		}
+		return hop, true
+	}
+	hop.Responded = true // we received a DNS reply
+	return hop, true
+}
+
+// newHopResult creates a new HopResult for the given TTL.
+func newHopResult(ttl int) *HopResult {
+	return &HopResult{
+		TTL:       ttl,
+		Failure:   "",
+		Responded: false,
+		Started:   time.Now(),
+		Finished:  time.Time{},
+	}
+}
+
+// newFlatFailure classifies the given error and converts it to a FlatFailure.
+func newFlatFailure(err error) archival.FlatFailure {
+	return archival.NewFlatFailure(netxlite.NewTopLevelGenericErrWrapper(err))
+}
+
+// describeFailure returns a description of the given failure.
+func describeFailure(failure archival.FlatFailure) string {
+	if failure == "" {
+		return "success"
+	}
+	return string(failure)
+}
+
+// setConnTTL sets the TTL of a connected socket.
+func setConnTTL(conn net.Conn, ipv6 bool, ttl int) error {
+	sc, ok := conn.(syscall.Conn)
+	if !ok {
+		return errors.New("traceroute: cannot access the underlying socket")
+	}
+	rc, err := sc.SyscallConn()
+	if err != nil {
+		return err
+	}
+	return setTTL(rc, ipv6, ttl)
+}
+
+// setPacketConnTTL sets the TTL of a UDP socket.
+func setPacketConnTTL(pconn model.UDPLikeConn, ipv6 bool, ttl int) error {
+	rc, err := pconn.SyscallConn()
+	if err != nil {
+		return err
+	}
+	return setTTL(rc, ipv6, ttl)
+}
+
+// setTTL sets the IPv4 TTL or the IPv6 hop limit using the given RawConn.
+func setTTL(rc syscall.RawConn, ipv6 bool, ttl int) error {
+	var err error
+	cerr := rc.Control(func(fd uintptr) {
+		err = setsockoptTTL(fd, ipv6, ttl)
+	})
+	if cerr != nil {
+		return cerr
+	}
+	return err
+}
+
+// isIPv6 returns whether the given endpoint address uses IPv6.
+func isIPv6(address string) bool {
+	addr, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return false
+	}
+	ip := net.ParseIP(addr)
+	return ip != nil && ip.To4() == nil
+}
@@ -0,0 +1,14 @@
+//go:build windows
+// +build windows
+
+package traceroute
+
+import "syscall"
+
+// setsockoptTTL sets the IPv4 TTL or the IPv6 hop limit of the given socket.
+func setsockoptTTL(fd uintptr, ipv6 bool, ttl int) error {
+	if ipv6 {
+		return syscall.SetsockoptInt(syscall.Handle(fd), syscall.IPPROTO_IPV6, syscall.IPV6_UNICAST_HOPS, ttl)
+	}
+	return syscall.SetsockoptInt(syscall.Handle(fd), syscall.IPPROTO_IP, syscall.IP_TTL, ttl)
+}
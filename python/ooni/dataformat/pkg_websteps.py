@@ -47,6 +47,9 @@ WEBSTEPS_FLAGS: List[Tuple[int, str]] = [
     (1 << 15, "#httpTimeout"),
     (1 << 16, "#httpReset"),
     (1 << 17, "#httpEOF"),
+    (1 << 18, "#throttling"),
+    (1 << 19, "#httpBlockpage"),
+    (1 << 20, "#dnsInjection"),
     (1 << 32, "#inconclusive"),
     (1 << 33, "#probeBug"),
     (1 << 34, "#httpDiffStatusCode"),
@@ -55,6 +58,8 @@ WEBSTEPS_FLAGS: List[Tuple[int, str]] = [
     (1 << 37, "#httpDiffBodyLength"),
     (1 << 38, "#httpDiffLegitimateRedirect"),
     (1 << 39, "#httpDiffTransparentProxy"),
+    (1 << 40, "#sniBlocking"),
+    (1 << 41, "#ipBlocking"),
 ]
 
 
@@ -80,6 +85,7 @@ class WebstepsAnalysisDNSOrEndpoint:
         self.id = entry.getinteger("id")
         self.refs = [IntWrapper(x).unwrap() for x in entry.getlist("refs")]
         self.flags = WebstepsAnalysisFlagsWrapper(entry.getinteger("flags"))
+        self.blockpage = entry.getoptionalstring("blockpage")
         self.raw = entry.unwrap()
 
 
@@ -97,6 +103,9 @@ class WebstepsAnalysis:
         self.th = [
             WebstepsAnalysisDNSOrEndpoint(DictWrapper(x)) for x in entry.getlist("th")
         ]
+        self.sni = [
+            WebstepsAnalysisDNSOrEndpoint(DictWrapper(x)) for x in entry.getlist("sni")
+        ]
         self.raw = entry.unwrap()
 
 